@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryAsOf is like [AtomicCircularBuffer2.QueryEvents], but ignores the events saved after the one with the
+// sequence number maxSeq, as if querying the buffer at the moment it was saved. The sequence number of the last
+// saved event is one less than the Head of [AtomicCircularBuffer2.Stats], so recording it gives a view that
+// doesn't change with the following saves, which is meant for investigating what a query returned back then.
+//
+// The view is only as old as the buffer allows: events evicted or deleted since are not returned, and events
+// updated since are returned as updated. Events saved again at the head, because they are pinned or with
+// the [LRU] eviction policy, get a new sequence number, so they are missing from the views older than their
+// last save. The query cache is never used.
+func (cb *AtomicCircularBuffer2) QueryAsOf(ctx context.Context, filter nostr.Filter, maxSeq uint64) ([]*nostr.Event, error) {
+	if err := cb.acquireQuery(ctx); err != nil {
+		return nil, err
+	}
+	defer cb.releaseQuery()
+
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var result []*nostr.Event
+	start, end := cb.bounds()
+	end = cb.seqEnd(start, end, maxSeq)
+	err = cb.scan(ctx, filter, nil, start, end, nil, func(stored *StoredEvent) bool {
+		result = append(result, stored.Event)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// seqEnd returns the end of the positions [start, end) holding the events saved up to maxSeq.
+// The sequence numbers grow with the positions, even after a compaction moved the events forward,
+// so only the positions of the events saved after maxSeq are walked, from the newest.
+func (cb *AtomicCircularBuffer2) seqEnd(start, end, maxSeq uint64) uint64 {
+	for end > start {
+		stored := cb.slot(end - 1).Load()
+		if stored != nil && stored.Seq <= maxSeq {
+			break
+		}
+		end--
+	}
+	return end
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryAsOf(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100, WithTagIndex())
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("before-%d", i), i%2))
+	}
+	seq := cb.Stats().Head - 1
+	before := ids(slices.Collect(cb.All()))
+
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("after-%d", i), i%2))
+	}
+
+	check := func(filter nostr.Filter, expected []string) {
+		t.Helper()
+		events, err := cb.QueryAsOf(ctx, filter, seq)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if !slices.Equal(ids(events), expected) {
+			t.Fatalf("filter %v: expected %v, got %v", filter, expected, ids(events))
+		}
+	}
+
+	check(nostr.Filter{}, before)
+	check(nostr.Filter{Kinds: []int{1}}, []string{"before-1", "before-3", "before-5", "before-7", "before-9"})
+	check(nostr.Filter{Limit: 3}, before[:3])
+	check(nostr.Filter{Tags: nostr.TagMap{"e": {"test-tag"}}}, before)
+	check(nostr.Filter{IDs: []string{"after-0"}}, nil)
+
+	// the compaction moves the events forward, past the positions of their sequence numbers
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "before-0"})
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "after-0"})
+	if removed := cb.Compact(); removed != 2 {
+		t.Fatalf("Expected 2 slots to be compacted, got %d", removed)
+	}
+	check(nostr.Filter{}, before[1:])
+
+	// the current view is still available
+	events, err := cb.QueryAsOf(ctx, nostr.Filter{}, cb.Stats().Head-1)
+	if err != nil || len(events) != 18 {
+		t.Fatalf("Expected 18 events, got %d (%v)", len(events), err)
+	}
+}
+
+func TestQueryAsOfMarksOnlyReturned(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("before-%d", i), 1))
+	}
+	seq := cb.Stats().Head - 1
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("after-%d", i), 1))
+	}
+
+	if _, err := cb.QueryAsOf(ctx, nostr.Filter{}, seq); err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	// the events saved after seq were not returned, so they are evicted unread
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("evictor-%d", i), 1))
+	}
+	if unread := cb.UnreadEvictions(); unread != 5 {
+		t.Fatalf("Expected 5 unread evictions, got %d", unread)
+	}
+}
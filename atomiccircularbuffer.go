@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"errors"
-	"slices"
 	"sync/atomic"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -13,163 +12,171 @@ import (
 // It efficiently manages ephemeral events with a fixed memory footprint and automatic
 // oldest-event replacement when full using atomic operations for thread safety.
 type AtomicCircularBuffer struct {
-	buffer []nostr.Event
-	head   uint64 // atomic
-	tail   uint64 // atomic
-	size   uint64
-	count  uint64 // atomic
+	// slots holding private copies of the saved events, which are never modified once stored
+	buffer []atomic.Pointer[nostr.Event]
+
+	// position of the next save, which only grows. The slot of a position is position % size
+	head atomic.Uint64
+	size uint64
+
+	// number of events in the buffer, which never exceeds size
+	count atomic.Uint64
+
+	// match is the matching used by the queries, see newAtomicCircularBuffer
+	match func(*nostr.Event, nostr.Filter, *kindMatcher) bool
+
+	bufferOptions
 }
 
 // NewAtomicCircularBuffer creates a new AtomicCircularBuffer with the specified capacity.
-func NewAtomicCircularBuffer(capacity int) *AtomicCircularBuffer {
+// It panics if an option is supported only by [AtomicCircularBuffer2], see [NewAtomicCircularBufferE].
+func NewAtomicCircularBuffer(capacity int, opts ...BufferOption) *AtomicCircularBuffer {
+	cb, err := NewAtomicCircularBufferE(capacity, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return cb
+}
+
+// NewAtomicCircularBufferE is like [NewAtomicCircularBuffer], but returns [ErrUnsupportedOption] instead of panicking
+// if an option is supported only by [AtomicCircularBuffer2].
+func NewAtomicCircularBufferE(capacity int, opts ...BufferOption) (*AtomicCircularBuffer, error) {
+	cb := newAtomicCircularBuffer(capacity, matchEvent, opts...)
+	if err := cb.checkLegacy(); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// newAtomicCircularBuffer is like [NewAtomicCircularBuffer], but the queries match the events with match,
+// which lets the tests replace [matchEvent], for example to make it panic.
+func newAtomicCircularBuffer(capacity int, match func(*nostr.Event, nostr.Filter, *kindMatcher) bool, opts ...BufferOption) *AtomicCircularBuffer {
 	return &AtomicCircularBuffer{
-		buffer: make([]nostr.Event, capacity),
-		size:   uint64(capacity),
+		buffer:        make([]atomic.Pointer[nostr.Event], capacity),
+		size:          uint64(capacity),
+		match:         match,
+		bufferOptions: newBufferOptions(opts),
 	}
 }
 
 // SaveEvent adds a new event to the circular buffer.
-// If the buffer is full, it automatically overwrites the oldest event.
+// If the buffer is full, it automatically overwrites the oldest event,
+// unless the overflow policy is [RejectNew], in which case [ErrBufferFull] is returned.
+// If ctx is already cancelled, its error is returned and the buffer is left unchanged.
 func (cb *AtomicCircularBuffer) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if evt == nil {
 		return errors.New("event cannot be nil")
 	}
 
-	// Atomically get and increment the head
-	head := atomic.LoadUint64(&cb.head)
-	newHead := (head + 1) % cb.size
-	atomic.StoreUint64(&cb.head, newHead)
+	if err := cb.validate(evt); err != nil {
+		return err
+	}
+
+	if cb.policy == RejectNew && cb.reserve() == 0 {
+		return ErrBufferFull
+	}
 
-	// Store the event at the current head position
-	cb.buffer[head] = *evt
+	// claiming the position with a single atomic add gives every concurrent save its own slot
+	stored := cloneEvent(evt)
+	pos := cb.head.Add(1) - 1
+	old := cb.buffer[pos%cb.size].Swap(stored)
 
-	// Update count and tail atomically
-	count := atomic.AddUint64(&cb.count, 1)
-	if count > cb.size {
-		// Buffer is full, advance tail to overwrite oldest
-		atomic.CompareAndSwapUint64(&cb.count, count, cb.size)
-		atomic.StoreUint64(&cb.tail, (atomic.LoadUint64(&cb.tail)+1)%cb.size)
+	if cb.policy == DropOldest {
+		cb.reserve()
 	}
 
+	if old != nil && cb.onEvict != nil {
+		cb.onEvict(old)
+	}
 	return nil
 }
 
-// QueryEvents returns a channel that will receive all events matching the filter.
-// Events are sent asynchronously to avoid blocking.
-func (cb *AtomicCircularBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event)
-
-	go func() {
-		defer close(ch)
-
-		// Get a snapshot of the current state
-		tail := atomic.LoadUint64(&cb.tail)
-		count := atomic.LoadUint64(&cb.count)
-
-		// Apply limit from filter or use all events if no limit
-		limit := int(count)
-		if filter.Limit > 0 && filter.Limit < limit {
-			limit = filter.Limit
+// reserve increments the count by one, unless the buffer is full. It returns the number of reserved slots.
+func (cb *AtomicCircularBuffer) reserve() uint64 {
+	for {
+		count := cb.count.Load()
+		if count >= cb.size {
+			return 0
 		}
-
-		// Pre-allocate the result slice
-		result := make([]nostr.Event, 0, limit)
-
-		// Start from the tail (oldest) and move towards head (newest)
-		for i, idx := uint64(0), tail; i < count; i++ {
-			evt := cb.buffer[idx]
-			if cb.eventMatchesFilter(&evt, filter) {
-				result = append(result, evt)
-				if len(result) >= limit {
-					break
-				}
-			}
-			idx = (idx + 1) % cb.size
+		if cb.count.CompareAndSwap(count, count+1) {
+			return 1
 		}
+	}
+}
 
-		// Send matching events to the channel
-		for i := range result {
-			select {
-			case <-ctx.Done():
-				return
-			case ch <- &result[i]:
-			}
-		}
-	}()
-
-	return ch, nil
+// Len returns the number of events in the buffer.
+func (cb *AtomicCircularBuffer) Len() int {
+	return int(cb.count.Load())
 }
 
-// eventMatchesFilter checks if an event matches the given filter.
-// Implements the Nostr filter matching logic for IDs, authors, kinds, tags, and timestamps.
-func (cb *AtomicCircularBuffer) eventMatchesFilter(evt *nostr.Event, filter nostr.Filter) bool {
-	// Check IDs
-	if len(filter.IDs) > 0 {
-		found := false
-		for _, id := range filter.IDs {
-			if id == evt.ID || (len(id) < 64 && len(evt.ID) >= len(id) && evt.ID[:len(id)] == id) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
+// Clear removes all the events from the buffer, keeping its memory for reuse.
+// It must not run concurrently with SaveEvent.
+func (cb *AtomicCircularBuffer) Clear() {
+	// empty the buffer first, so that concurrent queries stop reading the slots being cleared
+	cb.count.Store(0)
+	for i := range cb.buffer {
+		cb.buffer[i].Store(nil)
 	}
+	cb.head.Store(0)
+}
 
-	// Check Authors
-	if len(filter.Authors) > 0 {
-		found := false
-		for _, author := range filter.Authors {
-			if author == evt.PubKey || (len(author) < 64 && len(evt.PubKey) >= len(author) && evt.PubKey[:len(author)] == author) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
+// QueryEvents returns a channel that will receive all events matching the filter.
+// The events are collected before returning, into a closed channel large enough to hold them all,
+// so consumers can stop reading it at any time without leaking anything.
+// If ctx is already cancelled, its error is returned.
+// Invalid filters are rejected, see [NormalizeFilter]. A panic while matching the events is recovered,
+// see [ErrQueryPanicked].
+func (cb *AtomicCircularBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) (ch chan *nostr.Event, err error) {
+	defer recoverQuery(&ch, &err)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// Check Kinds
-	if len(filter.Kinds) > 0 {
-		hasMatchingKind := slices.Contains(filter.Kinds, evt.Kind)
-		if !hasMatchingKind {
-			return false
-		}
+	if err := cb.acquireQuery(ctx); err != nil {
+		return nil, err
 	}
+	defer cb.releaseQuery()
 
-	// Check Tags
-	for tagName, values := range filter.Tags {
-		if len(values) == 0 {
-			continue
-		}
+	filter, err = normalizeFilter(filter, int(cb.size))
+	if err != nil && !errors.Is(err, ErrUnsatisfiableFilter) {
+		return nil, err
+	}
 
-		found := false
-		for _, tag := range evt.Tags {
-			if len(tag) > 1 && tag[0] == tagName {
-				if slices.Contains(values, tag[1]) {
-					found = true
-				}
-				if found {
-					break
-				}
-			}
-		}
-		if !found {
-			return false
-		}
+	if err != nil {
+		// the filter can't match anything
+		return sendAll(nil), nil
 	}
 
-	// Check Since
-	if filter.Since != nil && evt.CreatedAt < *filter.Since {
-		return false
+	// Get a snapshot of the current state. The oldest event sits count positions behind the head
+	head := cb.head.Load()
+	count := min(cb.count.Load(), head)
+
+	// Apply limit from filter or use all events if no limit
+	limit := int(count)
+	if filter.Limit > 0 && filter.Limit < limit {
+		limit = filter.Limit
 	}
 
-	// Check Until
-	if filter.Until != nil && evt.CreatedAt > *filter.Until {
-		return false
+	// Pre-allocate the result slice
+	result := make([]*nostr.Event, 0, limit)
+	kinds := newKindMatcher(filter.Kinds)
+
+	// Start from the oldest and move towards head (newest).
+	// Slots being written by a concurrent save are either still empty or already hold the new event
+	for pos := head - count; pos < head; pos++ {
+		evt := cb.buffer[pos%cb.size].Load()
+		if evt != nil && cb.match(evt, filter, &kinds) {
+			result = append(result, evt)
+			if len(result) >= limit {
+				break
+			}
+		}
 	}
 
-	return true
+	return sendAll(result), nil
 }
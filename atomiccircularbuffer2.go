@@ -3,170 +3,1057 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
+// maxPreallocatedResults is the maximum capacity preallocated for the result of a query.
+const maxPreallocatedResults = 64
+
+// StoredEvent is an event stored in an [AtomicCircularBuffer2], with its sequence number.
+type StoredEvent struct {
+	Event *nostr.Event
+
+	// Seq is the sequence number of the save that stored the event. It's unique and increasing
+	// for the lifetime of the buffer, so it orders events by insertion even when they have the same CreatedAt.
+	Seq uint64
+
+	// read is set to 1 once the event is returned by a query, see [AtomicCircularBuffer2.UnreadEvictions].
+	// It's accessed with the atomic functions rather than being an atomic.Bool, so that StoredEvent can be copied
+	read uint32
+
+	// used is set to 1 when the event is returned by a query with the [LRU] eviction policy, so that it's
+	// saved again instead of being evicted, see [WithEvictionPolicy]
+	used uint32
+}
+
+// markRead records that the event has been returned by a query.
+func (s *StoredEvent) markRead() {
+	if atomic.LoadUint32(&s.read) == 0 {
+		atomic.StoreUint32(&s.read, 1)
+	}
+}
+
+// wasRead reports whether the event has been returned by a query.
+func (s *StoredEvent) wasRead() bool {
+	return atomic.LoadUint32(&s.read) == 1
+}
+
+// markUsed records that the event has been returned by a query since it was saved.
+func (s *StoredEvent) markUsed() {
+	if atomic.LoadUint32(&s.used) == 0 {
+		atomic.StoreUint32(&s.used, 1)
+	}
+}
+
+// wasUsed reports whether the event has been returned by a query since it was saved.
+func (s *StoredEvent) wasUsed() bool {
+	return atomic.LoadUint32(&s.used) == 1
+}
+
+// event returns the stored event, or nil if s is nil.
+func (s *StoredEvent) event() *nostr.Event {
+	if s == nil {
+		return nil
+	}
+	return s.Event
+}
+
 // AtomicCircularBuffer2 is an optimized, lock-free, fixed-size circular buffer for storing Nostr events.
 type AtomicCircularBuffer2 struct {
-	buffer []*atomic.Pointer[nostr.Event]
-	head   atomic.Uint64 // position to write next event
+	buffer []*atomic.Pointer[StoredEvent]
+	head   atomic.Uint64 // position to write next event, the slot is head % size. It's also the next sequence number
 	size   uint64        // fixed size of the buffer
-	count  atomic.Uint64 // number of events in buffer
+	count  atomic.Uint64 // number of events in buffer, not counting the deleted ones
+
+	// number of live positions [head-span, head), including the empty slots left by deleted events
+	span atomic.Uint64
+
+	// one plus the position of the last event saved with a CreatedAt older than its predecessor's,
+	// or zero if there is none. The events from that position onwards are not sorted by CreatedAt.
+	unsortedAt atomic.Uint64
+
+	// index of the tags of the events, nil unless enabled with [WithTagIndex]
+	index *tagIndex
+
+	// index of the CreatedAt of the events, nil unless enabled with [WithTimeIndex]
+	times *timeIndex
+
+	// index of the pubkeys of the events, nil unless enabled with [WithAuthorIndex]
+	authors *authorIndex
+
+	// positions of the events sorted by CreatedAt, nil unless enabled with [WithOrderIndex]
+	order *orderIndex
+
+	// bloom filter of the IDs of the events, nil unless enabled with [WithIDBloomFilter]
+	ids *idFilter
+
+	// cache of the query results, nil unless enabled with [WithQueryCache].
+	// version is bumped after every write, invalidating the cached results
+	cache   *queryCache
+	version atomic.Uint64
+
+	// subscriptions to the saved events, see [AtomicCircularBuffer2.Subscribe]
+	subs subscribers
+
+	// IDs of the events that are never evicted, see [AtomicCircularBuffer2.Pin]
+	pins pinSet
+
+	// lifetime number of saved events, see [AtomicCircularBuffer2.Stats]
+	saved atomic.Uint64
+
+	// evictions, including the ones of events never returned by a query, see [AtomicCircularBuffer2.UnreadEvictions]
+	evictions evictionStats
+
+	// replaceMu serializes the calls to ReplaceEvent, so that two versions of the same event
+	// can't both be saved. It isn't held by the other writes.
+	replaceMu sync.Mutex
+
+	// compactMu is held for reading by saves and deletes, and for writing by Compact.
+	// It's only used by saves and deletes when compaction is enabled with [WithCompaction].
+	compactMu sync.RWMutex
+
+	// done is closed by Close, stopping the background compaction and sweeping of expired events
+	done      chan struct{}
+	closeOnce sync.Once
+
+	bufferOptions
 }
 
+// ErrInvalidCapacity is returned when creating a buffer with a capacity that is not positive.
+var ErrInvalidCapacity = errors.New("capacity must be greater than 0")
+
 // NewAtomicCircularBuffer2 creates a new AtomicCircularBuffer2 with the specified capacity.
-func NewAtomicCircularBuffer2(capacity int) *AtomicCircularBuffer2 {
+// It panics if the capacity is not positive, use [NewAtomicCircularBuffer2E] when the capacity
+// comes from the configuration.
+func NewAtomicCircularBuffer2(capacity int, opts ...BufferOption) *AtomicCircularBuffer2 {
+	cb, err := NewAtomicCircularBuffer2E(capacity, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return cb
+}
+
+// NewAtomicCircularBuffer2E is like [NewAtomicCircularBuffer2], but returns [ErrInvalidCapacity]
+// instead of panicking if the capacity is not positive.
+func NewAtomicCircularBuffer2E(capacity int, opts ...BufferOption) (*AtomicCircularBuffer2, error) {
 	if capacity <= 0 {
-		panic("capacity must be greater than 0")
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidCapacity, capacity)
 	}
 
-	buffer := make([]*atomic.Pointer[nostr.Event], capacity)
+	buffer := make([]*atomic.Pointer[StoredEvent], capacity)
 	for i := range buffer {
-		buffer[i] = &atomic.Pointer[nostr.Event]{}
+		buffer[i] = &atomic.Pointer[StoredEvent]{}
+	}
+
+	cb := &AtomicCircularBuffer2{
+		buffer:        buffer,
+		size:          uint64(capacity),
+		bufferOptions: newBufferOptions(opts),
+	}
+
+	if cb.indexTags {
+		cb.index = newTagIndex()
+	}
+	if cb.timeBucket > 0 {
+		cb.times = newTimeIndex(cb.timeBucket)
+	}
+	if cb.indexAuthors {
+		cb.authors = newAuthorIndex()
+	}
+	if cb.indexOrder {
+		cb.order = newOrderIndex(capacity, cb.isCurrent)
+	}
+	if cb.bloomIDs {
+		cb.ids = newIDFilter(capacity)
+	}
+	if cb.cacheSize > 0 && cb.cacheTTL > 0 {
+		cb.cache = newQueryCache(cb.cacheSize, cb.cacheTTL)
+	}
+
+	if cb.compactInterval > 0 || cb.maxAge > 0 {
+		cb.done = make(chan struct{})
+	}
+	if cb.compactInterval > 0 {
+		go cb.compactLoop()
+	}
+	if cb.maxAge > 0 {
+		go cb.sweepLoop()
+	}
+	return cb, nil
+}
+
+// NewAtomicCircularBuffer2FromEvents creates a new AtomicCircularBuffer2 already containing the events,
+// as if they were saved in order. If there are more events than the capacity, only the most recent
+// (i.e. the last) ones are kept. Nil events are skipped.
+func NewAtomicCircularBuffer2FromEvents(capacity int, events []*nostr.Event, opts ...BufferOption) *AtomicCircularBuffer2 {
+	cb := NewAtomicCircularBuffer2(capacity, opts...)
+
+	events = slices.DeleteFunc(slices.Clone(events), func(evt *nostr.Event) bool { return evt == nil })
+	if len(events) > capacity {
+		events = events[len(events)-capacity:]
 	}
 
-	return &AtomicCircularBuffer2{
-		buffer: buffer,
-		size:   uint64(capacity),
+	for i, evt := range events {
+		evt = cloneEvent(evt)
+		cb.buffer[i].Store(&StoredEvent{Event: evt, Seq: uint64(i)})
+		if cb.index != nil {
+			cb.index.add(evt, uint64(i))
+		}
+		if cb.times != nil {
+			cb.times.add(evt, uint64(i), 0)
+		}
+		if cb.authors != nil {
+			cb.authors.add(evt.PubKey, uint64(i))
+		}
+		if cb.order != nil {
+			cb.order.add(evt, uint64(i))
+		}
+		if cb.ids != nil {
+			cb.ids.add(evt.ID)
+		}
+		if i > 0 && evt.CreatedAt < events[i-1].CreatedAt {
+			cb.unsortedAt.Store(uint64(i) + 1)
+		}
 	}
+
+	cb.head.Store(uint64(len(events)))
+	cb.saved.Store(uint64(len(events)))
+	cb.span.Store(uint64(len(events)))
+	cb.count.Store(uint64(len(events)))
+	return cb
 }
 
 // SaveEvent adds a new event to the circular buffer.
-// If the buffer is full, it automatically overwrites the oldest event.
+// If the buffer is full, it automatically overwrites the oldest event,
+// unless the overflow policy is [RejectNew], in which case [ErrBufferFull] is returned.
+// If ctx is already cancelled, its error is returned and the buffer is left unchanged.
 func (cb *AtomicCircularBuffer2) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if cb.tracer != nil {
+		return cb.tracedSave(ctx, evt)
+	}
+	return cb.saveEvent(ctx, evt)
+}
+
+// saveEvent saves the event, see [AtomicCircularBuffer2.SaveEvent].
+func (cb *AtomicCircularBuffer2) saveEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if evt == nil {
 		return errors.New("event cannot be nil")
 	}
 
-	head := cb.head.Load()
-	cb.buffer[head].Store(evt)
-	cb.head.Store((head + 1) % cb.size)
+	if err := cb.validate(evt); err != nil {
+		return err
+	}
+
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
+	}
+
+	if cb.policy == RejectNew && cb.reserve(1) == 0 {
+		return ErrBufferFull
+	}
+
+	// the buffer stores its own copy, unaffected by later changes to the event
+	evt = cloneEvent(evt)
+
+	// claim the position atomically, so that concurrent saves never write the same slot
+	pos := cb.head.Add(1) - 1
+	old := cb.put(pos, evt)
+
+	if cb.policy == DropOldest {
+		cb.reserve(1)
+	}
+	cb.version.Add(1)
+	cb.notify(evt)
+
+	if cb.metrics != nil {
+		cb.metrics.observeSave(old != nil)
+	}
+	if old != nil && cb.onEvict != nil {
+		cb.onEvict(old)
+	}
+	return nil
+}
+
+// SaveEvents adds the events to the buffer in order, as if they were saved one by one, claiming all their
+// positions at once. If there are more events than the capacity, only the last ones are stored, and the
+// others are dropped without being saved. It returns the number of events stored.
+// With the [RejectNew] policy, only the first events fitting in the buffer are stored, and [ErrBufferFull]
+// is returned if some didn't. If any event is nil or invalid, none is stored.
+// While some events are pinned, see [AtomicCircularBuffer2.Pin], or with the [LRU] eviction policy,
+// the events are saved one at a time.
+func (cb *AtomicCircularBuffer2) SaveEvents(ctx context.Context, events []*nostr.Event) (int, error) {
+	stored, err := cb.saveEvents(ctx, events)
+	return len(stored), err
+}
+
+// saveEvents saves the events, see [AtomicCircularBuffer2.SaveEvents], returning the consecutive events stored.
+func (cb *AtomicCircularBuffer2) saveEvents(ctx context.Context, events []*nostr.Event) ([]*nostr.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, evt := range events {
+		if evt == nil {
+			return nil, errors.New("event cannot be nil")
+		}
+		if err := cb.validate(evt); err != nil {
+			return nil, err
+		}
+	}
+
+	if cb.policy == DropOldest && (cb.pins.len.Load() > 0 || cb.eviction == LRU) {
+		// a pinned event stored again at the head could be overwritten by the rest of the batch, see put
+		return cb.saveOneByOne(ctx, events)
+	}
+
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
+	}
+
+	var err error
+	switch cb.policy {
+	case DropOldest:
+		if uint64(len(events)) > cb.size {
+			events = events[uint64(len(events))-cb.size:]
+		}
+
+	case RejectNew:
+		reserved := cb.reserve(uint64(len(events)))
+		if reserved < uint64(len(events)) {
+			events = events[:reserved]
+			err = ErrBufferFull
+		}
+	}
+
+	n := uint64(len(events))
+	if n == 0 {
+		return nil, err
+	}
+
+	stored := events
+	clones := make([]*nostr.Event, n)
+	for i, evt := range events {
+		clones[i] = cloneEvent(evt)
+	}
+	events = clones
+
+	start := cb.head.Add(n) - n
+	var evicted []*nostr.Event
+	for i, evt := range events {
+		old := cb.put(start+uint64(i), evt)
+		if cb.metrics != nil {
+			cb.metrics.observeSave(old != nil)
+		}
+		if old != nil && cb.onEvict != nil {
+			evicted = append(evicted, old)
+		}
+	}
+
+	if cb.policy == DropOldest {
+		cb.reserve(n)
+	}
+	cb.version.Add(1)
+	for _, evt := range events {
+		cb.notify(evt)
+	}
+
+	for _, old := range evicted {
+		cb.onEvict(old)
+	}
+	return stored, err
+}
+
+// saveOneByOne saves the last events fitting in the buffer one at a time, returning the events saved
+// before the first failure.
+func (cb *AtomicCircularBuffer2) saveOneByOne(ctx context.Context, events []*nostr.Event) ([]*nostr.Event, error) {
+	if uint64(len(events)) > cb.size {
+		events = events[uint64(len(events))-cb.size:]
+	}
+
+	for i, evt := range events {
+		if err := cb.SaveEvent(ctx, evt); err != nil {
+			return events[:i], err
+		}
+	}
+	return events, nil
+}
 
-	count := cb.count.Add(1)
-	if count > cb.size {
-		cb.count.Store(cb.size)
+// put stores the event at the claimed position, returning the event it has evicted, if any.
+// Pinned events are not evicted: they are stored again at the head, evicting the next oldest event instead.
+// With the [LRU] eviction policy, neither are the events used since they were saved.
+func (cb *AtomicCircularBuffer2) put(pos uint64, evt *nostr.Event) *nostr.Event {
+	cb.saved.Add(1)
+
+	old := cb.store(pos, evt)
+	for old != nil && (cb.pins.contains(old.Event.ID) || (cb.eviction == LRU && old.wasUsed())) {
+		old = cb.store(cb.head.Add(1)-1, old.Event)
+	}
+
+	if old != nil {
+		cb.observeEviction(old)
+	}
+	return old.event()
+}
+
+// store stores the event at the claimed position, returning the stored event it has overwritten, if any.
+func (cb *AtomicCircularBuffer2) store(pos uint64, evt *nostr.Event) *StoredEvent {
+	if pos > 0 {
+		prev := cb.slot(pos - 1).Load().event()
+		if prev == nil || evt.CreatedAt < prev.CreatedAt {
+			cb.unsortedAt.Store(pos + 1)
+		}
+	}
+
+	if cb.ids != nil {
+		if pos > 0 && pos%cb.size == 0 {
+			// a new pass over the buffer starts, see idFilter
+			cb.ids.rotate()
+		}
+		cb.ids.add(evt.ID)
+	}
+
+	old := cb.slot(pos).Swap(&StoredEvent{Event: evt, Seq: pos})
+	if old == nil {
+		cb.count.Add(1)
+	}
+	if cb.index != nil {
+		if old != nil {
+			cb.index.remove(old.Event, pos-cb.size)
+		}
+		cb.index.add(evt, pos)
+	}
+	if cb.times != nil {
+		cb.times.add(evt, pos, pos+1-min(pos+1, cb.size))
+	}
+	if cb.authors != nil {
+		if old != nil {
+			cb.authors.remove(old.Event.PubKey, pos-cb.size)
+		}
+		cb.authors.add(evt.PubKey, pos)
+	}
+	if cb.order != nil {
+		cb.order.add(evt, pos)
+	}
+	return old
+}
+
+// DeleteEvent removes the event with the same ID from the buffer, if present.
+// The slot is left empty rather than compacted, so the positions of the other events don't change,
+// and it's only reused once overwritten or the buffer compacted. The event is no longer counted by Len.
+func (cb *AtomicCircularBuffer2) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt == nil {
+		return errors.New("event cannot be nil")
+	}
+
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
 	}
 
+	if cb.pins.contains(evt.ID) {
+		cb.pins.remove(evt.ID)
+	}
+
+	start, end := cb.bounds()
+	for pos := start; pos < end; pos++ {
+		slot := cb.slot(pos)
+		stored := slot.Load()
+		if stored != nil && stored.Event.ID == evt.ID {
+			if slot.CompareAndSwap(stored, nil) {
+				if cb.index != nil {
+					cb.index.remove(stored.Event, pos)
+				}
+				if cb.authors != nil {
+					cb.authors.remove(stored.Event.PubKey, pos)
+				}
+				cb.uncount()
+				cb.version.Add(1)
+			}
+			return nil
+		}
+	}
 	return nil
 }
 
+// UpdateEvent replaces the event with the ID by a copy of it changed by mutate, keeping its position in the buffer.
+// The stored event is never modified, as concurrent queries might be reading it: mutate receives a deep copy,
+// which atomically replaces it. mutate must not change the ID, and it might be called more than once if
+// the event is concurrently updated. It reports whether the event was found, which is never the case if
+// ctx is cancelled.
+func (cb *AtomicCircularBuffer2) UpdateEvent(ctx context.Context, id string, mutate func(*nostr.Event)) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
+	}
+
+	for {
+		pos, stored, found := cb.find(id)
+		if !found {
+			return false
+		}
+
+		updated := cloneEvent(stored.Event)
+		mutate(updated)
+
+		replacement := &StoredEvent{Event: updated, Seq: stored.Seq}
+		if stored.wasRead() {
+			replacement.markRead()
+		}
+
+		if !cb.slot(pos).CompareAndSwap(stored, replacement) {
+			// the event was updated, deleted or evicted in the meantime
+			continue
+		}
+
+		if cb.index != nil {
+			cb.index.remove(stored.Event, pos)
+			cb.index.add(updated, pos)
+		}
+		if cb.authors != nil && updated.PubKey != stored.Event.PubKey {
+			cb.authors.remove(stored.Event.PubKey, pos)
+			cb.authors.add(updated.PubKey, pos)
+		}
+		if cb.times != nil && updated.CreatedAt != stored.Event.CreatedAt {
+			start, _ := cb.bounds()
+			cb.times.add(updated, pos, start)
+		}
+		if cb.order != nil && updated.CreatedAt != stored.Event.CreatedAt {
+			cb.order.remove(stored.Event, pos)
+			cb.order.add(updated, pos)
+		}
+		if updated.CreatedAt != stored.Event.CreatedAt {
+			// the event might now be out of order with both its neighbours, see put
+			cb.markUnsorted(pos + 2)
+		}
+		cb.version.Add(1)
+		return true
+	}
+}
+
+// find returns the position of the event with the ID, and the event itself.
+func (cb *AtomicCircularBuffer2) find(id string) (uint64, *StoredEvent, bool) {
+	start, end := cb.bounds()
+	for pos := start; pos < end; pos++ {
+		if stored := cb.slot(pos).Load(); stored != nil && stored.Event.ID == id {
+			return pos, stored, true
+		}
+	}
+	return 0, nil, false
+}
+
+// markUnsorted moves unsortedAt forward to the position, if it's behind it.
+func (cb *AtomicCircularBuffer2) markUnsorted(pos uint64) {
+	for {
+		current := cb.unsortedAt.Load()
+		if current >= pos || cb.unsortedAt.CompareAndSwap(current, pos) {
+			return
+		}
+	}
+}
+
+// Len returns the number of events in the buffer. Deleted events are not counted.
+func (cb *AtomicCircularBuffer2) Len() int {
+	// a deletion can uncount an event before its save has counted it, making the count wrap around for a moment
+	start, end := cb.bounds()
+	return int(min(cb.count.Load(), end-start))
+}
+
+// uncount decrements the count of events, after a deletion emptied the slot of one.
+func (cb *AtomicCircularBuffer2) uncount() {
+	cb.count.Add(^uint64(0))
+}
+
+// Clear removes all the events from the buffer, keeping its memory for reuse.
+// The slots are emptied, so that the events can be garbage collected.
+// The sequence numbers are not reset, so they are never reused.
+// It's safe to call concurrently with queries, but not with saves.
+func (cb *AtomicCircularBuffer2) Clear() {
+	cb.compactMu.Lock()
+	defer cb.compactMu.Unlock()
+
+	// empty the buffer first, so that concurrent queries stop reading the slots being cleared
+	cb.span.Store(0)
+	cb.count.Store(0)
+	for _, slot := range cb.buffer {
+		slot.Store(nil)
+	}
+	cb.unsortedAt.Store(0)
+	if cb.index != nil {
+		cb.index.reset()
+	}
+	if cb.times != nil {
+		cb.times.reset()
+	}
+	if cb.authors != nil {
+		cb.authors.reset()
+	}
+	if cb.order != nil {
+		cb.order.reset()
+	}
+	if cb.ids != nil {
+		cb.ids.reset()
+	}
+	cb.pins.reset()
+	cb.version.Add(1)
+}
+
+// All returns an iterator over the events in the buffer, from the oldest to the newest.
+// The range of events is fixed when the iteration starts, and deleted events are skipped.
+func (cb *AtomicCircularBuffer2) All() iter.Seq[*nostr.Event] {
+	return func(yield func(*nostr.Event) bool) {
+		start, end := cb.bounds()
+		for pos := start; pos < end; pos++ {
+			evt := cb.slot(pos).Load().event()
+			if evt != nil && !yield(evt) {
+				return
+			}
+		}
+	}
+}
+
+// Filter returns the events in the buffer satisfying pred, from the oldest to the newest.
+// It's meant for one-off tasks that can't be expressed with a [nostr.Filter], as it always scans the whole buffer.
+// Like [AtomicCircularBuffer2.All], the range of events is fixed when the scan starts, and deleted events are skipped.
+func (cb *AtomicCircularBuffer2) Filter(pred func(*nostr.Event) bool) []*nostr.Event {
+	var events []*nostr.Event
+	for evt := range cb.All() {
+		if pred(evt) {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+// Newest returns the most recently saved event in the buffer, or false if the buffer is empty.
+// Deleted events are skipped.
+func (cb *AtomicCircularBuffer2) Newest() (*nostr.Event, bool) {
+	start, end := cb.bounds()
+	for pos := end; pos > start; pos-- {
+		if evt := cb.slot(pos - 1).Load().event(); evt != nil {
+			return evt, true
+		}
+	}
+	return nil, false
+}
+
+// Oldest returns the least recently saved event in the buffer, or false if the buffer is empty.
+// Deleted events are skipped.
+func (cb *AtomicCircularBuffer2) Oldest() (*nostr.Event, bool) {
+	start, end := cb.bounds()
+	for pos := start; pos < end; pos++ {
+		if evt := cb.slot(pos).Load().event(); evt != nil {
+			return evt, true
+		}
+	}
+	return nil, false
+}
+
+// bounds returns the range of positions [start, end) holding the events currently in the buffer.
+// Slots in the range might still be empty, if the save that claimed them is in progress.
+func (cb *AtomicCircularBuffer2) bounds() (start, end uint64) {
+	span := cb.span.Load()
+	head := cb.head.Load()
+
+	if span > cb.size {
+		span = cb.size
+	}
+	if span > head {
+		// a save with the RejectNew policy reserved its slot but has yet to move the head
+		span = head
+	}
+
+	// the oldest event sits span positions behind the head, whether the buffer is full or not
+	return head - span, head
+}
+
+// slot returns the slot of the buffer for the provided position.
+func (cb *AtomicCircularBuffer2) slot(pos uint64) *atomic.Pointer[StoredEvent] {
+	return cb.buffer[pos%cb.size]
+}
+
+// reserve increments the span by up to n without exceeding the size of the buffer,
+// returning by how much it was incremented. The span is never observed above the size of the buffer.
+func (cb *AtomicCircularBuffer2) reserve(n uint64) uint64 {
+	for {
+		span := cb.span.Load()
+		reserved := min(n, cb.size-min(span, cb.size))
+		if reserved == 0 {
+			return 0
+		}
+		if cb.span.CompareAndSwap(span, span+reserved) {
+			return reserved
+		}
+	}
+}
+
 // QueryEvents returns a slice of events matching the filter.
 // This is more efficient than channel-based implementation as it avoids
 // goroutine creation and channel operations.
+// Invalid filters are rejected, see [NormalizeFilter].
+//
+// The events are returned in the order they were saved, from the oldest to the newest.
+// A positive limit keeps the first matching events in that order, so the oldest ones: a limit of at least
+// the number of matching events returns all of them, and limits above the capacity are clamped to it.
+// Use [AtomicCircularBuffer2.QueryEventsOrdered] to get the newest events instead.
+//
+// The events are the ones stored in the buffer, shared with the other queries, and must not be modified:
+// changing their fields or tags would change them for every later query, and leave the indexes out of date.
+// Use [AtomicCircularBuffer2.QueryEventsCopy] to get events the caller can modify.
 func (cb *AtomicCircularBuffer2) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
-	count := cb.count.Load()
-	head := cb.head.Load()
+	return cb.query(ctx, filter, nil, nil)
+}
 
-	if count == 0 {
-		return nil, nil
+// QueryEventsCopy is like [AtomicCircularBuffer2.QueryEvents], but returns deep copies of the events,
+// which the caller owns and can modify without affecting the buffer.
+func (cb *AtomicCircularBuffer2) QueryEventsCopy(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	events, err := cb.query(ctx, filter, nil, nil)
+	for i, evt := range events {
+		events[i] = cloneEvent(evt)
 	}
+	return events, err
+}
+
+// QueryEventsInto is like [AtomicCircularBuffer2.QueryEvents], but appends the events to dst[:0] and returns it,
+// so that the same slice can be reused across queries. The previous content of dst is overwritten.
+// If dst has enough capacity for the result, the query doesn't allocate.
+func (cb *AtomicCircularBuffer2) QueryEventsInto(ctx context.Context, filter nostr.Filter, dst []*nostr.Event) ([]*nostr.Event, error) {
+	return cb.query(ctx, filter, nil, dst[:0])
+}
+
+// QueryEventsExt is like [AtomicCircularBuffer2.QueryEvents], but also applies the extended
+// constraints of the filter on top of the standard matching.
+func (cb *AtomicCircularBuffer2) QueryEventsExt(ctx context.Context, filter ExtendedFilter) ([]*nostr.Event, error) {
+	filter = filter.prepare()
+	return cb.query(ctx, filter.Filter, filter.accepts, nil)
+}
 
-	limit := int(count)
-	if filter.Limit > 0 && filter.Limit < limit {
-		limit = filter.Limit
+// query runs queryEvents, recording the metrics and using the cache if enabled.
+// It waits for a slot first if the concurrent queries are bounded, see [WithMaxConcurrentQueries].
+func (cb *AtomicCircularBuffer2) query(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, dst []*nostr.Event) ([]*nostr.Event, error) {
+	if err := cb.acquireQuery(ctx); err != nil {
+		return dst, err
 	}
+	defer cb.releaseQuery()
 
-	result := make([]*nostr.Event, 0, limit)
+	if cb.tracer != nil {
+		return cb.tracedQuery(ctx, filter, accept, dst)
+	}
+	return cb.measuredQuery(ctx, filter, accept, dst)
+}
 
-	tail := uint64(0)
-	if count >= cb.size {
-		tail = (head + 1) % cb.size
+// measuredQuery runs the query, recording it into the metrics, if any.
+func (cb *AtomicCircularBuffer2) measuredQuery(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, dst []*nostr.Event) ([]*nostr.Event, error) {
+	if cb.metrics == nil {
+		return cb.cachedQuery(ctx, filter, accept, dst)
 	}
 
-	for i := uint64(0); i < count; i++ {
-		idx := (tail + i) % cb.size
-		evt := cb.buffer[idx].Load()
-		if evt != nil && cb.eventMatchesFilter(evt, filter) {
-			result = append(result, evt)
-			if len(result) >= limit {
-				break
-			}
+	start := time.Now()
+	events, err := cb.cachedQuery(ctx, filter, accept, dst)
+	cb.metrics.observeQuery(len(events), time.Since(start))
+	return events, err
+}
+
+// cachedQuery runs queryEvents, returning the cached result if the same filter was queried since the last write.
+// Queries with an accept function are never cached.
+func (cb *AtomicCircularBuffer2) cachedQuery(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, dst []*nostr.Event) ([]*nostr.Event, error) {
+	if cb.cache == nil || accept != nil {
+		return cb.queryEvents(ctx, filter, accept, dst, nil)
+	}
+
+	// the version is read before the scan, so that a write during the scan invalidates its result
+	key := fingerprint(filter)
+	version := cb.version.Load()
+	if events, ok := cb.cache.get(key, version); ok {
+		return append(dst, events...), nil
+	}
+
+	events, err := cb.queryEvents(ctx, filter, nil, dst, nil)
+	if err != nil {
+		return events, err
+	}
+	cb.cache.put(key, version, slices.Clone(events))
+	return events, nil
+}
+
+// queryEvents scans the buffer from the oldest to the newest event, collecting the ones matching the filter.
+// If ctx is cancelled during the scan, the context error is returned.
+// If accept is not nil, matching events are also required to be accepted by it.
+// The events are appended to dst, which is allocated if nil. If stats is not nil, the scan is counted in it.
+func (cb *AtomicCircularBuffer2) queryEvents(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, dst []*nostr.Event, stats *QueryStats) ([]*nostr.Event, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return dst, nil
 		}
+		return dst, err
+	}
+
+	start, end := cb.bounds()
+	count := end - start
+	if count == 0 {
+		return dst, nil
 	}
 
+	// the scan is bounded by the events in the buffer, while the result is bounded by the limit.
+	// Few events might match, so the result starts small and grows only when needed.
+	capacity := min(int(count), maxPreallocatedResults)
+	if filter.Limit > 0 {
+		capacity = min(capacity, filter.Limit)
+	}
+	result := dst
+	if result == nil {
+		result = make([]*nostr.Event, 0, capacity)
+	}
+
+	err = cb.scan(ctx, filter, accept, start, end, stats, func(stored *StoredEvent) bool {
+		result = append(result, stored.Event)
+		return true
+	})
+	if err != nil {
+		return dst, err
+	}
 	return result, nil
 }
 
-// eventMatchesFilter checks if an event matches the given filter.
-// Implements the Nostr filter matching logic for IDs, authors, kinds, tags, and timestamps.
-func (cb *AtomicCircularBuffer2) eventMatchesFilter(evt *nostr.Event, filter nostr.Filter) bool {
-	if filter.Since != nil && evt.CreatedAt < *filter.Since {
-		return false
+// ForEachMatching calls fn with every event matching the filter, from the oldest to the newest,
+// without collecting them. The scan stops when fn returns false, when the limit of the filter
+// is reached, or when ctx is cancelled, in which case the context error is returned.
+// Invalid filters are rejected, see [NormalizeFilter].
+func (cb *AtomicCircularBuffer2) ForEachMatching(ctx context.Context, filter nostr.Filter, fn func(*nostr.Event) bool) error {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil
+		}
+		return err
 	}
-	if filter.Until != nil && evt.CreatedAt > *filter.Until {
-		return false
+
+	start, end := cb.bounds()
+	return cb.scan(ctx, filter, nil, start, end, nil, func(stored *StoredEvent) bool {
+		return fn(stored.Event)
+	})
+}
+
+// QueryIDs is like [AtomicCircularBuffer2.QueryEvents], but returns only the IDs of the events,
+// which is cheaper for existence checks and syncing. It never uses the query cache.
+func (cb *AtomicCircularBuffer2) QueryIDs(ctx context.Context, filter nostr.Filter) ([]string, error) {
+	if cb.metrics == nil {
+		return cb.queryIDs(ctx, filter)
 	}
 
-	if len(filter.Kinds) > 0 {
-		hasMatchingKind := false
-		for _, k := range filter.Kinds {
-			if k == evt.Kind {
-				hasMatchingKind = true
-				break
-			}
+	start := time.Now()
+	ids, err := cb.queryIDs(ctx, filter)
+	cb.metrics.observeQuery(len(ids), time.Since(start))
+	return ids, err
+}
+
+// queryIDs scans the buffer from the oldest to the newest event, collecting the IDs of the ones matching the filter.
+func (cb *AtomicCircularBuffer2) queryIDs(ctx context.Context, filter nostr.Filter) ([]string, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil, nil
 		}
-		if !hasMatchingKind {
-			return false
+		return nil, err
+	}
+
+	var ids []string
+	start, end := cb.bounds()
+	err = cb.scan(ctx, filter, nil, start, end, nil, func(stored *StoredEvent) bool {
+		ids = append(ids, stored.Event.ID)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ctxCheckInterval is the number of positions scanned between two checks of the context.
+const ctxCheckInterval = 256
+
+// scan calls fn with the events at the positions [start, end) matching the normalized filter, from the oldest
+// to the newest, until fn returns false, the limit of the filter is reached, or ctx is cancelled.
+// If accept is not nil, matching events are also required to be accepted by it.
+// If stats is not nil, the scanned positions and the matching events are counted in it.
+// The events passed to fn are marked as returned, see [AtomicCircularBuffer2.peek] to scan without marking them.
+func (cb *AtomicCircularBuffer2) scan(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, start, end uint64, stats *QueryStats, fn func(*StoredEvent) bool) error {
+	return cb.peek(ctx, filter, accept, start, end, stats, func(stored *StoredEvent) bool {
+		cb.markReturned(stored)
+		return fn(stored)
+	})
+}
+
+// peek is like [AtomicCircularBuffer2.scan], but doesn't mark the events as returned,
+// for the callers counting the events or returning only some of them.
+func (cb *AtomicCircularBuffer2) peek(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, start, end uint64, stats *QueryStats, fn func(*StoredEvent) bool) error {
+	if cb.ids != nil && !cb.mayContainAny(filter.IDs) {
+		return nil
+	}
+
+	if cb.maxAge > 0 {
+		// expired events are skipped as if the filter asked for the events since the expiration
+		cutoff := cb.expiration()
+		if filter.Since == nil || *filter.Since < cutoff {
+			filter.Since = &cutoff
 		}
 	}
 
-	if len(filter.IDs) > 0 {
-		found := false
-		for _, id := range filter.IDs {
-			if id == evt.ID {
-				found = true
-				break
-			}
-			if len(id) < 64 && len(evt.ID) >= len(id) && evt.ID[:len(id)] == id {
-				found = true
-				break
+	kinds := newKindMatcher(filter.Kinds)
+	matches := 0
+
+	// visit passes the event at the position to fn if it matches, reporting whether the scan must stop
+	visit := func(pos uint64) bool {
+		if stats != nil {
+			stats.Scanned++
+		}
+		stored := cb.slot(pos).Load()
+		if stored != nil && matchEvent(stored.Event, filter, &kinds) && (accept == nil || accept(stored.Event)) {
+			matches++
+			if stats != nil {
+				stats.Matched++
 			}
+			return !fn(stored) || (filter.Limit > 0 && matches >= filter.Limit)
 		}
-		if !found {
-			return false
+		return false
+	}
+
+	// with both indexes, the one narrowing the search the most is used
+	var candidates []uint64
+	indexed := false
+	if cb.index != nil && len(filter.Tags) > 0 {
+		candidates, indexed = cb.index.candidates(filter.Tags, start, end)
+	}
+	if cb.authors != nil && len(filter.Authors) > 0 {
+		if positions, ok := cb.authors.candidates(filter.Authors, start, end); ok && (!indexed || len(positions) < len(candidates)) {
+			candidates, indexed = positions, true
 		}
 	}
 
-	if len(filter.Authors) > 0 {
-		found := false
-		for _, author := range filter.Authors {
-			if author == evt.PubKey {
-				found = true
-				break
+	if indexed {
+		for i, pos := range candidates {
+			if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+				return ctx.Err()
 			}
-			if len(author) < 64 && len(evt.PubKey) >= len(author) && evt.PubKey[:len(author)] == author {
-				found = true
+			if visit(pos) {
 				break
 			}
 		}
-		if !found {
-			return false
-		}
+		return nil
 	}
 
-	for tagName, values := range filter.Tags {
-		if len(values) == 0 {
-			continue
-		}
+	if filter.Since != nil || filter.Until != nil {
+		switch {
+		case cb.sortedFrom(start):
+			start, end = cb.timeWindow(start, end, filter.Since, filter.Until)
 
-		found := false
-		tagLoop:
-		for _, tag := range evt.Tags {
-			if len(tag) > 1 && tag[0] == tagName {
-				for _, v := range values {
-					if v == tag[1] {
-						found = true
-						break tagLoop
+		case cb.times != nil:
+			scanned := 0
+			for _, r := range cb.times.ranges(filter.Since, filter.Until, start, end) {
+				for pos := r.from; pos < r.to; pos++ {
+					if scanned%ctxCheckInterval == 0 && ctx.Err() != nil {
+						return ctx.Err()
+					}
+					scanned++
+					if visit(pos) {
+						return nil
 					}
 				}
 			}
+			return nil
 		}
-		if !found {
-			return false
+	}
+
+	for pos := start; pos < end; pos++ {
+		if (pos-start)%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if visit(pos) {
+			break
+		}
+	}
+	return nil
+}
+
+// markReturned records that the event is returned by a query.
+func (cb *AtomicCircularBuffer2) markReturned(stored *StoredEvent) {
+	stored.markRead()
+	if cb.eviction == LRU {
+		stored.markUsed()
+	}
+}
+
+// mayContainAny reports whether any event with the IDs may be in the buffer, according to the bloom filter.
+// Prefixes can't be checked, so it returns true if the IDs are nil or any of them is a prefix.
+func (cb *AtomicCircularBuffer2) mayContainAny(ids []string) bool {
+	if ids == nil {
+		return true
+	}
+
+	for _, id := range ids {
+		if len(id) != 64 || cb.ids.mayContain(id) {
+			return true
 		}
 	}
+	return false
+}
+
+// sortedFrom reports whether the events from the provided position to the head are sorted by CreatedAt.
+// Events are usually saved in chronological order, but nothing prevents a client from publishing an old event.
+// The check is exact when saves don't happen concurrently, as it's the case for the relay.
+func (cb *AtomicCircularBuffer2) sortedFrom(pos uint64) bool {
+	unsortedAt := cb.unsortedAt.Load()
+	return unsortedAt <= pos+1
+}
+
+// timeWindow narrows the positions [start, end) to the ones whose events can be within since and until.
+// The events in the range must be sorted by CreatedAt, which allows to find the window with two binary searches
+// instead of scanning the whole buffer. If an empty slot is found, the range is returned unchanged.
+func (cb *AtomicCircularBuffer2) timeWindow(start, end uint64, since, until *nostr.Timestamp) (uint64, uint64) {
+	n := int(end - start)
+	valid := true
+
+	// search returns the first position in [start, end) whose event satisfies the condition
+	search := func(condition func(nostr.Timestamp) bool) uint64 {
+		i := sort.Search(n, func(i int) bool {
+			evt := cb.slot(start + uint64(i)).Load().event()
+			if evt == nil {
+				valid = false
+				return true
+			}
+			return condition(evt.CreatedAt)
+		})
+		return start + uint64(i)
+	}
 
-	return true
+	from, to := start, end
+	if since != nil {
+		from = search(func(t nostr.Timestamp) bool { return t >= *since })
+	}
+	if until != nil {
+		to = search(func(t nostr.Timestamp) bool { return t > *until })
+	}
+
+	if !valid || from > to {
+		return start, end
+	}
+	return from, to
 }
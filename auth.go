@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip70"
+	"github.com/pippellia-btc/rely"
+)
+
+// AuthorizeSave is called by [Save] before routing an event to any store.
+// A non-nil error rejects the event, and is sent to the client in the OK message.
+// It defaults to [AllowAllSaves]. For example, to only accept kind 20000 from a few authenticated pubkeys:
+//
+//	AuthorizeSave = RestrictKindToPubkeys(20000, "<hex pubkey>", "<another hex pubkey>")
+var AuthorizeSave func(c *rely.Client, e *nostr.Event) error = AllowAllSaves
+
+// AllowAllSaves accepts every event.
+func AllowAllSaves(c *rely.Client, e *nostr.Event) error {
+	return nil
+}
+
+// clientPubkey returns the pubkey the client authenticated with (NIP-42), or nil.
+func clientPubkey(c *rely.Client) *string {
+	if c == nil {
+		return nil
+	}
+	return c.Pubkey()
+}
+
+// RestrictKindToPubkeys returns an AuthorizeSave function that only accepts events of the provided kind
+// from clients authenticated as one of the pubkeys. Events of other kinds are always accepted.
+func RestrictKindToPubkeys(kind int, pubkeys ...string) func(c *rely.Client, e *nostr.Event) error {
+	return restrictKindToPubkeys(kind, clientPubkey, pubkeys)
+}
+
+// restrictKindToPubkeys is like [RestrictKindToPubkeys], finding the pubkey the clients authenticated with
+// by calling pubkeyOf, so that tests can fake authenticated clients.
+func restrictKindToPubkeys(kind int, pubkeyOf func(*rely.Client) *string, pubkeys []string) func(c *rely.Client, e *nostr.Event) error {
+	return func(c *rely.Client, e *nostr.Event) error {
+		if e.Kind != kind {
+			return nil
+		}
+
+		pubkey := pubkeyOf(c)
+		if pubkey == nil {
+			return fmt.Errorf("auth-required: kind %d is only accepted from authenticated users", kind)
+		}
+
+		if !slices.Contains(pubkeys, *pubkey) {
+			return errors.New("restricted: you are not allowed to publish this kind")
+		}
+		return nil
+	}
+}
+
+// checkProtected enforces NIP-70: events with the "-" tag are only accepted from clients
+// authenticated as their author. Other events are always accepted.
+// The pubkey is the one the client authenticated with, or nil.
+func checkProtected(pubkey *string, e *nostr.Event) error {
+	if !nip70.IsProtected(*e) {
+		return nil
+	}
+
+	if pubkey == nil {
+		return errors.New("restricted: protected events are only accepted from their authenticated author")
+	}
+	if *pubkey != e.PubKey {
+		return errors.New("restricted: protected events can only be published by their author")
+	}
+	return nil
+}
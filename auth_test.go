@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+// setAuthorizeSave replaces AuthorizeSave for the duration of the test.
+func setAuthorizeSave(t *testing.T, authorize func(*rely.Client, *nostr.Event) error) {
+	old := AuthorizeSave
+	AuthorizeSave = authorize
+	t.Cleanup(func() { AuthorizeSave = old })
+}
+
+func TestSaveAuthorization(t *testing.T) {
+	allowed := "allowed-pubkey"
+	other := "other-pubkey"
+
+	tests := []struct {
+		name   string
+		pubkey *string
+		kind   int
+		err    string
+	}{
+		{"whitelisted pubkey", &allowed, 20000, ""},
+		{"other pubkey", &other, 20000, "restricted:"},
+		{"unauthenticated", nil, 20000, "auth-required:"},
+		{"unrestricted kind", nil, 20001, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ephemeral := NewAtomicCircularBuffer2(10)
+			setupStores(t, &mockStore{}, ephemeral)
+			// every client appears authenticated as the pubkey of the test, or unauthenticated if nil
+			pubkeyOf := func(*rely.Client) *string { return test.pubkey }
+			setAuthorizeSave(t, restrictKindToPubkeys(20000, pubkeyOf, []string{allowed}))
+
+			err := Save(&rely.Client{}, createTestEvent("id-0", test.kind))
+			stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Expected the event to be accepted, got %v", err)
+				}
+				if len(stored) != 1 {
+					t.Fatalf("Expected the event to be stored, got %d events", len(stored))
+				}
+				return
+			}
+
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("Expected an error starting with %q, got %v", test.err, err)
+			}
+			if len(stored) != 0 {
+				t.Fatalf("Expected the rejected event not to be stored, got %d events", len(stored))
+			}
+		})
+	}
+}
+
+func TestSaveAllowAllByDefault(t *testing.T) {
+	ephemeral := NewAtomicCircularBuffer2(10)
+	setupStores(t, &mockStore{}, ephemeral)
+
+	if err := Save(&rely.Client{}, createTestEvent("id-0", 20000)); err != nil {
+		t.Fatalf("Expected the event to be accepted, got %v", err)
+	}
+}
+
+func TestSaveProtectedEvents(t *testing.T) {
+	author := "author-pubkey"
+	other := "other-pubkey"
+
+	tests := []struct {
+		name      string
+		pubkey    *string
+		kind      int
+		protected bool
+		err       string
+	}{
+		{"protected from the author", &author, 20000, true, ""},
+		{"protected from another pubkey", &other, 20000, true, "restricted:"},
+		{"protected from unauthenticated", nil, 20000, true, "restricted:"},
+		{"protected regular event", nil, 1, true, "restricted:"},
+		{"unprotected", nil, 20000, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evt := createTestEvent("id-0", test.kind)
+			evt.PubKey = author
+			if test.protected {
+				evt.Tags = nostr.Tags{{"-"}}
+			}
+
+			err := checkProtected(test.pubkey, evt)
+			if test.err == "" && err != nil {
+				t.Fatalf("Expected the event to be accepted, got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+				t.Fatalf("Expected an error starting with %q, got %v", test.err, err)
+			}
+
+			if test.pubkey != nil {
+				return
+			}
+
+			// the clients of the tests are never authenticated, so Save must give the same result
+			store := &mockStore{}
+			ephemeral := NewAtomicCircularBuffer2(10)
+			setupStores(t, store, ephemeral)
+
+			saveErr := Save(&rely.Client{}, evt)
+			stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+			total := len(stored) + len(store.events)
+
+			if (saveErr == nil) != (err == nil) {
+				t.Fatalf("Expected Save to return %v, got %v", err, saveErr)
+			}
+			expected := 0
+			if err == nil {
+				expected = 1
+			}
+			if total != expected {
+				t.Fatalf("Expected %d events to be stored, got %d", expected, total)
+			}
+		})
+	}
+}
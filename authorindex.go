@@ -0,0 +1,82 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// authorIndex is an inverted index from the pubkeys of the events in a buffer to their positions.
+type authorIndex struct {
+	mu        sync.RWMutex
+	positions map[string]map[uint64]struct{}
+}
+
+func newAuthorIndex() *authorIndex {
+	return &authorIndex{positions: make(map[string]map[uint64]struct{})}
+}
+
+// add indexes the pubkey of the event saved at the position.
+func (idx *authorIndex) add(pubkey string, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	set, ok := idx.positions[pubkey]
+	if !ok {
+		set = make(map[uint64]struct{}, 1)
+		idx.positions[pubkey] = set
+	}
+	set[pos] = struct{}{}
+}
+
+// remove drops the pubkey of the event saved at the position, after it has been evicted or deleted.
+func (idx *authorIndex) remove(pubkey string, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	set, ok := idx.positions[pubkey]
+	if !ok {
+		return
+	}
+
+	delete(set, pos)
+	if len(set) == 0 {
+		delete(idx.positions, pubkey)
+	}
+}
+
+// reset empties the index.
+func (idx *authorIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	clear(idx.positions)
+}
+
+// candidates returns, in ascending order, the positions in [start, end) of the events published by any
+// of the authors, which must still be matched against the whole filter. It returns false if the index
+// can't narrow the search, because some authors are prefixes rather than full pubkeys.
+func (idx *authorIndex) candidates(authors []string, start, end uint64) ([]uint64, bool) {
+	if slices.ContainsFunc(authors, func(a string) bool { return len(a) != 64 }) {
+		return nil, false
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	size := 0
+	for _, author := range authors {
+		size += len(idx.positions[author])
+	}
+
+	positions := make([]uint64, 0, size)
+	for _, author := range authors {
+		for pos := range idx.positions[author] {
+			if pos >= start && pos < end {
+				positions = append(positions, pos)
+			}
+		}
+	}
+
+	// the same author can be requested more than once
+	slices.Sort(positions)
+	return slices.Compact(positions), true
+}
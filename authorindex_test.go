@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// authoredEvent creates a test event published by one of 50 authors
+func authoredEvent(i int) *nostr.Event {
+	evt := createTestEvent(fmt.Sprintf("id-%d", i), i%3)
+	evt.PubKey = hexID(i % 50)
+	return evt
+}
+
+func TestAuthorIndexMatchesScan(t *testing.T) {
+	ctx := context.Background()
+
+	// 1000 events in a 300 slot buffer, so that the index must follow the wrap-around eviction
+	indexed := NewAtomicCircularBuffer2(300, WithAuthorIndex(), WithTagIndex())
+	scanned := NewAtomicCircularBuffer2(300)
+	for i := range 1000 {
+		evt := authoredEvent(i)
+		evt.Tags = nostr.Tags{{"t", fmt.Sprint(i % 7)}}
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+
+	// deleted and updated events must be found under their new author, or not at all
+	for _, id := range []string{"id-800", "id-850", "id-950"} {
+		indexed.DeleteEvent(ctx, &nostr.Event{ID: id})
+		scanned.DeleteEvent(ctx, &nostr.Event{ID: id})
+	}
+	for _, id := range []string{"id-801", "id-900"} {
+		reassign := func(evt *nostr.Event) { evt.PubKey = hexID(60) }
+		indexed.UpdateEvent(ctx, id, reassign)
+		scanned.UpdateEvent(ctx, id, reassign)
+	}
+
+	filters := []nostr.Filter{
+		{Authors: []string{hexID(0)}},
+		{Authors: []string{hexID(1), hexID(2), hexID(1)}},
+		{Authors: []string{hexID(60)}},
+		{Authors: []string{hexID(99)}},
+		{Authors: []string{hexID(0), hexID(3)}, Kinds: []int{1}},
+		{Authors: []string{hexID(0), hexID(3)}, Limit: 5},
+		{Authors: []string{hexID(4)[:10]}},
+		{Authors: []string{hexID(5), hexID(6)}, Tags: nostr.TagMap{"t": {"1", "2"}}},
+		{Authors: []string{hexID(5)}, Tags: nostr.TagMap{"t": {"1"}}, Since: timestamp(0)},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, filter := range filters {
+			expected, err := scanned.QueryEvents(ctx, filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			events, err := indexed.QueryEvents(ctx, filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			if !slices.Equal(ids(events), ids(expected)) {
+				t.Fatalf("filter %v: expected %v, got %v", filter, ids(expected), ids(events))
+			}
+		}
+	}
+
+	check()
+
+	// compaction moves the events, so the index is rebuilt
+	indexed.Compact()
+	scanned.Compact()
+	check()
+
+	// the positions of the evicted events are dropped
+	for i := 1000; i < 3000; i++ {
+		evt := authoredEvent(i)
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+	check()
+
+	positions := 0
+	for _, set := range indexed.authors.positions {
+		positions += len(set)
+	}
+	if positions != indexed.Len() {
+		t.Fatalf("Expected %d indexed positions, got %d", indexed.Len(), positions)
+	}
+
+	indexed.Clear()
+	if len(indexed.authors.positions) != 0 {
+		t.Fatal("Expected Clear to empty the index")
+	}
+}
+
+// BenchmarkAuthorQuery tests a query for the events of 100 followed authors in a buffer of 200k events
+// published by 10k authors
+func BenchmarkAuthorQuery(b *testing.B) {
+	ctx := context.Background()
+	const size = 200_000
+
+	authors := make([]string, 100)
+	for i := range authors {
+		authors[i] = hexID(i * 100)
+	}
+	filter := nostr.Filter{Authors: authors}
+
+	for name, opts := range map[string][]BufferOption{
+		"scan":    nil,
+		"indexed": {WithAuthorIndex()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			cb := NewAtomicCircularBuffer2(size, opts...)
+			for i := range size {
+				evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+				evt.PubKey = hexID(i % 10_000)
+				cb.SaveEvent(ctx, evt)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				events, _ := cb.QueryEvents(ctx, filter)
+				if len(events) != 2000 {
+					b.Fatalf("Expected 2000 events, got %d", len(events))
+				}
+			}
+		})
+	}
+}
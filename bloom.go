@@ -0,0 +1,86 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+)
+
+const (
+	// bloomBitsPerEvent and bloomHashes give a false positive rate of about 1% for each generation.
+	bloomBitsPerEvent = 10
+	bloomHashes       = 7
+)
+
+// idFilter is a bloom filter of the IDs of the events in a buffer, used to skip the queries for IDs
+// that are certainly not there. It can report that an ID may be present when it's not (a false positive),
+// which only costs a scan, but never that an ID is absent when it's present.
+//
+// Bloom filters can't forget evicted IDs, so the IDs are split in two generations, each holding the IDs
+// saved in one pass over the buffer. When a new pass starts, the previous generation is dropped, as all of
+// its events have been evicted by then. This bounds the false positives to about twice the rate of one generation.
+type idFilter struct {
+	current  atomic.Pointer[bloom]
+	previous atomic.Pointer[bloom]
+	bits     uint64
+	seed     maphash.Seed
+}
+
+// bloom is the bitset of one generation of IDs.
+type bloom []atomic.Uint64
+
+func newIDFilter(capacity int) *idFilter {
+	words := (capacity*bloomBitsPerEvent + 63) / 64
+	f := &idFilter{
+		bits: uint64(words) * 64,
+		seed: maphash.MakeSeed(),
+	}
+	f.reset()
+	return f
+}
+
+// reset drops all the IDs.
+func (f *idFilter) reset() {
+	words := f.bits / 64
+	current, previous := make(bloom, words), make(bloom, words)
+	f.current.Store(&current)
+	f.previous.Store(&previous)
+}
+
+// rotate starts a new generation, dropping the oldest one.
+func (f *idFilter) rotate() {
+	fresh := make(bloom, f.bits/64)
+	f.previous.Store(f.current.Swap(&fresh))
+}
+
+// add records the ID in the current generation.
+func (f *idFilter) add(id string) {
+	b := *f.current.Load()
+	h1, h2 := f.hash(id)
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) % f.bits
+		b[bit/64].Or(1 << (bit % 64))
+	}
+}
+
+// mayContain reports whether the ID may have been added. If it returns false, the ID was certainly not added.
+func (f *idFilter) mayContain(id string) bool {
+	h1, h2 := f.hash(id)
+	return f.current.Load().has(h1, h2, f.bits) || f.previous.Load().has(h1, h2, f.bits)
+}
+
+// has reports whether all the bits of the hashes are set.
+func (b *bloom) has(h1, h2, bits uint64) bool {
+	for i := range uint64(bloomHashes) {
+		bit := (h1 + i*h2) % bits
+		if (*b)[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hash returns the two hashes of the ID from which the bits are derived, with double hashing.
+func (f *idFilter) hash(id string) (uint64, uint64) {
+	h := maphash.String(f.seed, id)
+	return h & 0xffffffff, h>>32 | 1
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// hexID returns a full 64 characters ID derived from i
+func hexID(i int) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "event-%d", i))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIDBloomFilterNoFalseNegatives(t *testing.T) {
+	ctx := context.Background()
+
+	// 1000 events in a 100 slot buffer, so that the bloom filter goes through many generations
+	cb := NewAtomicCircularBuffer2(100, WithIDBloomFilter())
+	for i := range 1000 {
+		cb.SaveEvent(ctx, createTestEvent(hexID(i), 1))
+
+		// every stored event must still be found by ID
+		for j := max(0, i-99); j <= i; j++ {
+			events, err := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{hexID(j)}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(events) != 1 {
+				t.Fatalf("after saving %d events, expected to find %s, got %d events", i+1, hexID(j), len(events))
+			}
+		}
+	}
+
+	// evicted IDs can't match, whether skipped or scanned
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{hexID(0), hexID(850)}})
+	if len(events) != 0 {
+		t.Fatalf("expected no events, got %d", len(events))
+	}
+
+	// prefixes bypass the bloom filter
+	events, _ = cb.QueryEvents(ctx, nostr.Filter{IDs: []string{hexID(999)[:10]}})
+	if len(events) != 1 {
+		t.Fatalf("expected the prefix to match 1 event, got %d", len(events))
+	}
+
+	// compaction moves events, which must still be found afterwards
+	for i := 900; i < 1000; i += 2 {
+		cb.DeleteEvent(ctx, &nostr.Event{ID: hexID(i)})
+	}
+	cb.Compact()
+	for i := range 200 {
+		cb.SaveEvent(ctx, createTestEvent(hexID(1000+i), 1))
+
+		for j := 1000 + max(0, i-99); j <= 1000+i; j++ {
+			events, _ := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{hexID(j)}})
+			if len(events) != 1 {
+				t.Fatalf("after compaction, expected to find %s, got %d events", hexID(j), len(events))
+			}
+		}
+	}
+
+	cb.Clear()
+	if cb.ids.mayContain(hexID(1199)) {
+		t.Fatal("expected the bloom filter to be empty after Clear")
+	}
+}
+
+func BenchmarkIDQueryMissing(b *testing.B) {
+	ctx := context.Background()
+	missing := nostr.Filter{IDs: []string{hexID(-1), hexID(-2), hexID(-3)}}
+
+	for _, bench := range []struct {
+		name string
+		opts []BufferOption
+	}{
+		{name: "scan"},
+		{name: "bloom", opts: []BufferOption{WithIDBloomFilter()}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cb := NewAtomicCircularBuffer2(10000, bench.opts...)
+			for i := range 10000 {
+				cb.SaveEvent(ctx, createTestEvent(hexID(i), 1))
+			}
+
+			b.ResetTimer()
+			for b.Loop() {
+				cb.QueryEvents(ctx, missing)
+			}
+		})
+	}
+}
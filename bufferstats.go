@@ -0,0 +1,32 @@
+package main
+
+// BufferStats is a snapshot of the state of an [AtomicCircularBuffer2], see [AtomicCircularBuffer2.Stats].
+type BufferStats struct {
+	// Capacity is the maximum number of events in the buffer.
+	Capacity uint64
+	// Len is the number of events in the buffer, see [AtomicCircularBuffer2.Len].
+	Len uint64
+	// Head is the position the next event will be saved at, which is also its sequence number.
+	Head uint64
+	// TotalSaved is the number of events saved over the lifetime of the buffer.
+	TotalSaved uint64
+	// TotalEvicted is the number of events overwritten to make room for newer ones over the lifetime of the buffer.
+	TotalEvicted uint64
+}
+
+// Stats returns a snapshot of the state of the buffer, meant for dashboards.
+// The fields are read one at a time without stopping the writers, so with concurrent saves they might be
+// off by the saves in progress. The lifetime counters are read first, so they never exceed the head.
+func (cb *AtomicCircularBuffer2) Stats() BufferStats {
+	evicted := cb.evictions.total.Load()
+	saved := cb.saved.Load()
+	head := cb.head.Load()
+
+	return BufferStats{
+		Capacity:     cb.size,
+		Len:          uint64(cb.Len()),
+		Head:         head,
+		TotalSaved:   saved,
+		TotalEvicted: evicted,
+	}
+}
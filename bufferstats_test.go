@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestBufferStats(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5)
+
+	for i := range 8 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+
+		stats := cb.Stats()
+		saved := uint64(i + 1)
+		if stats.TotalSaved != saved {
+			t.Fatalf("Expected %d saved events, got %d", saved, stats.TotalSaved)
+		}
+
+		// events are evicted only once the buffer wraps around
+		evicted := uint64(max(0, i-4))
+		if stats.TotalEvicted != evicted {
+			t.Fatalf("Expected %d evicted events after %d saves, got %d", evicted, saved, stats.TotalEvicted)
+		}
+
+		expected := BufferStats{Capacity: 5, Len: min(saved, 5), Head: saved, TotalSaved: saved, TotalEvicted: evicted}
+		if stats != expected {
+			t.Fatalf("Expected %+v, got %+v", expected, stats)
+		}
+	}
+
+	// the lifetime counters survive Clear
+	cb.Clear()
+	if stats := cb.Stats(); stats.Len != 0 || stats.TotalSaved != 8 || stats.TotalEvicted != 3 {
+		t.Fatalf("Expected an empty buffer with the lifetime counters unchanged, got %+v", stats)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"maps"
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// maxResultCapacity is the maximum capacity preallocated for the events of a REQ.
+	maxResultCapacity = 2048
+
+	// maxTrackedShapes bounds the number of REQ shapes whose result sizes are tracked.
+	maxTrackedShapes = 1024
+
+	// resultSizeSmoothing is the weight of the latest result size in the rolling average of its shape.
+	resultSizeSmoothing = 0.2
+)
+
+// resultSizes tracks the rolling average of the number of events collected for every shape of REQ,
+// see [reqShape], so that [Query] can preallocate the right capacity for the next REQs with the same shape.
+var resultSizes = newSizeEstimator(maxTrackedShapes)
+
+// sizeEstimator keeps an exponential moving average of the result sizes per shape.
+// Once max shapes are tracked, the least recently used one is forgotten to track a new one,
+// so that shapes seen once don't keep the others from being tracked.
+type sizeEstimator struct {
+	mu       sync.Mutex
+	averages map[string]*list.Element
+	lru      *list.List // front is the most recently used
+	max      int
+}
+
+type sizeEntry struct {
+	shape   string
+	average float64
+}
+
+func newSizeEstimator(max int) *sizeEstimator {
+	return &sizeEstimator{averages: make(map[string]*list.Element), lru: list.New(), max: max}
+}
+
+// estimate returns the average result size of the shape, rounded up, and false if the shape is not tracked.
+func (e *sizeEstimator) estimate(shape string) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	element, ok := e.averages[shape]
+	if !ok {
+		return 0, false
+	}
+	e.lru.MoveToFront(element)
+	return int(math.Ceil(element.Value.(*sizeEntry).average)), true
+}
+
+// observe adds the size of a result to the average of the shape.
+func (e *sizeEstimator) observe(shape string, size int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if element, ok := e.averages[shape]; ok {
+		entry := element.Value.(*sizeEntry)
+		entry.average += resultSizeSmoothing * (float64(size) - entry.average)
+		e.lru.MoveToFront(element)
+		return
+	}
+
+	e.averages[shape] = e.lru.PushFront(&sizeEntry{shape: shape, average: float64(size)})
+	if e.lru.Len() > e.max {
+		oldest := e.lru.Back()
+		e.lru.Remove(oldest)
+		delete(e.averages, oldest.Value.(*sizeEntry).shape)
+	}
+}
+
+// estimateCapacity returns the capacity to preallocate for the events of the filters: the average result size
+// of their shape if known, see [resultSizes], otherwise the static estimate of [estimateCapacityFromFilters].
+// It's never more than [maxResultCapacity].
+func estimateCapacity(filters nostr.Filters) int {
+	if size, ok := resultSizes.estimate(reqShape(filters)); ok {
+		return min(size, maxResultCapacity)
+	}
+	return estimateCapacityFromFilters(filters)
+}
+
+// reqShape returns a key identifying the shape of the filters: the classes of their kinds, the size class of
+// their limits and the names of their constraints, regardless of their values. REQs with the same shape,
+// for example the feeds of different users, tend to return a similar number of events.
+// The kinds and limits are not used as they are, as clients could make up endless shapes with them.
+func reqShape(filters nostr.Filters) string {
+	var b strings.Builder
+	for _, f := range filters {
+		fmt.Fprintf(&b, "k%s l%d", kindsShape(f.Kinds), sizeClass(f.Limit))
+		if f.IDs != nil {
+			b.WriteString(" ids")
+		}
+		if f.Authors != nil {
+			b.WriteString(" authors")
+		}
+		for _, name := range slices.Sorted(maps.Keys(f.Tags)) {
+			b.WriteString(" #" + name)
+		}
+		if f.Since != nil {
+			b.WriteString(" since")
+		}
+		if f.Until != nil {
+			b.WriteString(" until")
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// kindsShape returns the size class of the number of kinds, followed by a letter for each class of kinds
+// among them: regular, replaceable, ephemeral and addressable. Nil kinds, matching every kind, are "*".
+func kindsShape(kinds []int) string {
+	if kinds == nil {
+		return "*"
+	}
+
+	classes := []struct {
+		letter byte
+		is     func(int) bool
+	}{
+		{'r', nostr.IsRegularKind},
+		{'p', nostr.IsReplaceableKind},
+		{'e', nostr.IsEphemeralKind},
+		{'a', nostr.IsAddressableKind},
+	}
+
+	shape := []byte(strconv.Itoa(sizeClass(len(kinds))))
+	for _, class := range classes {
+		if slices.ContainsFunc(kinds, class.is) {
+			shape = append(shape, class.letter)
+		}
+	}
+	return string(shape)
+}
+
+// sizeClass returns n rounded up to a power of two, so that close sizes share a shape. It returns 0 for 0.
+func sizeClass(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return 1 << bits.Len(uint(n-1))
+}
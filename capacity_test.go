@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setResultSizes replaces resultSizes with an empty estimator for the duration of the test.
+func setResultSizes(t testing.TB) {
+	old := resultSizes
+	resultSizes = newSizeEstimator(maxTrackedShapes)
+	t.Cleanup(func() { resultSizes = old })
+}
+
+func TestEstimateCapacityAdapts(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+	setResultSizes(t)
+
+	events := make([]*nostr.Event, 1000)
+	for i := range events {
+		events[i] = createTestEvent(fmt.Sprintf("id-%d", i), 1)
+	}
+	setupStores(t, &mockStore{events: events}, NewAtomicCircularBuffer2(10))
+
+	filters := nostr.Filters{{Kinds: []int{1}}}
+	if estimate := estimateCapacity(filters); estimate != 32 {
+		t.Fatalf("Expected the static estimate of 32 before any query, got %d", estimate)
+	}
+
+	for range 5 {
+		if _, err := Query(ctx, nil, filters); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if estimate := estimateCapacity(filters); estimate != 1000 {
+		t.Fatalf("Expected the estimate to grow to 1000 after large queries, got %d", estimate)
+	}
+
+	// the estimate is shared by the filters of the same shape, and follows the recent results
+	other := nostr.Filters{{Kinds: []int{1}, Authors: []string{"someone"}}}
+	for range 20 {
+		Query(ctx, nil, other)
+	}
+	if estimate := estimateCapacity(other); estimate != 0 {
+		t.Fatalf("Expected the estimate of a shape with empty results to be 0, got %d", estimate)
+	}
+	if estimate := estimateCapacity(nostr.Filters{{Kinds: []int{1}, Authors: []string{"another"}}}); estimate != 0 {
+		t.Fatalf("Expected filters with the same shape to share the estimate, got %d", estimate)
+	}
+
+	// the hard cap still applies
+	resultSizes.observe(reqShape(filters), 1_000_000)
+	resultSizes.observe(reqShape(filters), 1_000_000)
+	if estimate := estimateCapacity(filters); estimate != maxResultCapacity {
+		t.Fatalf("Expected the estimate to be capped to %d, got %d", maxResultCapacity, estimate)
+	}
+}
+
+// TestReqShapeBuckets tests that the shapes don't depend on the exact kinds and limits chosen by the clients
+func TestReqShapeBuckets(t *testing.T) {
+	same := [][2]nostr.Filter{
+		{{Kinds: []int{1}, Limit: 51}, {Kinds: []int{7}, Limit: 64}},
+		{{Kinds: []int{0, 3}}, {Kinds: []int{10002, 10000}}},
+		{{Kinds: []int{30023, 1, 7, 5}, Limit: 500}, {Kinds: []int{1, 30000, 6}, Limit: 300}},
+	}
+	for _, filters := range same {
+		if a, b := reqShape(nostr.Filters{filters[0]}), reqShape(nostr.Filters{filters[1]}); a != b {
+			t.Errorf("Expected %v and %v to have the same shape, got %q and %q", filters[0], filters[1], a, b)
+		}
+	}
+
+	different := [][2]nostr.Filter{
+		{{Kinds: []int{1}}, {Kinds: []int{0}}},
+		{{Kinds: []int{1}}, {}},
+		{{Limit: 10}, {Limit: 100}},
+	}
+	for _, filters := range different {
+		if a, b := reqShape(nostr.Filters{filters[0]}), reqShape(nostr.Filters{filters[1]}); a == b {
+			t.Errorf("Expected %v and %v to have different shapes, got %q", filters[0], filters[1], a)
+		}
+	}
+}
+
+// TestSizeEstimatorEvicts tests that once full, the estimator forgets the least recently used shape
+// instead of ignoring the new ones
+func TestSizeEstimatorEvicts(t *testing.T) {
+	e := newSizeEstimator(2)
+	e.observe("a", 10)
+	e.observe("b", 20)
+	e.estimate("a")
+	e.observe("c", 30)
+
+	if _, ok := e.estimate("b"); ok {
+		t.Fatal("Expected the least recently used shape to be forgotten")
+	}
+	for shape, expected := range map[string]int{"a": 10, "c": 30} {
+		if size, ok := e.estimate(shape); !ok || size != expected {
+			t.Fatalf("Expected %s to be estimated at %d, got %d (%v)", shape, expected, size, ok)
+		}
+	}
+}
+
+// BenchmarkResultCapacity tests how many times the result slice of a REQ returning 1000 events grows,
+// with the static estimate and with the one adapted to the previous results
+func BenchmarkResultCapacity(b *testing.B) {
+	const results = 1000
+	filters := nostr.Filters{{Kinds: []int{1}}}
+	event := createTestEvent("id", 1)
+
+	collect := func(capacity int) int {
+		growths := 0
+		result := make([]nostr.Event, 0, capacity)
+		for range results {
+			if len(result) == cap(result) {
+				growths++
+			}
+			result = append(result, *event)
+		}
+		return growths
+	}
+
+	b.Run("static", func(b *testing.B) {
+		growths := 0
+		for i := 0; i < b.N; i++ {
+			growths += collect(estimateCapacityFromFilters(filters))
+		}
+		b.ReportMetric(float64(growths)/float64(b.N), "growths/op")
+	})
+
+	b.Run("adaptive", func(b *testing.B) {
+		setResultSizes(b)
+		growths := 0
+		for i := 0; i < b.N; i++ {
+			growths += collect(estimateCapacity(filters))
+			resultSizes.observe(reqShape(filters), results)
+		}
+		b.ReportMetric(float64(growths)/float64(b.N), "growths/op")
+	})
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"errors"
-	"slices"
+	"fmt"
+	"log"
+	"runtime/debug"
 	"sync"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -15,33 +17,82 @@ import (
 type CircularBuffer struct {
 	sync.Mutex
 
-	buffer []nostr.Event
+	// each slot points to a private copy of the saved event, which is never modified afterwards.
+	// Saving replaces the pointer instead, so queries can return the pointers without copying.
+	buffer []*nostr.Event
 	head   int
 	tail   int
 	size   int
 	count  int
+
+	// match is the matching used by the queries, see newCircularBuffer
+	match func(*nostr.Event, nostr.Filter, *kindMatcher) bool
+
+	bufferOptions
 }
 
 // NewCircularBuffer creates a new CircularBuffer with the specified capacity.
-func NewCircularBuffer(capacity int) *CircularBuffer {
+// It panics if an option is supported only by [AtomicCircularBuffer2], see [NewCircularBufferE].
+func NewCircularBuffer(capacity int, opts ...BufferOption) *CircularBuffer {
+	cb, err := NewCircularBufferE(capacity, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return cb
+}
+
+// NewCircularBufferE is like [NewCircularBuffer], but returns [ErrUnsupportedOption] instead of panicking
+// if an option is supported only by [AtomicCircularBuffer2].
+func NewCircularBufferE(capacity int, opts ...BufferOption) (*CircularBuffer, error) {
+	cb := newCircularBuffer(capacity, matchEvent, opts...)
+	if err := cb.checkLegacy(); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// newCircularBuffer is like [NewCircularBuffer], but the queries match the events with match,
+// which lets the tests replace [matchEvent], for example to make it panic.
+func newCircularBuffer(capacity int, match func(*nostr.Event, nostr.Filter, *kindMatcher) bool, opts ...BufferOption) *CircularBuffer {
 	return &CircularBuffer{
-		buffer: make([]nostr.Event, capacity),
-		size:   capacity,
+		buffer:        make([]*nostr.Event, capacity),
+		size:          capacity,
+		match:         match,
+		bufferOptions: newBufferOptions(opts),
 	}
 }
 
 // SaveEvent adds a new event to the circular buffer.
-// If the buffer is full, it automatically overwrites the oldest event.
+// If the buffer is full, it automatically overwrites the oldest event,
+// unless the overflow policy is [RejectNew], in which case [ErrBufferFull] is returned.
+// If ctx is already cancelled, its error is returned and the buffer is left unchanged.
 func (cb *CircularBuffer) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if evt == nil {
 		return errors.New("event cannot be nil")
 	}
 
+	if err := cb.validate(evt); err != nil {
+		return err
+	}
+
 	cb.Lock()
-	defer cb.Unlock()
 
-	// Store a copy of the event
-	cb.buffer[cb.head] = *evt
+	if cb.count == cb.size && cb.policy == RejectNew {
+		cb.Unlock()
+		return ErrBufferFull
+	}
+
+	var evicted *nostr.Event
+	if cb.count == cb.size && cb.onEvict != nil {
+		evicted = cb.buffer[cb.head]
+	}
+
+	// Store a copy of the event, so that the caller can't modify it
+	cb.buffer[cb.head] = cloneEvent(evt)
 	cb.head = (cb.head + 1) % cb.size
 
 	if cb.count == cb.size {
@@ -51,38 +102,98 @@ func (cb *CircularBuffer) SaveEvent(ctx context.Context, evt *nostr.Event) error
 		cb.count++
 	}
 
+	cb.Unlock()
+
+	if evicted != nil {
+		cb.onEvict(evicted)
+	}
 	return nil
 }
 
+// Len returns the number of events in the buffer.
+func (cb *CircularBuffer) Len() int {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.count
+}
+
+// Clear removes all the events from the buffer, keeping its memory for reuse.
+func (cb *CircularBuffer) Clear() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	clear(cb.buffer)
+	cb.head = 0
+	cb.tail = 0
+	cb.count = 0
+}
+
 // QueryEvents returns a channel that will receive all events matching the filter.
-// Events are sent asynchronously to avoid blocking.
-func (cb *CircularBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
-	ch := make(chan *nostr.Event)
+// The events are collected before returning, into a closed channel large enough to hold them all,
+// so consumers can stop reading it at any time without leaking anything.
+// If ctx is already cancelled, its error is returned.
+// Invalid filters are rejected, see [NormalizeFilter]. A panic while matching the events is recovered,
+// see [ErrQueryPanicked].
+func (cb *CircularBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) (ch chan *nostr.Event, err error) {
+	defer recoverQuery(&ch, &err)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	go func() {
-		defer close(ch)
+	if err := cb.acquireQuery(ctx); err != nil {
+		return nil, err
+	}
+	defer cb.releaseQuery()
 
-		cb.Lock()
-		// Create a copy of the events to avoid holding the lock while sending to channel
-		matchingEvents := cb.getMatchingEvents(filter)
-		cb.Unlock()
+	filter, err = normalizeFilter(filter, cb.size)
+	if err != nil && !errors.Is(err, ErrUnsatisfiableFilter) {
+		return nil, err
+	}
 
-		// Send matching events to the channel
-		for i := range matchingEvents {
-			select {
-			case <-ctx.Done():
-				return
-			case ch <- &matchingEvents[i]:
-			}
-		}
-	}()
+	if err != nil {
+		// the filter can't match anything
+		return sendAll(nil), nil
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+	return sendAll(cb.getMatchingEvents(filter)), nil
+}
+
+// ErrQueryPanicked is returned by the queries of [CircularBuffer] and [AtomicCircularBuffer]
+// when matching the events panics, so that a bug failing on a malformed event fails the query
+// instead of crashing the relay.
+var ErrQueryPanicked = errors.New("query panicked")
+
+// recoverQuery recovers a panic of the query returning ch and err, if any, logging it with its stack trace.
+// The query then returns [ErrQueryPanicked] and a closed empty channel.
+// It must be deferred by the query.
+func recoverQuery(ch *chan *nostr.Event, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
 
-	return ch, nil
+	log.Printf("[ERROR] query panicked: %v\n%s", r, debug.Stack())
+	*ch = sendAll(nil)
+	*err = fmt.Errorf("%w: %v", ErrQueryPanicked, r)
+}
+
+// sendAll returns a closed channel holding the events.
+func sendAll(events []*nostr.Event) chan *nostr.Event {
+	ch := make(chan *nostr.Event, len(events))
+	for _, evt := range events {
+		ch <- evt
+	}
+	close(ch)
+	return ch
 }
 
 // getMatchingEvents returns a slice of events that match the given filter.
+// The events are shared with the buffer, and must not be modified.
 // This function must be called with the lock held.
-func (cb *CircularBuffer) getMatchingEvents(filter nostr.Filter) []nostr.Event {
+func (cb *CircularBuffer) getMatchingEvents(filter nostr.Filter) []*nostr.Event {
 	// Apply limit from filter or use all events if no limit
 	limit := cb.count
 	if filter.Limit > 0 && filter.Limit < limit {
@@ -90,12 +201,14 @@ func (cb *CircularBuffer) getMatchingEvents(filter nostr.Filter) []nostr.Event {
 	}
 
 	// Pre-allocate the result slice
-	result := make([]nostr.Event, 0, limit)
+	result := make([]*nostr.Event, 0, limit)
+
+	kinds := newKindMatcher(filter.Kinds)
 
 	// Start from the tail (oldest) and move towards head (newest)
 	for i, idx := 0, cb.tail; i < cb.count; i++ {
 		evt := cb.buffer[idx]
-		if cb.eventMatchesFilter(&evt, filter) {
+		if evt != nil && cb.match(evt, filter, &kinds) {
 			result = append(result, evt)
 			if len(result) >= limit {
 				break
@@ -106,77 +219,3 @@ func (cb *CircularBuffer) getMatchingEvents(filter nostr.Filter) []nostr.Event {
 
 	return result
 }
-
-// eventMatchesFilter checks if an event matches the given filter.
-// Implements the Nostr filter matching logic for IDs, authors, kinds, tags, and timestamps.
-func (cb *CircularBuffer) eventMatchesFilter(evt *nostr.Event, filter nostr.Filter) bool {
-	// Check IDs
-	if len(filter.IDs) > 0 {
-		found := false
-		for _, id := range filter.IDs {
-			if id == evt.ID || (len(id) < 64 && len(evt.ID) >= len(id) && evt.ID[:len(id)] == id) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
-	}
-
-	// Check Authors
-	if len(filter.Authors) > 0 {
-		found := false
-		for _, author := range filter.Authors {
-			if author == evt.PubKey || (len(author) < 64 && len(evt.PubKey) >= len(author) && evt.PubKey[:len(author)] == author) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
-	}
-
-	// Check Kinds
-	if len(filter.Kinds) > 0 {
-		hasMatchingKind := slices.Contains(filter.Kinds, evt.Kind)
-		if !hasMatchingKind {
-			return false
-		}
-	}
-
-	// Check Tags
-	for tagName, values := range filter.Tags {
-		if len(values) == 0 {
-			continue
-		}
-
-		found := false
-		for _, tag := range evt.Tags {
-			if len(tag) > 1 && tag[0] == tagName {
-				if slices.Contains(values, tag[1]) {
-					found = true
-				}
-				if found {
-					break
-				}
-			}
-		}
-		if !found {
-			return false
-		}
-	}
-
-	// Check Since
-	if filter.Since != nil && evt.CreatedAt < *filter.Since {
-		return false
-	}
-
-	// Check Until
-	if filter.Until != nil && evt.CreatedAt > *filter.Until {
-		return false
-	}
-
-	return true
-}
@@ -2,7 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -364,6 +371,185 @@ func BenchmarkMixed_Ephemeral(b *testing.B) {
 	})
 }
 
+// BenchmarkMixedRatio tests mixed read/write workloads with different read:write ratios on all the buffers.
+// The buffers are compared through the Store returned by NewEphemeralStore, so the channel-based ones
+// also pay for collecting the events, as they do in the relay.
+func BenchmarkMixedRatio(b *testing.B) {
+	ratios := []struct{ reads, writes int }{{90, 10}, {50, 50}, {10, 90}}
+	impls := []string{ImplMutex, ImplAtomic1, ImplAtomic2}
+
+	ctx := context.Background()
+	filter := nostr.Filter{
+		Kinds: []int{1, 2, 3, 4},
+		Limit: 50,
+	}
+
+	for _, ratio := range ratios {
+		for _, impl := range impls {
+			b.Run(fmt.Sprintf("%d:%d/%s", ratio.reads, ratio.writes, impl), func(b *testing.B) {
+				store, err := NewEphemeralStore(impl, 1000)
+				if err != nil {
+					b.Fatalf("Failed to create the store: %v", err)
+				}
+
+				// Pre-fill with some data
+				for i := range 500 {
+					store.SaveEvent(ctx, createTestEvent(fmt.Sprintf("prefill-%d", i), i%5))
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					counter := 0
+					for pb.Next() {
+						if counter%(ratio.reads+ratio.writes) < ratio.reads {
+							_, _ = store.QueryEvents(ctx, filter)
+						} else {
+							store.SaveEvent(ctx, createTestEvent(fmt.Sprintf("mixed-%d", counter), counter%5))
+						}
+						counter++
+					}
+				})
+			})
+		}
+	}
+}
+
+// TestQueryEventsAbandonedChannel tests that the channel-based queries don't leave goroutines behind
+// when the consumer stops reading the channel
+func TestQueryEventsAbandonedChannel(t *testing.T) {
+	buffers := map[string]channelBuffer{
+		"Original": NewCircularBuffer(100),
+		"Atomic":   NewAtomicCircularBuffer(100),
+	}
+
+	for name, cb := range buffers {
+		t.Run(name, func(t *testing.T) {
+			for i := range 100 {
+				cb.SaveEvent(context.Background(), createTestEvent(fmt.Sprintf("id-%d", i), 1))
+			}
+
+			before := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			for range 50 {
+				ch, err := cb.QueryEvents(ctx, nostr.Filter{})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				<-ch // read one event, then abandon the channel
+			}
+
+			// nothing is left blocked on the abandoned channels, even before the context is cancelled
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected the queries to leave no goroutines, %d are left", runtime.NumGoroutine()-before)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			cancel()
+			if _, err := cb.QueryEvents(ctx, nostr.Filter{}); !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected the cancelled query to fail, got %v", err)
+			}
+		})
+	}
+}
+
+// TestLegacyUnsupportedOptions tests that the buffers other than AtomicCircularBuffer2 reject the options
+// they don't support instead of ignoring them
+func TestLegacyUnsupportedOptions(t *testing.T) {
+	options := map[string]BufferOption{
+		"WithMetrics":        WithMetrics(NewMetrics()),
+		"WithEvictionPolicy": WithEvictionPolicy(LRU),
+		"WithTagIndex":       WithTagIndex(),
+		"WithAuthorIndex":    WithAuthorIndex(),
+		"WithOrderIndex":     WithOrderIndex(),
+		"WithTimeIndex":      WithTimeIndex(time.Minute),
+		"WithCompaction":     WithCompaction(time.Minute),
+		"WithIDBloomFilter":  WithIDBloomFilter(),
+		"WithQueryCache":     WithQueryCache(10, time.Minute),
+		"WithMaxAge":         WithMaxAge(time.Minute),
+	}
+
+	for name, opt := range options {
+		if _, err := NewCircularBufferE(10, opt); !errors.Is(err, ErrUnsupportedOption) || !strings.Contains(err.Error(), name) {
+			t.Errorf("CircularBuffer %s: expected ErrUnsupportedOption, got %v", name, err)
+		}
+		if _, err := NewAtomicCircularBufferE(10, opt); !errors.Is(err, ErrUnsupportedOption) || !strings.Contains(err.Error(), name) {
+			t.Errorf("AtomicCircularBuffer %s: expected ErrUnsupportedOption, got %v", name, err)
+		}
+	}
+
+	// a disabled cache is not an unsupported option
+	if _, err := NewCircularBufferE(10, WithQueryCache(0, time.Minute), WithEvictionPolicy(FIFO)); err != nil {
+		t.Fatalf("Expected the disabled options to be accepted, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected NewCircularBuffer to panic with an unsupported option")
+		}
+	}()
+	NewCircularBuffer(10, WithTagIndex())
+}
+
+// TestQueryEventsRecoversPanic tests that a matcher panicking on a malformed event fails the query,
+// closing its channel, without crashing the relay nor leaving the buffer locked
+func TestQueryEventsRecoversPanic(t *testing.T) {
+	ctx := context.Background()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	panicking := func(evt *nostr.Event, filter nostr.Filter, kinds *kindMatcher) bool {
+		if evt.ID == "malformed" {
+			panic("malformed event")
+		}
+		return matchEvent(evt, filter, kinds)
+	}
+
+	buffers := map[string]channelBuffer{
+		"Original": newCircularBuffer(10, panicking),
+		"Atomic":   newAtomicCircularBuffer(10, panicking),
+	}
+
+	for name, cb := range buffers {
+		t.Run(name, func(t *testing.T) {
+			cb.SaveEvent(ctx, createTestEvent("valid", 20000))
+			cb.SaveEvent(ctx, createTestEvent("malformed", 20000))
+
+			ch, err := cb.QueryEvents(ctx, nostr.Filter{})
+			if !errors.Is(err, ErrQueryPanicked) {
+				t.Fatalf("Expected the query to fail with ErrQueryPanicked, got %v", err)
+			}
+			if _, ok := <-ch; ok {
+				t.Fatal("Expected the channel to be closed and empty")
+			}
+
+			// the relay only logs the failure of the ephemeral store
+			setupStores(t, &mockStore{events: []*nostr.Event{createTestEvent("regular", 1)}}, collectingStore{cb})
+			result, err := Query(ctx, nil, nostr.Filters{{Kinds: []int{1, 20000}}})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(result) != 1 || result[0].ID != "regular" {
+				t.Fatalf("Expected only the regular event, got %v", result)
+			}
+
+			// the buffer is still usable, and queries succeed once the malformed event is evicted
+			for i := range 10 {
+				if err := cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("after-%d", i), 20000)); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			events, err := collectingStore{cb}.QueryEvents(ctx, nostr.Filter{})
+			if err != nil || len(events) != 10 {
+				t.Fatalf("Expected the 10 new events, got %d events and %v", len(events), err)
+			}
+		})
+	}
+}
+
 // TestAtomicCircularBuffer2 tests the correctness of the AtomicCircularBuffer2 implementation
 func TestAtomicCircularBuffer2(t *testing.T) {
 	// Test initialization
@@ -507,3 +693,1092 @@ func TestConcurrentSaveAndQuery2(t *testing.T) {
 
 	wg.Wait()
 }
+
+// TestOnEvict tests that every buffer reports the overwritten events, oldest first
+func TestOnEvict(t *testing.T) {
+	ctx := context.Background()
+
+	var evicted []string
+	onEvict := WithOnEvict(func(evt *nostr.Event) {
+		evicted = append(evicted, evt.ID)
+	})
+
+	buffers := map[string]func(context.Context, *nostr.Event) error{
+		"Original": NewCircularBuffer(3, onEvict).SaveEvent,
+		"Atomic":   NewAtomicCircularBuffer(3, onEvict).SaveEvent,
+		"Atomic2":  NewAtomicCircularBuffer2(3, onEvict).SaveEvent,
+	}
+
+	for name, save := range buffers {
+		t.Run(name, func(t *testing.T) {
+			evicted = nil
+			for i := range 7 {
+				if err := save(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i)); err != nil {
+					t.Fatalf("Failed to save event: %v", err)
+				}
+			}
+
+			expected := []string{"id-0", "id-1", "id-2", "id-3"}
+			if len(evicted) != len(expected) {
+				t.Fatalf("Expected %d evicted events, got %v", len(expected), evicted)
+			}
+			for i := range expected {
+				if evicted[i] != expected[i] {
+					t.Fatalf("Expected evicted events %v, got %v", expected, evicted)
+				}
+			}
+		})
+	}
+}
+
+// TestAtomicCircularBuffer2FullCapacity tests that a buffer filled exactly to capacity
+// returns every event once, in chronological order
+func TestAtomicCircularBuffer2FullCapacity(t *testing.T) {
+	const size = 8
+	ctx := context.Background()
+
+	for _, saved := range []int{size, size + 3, 2 * size} {
+		t.Run(fmt.Sprintf("saved=%d", saved), func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(size)
+			for i := range saved {
+				cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+			}
+
+			events, err := cb.QueryEvents(ctx, nostr.Filter{})
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			if len(events) != size {
+				t.Fatalf("Expected %d events, got %d", size, len(events))
+			}
+
+			for i, evt := range events {
+				expected := fmt.Sprintf("id-%d", saved-size+i)
+				if evt.ID != expected {
+					t.Fatalf("Event %d: expected %s, got %s", i, expected, evt.ID)
+				}
+			}
+		})
+	}
+}
+
+// TestNewAtomicCircularBuffer2FromEvents tests that a preloaded buffer keeps only the newest events, in order
+func TestNewAtomicCircularBuffer2FromEvents(t *testing.T) {
+	ctx := context.Background()
+
+	events := make([]*nostr.Event, 0, 12)
+	for i := range 12 {
+		events = append(events, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	cb := NewAtomicCircularBuffer2FromEvents(5, events)
+	if count := cb.count.Load(); count != 5 {
+		t.Fatalf("Expected count 5, got %d", count)
+	}
+
+	result, err := cb.QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	if len(result) != 5 {
+		t.Fatalf("Expected 5 events, got %d", len(result))
+	}
+	for i, evt := range result {
+		if expected := fmt.Sprintf("id-%d", 7+i); evt.ID != expected {
+			t.Fatalf("Event %d: expected %s, got %s", i, expected, evt.ID)
+		}
+	}
+
+	// the buffer must keep working as if the events were saved one by one
+	cb.SaveEvent(ctx, createTestEvent("id-12", 1))
+	result, _ = cb.QueryEvents(ctx, nostr.Filter{})
+	if len(result) != 5 || result[0].ID != "id-8" || result[4].ID != "id-12" {
+		t.Fatalf("Unexpected events after a save: first %s, last %s", result[0].ID, result[len(result)-1].ID)
+	}
+
+	partial := NewAtomicCircularBuffer2FromEvents(5, events[:2])
+	result, _ = partial.QueryEvents(ctx, nostr.Filter{})
+	if len(result) != 2 || result[0].ID != "id-0" || result[1].ID != "id-1" {
+		t.Fatalf("Expected id-0 and id-1 in a partially filled buffer, got %v", result)
+	}
+}
+
+// collectEvents drains the channel returned by a channel-based QueryEvents
+func collectEvents(ch chan *nostr.Event) []*nostr.Event {
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events
+}
+
+// TestOverflowPolicy tests that DropOldest evicts when full while RejectNew preserves the stored events
+func TestOverflowPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	type buffer struct {
+		save  func(context.Context, *nostr.Event) error
+		query func(context.Context, nostr.Filter) []*nostr.Event
+	}
+
+	newBuffers := func(policy OverflowPolicy) map[string]buffer {
+		cb := NewCircularBuffer(3, WithOverflowPolicy(policy))
+		acb := NewAtomicCircularBuffer(3, WithOverflowPolicy(policy))
+		acb2 := NewAtomicCircularBuffer2(3, WithOverflowPolicy(policy))
+
+		return map[string]buffer{
+			"Original": {cb.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+				ch, _ := cb.QueryEvents(ctx, f)
+				return collectEvents(ch)
+			}},
+			"Atomic": {acb.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+				ch, _ := acb.QueryEvents(ctx, f)
+				return collectEvents(ch)
+			}},
+			"Atomic2": {acb2.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+				events, _ := acb2.QueryEvents(ctx, f)
+				return events
+			}},
+		}
+	}
+
+	tests := []struct {
+		policy   OverflowPolicy
+		err      error
+		expected []string
+	}{
+		{DropOldest, nil, []string{"id-2", "id-3", "id-4"}},
+		{RejectNew, ErrBufferFull, []string{"id-0", "id-1", "id-2"}},
+	}
+
+	for _, test := range tests {
+		for name, b := range newBuffers(test.policy) {
+			t.Run(fmt.Sprintf("%s/policy=%d", name, test.policy), func(t *testing.T) {
+				for i := range 3 {
+					if err := b.save(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1)); err != nil {
+						t.Fatalf("Failed to save event: %v", err)
+					}
+				}
+
+				for i := 3; i < 5; i++ {
+					if err := b.save(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1)); err != test.err {
+						t.Fatalf("Expected error %v when full, got %v", test.err, err)
+					}
+				}
+
+				events := b.query(ctx, nostr.Filter{})
+				ids := make(map[string]bool, len(events))
+				for _, evt := range events {
+					ids[evt.ID] = true
+				}
+
+				if len(events) != len(test.expected) {
+					t.Fatalf("Expected %v, got %d events", test.expected, len(events))
+				}
+				for _, id := range test.expected {
+					if !ids[id] {
+						t.Fatalf("Expected %v, missing %s", test.expected, id)
+					}
+				}
+			})
+		}
+	}
+}
+
+// TestEvictionPolicy tests that FIFO evicts the oldest saved events, while LRU keeps the old events
+// that are still queried
+func TestEvictionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		policy   EvictionPolicy
+		expected []string
+	}{
+		{FIFO, []string{"id-3", "id-4", "id-5", "id-6", "id-7"}},
+		{LRU, []string{"id-5", "id-0", "id-6", "id-2", "id-7"}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("policy=%d", test.policy), func(t *testing.T) {
+			var evicted []string
+			cb := NewAtomicCircularBuffer2(5, WithEvictionPolicy(test.policy), WithTagIndex(),
+				WithOnEvict(func(evt *nostr.Event) { evicted = append(evicted, evt.ID) }))
+			for i := range 5 {
+				cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+			}
+
+			// two of the oldest events are queried, the others are not
+			if _, err := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-0", "id-2"}}); err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			cb.SaveEvents(ctx, []*nostr.Event{createTestEvent("id-5", 1), createTestEvent("id-6", 1)})
+			cb.SaveEvent(ctx, createTestEvent("id-7", 1))
+
+			if got := ids(slices.Collect(cb.All())); !slices.Equal(got, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+			if len(evicted) != 3 || slices.Contains(evicted, "id-0") != (test.policy == FIFO) {
+				t.Fatalf("Unexpected evicted events %v", evicted)
+			}
+			if err := cb.CheckIntegrity(); err != nil {
+				t.Fatalf("Unexpected integrity error: %v", err)
+			}
+		})
+	}
+
+	// the used events get a single second chance: unless queried again, they are evicted on the next pass
+	cb := NewAtomicCircularBuffer2(3, WithEvictionPolicy(LRU))
+	for i := range 3 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-0"}})
+	for i := 3; i < 6; i++ {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if got, expected := ids(slices.Collect(cb.All())), []string{"id-0", "id-4", "id-5"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	cb.SaveEvent(ctx, createTestEvent("id-6", 1))
+	cb.SaveEvent(ctx, createTestEvent("id-7", 1))
+	cb.SaveEvent(ctx, createTestEvent("id-8", 1))
+	if got, expected := ids(slices.Collect(cb.All())), []string{"id-6", "id-7", "id-8"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+// TestEvictionPolicyUnreturned tests that LRU evicts first the events counted or cut by the limit of an ordered
+// query, as they were not returned
+func TestEvictionPolicyUnreturned(t *testing.T) {
+	ctx := context.Background()
+
+	tests := map[string]func(*AtomicCircularBuffer2) error{
+		"count": func(cb *AtomicCircularBuffer2) error {
+			_, err := cb.CountEvents(ctx, nostr.Filter{IDs: []string{"id-0"}})
+			return err
+		},
+		"limit": func(cb *AtomicCircularBuffer2) error {
+			_, err := cb.QueryEventsOrdered(ctx, nostr.Filter{IDs: []string{"id-0", "id-1"}, Limit: 1}, QueryOptions{})
+			return err
+		},
+	}
+
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(3, WithEvictionPolicy(LRU))
+			for i := range 3 {
+				evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+				evt.CreatedAt = nostr.Timestamp(100 * (i + 1))
+				cb.SaveEvent(ctx, evt)
+			}
+
+			if err := query(cb); err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			cb.SaveEvent(ctx, createTestEvent("id-3", 1))
+
+			if got := ids(slices.Collect(cb.All())); slices.Contains(got, "id-0") {
+				t.Fatalf("Expected id-0 to be evicted, got %v", got)
+			}
+		})
+	}
+}
+
+// TestMaxConcurrentQueries tests that once the concurrent queries are saturated, the next query of every buffer
+// waits for a slot with WaitWhenBusy, and fails with ErrTooBusy with RejectWhenBusy
+func TestMaxConcurrentQueries(t *testing.T) {
+	ctx := context.Background()
+
+	type buffer struct {
+		options *bufferOptions
+		query   func(context.Context) error
+	}
+
+	newBuffers := func(policy BusyPolicy) map[string]buffer {
+		cb := NewCircularBuffer(10, WithMaxConcurrentQueries(2, policy))
+		acb := NewAtomicCircularBuffer(10, WithMaxConcurrentQueries(2, policy))
+		acb2 := NewAtomicCircularBuffer2(10, WithMaxConcurrentQueries(2, policy))
+
+		return map[string]buffer{
+			"Original": {&cb.bufferOptions, func(ctx context.Context) error {
+				_, err := cb.QueryEvents(ctx, nostr.Filter{})
+				return err
+			}},
+			"Atomic": {&acb.bufferOptions, func(ctx context.Context) error {
+				_, err := acb.QueryEvents(ctx, nostr.Filter{})
+				return err
+			}},
+			"Atomic2": {&acb2.bufferOptions, func(ctx context.Context) error {
+				_, err := acb2.QueryEvents(ctx, nostr.Filter{})
+				return err
+			}},
+		}
+	}
+
+	for name, b := range newBuffers(RejectWhenBusy) {
+		t.Run(name+"/reject", func(t *testing.T) {
+			if err := b.query(ctx); err != nil {
+				t.Fatalf("Expected the query to run, got %v", err)
+			}
+
+			// two queries in progress saturate the buffer
+			for range 2 {
+				b.options.acquireQuery(ctx)
+			}
+			if err := b.query(ctx); !errors.Is(err, ErrTooBusy) {
+				t.Fatalf("Expected ErrTooBusy, got %v", err)
+			}
+
+			b.options.releaseQuery()
+			if err := b.query(ctx); err != nil {
+				t.Fatalf("Expected the query to run once a slot is released, got %v", err)
+			}
+		})
+	}
+
+	for name, b := range newBuffers(WaitWhenBusy) {
+		t.Run(name+"/wait", func(t *testing.T) {
+			for range 2 {
+				b.options.acquireQuery(ctx)
+			}
+
+			timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer cancel()
+			if err := b.query(timeout); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Expected the query to wait until its context expires, got %v", err)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- b.query(ctx) }()
+
+			select {
+			case err := <-done:
+				t.Fatalf("Expected the query to wait for a slot, got %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+
+			b.options.releaseQuery()
+			if err := <-done; err != nil {
+				t.Fatalf("Expected the query to run once a slot is released, got %v", err)
+			}
+		})
+	}
+
+	// a limit of zero or less means no limit, whatever the policy
+	for _, n := range []int{0, -1} {
+		for _, policy := range []BusyPolicy{WaitWhenBusy, RejectWhenBusy} {
+			cb := NewAtomicCircularBuffer2(10, WithMaxConcurrentQueries(n, policy))
+
+			timeout, cancel := context.WithTimeout(ctx, time.Second)
+			_, err := cb.QueryEvents(timeout, nostr.Filter{})
+			cancel()
+			if err != nil {
+				t.Fatalf("Expected the query to run without a limit of %d, got %v", n, err)
+			}
+		}
+	}
+}
+
+// TestClear tests that every buffer is empty after Clear, and can be filled again
+func TestClear(t *testing.T) {
+	ctx := context.Background()
+
+	type buffer struct {
+		save  func(context.Context, *nostr.Event) error
+		query func(context.Context, nostr.Filter) []*nostr.Event
+		len   func() int
+		clear func()
+	}
+
+	cb := NewCircularBuffer(5)
+	acb := NewAtomicCircularBuffer(5)
+	acb2 := NewAtomicCircularBuffer2(5)
+
+	buffers := map[string]buffer{
+		"Original": {cb.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+			ch, _ := cb.QueryEvents(ctx, f)
+			return collectEvents(ch)
+		}, cb.Len, cb.Clear},
+		"Atomic": {acb.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+			ch, _ := acb.QueryEvents(ctx, f)
+			return collectEvents(ch)
+		}, acb.Len, acb.Clear},
+		"Atomic2": {acb2.SaveEvent, func(ctx context.Context, f nostr.Filter) []*nostr.Event {
+			events, _ := acb2.QueryEvents(ctx, f)
+			return events
+		}, acb2.Len, acb2.Clear},
+	}
+
+	for name, b := range buffers {
+		t.Run(name, func(t *testing.T) {
+			for i := range 8 {
+				b.save(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+			}
+			if n := b.len(); n != 5 {
+				t.Fatalf("Expected 5 events before clearing, got %d", n)
+			}
+
+			b.clear()
+			if n := b.len(); n != 0 {
+				t.Fatalf("Expected 0 events after clearing, got %d", n)
+			}
+			if events := b.query(ctx, nostr.Filter{}); len(events) != 0 {
+				t.Fatalf("Expected no events after clearing, got %d", len(events))
+			}
+
+			for i := range 3 {
+				if err := b.save(ctx, createTestEvent(fmt.Sprintf("new-%d", i), 1)); err != nil {
+					t.Fatalf("Failed to save event after clearing: %v", err)
+				}
+			}
+
+			events := b.query(ctx, nostr.Filter{})
+			if len(events) != 3 || b.len() != 3 {
+				t.Fatalf("Expected 3 events after refilling, got %d (len %d)", len(events), b.len())
+			}
+			for i, evt := range events {
+				if expected := fmt.Sprintf("new-%d", i); evt.ID != expected {
+					t.Fatalf("Event %d: expected %s, got %s", i, expected, evt.ID)
+				}
+			}
+		})
+	}
+}
+
+// TestAtomicCircularBuffer2All tests that All yields the live events in chronological order, skipping deleted ones
+func TestAtomicCircularBuffer2All(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5)
+	for i := range 8 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	cb.DeleteEvent(ctx, createTestEvent("id-5", 1))
+
+	var ids []string
+	for evt := range cb.All() {
+		ids = append(ids, evt.ID)
+	}
+
+	expected := []string{"id-3", "id-4", "id-6", "id-7"}
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+}
+
+// TestAtomicCircularBuffer2AllBreak tests that the iteration stops as soon as the loop breaks
+func TestAtomicCircularBuffer2AllBreak(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	var ids []string
+	for evt := range cb.All() {
+		ids = append(ids, evt.ID)
+		if len(ids) == 3 {
+			break
+		}
+	}
+
+	expected := []string{"id-0", "id-1", "id-2"}
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids)
+	}
+}
+
+func TestAtomicCircularBuffer2Filter(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5)
+	for i := range 8 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+		if i%2 == 1 {
+			evt.Content = "gm nostr"
+		}
+		cb.SaveEvent(ctx, evt)
+	}
+	cb.DeleteEvent(ctx, createTestEvent("id-5", 1))
+
+	events := cb.Filter(func(evt *nostr.Event) bool {
+		return strings.Contains(evt.Content, "gm")
+	})
+
+	expected := []string{"id-3", "id-7"}
+	if got := ids(events); !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+// TestAtomicCircularBuffer2LimitCountsMatches tests that the limit applies to the matching events, not the scanned ones
+func TestAtomicCircularBuffer2LimitCountsMatches(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		kind := 1
+		if i%10 == 0 {
+			kind = 7
+		}
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), kind))
+	}
+
+	events, err := cb.QueryEvents(ctx, nostr.Filter{Kinds: []int{7}, Limit: 5})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 matching events, got %d", len(events))
+	}
+	for _, evt := range events {
+		if evt.Kind != 7 {
+			t.Fatalf("Expected only kind 7 events, got %s with kind %d", evt.ID, evt.Kind)
+		}
+	}
+}
+
+// TestAtomicCircularBuffer2LimitAroundSize tests limits close to the size of a full buffer,
+// with every path of the scan: the full scan, the time window and the tag index
+func TestAtomicCircularBuffer2LimitAroundSize(t *testing.T) {
+	const size = 10
+	ctx := context.Background()
+
+	buffers := map[string]*AtomicCircularBuffer2{
+		"plain":   NewAtomicCircularBuffer2(size),
+		"indexed": NewAtomicCircularBuffer2(size, WithTagIndex()),
+	}
+	for _, cb := range buffers {
+		// the buffer wraps around, keeping the events from id-5 to id-14
+		for i := range size + 5 {
+			evt := createTimedEvent(fmt.Sprintf("id-%d", i), int64(1000+i))
+			evt.Tags = nostr.Tags{{"t", "tag"}}
+			cb.SaveEvent(ctx, evt)
+		}
+	}
+
+	var all []string
+	for i := 5; i < size+5; i++ {
+		all = append(all, fmt.Sprintf("id-%d", i))
+	}
+
+	filters := map[string]nostr.Filter{
+		"scan":   {},
+		"window": {Since: timestamp(1000)},
+		"tags":   {Tags: nostr.TagMap{"t": {"tag"}}},
+	}
+
+	tests := []struct {
+		limit    int
+		expected []string
+		newest   []string
+	}{
+		{size + 1, all, all},
+		{size, all, all},
+		{size - 1, all[:size-1], all[1:]},
+	}
+
+	for name, cb := range buffers {
+		for filterName, filter := range filters {
+			for _, test := range tests {
+				t.Run(fmt.Sprintf("%s/%s/%d", name, filterName, test.limit), func(t *testing.T) {
+					filter.Limit = test.limit
+					events, err := cb.QueryEvents(ctx, filter)
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					if got := ids(events); !slices.Equal(got, test.expected) {
+						t.Fatalf("Expected %v, got %v", test.expected, got)
+					}
+
+					// the newest first order keeps the newest events instead
+					ordered, err := cb.QueryEventsOrdered(ctx, filter, QueryOptions{})
+					if err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					got := ids(ordered)
+					slices.Reverse(got)
+					if !slices.Equal(got, test.newest) {
+						t.Fatalf("Expected the newest events %v, got %v", test.newest, got)
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestAtomicCircularBuffer2NewestOldest tests the accessors to the ends of the buffer, before and after it wraps around
+func TestAtomicCircularBuffer2NewestOldest(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		saved          int
+		oldest, newest string
+	}{
+		{0, "", ""},
+		{1, "id-0", "id-0"},
+		{3, "id-0", "id-2"},
+		{5, "id-0", "id-4"},
+		{12, "id-7", "id-11"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("saved=%d", test.saved), func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(5)
+			for i := range test.saved {
+				cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+			}
+
+			oldest, ok := cb.Oldest()
+			if ok != (test.saved > 0) {
+				t.Fatalf("Expected Oldest to report %v, got %v", test.saved > 0, ok)
+			}
+			if ok && oldest.ID != test.oldest {
+				t.Fatalf("Expected the oldest event to be %s, got %s", test.oldest, oldest.ID)
+			}
+
+			newest, ok := cb.Newest()
+			if ok != (test.saved > 0) {
+				t.Fatalf("Expected Newest to report %v, got %v", test.saved > 0, ok)
+			}
+			if ok && newest.ID != test.newest {
+				t.Fatalf("Expected the newest event to be %s, got %s", test.newest, newest.ID)
+			}
+		})
+	}
+}
+
+// TestEventSizeLimits tests that every buffer rejects the events over the size limits, and accepts the ones at the limit
+func TestEventSizeLimits(t *testing.T) {
+	ctx := context.Background()
+
+	atLimit := createTestEvent("at-limit", 1)
+	atLimit.Tags = nostr.Tags{{"e", "a"}, {"e", "b"}}
+	data, _ := atLimit.MarshalJSON()
+	maxSize := len(data)
+
+	tooBig := createTestEvent("at-limit", 1)
+	tooBig.Tags = atLimit.Tags
+	tooBig.Content = atLimit.Content + "x"
+
+	tooManyTags := createTestEvent("tags", 1)
+	tooManyTags.Tags = nostr.Tags{{"e", "a"}, {"e", "b"}, {"e", "c"}}
+
+	opts := []BufferOption{WithMaxEventSize(maxSize), WithMaxTags(2)}
+	buffers := map[string]func(context.Context, *nostr.Event) error{
+		"Original": NewCircularBuffer(3, opts...).SaveEvent,
+		"Atomic":   NewAtomicCircularBuffer(3, opts...).SaveEvent,
+		"Atomic2":  NewAtomicCircularBuffer2(3, opts...).SaveEvent,
+	}
+
+	for name, save := range buffers {
+		t.Run(name, func(t *testing.T) {
+			if err := save(ctx, atLimit); err != nil {
+				t.Fatalf("Expected the event at the limit to be saved, got %v", err)
+			}
+			if err := save(ctx, createTestEvent("small", 1)); err != nil {
+				t.Fatalf("Expected a small event to be saved, got %v", err)
+			}
+			if err := save(ctx, tooBig); !errors.Is(err, ErrEventTooLarge) {
+				t.Fatalf("Expected ErrEventTooLarge for an event over the size, got %v", err)
+			}
+			if err := save(ctx, tooManyTags); !errors.Is(err, ErrEventTooLarge) {
+				t.Fatalf("Expected ErrEventTooLarge for an event with too many tags, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxFutureDrift(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock(10000)
+
+	withinDrift := createTimedEvent("within-drift", 10000+60)
+	farFuture := createTimedEvent("far-future", 10000+3600)
+
+	opts := []BufferOption{WithMaxFutureDrift(15 * time.Minute), WithClock(clock)}
+	buffers := map[string]func(context.Context, *nostr.Event) error{
+		"Original": NewCircularBuffer(3, opts...).SaveEvent,
+		"Atomic":   NewAtomicCircularBuffer(3, opts...).SaveEvent,
+		"Atomic2":  NewAtomicCircularBuffer2(3, opts...).SaveEvent,
+	}
+
+	for name, save := range buffers {
+		t.Run(name, func(t *testing.T) {
+			if err := save(ctx, withinDrift); err != nil {
+				t.Fatalf("Expected the event within the drift to be saved, got %v", err)
+			}
+			if err := save(ctx, farFuture); !errors.Is(err, ErrEventInFuture) {
+				t.Fatalf("Expected ErrEventInFuture for an event far in the future, got %v", err)
+			}
+		})
+	}
+}
+
+// TestQueryEventsInto tests that the events are written over the previous content of the provided slice
+func TestQueryEventsInto(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 6 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%2))
+	}
+
+	dst := make([]*nostr.Event, 0, 10)
+	dst, err := cb.QueryEventsInto(ctx, nostr.Filter{Kinds: []int{0}}, dst)
+	if err != nil || len(dst) != 3 {
+		t.Fatalf("Expected 3 events, got %d (%v)", len(dst), err)
+	}
+	first := &dst[0]
+
+	dst, err = cb.QueryEventsInto(ctx, nostr.Filter{Kinds: []int{1}, Limit: 2}, dst)
+	if err != nil || len(dst) != 2 {
+		t.Fatalf("Expected 2 events, got %d (%v)", len(dst), err)
+	}
+	if dst[0].ID != "id-1" || dst[1].ID != "id-3" {
+		t.Fatalf("Expected id-1 and id-3, got %s and %s", dst[0].ID, dst[1].ID)
+	}
+	if &dst[0] != first {
+		t.Fatal("Expected the slice to be reused")
+	}
+
+	dst, _ = cb.QueryEventsInto(ctx, nostr.Filter{Kinds: []int{7}}, dst)
+	if len(dst) != 0 {
+		t.Fatalf("Expected no events, got %d", len(dst))
+	}
+}
+
+// BenchmarkQueryEventsInto shows that queries reusing a slice with enough capacity don't allocate
+func BenchmarkQueryEventsInto(b *testing.B) {
+	cb := NewAtomicCircularBuffer2(1000)
+	ctx := context.Background()
+	for i := range 500 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%5))
+	}
+
+	filter := nostr.Filter{Kinds: []int{1, 2, 3}, Limit: 100}
+	dst := make([]*nostr.Event, 0, 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst, _ = cb.QueryEventsInto(ctx, filter, dst)
+	}
+}
+
+// TestQueryEventsCopy tests that the events returned by QueryEventsCopy can be modified without affecting
+// the buffer, while the ones returned by QueryEvents are shared with it
+func TestQueryEventsCopy(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10, WithTagIndex())
+	cb.SaveEvent(ctx, createTestEvent("id-0", 1))
+	filter := nostr.Filter{Tags: nostr.TagMap{"e": {"test-tag"}}}
+
+	copies, err := cb.QueryEventsCopy(ctx, filter)
+	if err != nil || len(copies) != 1 {
+		t.Fatalf("Expected 1 event, got %d (%v)", len(copies), err)
+	}
+	copies[0].Tags[0][1] = "changed"
+	copies[0].Tags = append(copies[0].Tags, nostr.Tag{"p", "added"})
+	copies[0].Content = "changed"
+
+	events, err := cb.QueryEvents(ctx, filter)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected the copy not to affect the buffer, got %d events (%v)", len(events), err)
+	}
+	if evt := events[0]; evt.Tags[0][1] != "test-tag" || len(evt.Tags) != 1 || evt.Content != "test content id-0" {
+		t.Fatalf("Expected the stored event to be unchanged, got %v", evt)
+	}
+
+	// the documented sharp edge: the events of QueryEvents are the stored ones
+	events[0].Tags[0][1] = "shared"
+	again, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	if again[0] != events[0] || again[0].Tags[0][1] != "shared" {
+		t.Fatal("Expected QueryEvents to return the stored event")
+	}
+}
+
+// TestSaveEventCancelled tests that no buffer saves an event with an already cancelled context
+func TestSaveEventCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cb := NewCircularBuffer(3)
+	acb := NewAtomicCircularBuffer(3)
+	acb2 := NewAtomicCircularBuffer2(3)
+	rs := NewReplaceableStore()
+
+	buffers := map[string]struct {
+		save func(context.Context, *nostr.Event) error
+		len  func() int
+	}{
+		"Original":    {cb.SaveEvent, cb.Len},
+		"Atomic":      {acb.SaveEvent, acb.Len},
+		"Atomic2":     {acb2.SaveEvent, acb2.Len},
+		"Replaceable": {rs.SaveEvent, rs.Len},
+	}
+
+	for name, b := range buffers {
+		t.Run(name, func(t *testing.T) {
+			if err := b.save(ctx, createTestEvent("id", 0)); !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected context.Canceled, got %v", err)
+			}
+			if n := b.len(); n != 0 {
+				t.Fatalf("Expected the buffer to be unchanged, got %d events", n)
+			}
+		})
+	}
+}
+
+// TestNewAtomicCircularBuffer2E tests that invalid capacities are reported as errors instead of panics
+func TestNewAtomicCircularBuffer2E(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		cb, err := NewAtomicCircularBuffer2E(capacity)
+		if !errors.Is(err, ErrInvalidCapacity) || cb != nil {
+			t.Fatalf("capacity %d: expected ErrInvalidCapacity, got %v", capacity, err)
+		}
+	}
+
+	cb, err := NewAtomicCircularBuffer2E(10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := cb.SaveEvent(context.Background(), createTestEvent("id", 1)); err != nil || cb.Len() != 1 {
+		t.Fatalf("Expected the buffer to be usable, got %v", err)
+	}
+
+	if _, err := NewDurableBuffer(t.TempDir(), 0, 0); !errors.Is(err, ErrInvalidCapacity) {
+		t.Fatalf("Expected ErrInvalidCapacity from NewDurableBuffer, got %v", err)
+	}
+}
+
+// TestForEachMatching tests that the scan visits the matching events in order, and stops as soon as asked
+func TestForEachMatching(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%2))
+	}
+
+	var visited []string
+	err := cb.ForEachMatching(ctx, nostr.Filter{Kinds: []int{1}}, func(evt *nostr.Event) bool {
+		visited = append(visited, evt.ID)
+		return len(visited) < 3
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Equal(visited, []string{"id-1", "id-3", "id-5"}) {
+		t.Fatalf("Expected the scan to stop after 3 events, visited %v", visited)
+	}
+
+	visited = nil
+	cb.ForEachMatching(ctx, nostr.Filter{Kinds: []int{0}, Limit: 4}, func(evt *nostr.Event) bool {
+		visited = append(visited, evt.ID)
+		return true
+	})
+	if !slices.Equal(visited, []string{"id-0", "id-2", "id-4", "id-6"}) {
+		t.Fatalf("Expected the scan to stop at the limit, visited %v", visited)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	calls := 0
+	err = cb.ForEachMatching(cancelled, nostr.Filter{}, func(*nostr.Event) bool {
+		calls++
+		return true
+	})
+	if !errors.Is(err, context.Canceled) || calls != 0 {
+		t.Fatalf("Expected the cancelled scan to stop immediately, got %v after %d calls", err, calls)
+	}
+}
+
+func TestQueryIDs(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(50)
+	for i := range 80 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%3))
+	}
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "id-60"})
+
+	filters := []nostr.Filter{
+		{},
+		{Kinds: []int{0}},
+		{Kinds: []int{1, 2}, Limit: 5},
+		{IDs: []string{"id-10", "id-45", "id-60", "id-79"}},
+		{Kinds: []int{7}},
+	}
+
+	for _, filter := range filters {
+		events, err := cb.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		got, err := cb.QueryIDs(ctx, filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := ids(events); !slices.Equal(got, expected) {
+			t.Fatalf("Filter %v: expected the IDs %v, got %v", filter, expected, got)
+		}
+	}
+}
+
+// TestSaveEvents tests that a batch larger than the buffer leaves exactly its last events, in order
+func TestSaveEvents(t *testing.T) {
+	const size = 10
+	ctx := context.Background()
+
+	evicted := 0
+	cb := NewAtomicCircularBuffer2(size, WithOnEvict(func(*nostr.Event) { evicted++ }))
+	for i := range 4 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("old-%d", i), 1))
+	}
+
+	batch := make([]*nostr.Event, 0, 3*size)
+	for i := range 3 * size {
+		batch = append(batch, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	stored, err := cb.SaveEvents(ctx, batch)
+	if err != nil || stored != size {
+		t.Fatalf("Expected %d events to be stored, got %d (%v)", size, stored, err)
+	}
+	if evicted != 4 {
+		t.Fatalf("Expected the 4 old events to be evicted, got %d", evicted)
+	}
+
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != size {
+		t.Fatalf("Expected %d events, got %d", size, len(events))
+	}
+	for i, evt := range events {
+		if expected := fmt.Sprintf("id-%d", 2*size+i); evt.ID != expected {
+			t.Fatalf("Event %d: expected %s, got %s", i, expected, evt.ID)
+		}
+	}
+
+	// a small batch keeps working like single saves
+	stored, err = cb.SaveEvents(ctx, batch[:2])
+	if err != nil || stored != 2 || cb.Len() != size {
+		t.Fatalf("Expected 2 events to be stored in a full buffer, got %d (%v)", stored, err)
+	}
+	if newest, _ := cb.Newest(); newest.ID != "id-1" {
+		t.Fatalf("Expected id-1 to be the newest event, got %s", newest.ID)
+	}
+
+	if _, err := cb.SaveEvents(ctx, []*nostr.Event{batch[0], nil}); err == nil {
+		t.Fatal("Expected an error for a batch with a nil event")
+	}
+}
+
+// TestSaveEventsRejectNew tests that only the events fitting in the buffer are stored with the RejectNew policy
+func TestSaveEventsRejectNew(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5, WithOverflowPolicy(RejectNew))
+	cb.SaveEvent(ctx, createTestEvent("first", 1))
+
+	batch := []*nostr.Event{}
+	for i := range 6 {
+		batch = append(batch, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	stored, err := cb.SaveEvents(ctx, batch)
+	if !errors.Is(err, ErrBufferFull) || stored != 4 {
+		t.Fatalf("Expected 4 events to be stored and ErrBufferFull, got %d (%v)", stored, err)
+	}
+
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	expected := []string{"first", "id-0", "id-1", "id-2", "id-3"}
+	if !slices.Equal(ids(events), expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids(events))
+	}
+}
+
+func TestUpdateEvent(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5, WithTagIndex())
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	before, _ := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-2"}})
+
+	refresh := func(evt *nostr.Event) { evt.Tags = append(evt.Tags, nostr.Tag{"expiration", "1000"}) }
+	if !cb.UpdateEvent(ctx, "id-2", refresh) {
+		t.Fatal("expected the event to be found")
+	}
+	if cb.UpdateEvent(ctx, "missing", refresh) {
+		t.Fatal("expected a missing event not to be found")
+	}
+
+	// the event keeps its position, and is found by its new tag
+	all := slices.Collect(cb.All())
+	if all[2].ID != "id-2" || all[2].Tags.Find("expiration") == nil {
+		t.Fatalf("expected the updated event in the same position, got %v", all[2])
+	}
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"expiration": {"1000"}}})
+	if len(events) != 1 || events[0].ID != "id-2" {
+		t.Fatalf("expected the updated event to be indexed by its new tag, got %v", events)
+	}
+
+	// the event returned before the update is unchanged
+	if before[0].Tags.Find("expiration") != nil {
+		t.Fatal("expected the stored event not to be mutated in place")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if cb.UpdateEvent(cancelled, "id-3", refresh) {
+		t.Fatal("expected no update with a cancelled context")
+	}
+}
+
+func TestSaveEventCopiesTags(t *testing.T) {
+	ctx := context.Background()
+
+	cb := NewCircularBuffer(10)
+	acb := NewAtomicCircularBuffer(10)
+	acb2 := NewAtomicCircularBuffer2(10)
+
+	queries := map[string]func(nostr.Filter) []*nostr.Event{
+		"CircularBuffer": func(f nostr.Filter) []*nostr.Event {
+			ch, _ := cb.QueryEvents(ctx, f)
+			return collectEvents(ch)
+		},
+		"AtomicCircularBuffer": func(f nostr.Filter) []*nostr.Event {
+			ch, _ := acb.QueryEvents(ctx, f)
+			return collectEvents(ch)
+		},
+		"AtomicCircularBuffer2": func(f nostr.Filter) []*nostr.Event {
+			events, _ := acb2.QueryEvents(ctx, f)
+			return events
+		},
+	}
+
+	evt := createTestEvent("id-0", 1)
+	evt.Tags = nostr.Tags{{"t", "original"}}
+	cb.SaveEvent(ctx, evt)
+	acb.SaveEvent(ctx, evt)
+	acb2.SaveEvent(ctx, evt)
+
+	batch := createTestEvent("id-1", 1)
+	batch.Tags = nostr.Tags{{"t", "original"}}
+	acb2.SaveEvents(ctx, []*nostr.Event{batch})
+
+	// the caller reuses the events after saving them
+	evt.Tags[0][1] = "mutated"
+	evt.Tags = append(evt.Tags, nostr.Tag{"p", "appended"})
+	batch.Tags[0][1] = "mutated"
+
+	for name, query := range queries {
+		events := query(nostr.Filter{})
+		if len(events) == 0 {
+			t.Fatalf("%s: expected the saved events", name)
+		}
+		for _, stored := range events {
+			if len(stored.Tags) != 1 || stored.Tags[0][1] != "original" {
+				t.Errorf("%s: expected the stored tags to be unchanged, got %v", name, stored.Tags)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "github.com/nbd-wtf/go-nostr"
+
+// Clock tells the time to the buffers, see [WithClock].
+type Clock interface {
+	Now() nostr.Timestamp
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() nostr.Timestamp { return nostr.Now() }
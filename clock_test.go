@@ -0,0 +1,23 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fakeClock is a [Clock] that only moves when advanced.
+type fakeClock struct {
+	now atomic.Int64
+}
+
+func newFakeClock(now nostr.Timestamp) *fakeClock {
+	c := &fakeClock{}
+	c.now.Store(int64(now))
+	return c
+}
+
+func (c *fakeClock) Now() nostr.Timestamp { return nostr.Timestamp(c.now.Load()) }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now.Add(int64(d / time.Second)) }
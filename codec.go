@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Codec serializes the events written by [AtomicCircularBuffer2.Snapshot] and read by [AtomicCircularBuffer2.Load].
+// A snapshot is the sequence of the encoded events, so Decode must read exactly one event from r, leaving the
+// rest for the next call, and return io.EOF when there are no events left. The reader passed by Load is buffered.
+type Codec interface {
+	Encode(w io.Writer, evt *nostr.Event) error
+	Decode(r io.Reader) (*nostr.Event, error)
+}
+
+// JSONCodec is the default [Codec], which encodes every event as a line of JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(w io.Writer, evt *nostr.Event) error {
+	data, err := evt.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (JSONCodec) Decode(r io.Reader) (*nostr.Event, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	evt := &nostr.Event{}
+	if err := json.Unmarshal(line, evt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+	}
+	return evt, nil
+}
+
+// readLine reads r up to and including the next newline, returning the line without it.
+// The last line doesn't need to end with a newline. It returns io.EOF if r has no bytes left.
+// Readers other than a [bufio.Reader] are read one byte at a time, so that nothing after the line is consumed.
+func readLine(r io.Reader) ([]byte, error) {
+	if br, ok := r.(*bufio.Reader); ok {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 || (err != nil && err != io.EOF) {
+			return nil, err
+		}
+		return bytes.TrimSuffix(line, []byte{'\n'}), nil
+	}
+
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return line, nil
+			}
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line, nil
+		}
+		line = append(line, b[0])
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// lengthPrefixedCodec encodes every event as its JSON prefixed by its length.
+type lengthPrefixedCodec struct{}
+
+func (lengthPrefixedCodec) Encode(w io.Writer, evt *nostr.Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (lengthPrefixedCodec) Decode(r io.Reader) (*nostr.Event, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	evt := &nostr.Event{}
+	return evt, json.Unmarshal(data, evt)
+}
+
+func TestSnapshotLoad(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5)
+	for i := range 7 {
+		evt := createTimedEvent(fmt.Sprintf("id-%d", i), int64(1000+i))
+		evt.Content = fmt.Sprintf("line %d\nanother line", i)
+		evt.Tags = nostr.Tags{{"t", fmt.Sprintf("tag-%d", i)}}
+		cb.SaveEvent(ctx, evt)
+	}
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "id-4"})
+	expected := slices.Collect(cb.All())
+
+	codecs := map[string]Codec{
+		"default": nil,
+		"json":    JSONCodec{},
+		"custom":  lengthPrefixedCodec{},
+	}
+
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := cb.Snapshot(&buf, codec); err != nil {
+				t.Fatalf("Failed to write the snapshot: %v", err)
+			}
+
+			restored := NewAtomicCircularBuffer2(5)
+			n, err := restored.Load(ctx, &buf, codec)
+			if err != nil {
+				t.Fatalf("Failed to load the snapshot: %v", err)
+			}
+			if n != len(expected) {
+				t.Fatalf("Expected %d events to be loaded, got %d", len(expected), n)
+			}
+
+			got := slices.Collect(restored.All())
+			if len(got) != len(expected) {
+				t.Fatalf("Expected %v, got %v", ids(expected), ids(got))
+			}
+			for i, evt := range got {
+				if evt.String() != expected[i].String() {
+					t.Fatalf("Expected %s, got %s", expected[i], evt)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONCodecUnbufferedReader(t *testing.T) {
+	var buf bytes.Buffer
+	for i := range 2 {
+		if err := (JSONCodec{}).Encode(&buf, createTestEvent(fmt.Sprintf("id-%d", i), 1)); err != nil {
+			t.Fatalf("Failed to encode: %v", err)
+		}
+	}
+
+	// the reader is consumed line by line, so that every call decodes the next event
+	r := bytes.NewReader(buf.Bytes())
+	for i := range 2 {
+		evt, err := (JSONCodec{}).Decode(r)
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		if expected := fmt.Sprintf("id-%d", i); evt.ID != expected {
+			t.Fatalf("Expected %s, got %s", expected, evt.ID)
+		}
+	}
+	if _, err := (JSONCodec{}).Decode(r); err != io.EOF {
+		t.Fatalf("Expected io.EOF after the last event, got %v", err)
+	}
+}
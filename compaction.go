@@ -0,0 +1,119 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Compact removes the empty slots left by deleted events, moving the remaining events towards the head
+// while preserving their order, so that queries don't scan the empty slots and saves reuse them.
+// It returns the number of empty slots removed.
+//
+// Saves and deletes are blocked while compacting only if compaction is enabled with [WithCompaction],
+// otherwise Compact must not run concurrently with them. Queries are never blocked, but those running
+// concurrently with a compaction might see an event twice or miss one that is being moved.
+func (cb *AtomicCircularBuffer2) Compact() int {
+	cb.compactMu.Lock()
+	defer cb.compactMu.Unlock()
+
+	start, end := cb.bounds()
+
+	// move the events from the newest to the oldest, so that every event is written
+	// at or after its position, into a slot whose event was already moved
+	write := end
+	for read := end; read > start; read-- {
+		stored := cb.slot(read - 1).Load()
+		if stored == nil {
+			continue
+		}
+
+		// the sequence number moves with the event, so it keeps its order
+		write--
+		if write != read-1 {
+			cb.slot(write).Store(stored)
+		}
+	}
+
+	removed := int(write - start)
+	if removed == 0 {
+		return 0
+	}
+
+	for pos := start; pos < write; pos++ {
+		cb.slot(pos).Store(nil)
+	}
+	cb.span.Store(end - write)
+	cb.count.Store(end - write)
+
+	// the positions of the events have changed, so the index and the sorted range must be rebuilt
+	// the IDs are all added to the current generation of the bloom filter, as some events
+	// moved to positions that will be evicted after the previous generation is dropped
+	if cb.index != nil {
+		cb.index.reset()
+	}
+	if cb.times != nil {
+		cb.times.reset()
+	}
+	if cb.authors != nil {
+		cb.authors.reset()
+	}
+	if cb.order != nil {
+		cb.order.reset()
+	}
+	if cb.ids != nil {
+		cb.ids.reset()
+	}
+	cb.unsortedAt.Store(0)
+
+	var prev *nostr.Event
+	for pos := write; pos < end; pos++ {
+		evt := cb.slot(pos).Load().Event
+		if cb.index != nil {
+			cb.index.add(evt, pos)
+		}
+		if cb.times != nil {
+			cb.times.add(evt, pos, write)
+		}
+		if cb.authors != nil {
+			cb.authors.add(evt.PubKey, pos)
+		}
+		if cb.order != nil {
+			cb.order.add(evt, pos)
+		}
+		if cb.ids != nil {
+			cb.ids.add(evt.ID)
+		}
+		if prev != nil && evt.CreatedAt < prev.CreatedAt {
+			cb.unsortedAt.Store(pos + 1)
+		}
+		prev = evt
+	}
+
+	return removed
+}
+
+// Close stops the background compaction and sweeping of expired events, if enabled with [WithCompaction]
+// and [WithMaxAge]. The buffer remains usable, but it's no longer compacted nor swept automatically.
+func (cb *AtomicCircularBuffer2) Close() {
+	cb.closeOnce.Do(func() {
+		if cb.done != nil {
+			close(cb.done)
+		}
+	})
+}
+
+// compactLoop periodically compacts the buffer until it's closed.
+func (cb *AtomicCircularBuffer2) compactLoop() {
+	ticker := time.NewTicker(cb.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cb.done:
+			return
+		case <-ticker.C:
+			cb.Compact()
+		}
+	}
+}
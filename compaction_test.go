@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ids returns the IDs of the events
+func ids(events []*nostr.Event) []string {
+	ids := make([]string, len(events))
+	for i, evt := range events {
+		ids[i] = evt.ID
+	}
+	return ids
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+
+	evicted := 0
+	cb := NewAtomicCircularBuffer2(20, WithTagIndex(), WithOnEvict(func(*nostr.Event) { evicted++ }))
+	for i := range 20 {
+		cb.SaveEvent(ctx, createTaggedEvent(fmt.Sprintf("id-%d", i), 1, fmt.Sprintf("e-%d", i%2), "p"))
+	}
+
+	var expected []string
+	for i := range 20 {
+		if i%2 == 0 {
+			cb.DeleteEvent(ctx, &nostr.Event{ID: fmt.Sprintf("id-%d", i)})
+		} else {
+			expected = append(expected, fmt.Sprintf("id-%d", i))
+		}
+	}
+
+	if n := cb.Len(); n != 10 {
+		t.Fatalf("Expected the deleted events not to be counted, got %d", n)
+	}
+	if span := cb.span.Load(); span != 20 {
+		t.Fatalf("Expected the deleted events to leave 20 slots to scan, got %d", span)
+	}
+
+	if removed := cb.Compact(); removed != 10 {
+		t.Fatalf("Expected 10 empty slots to be removed, got %d", removed)
+	}
+	if span := cb.span.Load(); span != 10 {
+		t.Fatalf("Expected 10 slots to scan after compacting, got %d", span)
+	}
+	if n := cb.Len(); n != 10 {
+		t.Fatalf("Expected the events to be counted after compacting, got %d", n)
+	}
+
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	if !slices.Equal(ids(events), expected) {
+		t.Fatalf("Expected %v, got %v", expected, ids(events))
+	}
+
+	// the tag index must follow the events to their new positions
+	events, _ = cb.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"e": {"e-1"}}})
+	if !slices.Equal(ids(events), expected) {
+		t.Fatalf("Expected %v from the tag index, got %v", expected, ids(events))
+	}
+
+	if removed := cb.Compact(); removed != 0 {
+		t.Fatalf("Expected nothing to compact, got %d", removed)
+	}
+
+	// the freed slots are reused before evicting the oldest events
+	for i := 20; i < 35; i++ {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if evicted != 5 {
+		t.Fatalf("Expected 5 events to be evicted, got %d", evicted)
+	}
+
+	events, _ = cb.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 20 || events[0].ID != "id-11" || events[19].ID != "id-34" {
+		t.Fatalf("Expected id-11 to id-34, got %v", ids(events))
+	}
+}
+
+func TestCompactionLoop(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10, WithCompaction(5*time.Millisecond))
+	defer cb.Close()
+
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	for i := range 5 {
+		cb.DeleteEvent(ctx, &nostr.Event{ID: fmt.Sprintf("id-%d", i)})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for cb.Len() != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the buffer to be compacted, Len is %d", cb.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// saves keep working while the compaction runs
+	for i := 10; i < 30; i++ {
+		if err := cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1)); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 10 || events[0].ID != "id-20" || events[9].ID != "id-29" {
+		t.Fatalf("Expected id-20 to id-29, got %v", ids(events))
+	}
+}
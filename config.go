@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultAddr is the address the relay listens on, unless overridden
+// by the -addr flag or the LISTEN_ADDR environment variable (RELY_ADDR is also accepted).
+const defaultAddr = "localhost:3334"
+
+// defaultEphemeralImpl is the implementation of the ephemeral store, unless overridden
+// by the -ephemeral-impl flag or the RELY_EPHEMERAL_IMPL environment variable.
+const defaultEphemeralImpl = ImplAtomic2
+
+// defaultEphemeralCapacity is the number of events the ephemeral store holds, unless overridden
+// by the -ephemeral-capacity flag or the EPHEMERAL_CAPACITY environment variable
+// (RELY_EPHEMERAL_CAPACITY is also accepted).
+const defaultEphemeralCapacity = 500
+
+// defaultSQLitePath is the path of the SQLite database, unless overridden
+// by the -sqlite-path flag or the SQLITE_PATH environment variable (RELY_SQLITE_PATH is also accepted).
+const defaultSQLitePath = "./rely-sqlite.db"
+
+// defaultQueryTimeout is how long the queries of a REQ can run, unless overridden
+// by the -query-timeout flag or the RELY_QUERY_TIMEOUT environment variable.
+const defaultQueryTimeout = 10 * time.Second
+
+// defaultMinPoW is the minimum proof of work difficulty of the saved events, unless overridden
+// by the -min-pow flag or the RELY_MIN_POW environment variable.
+const defaultMinPoW = 0
+
+// Config is the configuration of the relay, see [loadConfig].
+type Config struct {
+	// Addr is the address the relay listens on.
+	Addr string
+
+	// EphemeralImpl is the implementation of the ephemeral store, see [NewEphemeralStore].
+	EphemeralImpl string
+
+	// EphemeralCapacity is the number of events the ephemeral store holds.
+	EphemeralCapacity int
+
+	// SQLitePath is the path of the SQLite database storing the regular and replaceable events.
+	SQLitePath string
+
+	// QueryTimeout is how long the queries of a REQ can run, see [QueryTimeout]. Zero means no timeout.
+	QueryTimeout time.Duration
+
+	// MinPoW is the minimum proof of work difficulty of the saved events, see [MinPoW]. Zero means no minimum.
+	MinPoW int
+}
+
+// loadConfig returns the configuration parsed from the command line arguments, without the program name.
+// Every flag defaults to its environment variable if set, otherwise to its default value,
+// so that flags take precedence over the environment. It returns an error if the arguments
+// or the environment variables can't be parsed, or if the configuration is invalid.
+func loadConfig(args []string) (Config, error) {
+	var cfg Config
+	capacity, err := envIntOr(envKey("EPHEMERAL_CAPACITY", "RELY_EPHEMERAL_CAPACITY"), defaultEphemeralCapacity)
+	if err != nil {
+		return Config{}, err
+	}
+	timeout, err := envDurationOr("RELY_QUERY_TIMEOUT", defaultQueryTimeout)
+	if err != nil {
+		return Config{}, err
+	}
+	minPoW, err := envIntOr("RELY_MIN_POW", defaultMinPoW)
+	if err != nil {
+		return Config{}, err
+	}
+
+	fs := flag.NewFlagSet("rely-evstore", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", envOr(envKey("LISTEN_ADDR", "RELY_ADDR"), defaultAddr), "address the relay listens on")
+	fs.StringVar(&cfg.EphemeralImpl, "ephemeral-impl", envOr("RELY_EPHEMERAL_IMPL", defaultEphemeralImpl),
+		"implementation of the ephemeral store: mutex, atomic1 or atomic2")
+	fs.IntVar(&cfg.EphemeralCapacity, "ephemeral-capacity", capacity, "number of events the ephemeral store holds")
+	fs.StringVar(&cfg.SQLitePath, "sqlite-path", envOr(envKey("SQLITE_PATH", "RELY_SQLITE_PATH"), defaultSQLitePath),
+		"path of the SQLite database")
+	fs.DurationVar(&cfg.QueryTimeout, "query-timeout", timeout, "how long the queries of a REQ can run, 0 for no timeout")
+	fs.IntVar(&cfg.MinPoW, "min-pow", minPoW, "minimum proof of work difficulty of the saved events (NIP-13), 0 for no minimum")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// validate returns an error if any setting of the configuration is invalid.
+// The implementation of the ephemeral store is checked by [NewEphemeralStore].
+func (cfg Config) validate() error {
+	if cfg.Addr == "" {
+		return errors.New("the address must not be empty")
+	}
+	if cfg.EphemeralCapacity <= 0 {
+		return fmt.Errorf("invalid ephemeral capacity: %w, got %d", ErrInvalidCapacity, cfg.EphemeralCapacity)
+	}
+	if cfg.SQLitePath == "" {
+		return errors.New("the SQLite path must not be empty")
+	}
+	if cfg.QueryTimeout < 0 {
+		return fmt.Errorf("invalid query timeout: negative duration %v", cfg.QueryTimeout)
+	}
+	if cfg.MinPoW < 0 || cfg.MinPoW > 256 {
+		return fmt.Errorf("invalid minimum proof of work: %d is not between 0 and 256 bits", cfg.MinPoW)
+	}
+	return nil
+}
+
+// envKey returns the first of the environment variables that is set and not empty, or the first one if none is.
+// It lets a setting be read from its documented variable, while still accepting the older RELY_ prefixed one.
+func envKey(keys ...string) string {
+	for _, key := range keys {
+		if os.Getenv(key) != "" {
+			return key
+		}
+	}
+	return keys[0]
+}
+
+// envOr returns the value of the environment variable, or fallback if it's not set.
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envIntOr returns the value of the environment variable parsed as an integer, or fallback if it's not set.
+func envIntOr(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: not an integer", key, value)
+	}
+	return n, nil
+}
+
+// envDurationOr returns the value of the environment variable parsed as a duration, or fallback if it's not set.
+func envDurationOr(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: not a duration", key, value)
+	}
+	return d, nil
+}
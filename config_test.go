@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defaults := Config{
+		Addr:              defaultAddr,
+		EphemeralImpl:     defaultEphemeralImpl,
+		EphemeralCapacity: defaultEphemeralCapacity,
+		SQLitePath:        defaultSQLitePath,
+		QueryTimeout:      defaultQueryTimeout,
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		expected Config
+	}{
+		{"defaults", nil, nil, defaults},
+		{
+			"environment",
+			map[string]string{"RELY_ADDR": ":8080", "RELY_EPHEMERAL_CAPACITY": "2000", "RELY_SQLITE_PATH": "/data/relay.db", "RELY_QUERY_TIMEOUT": "3s", "RELY_MIN_POW": "20"},
+			nil,
+			Config{Addr: ":8080", EphemeralImpl: defaultEphemeralImpl, EphemeralCapacity: 2000, SQLitePath: "/data/relay.db", QueryTimeout: 3 * time.Second, MinPoW: 20},
+		},
+		{
+			"flags override the environment",
+			map[string]string{"RELY_EPHEMERAL_CAPACITY": "2000", "RELY_SQLITE_PATH": "/data/relay.db", "RELY_QUERY_TIMEOUT": "3s", "RELY_MIN_POW": "20"},
+			[]string{"-ephemeral-capacity", "100", "-ephemeral-impl", ImplMutex, "-query-timeout", "0", "-min-pow", "8"},
+			Config{Addr: defaultAddr, EphemeralImpl: ImplMutex, EphemeralCapacity: 100, SQLitePath: "/data/relay.db", MinPoW: 8},
+		},
+		{"empty environment variables", map[string]string{"RELY_EPHEMERAL_CAPACITY": "", "RELY_SQLITE_PATH": ""}, nil, defaults},
+		{
+			"unprefixed environment",
+			map[string]string{"LISTEN_ADDR": ":8080", "EPHEMERAL_CAPACITY": "2000", "SQLITE_PATH": "/data/relay.db"},
+			nil,
+			Config{Addr: ":8080", EphemeralImpl: defaultEphemeralImpl, EphemeralCapacity: 2000, SQLitePath: "/data/relay.db", QueryTimeout: defaultQueryTimeout},
+		},
+		{
+			"unprefixed environment takes precedence",
+			map[string]string{"LISTEN_ADDR": ":8080", "RELY_ADDR": ":9090", "EPHEMERAL_CAPACITY": "2000", "RELY_EPHEMERAL_CAPACITY": "3000", "RELY_SQLITE_PATH": "/data/relay.db", "SQLITE_PATH": ""},
+			nil,
+			Config{Addr: ":8080", EphemeralImpl: defaultEphemeralImpl, EphemeralCapacity: 2000, SQLitePath: "/data/relay.db", QueryTimeout: defaultQueryTimeout},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := loadConfig(test.args)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cfg != test.expected {
+				t.Fatalf("Expected %+v, got %+v", test.expected, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		err  error
+	}{
+		{"zero capacity", nil, []string{"-ephemeral-capacity", "0"}, ErrInvalidCapacity},
+		{"negative capacity", nil, []string{"-ephemeral-capacity=-5"}, ErrInvalidCapacity},
+		{"zero capacity from the environment", map[string]string{"RELY_EPHEMERAL_CAPACITY": "0"}, nil, ErrInvalidCapacity},
+		{"capacity not a number", nil, []string{"-ephemeral-capacity", "many"}, nil},
+		{"capacity not a number in the environment", map[string]string{"RELY_EPHEMERAL_CAPACITY": "many"}, nil, nil},
+		{"capacity not a number in the unprefixed environment", map[string]string{"EPHEMERAL_CAPACITY": "many"}, nil, nil},
+		{"empty SQLite path", nil, []string{"-sqlite-path", ""}, nil},
+		{"empty address", nil, []string{"-addr="}, nil},
+		{"unknown flag", nil, []string{"-capacity", "10"}, nil},
+		{"negative query timeout", nil, []string{"-query-timeout=-1s"}, nil},
+		{"query timeout not a duration in the environment", map[string]string{"RELY_QUERY_TIMEOUT": "10"}, nil, nil},
+		{"negative minimum proof of work", nil, []string{"-min-pow=-1"}, nil},
+		{"minimum proof of work over 256 bits", nil, []string{"-min-pow", "257"}, nil},
+		{"minimum proof of work not a number in the environment", map[string]string{"RELY_MIN_POW": "high"}, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig(test.args)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
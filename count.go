@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CountEvents returns the number of events matching the filter, as needed to answer NIP-45 COUNT requests.
+// If the filter has a limit, the count stops there, returning at most the limit without scanning the rest of the buffer.
+// If ctx is cancelled during the scan, the context error is returned.
+// The counted events are not marked as returned, so they are not kept from the [LRU] eviction.
+// Invalid filters are rejected, see [NormalizeFilter].
+func (cb *AtomicCircularBuffer2) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	return cb.countEvents(ctx, filter, nil)
+}
+
+// countEvents is like [AtomicCircularBuffer2.CountEvents], but counts the scan in stats if not nil.
+func (cb *AtomicCircularBuffer2) countEvents(ctx context.Context, filter nostr.Filter, stats *QueryStats) (int64, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var count int64
+	start, end := cb.bounds()
+	err = cb.peek(ctx, filter, nil, start, end, stats, func(*StoredEvent) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// KindCounts returns the number of events of every kind in the buffer, from a single scan,
+// which is cheaper than counting the events of every kind with a query each.
+// Like the queries, it skips deleted and expired events. The range of events is fixed when the scan starts.
+func (cb *AtomicCircularBuffer2) KindCounts() map[int]int {
+	var cutoff nostr.Timestamp
+	if cb.maxAge > 0 {
+		cutoff = cb.expiration()
+	}
+
+	counts := make(map[int]int)
+	for evt := range cb.All() {
+		if evt.CreatedAt >= cutoff {
+			counts[evt.Kind]++
+		}
+	}
+	return counts
+}
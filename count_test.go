@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCountEvents(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10000)
+	for i := range 10000 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%2))
+	}
+
+	var stats QueryStats
+	count, err := cb.countEvents(ctx, nostr.Filter{Limit: 10}, &stats)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count != 10 {
+		t.Fatalf("Expected the count to stop at the limit of 10, got %d", count)
+	}
+	if stats.Scanned != 10 {
+		t.Fatalf("Expected the scan to stop after 10 positions, scanned %d", stats.Scanned)
+	}
+
+	tests := []struct {
+		filter   nostr.Filter
+		expected int64
+	}{
+		{nostr.Filter{}, 10000},
+		{nostr.Filter{Kinds: []int{1}}, 5000},
+		{nostr.Filter{Kinds: []int{1}, Limit: 100}, 100},
+		{nostr.Filter{Kinds: []int{7}, Limit: 100}, 0},
+	}
+	for _, test := range tests {
+		count, err := cb.CountEvents(ctx, test.filter)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if count != test.expected {
+			t.Fatalf("Filter %v: expected %d, got %d", test.filter, test.expected, count)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cb.CountEvents(cancelled, nostr.Filter{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the cancelled count to fail, got %v", err)
+	}
+}
+
+func TestKindCounts(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%4))
+	}
+
+	if got, expected := cb.KindCounts(), map[int]int{0: 25, 1: 25, 2: 25, 3: 25}; !maps.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// the wrap-around evicts the 30 oldest events, 8 of kind 0 and 1, 7 of kind 2 and 3
+	for i := range 30 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("new-%d", i), 7))
+	}
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "new-0"})
+
+	if got, expected := cb.KindCounts(), map[int]int{0: 17, 1: 17, 2: 18, 3: 18, 7: 29}; !maps.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	cb.Clear()
+	if got := cb.KindCounts(); len(got) != 0 {
+		t.Fatalf("Expected no kinds after Clear, got %v", got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DeleteByFilter removes all the events matching the filter, for example to purge the events of a spammer,
+// returning how many were removed. The limit of the filter is ignored. Like [AtomicCircularBuffer2.DeleteEvent],
+// the slots are left empty rather than compacted, and the removed events are no longer counted by Len, although
+// their slots are only reused once overwritten or the buffer compacted. It's safe to call concurrently with queries,
+// which stop returning each event as soon as it's deleted. If ctx is cancelled, the deletion stops returning the
+// context error, with the events already deleted staying deleted.
+// Invalid filters are rejected, see [NormalizeFilter].
+func (cb *AtomicCircularBuffer2) DeleteByFilter(ctx context.Context, filter nostr.Filter) (int, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
+	}
+
+	kinds := newKindMatcher(filter.Kinds)
+	removed := 0
+	defer func() {
+		if removed > 0 {
+			cb.version.Add(1)
+		}
+	}()
+
+	start, end := cb.bounds()
+	for pos := start; pos < end; pos++ {
+		if (pos-start)%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+
+		slot := cb.slot(pos)
+		stored := slot.Load()
+		if stored == nil || !matchEvent(stored.Event, filter, &kinds) {
+			continue
+		}
+
+		if slot.CompareAndSwap(stored, nil) {
+			if cb.index != nil {
+				cb.index.remove(stored.Event, pos)
+			}
+			if cb.authors != nil {
+				cb.authors.remove(stored.Event.PubKey, pos)
+			}
+			if cb.pins.contains(stored.Event.ID) {
+				cb.pins.remove(stored.Event.ID)
+			}
+			cb.uncount()
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDeleteByFilter(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(31, WithTagIndex(), WithQueryCache(10, time.Minute))
+	for i := range 30 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), i%3)
+		evt.PubKey = fmt.Sprintf("pk-%d", i%5)
+		cb.SaveEvent(ctx, evt)
+	}
+
+	// the cached result must not survive the deletion
+	if events, _ := cb.QueryEvents(ctx, nostr.Filter{Authors: []string{"spammer"}}); len(events) != 0 {
+		t.Fatalf("Expected no events from the spammer yet, got %d", len(events))
+	}
+	spam := createTestEvent("spam", 1)
+	spam.PubKey = "spammer"
+	cb.SaveEvent(ctx, spam)
+	cb.QueryEvents(ctx, nostr.Filter{Authors: []string{"spammer"}})
+
+	tests := []struct {
+		name    string
+		filter  nostr.Filter
+		removed int
+	}{
+		{"by author", nostr.Filter{Authors: []string{"spammer"}}, 1},
+		{"by author ignoring the limit", nostr.Filter{Authors: []string{"pk-0"}, Limit: 1}, 6},
+		{"by kind", nostr.Filter{Kinds: []int{2}}, 8},
+		{"nothing left to match", nostr.Filter{Kinds: []int{2}}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			removed, err := cb.DeleteByFilter(ctx, test.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if removed != test.removed {
+				t.Fatalf("Expected %d events to be removed, got %d", test.removed, removed)
+			}
+
+			test.filter.Limit = 0
+			events, err := cb.QueryEvents(ctx, test.filter)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(events) != 0 {
+				t.Fatalf("Expected the purged events not to be returned, got %v", ids(events))
+			}
+		})
+	}
+
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 30-6-8 {
+		t.Fatalf("Expected the other %d events to be left, got %d", 30-6-8, len(events))
+	}
+	if n, stats := cb.Len(), cb.Stats(); n != 30-6-8 || stats.Len != 30-6-8 {
+		t.Fatalf("Expected the purged events not to be counted, got Len %d and Stats().Len %d", n, stats.Len)
+	}
+	if err := cb.CheckIntegrity(); err != nil {
+		t.Fatalf("Unexpected integrity error: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cb.DeleteByFilter(cancelled, nostr.Filter{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the cancelled deletion to fail, got %v", err)
+	}
+}
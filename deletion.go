@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// deleter is implemented by the ephemeral stores that support deleting events.
+type deleter interface {
+	DeleteEvent(ctx context.Context, evt *nostr.Event) error
+}
+
+// handleDeletion applies the NIP-09 deletion request, deleting from the stores the events it references:
+//   - "e" tags reference events by ID, which must be a full lowercase hex ID;
+//   - "a" tags reference replaceable and addressable events by their kind:pubkey:d-tag coordinates,
+//     deleting all their versions up to the CreatedAt of the request;
+//   - "k" tags, if any, restrict the deletion to the events of those kinds.
+//
+// Only the events published by the author of the request are deleted, the other references are ignored.
+// Deletion requests are never deleted themselves. The ephemeral events are kept, and logged, when the
+// ephemeral store doesn't support deletions, see [deleter].
+func handleDeletion(ctx context.Context, deletion *nostr.Event) error {
+	// the store held by a StoreHolder is loaded once, so that its events are deleted from the store they were found in
+	current := loadEphemeralStore()
+
+	for _, filter := range deletionFilters(deletion) {
+		targets, err := queryDB(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		ephemeral, err := current.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, target := range targets {
+			if deletable(deletion, target) {
+				if err := db.DeleteEvent(ctx, target); err != nil {
+					return err
+				}
+				log.Printf("[DELETION] deleted: %s", target.ID)
+			}
+		}
+
+		store, ok := current.(deleter)
+		for _, target := range ephemeral {
+			if !deletable(deletion, target) {
+				continue
+			}
+			if !ok {
+				log.Printf("[DELETION] %s: the ephemeral store doesn't support deletions, keeping %s", deletion.ID, target.ID)
+				continue
+			}
+			if err := store.DeleteEvent(ctx, target); err != nil {
+				return err
+			}
+			log.Printf("[DELETION] deleted ephemeral: %s", target.ID)
+		}
+	}
+	return nil
+}
+
+// deletionFilters returns the filters matching the events referenced by the deletion request.
+// All the filters are restricted to the events of its author.
+func deletionFilters(deletion *nostr.Event) []nostr.Filter {
+	var kinds []int
+	for tag := range deletion.Tags.FindAll("k") {
+		if kind, err := strconv.Atoi(tag[1]); err == nil {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	var filters []nostr.Filter
+	var ids []string
+	for tag := range deletion.Tags.FindAll("e") {
+		// the stores match IDs by prefix, so anything but a full ID could delete unrelated events
+		if !nostr.IsValid32ByteHex(tag[1]) {
+			log.Printf("[DELETION] %s: ignoring %s, not an event ID", deletion.ID, tag[1])
+			continue
+		}
+		ids = append(ids, tag[1])
+	}
+	if len(ids) > 0 {
+		filters = append(filters, nostr.Filter{IDs: ids, Authors: []string{deletion.PubKey}, Kinds: kinds})
+	}
+
+	for tag := range deletion.Tags.FindAll("a") {
+		pointer, err := nostr.EntityPointerFromTag(tag)
+		if err != nil {
+			continue
+		}
+
+		if pointer.PublicKey != deletion.PubKey {
+			log.Printf("[DELETION] %s: ignoring %s, published by another author", deletion.ID, tag[1])
+			continue
+		}
+		if kinds != nil && !slices.Contains(kinds, pointer.Kind) {
+			continue
+		}
+
+		filter := nostr.Filter{
+			Kinds:   []int{pointer.Kind},
+			Authors: []string{pointer.PublicKey},
+			Until:   &deletion.CreatedAt,
+		}
+		if nostr.IsAddressableKind(pointer.Kind) {
+			filter.Tags = nostr.TagMap{"d": []string{pointer.Identifier}}
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// deletable reports whether the deletion request can delete the target event.
+func deletable(deletion, target *nostr.Event) bool {
+	return target.PubKey == deletion.PubKey && target.Kind != nostr.KindDeletion
+}
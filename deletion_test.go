@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+// namedID returns the full ID of the test event with the name
+func namedID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAuthoredEvent creates a test event published by pubkey at createdAt, with the provided tags
+func createAuthoredEvent(id string, kind int, pubkey string, createdAt int64, tags ...nostr.Tag) *nostr.Event {
+	evt := createTimedEvent(id, createdAt)
+	evt.Kind = kind
+	evt.PubKey = pubkey
+	evt.Tags = tags
+	return evt
+}
+
+func TestDeletion(t *testing.T) {
+	author, other := hexID(100), hexID(101)
+
+	tests := []struct {
+		name      string
+		deletion  *nostr.Event
+		remaining []string
+	}{
+		{
+			name:      "e tags",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("note")}, nostr.Tag{"e", namedID("ephemeral")}),
+			remaining: []string{"post-v1", "post-v2", "article", "other-note", "other-post"},
+		},
+		{
+			name:      "e tags restricted by k tags",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("note")}, nostr.Tag{"e", namedID("ephemeral")}, nostr.Tag{"k", "1"}),
+			remaining: []string{"post-v1", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+		{
+			name:      "a tag deletes the versions up to the request",
+			deletion:  createAuthoredEvent("deletion", 5, author, 250, nostr.Tag{"a", "30023:" + author + ":post"}),
+			remaining: []string{"note", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+		{
+			name:      "a tag of another author",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"a", "30023:" + other + ":post"}),
+			remaining: []string{"note", "post-v1", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+		{
+			name:      "e tag prefix",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("note")[:8]}, nostr.Tag{"e", namedID("ephemeral")[:8]}),
+			remaining: []string{"note", "post-v1", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+		{
+			name:      "e tag uppercase",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", strings.ToUpper(namedID("note"))}),
+			remaining: []string{"note", "post-v1", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+		{
+			name:      "e tag of another author",
+			deletion:  createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("other-note")}),
+			remaining: []string{"note", "post-v1", "post-v2", "article", "other-note", "other-post", "ephemeral"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &mockStore{events: []*nostr.Event{
+				createAuthoredEvent(namedID("note"), 1, author, 100),
+				createAuthoredEvent(namedID("post-v1"), 30023, author, 100, nostr.Tag{"d", "post"}),
+				createAuthoredEvent(namedID("post-v2"), 30023, author, 300, nostr.Tag{"d", "post"}),
+				createAuthoredEvent(namedID("article"), 30023, author, 100, nostr.Tag{"d", "article"}),
+				createAuthoredEvent(namedID("other-note"), 1, other, 100),
+				createAuthoredEvent(namedID("other-post"), 30023, other, 100, nostr.Tag{"d", "post"}),
+			}}
+			ephemeral := NewAtomicCircularBuffer2(10)
+			ephemeral.SaveEvent(context.Background(), createAuthoredEvent(namedID("ephemeral"), 20000, author, 100))
+			setupStores(t, store, ephemeral)
+
+			if err := Save(&rely.Client{}, test.deletion); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+			remaining := append(ids(store.events), ids(stored)...)
+
+			// the deletion request itself is kept
+			expected := []string{"deletion"}
+			for _, name := range test.remaining {
+				expected = append(expected, namedID(name))
+			}
+			slices.Sort(expected)
+			slices.Sort(remaining)
+			if !slices.Equal(remaining, expected) {
+				t.Fatalf("expected %v to remain, got %v", expected, remaining)
+			}
+		})
+	}
+}
+
+func TestDeletionThroughStoreHolder(t *testing.T) {
+	ctx := context.Background()
+	author := hexID(100)
+
+	ephemeral := NewAtomicCircularBuffer2(10)
+	ephemeral.SaveEvent(ctx, createAuthoredEvent(namedID("ephemeral"), 20000, author, 100))
+	ephemeral.SaveEvent(ctx, createAuthoredEvent(namedID("kept"), 20000, author, 100))
+	setupStores(t, &mockStore{}, NewStoreHolder(ephemeral))
+
+	deletion := createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("ephemeral")})
+	if err := Save(&rely.Client{}, deletion); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored, _ := ephemeral.QueryEvents(ctx, nostr.Filter{})
+	if remaining := ids(stored); !slices.Equal(remaining, []string{namedID("kept")}) {
+		t.Fatalf("expected only the event not referenced to remain, got %v", remaining)
+	}
+}
+
+func TestDeletionUnsupportedStore(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx := context.Background()
+	author := hexID(100)
+
+	ephemeral := NewCircularBuffer(10)
+	ephemeral.SaveEvent(ctx, createAuthoredEvent(namedID("ephemeral"), 20000, author, 100))
+	setupStores(t, &mockStore{}, collectingStore{ephemeral})
+
+	deletion := createAuthoredEvent("deletion", 5, author, 500, nostr.Tag{"e", namedID("ephemeral")})
+	if err := Save(&rely.Client{}, deletion); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "the ephemeral store doesn't support deletions, keeping " + namedID("ephemeral")
+	if !strings.Contains(logs.String(), expected) {
+		t.Fatalf("expected the kept event to be logged, got %q", logs.String())
+	}
+}
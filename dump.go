@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DumpJSON writes the events matching the filter to w as a JSON array, from the oldest to the newest.
+// Events are marshaled and written one at a time, so the whole array is never held in memory.
+// It's meant for debugging endpoints, for example to inspect the content of the ephemeral store.
+func (cb *AtomicCircularBuffer2) DumpJSON(w io.Writer, filter nostr.Filter) error {
+	events, err := cb.QueryEvents(context.Background(), filter)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	for i, evt := range events {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		data, err := evt.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal event %s: %w", evt.ID, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "]")
+	return err
+}
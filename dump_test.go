@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDumpJSON(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 5 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), i%2)
+		evt.Content = fmt.Sprintf("content with \"quotes\" %d", i)
+		cb.SaveEvent(ctx, evt)
+	}
+
+	tests := []struct {
+		filter   nostr.Filter
+		expected []string
+	}{
+		{nostr.Filter{}, []string{"id-0", "id-1", "id-2", "id-3", "id-4"}},
+		{nostr.Filter{Kinds: []int{1}}, []string{"id-1", "id-3"}},
+		{nostr.Filter{Kinds: []int{7}}, nil},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := cb.DumpJSON(&buf, test.filter); err != nil {
+			t.Fatalf("Failed to dump events: %v", err)
+		}
+
+		var events []nostr.Event
+		if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", buf.String(), err)
+		}
+
+		if len(events) != len(test.expected) {
+			t.Fatalf("filter %v: expected %v, got %d events", test.filter, test.expected, len(events))
+		}
+		for i, evt := range events {
+			if evt.ID != test.expected[i] {
+				t.Fatalf("filter %v: expected %v, got %s at %d", test.filter, test.expected, evt.ID, i)
+			}
+			if evt.Content != fmt.Sprintf("content with \"quotes\" %s", evt.ID[3:]) {
+				t.Fatalf("Unexpected content %q for %s", evt.Content, evt.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultFlushInterval is the flush interval used by [DurableBuffer] when none is specified.
+const DefaultFlushInterval = 100 * time.Millisecond
+
+const (
+	currentLogName  = "current.wal"
+	previousLogName = "previous.wal"
+)
+
+// DurableBuffer wraps an [AtomicCircularBuffer2] whose events are also appended to an on-disk log,
+// so that the most recent events survive a crash or a restart.
+//
+// Writes to the log are batched and flushed every flush interval, which means that events saved
+// in the last interval before a crash can be lost. The log is made of two segments of at most
+// capacity events each: when the current segment is full it becomes the previous one, so the disk usage is bounded.
+// Removing events from the buffer rewrites the log at the next flush, so that they are not replayed after a restart.
+//
+// Only the methods that keep the log in sync with the buffer are exposed.
+type DurableBuffer struct {
+	buffer *AtomicCircularBuffer2
+
+	dir      string
+	capacity int
+
+	mu      sync.Mutex
+	pending []*nostr.Event
+	file    *os.File
+	written int  // number of events in the current segment
+	rewrite bool // whether events were removed since the last flush
+
+	interval  time.Duration
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewDurableBuffer creates a DurableBuffer storing its log in dir, and rehydrates it
+// with the most recent events found in the log.
+func NewDurableBuffer(dir string, capacity int, flushInterval time.Duration, opts ...BufferOption) (*DurableBuffer, error) {
+	buffer, err := NewAtomicCircularBuffer2E(capacity, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		buffer.Close()
+		return nil, fmt.Errorf("failed to create the log directory: %w", err)
+	}
+
+	d := &DurableBuffer{
+		buffer:   buffer,
+		dir:      dir,
+		capacity: capacity,
+		interval: flushInterval,
+		done:     make(chan struct{}),
+	}
+
+	if err := d.replay(); err != nil {
+		buffer.Close()
+		return nil, err
+	}
+
+	file, err := os.OpenFile(d.path(currentLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		buffer.Close()
+		return nil, fmt.Errorf("failed to open the log: %w", err)
+	}
+	d.file = file
+
+	d.wg.Add(1)
+	go d.flushLoop()
+	return d, nil
+}
+
+// SaveEvent adds the event to the buffer and schedules it to be appended to the log.
+func (d *DurableBuffer) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := d.buffer.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+
+	d.schedule(evt)
+	return nil
+}
+
+// SaveEvents adds the events to the buffer, see [AtomicCircularBuffer2.SaveEvents],
+// and schedules the stored ones to be appended to the log.
+func (d *DurableBuffer) SaveEvents(ctx context.Context, events []*nostr.Event) (int, error) {
+	stored, err := d.buffer.saveEvents(ctx, events)
+	d.schedule(stored...)
+	return len(stored), err
+}
+
+// schedule adds copies of the events to the ones to append to the log at the next flush,
+// so that later changes by the caller are not persisted.
+func (d *DurableBuffer) schedule(events ...*nostr.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, evt := range events {
+		d.pending = append(d.pending, cloneEvent(evt))
+	}
+	if len(d.pending) > d.capacity {
+		// older events would be evicted on replay anyway
+		clear(d.pending[:len(d.pending)-d.capacity])
+		d.pending = d.pending[len(d.pending)-d.capacity:]
+	}
+}
+
+// QueryEvents returns the events in the buffer matching the filter, see [AtomicCircularBuffer2.QueryEvents].
+func (d *DurableBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	return d.buffer.QueryEvents(ctx, filter)
+}
+
+// QueryEventsOrdered returns the events in the buffer matching the filter sorted by CreatedAt,
+// see [AtomicCircularBuffer2.QueryEventsOrdered].
+func (d *DurableBuffer) QueryEventsOrdered(ctx context.Context, filter nostr.Filter, opts QueryOptions) ([]*nostr.Event, error) {
+	return d.buffer.QueryEventsOrdered(ctx, filter, opts)
+}
+
+// Len returns the number of events in the buffer, see [AtomicCircularBuffer2.Len].
+func (d *DurableBuffer) Len() int {
+	return d.buffer.Len()
+}
+
+// DeleteEvent removes the event with the same ID from the buffer, if present, and from the log at the next flush.
+func (d *DurableBuffer) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := d.buffer.DeleteEvent(ctx, evt); err != nil {
+		return err
+	}
+
+	d.markRemoved()
+	return nil
+}
+
+// DeleteByFilter removes the events matching the filter from the buffer, see [AtomicCircularBuffer2.DeleteByFilter],
+// and from the log at the next flush.
+func (d *DurableBuffer) DeleteByFilter(ctx context.Context, filter nostr.Filter) (int, error) {
+	n, err := d.buffer.DeleteByFilter(ctx, filter)
+	if n > 0 {
+		d.markRemoved()
+	}
+	return n, err
+}
+
+// Clear removes all the events from the buffer, see [AtomicCircularBuffer2.Clear], and from the log at the next flush.
+func (d *DurableBuffer) Clear() {
+	d.buffer.Clear()
+	d.markRemoved()
+}
+
+// markRemoved schedules the log to be rewritten with the events in the buffer at the next flush,
+// as some were removed from it.
+func (d *DurableBuffer) markRemoved() {
+	d.mu.Lock()
+	d.rewrite = true
+	d.mu.Unlock()
+}
+
+// Flush writes the pending events to the log and syncs it to disk.
+// If events were removed from the buffer since the last flush, the log is rewritten with the events in the buffer.
+func (d *DurableBuffer) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rewrite {
+		return d.rewriteLog()
+	}
+
+	if len(d.pending) == 0 {
+		return nil
+	}
+
+	w := bufio.NewWriter(d.file)
+	for _, evt := range d.pending {
+		if d.written >= d.capacity {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if err := d.rotate(); err != nil {
+				return err
+			}
+			w.Reset(d.file)
+		}
+
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", evt.ID, err)
+		}
+
+		w.Write(line)
+		w.WriteByte('\n')
+		d.written++
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	clear(d.pending)
+	d.pending = d.pending[:0]
+	return d.file.Sync()
+}
+
+// rewriteLog replaces the log with a single segment holding the events in the buffer, which include the pending ones.
+// The previous segment is removed before the new one replaces the current segment, so that a crash in between can lose
+// the events of the previous segment, but never replay the removed events.
+// It must be called with the lock held.
+func (d *DurableBuffer) rewriteLog() error {
+	tmp := d.path(currentLogName + ".tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the log: %w", err)
+	}
+
+	written, err := writeLog(file, d.buffer.All())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(d.path(previousLogName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the previous log: %w", err)
+	}
+	if err := os.Rename(tmp, d.path(currentLogName)); err != nil {
+		return fmt.Errorf("failed to rewrite the log: %w", err)
+	}
+
+	// the renamed segment replaces the current one, which is reopened to keep appending to it
+	current, err := os.OpenFile(d.path(currentLogName), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the log: %w", err)
+	}
+	d.file.Close()
+
+	d.file = current
+	d.written = written
+	d.rewrite = false
+	clear(d.pending)
+	d.pending = d.pending[:0]
+	return nil
+}
+
+// writeLog writes the events to the file, one JSON per line, and syncs it to disk.
+// It returns the number of events written.
+func writeLog(file *os.File, events iter.Seq[*nostr.Event]) (int, error) {
+	w := bufio.NewWriter(file)
+	written := 0
+	for evt := range events {
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return written, fmt.Errorf("failed to encode event %s: %w", evt.ID, err)
+		}
+
+		w.Write(line)
+		w.WriteByte('\n')
+		written++
+	}
+
+	if err := w.Flush(); err != nil {
+		return written, err
+	}
+	return written, file.Sync()
+}
+
+// Close stops the background flushing, flushes the pending events and closes the log.
+// Calling it more than once returns the result of the first call.
+func (d *DurableBuffer) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+		d.buffer.Close()
+
+		err := d.Flush()
+		d.closeErr = errors.Join(err, d.file.Close())
+	})
+	return d.closeErr
+}
+
+// flushLoop periodically flushes the pending events until the buffer is closed.
+func (d *DurableBuffer) flushLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+
+		case <-ticker.C:
+			if err := d.Flush(); err != nil {
+				log.Printf("[ERROR] flushing the ephemeral log: %v", err)
+			}
+		}
+	}
+}
+
+// rotate turns the current segment into the previous one and starts a new current segment.
+// It must be called with the lock held.
+func (d *DurableBuffer) rotate() error {
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(d.path(currentLogName), d.path(previousLogName)); err != nil {
+		return fmt.Errorf("failed to rotate the log: %w", err)
+	}
+
+	file, err := os.OpenFile(d.path(currentLogName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the log: %w", err)
+	}
+
+	d.file = file
+	d.written = 0
+	return nil
+}
+
+// replay loads the events of the previous and current segments into the buffer, oldest first.
+// Lines that can't be decoded (e.g. one truncated by a crash) are skipped, and so are the events
+// already loaded, which a save concurrent with a rewrite of the log can leave twice in it.
+func (d *DurableBuffer) replay() error {
+	ctx := context.Background()
+	loaded := make(map[string]struct{})
+
+	for _, name := range []string{previousLogName, currentLogName} {
+		events, err := readLog(d.path(name))
+		if err != nil {
+			return err
+		}
+
+		for _, evt := range events {
+			if _, ok := loaded[evt.ID]; ok {
+				continue
+			}
+			loaded[evt.ID] = struct{}{}
+
+			if err := d.buffer.SaveEvent(ctx, evt); err != nil {
+				return err
+			}
+		}
+
+		if name == currentLogName {
+			d.written = len(events)
+		}
+	}
+	return nil
+}
+
+// readLog returns the events stored in the log segment at path, if it exists.
+func readLog(path string) ([]*nostr.Event, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the log: %w", err)
+	}
+	defer file.Close()
+
+	var events []*nostr.Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		evt := &nostr.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), evt); err != nil {
+			log.Printf("[WARN] skipping malformed line in %s: %v", path, err)
+			continue
+		}
+		events = append(events, evt)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the log: %w", err)
+	}
+	return events, nil
+}
+
+// path returns the path of the log segment with the provided name.
+func (d *DurableBuffer) path(name string) string {
+	return filepath.Join(d.dir, name)
+}
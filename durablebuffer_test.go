@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDurableBufferRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	buffer, err := NewDurableBuffer(dir, 5, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+
+	for i := range 12 {
+		if err := buffer.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000)); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+
+	// give the background loop the chance to flush part of the events
+	time.Sleep(30 * time.Millisecond)
+	if err := buffer.SaveEvent(ctx, createTestEvent("id-12", 20000)); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Failed to close durable buffer: %v", err)
+	}
+
+	// simulate a restart
+	restarted, err := NewDurableBuffer(dir, 5, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to reopen durable buffer: %v", err)
+	}
+	defer restarted.Close()
+
+	events, err := restarted.QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events after restart, got %d", len(events))
+	}
+
+	for i, evt := range events {
+		expected := fmt.Sprintf("id-%d", 8+i)
+		if evt.ID != expected {
+			t.Errorf("Event %d: expected %s, got %s", i, expected, evt.ID)
+		}
+	}
+}
+
+func TestDurableBufferBoundedLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	buffer, err := NewDurableBuffer(dir, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+
+	for i := range 10 {
+		buffer.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000))
+		if err := buffer.Flush(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	buffer.Close()
+
+	total := 0
+	for _, name := range []string{currentLogName, previousLogName} {
+		events, err := readLog(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		total += len(events)
+	}
+
+	if total > 6 {
+		t.Fatalf("Expected at most 2*capacity events on disk, got %d", total)
+	}
+}
+
+func TestDurableBufferSkipsTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"id":"id-0","pubkey":"pk","created_at":1,"kind":20000,"tags":[],"content":"","sig":""}` + "\n" + `{"id":"id-1","pub`
+	if err := os.WriteFile(filepath.Join(dir, currentLogName), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer, err := NewDurableBuffer(dir, 5, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	events, _ := buffer.QueryEvents(context.Background(), nostr.Filter{})
+	if len(events) != 1 || events[0].ID != "id-0" {
+		t.Fatalf("Expected only the valid event to be replayed, got %v", events)
+	}
+}
+
+// reopen closes the durable buffer and opens a new one on the same directory, simulating a restart
+func reopen(t *testing.T, buffer *DurableBuffer, dir string, capacity int) *DurableBuffer {
+	t.Helper()
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Failed to close durable buffer: %v", err)
+	}
+
+	restarted, err := NewDurableBuffer(dir, capacity, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to reopen durable buffer: %v", err)
+	}
+	t.Cleanup(func() { restarted.Close() })
+	return restarted
+}
+
+func TestDurableBufferSaveEvents(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	buffer, err := NewDurableBuffer(dir, 5, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+
+	batch := []*nostr.Event{createTestEvent("id-0", 20000), createTestEvent("id-1", 20000), createTestEvent("id-2", 20000)}
+	if n, err := buffer.SaveEvents(ctx, batch); n != 3 || err != nil {
+		t.Fatalf("Expected the 3 events to be saved, got %d (%v)", n, err)
+	}
+
+	// changes by the caller after the save must not be persisted
+	batch[0].Content = "changed"
+
+	restarted := reopen(t, buffer, dir, 5)
+	events, _ := restarted.QueryEvents(ctx, nostr.Filter{})
+	if got := ids(events); !slices.Equal(got, []string{"id-0", "id-1", "id-2"}) {
+		t.Fatalf("Expected the batch to be replayed, got %v", got)
+	}
+	if events[0].Content != "test content id-0" {
+		t.Fatalf("Expected the saved content to be persisted, got %q", events[0].Content)
+	}
+}
+
+func TestDurableBufferSaveEventsPartial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+
+	// the first eviction cancels the batch, which is saved one event at a time while an event is pinned
+	buffer, err := NewDurableBuffer(dir, 4, time.Hour, WithOnEvict(func(*nostr.Event) { cancel() }))
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+	for i := range 4 {
+		buffer.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000))
+	}
+	if err := buffer.buffer.Pin("id-0"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+
+	batch := make([]*nostr.Event, 6)
+	for i := range batch {
+		batch[i] = createTestEvent(fmt.Sprintf("batch-%d", i), 20000)
+	}
+	n, err := buffer.SaveEvents(ctx, batch)
+	if n != 1 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected 1 event to be saved before the cancellation, got %d (%v)", n, err)
+	}
+
+	// only the event actually stored is logged: the last events fitting in the buffer start at batch-2
+	restarted := reopen(t, buffer, dir, 4)
+	events, _ := restarted.QueryEvents(context.Background(), nostr.Filter{})
+	if got := ids(events); !slices.Contains(got, "batch-2") || slices.Contains(got, "batch-5") {
+		t.Fatalf("Expected batch-2 to be replayed instead of batch-5, got %v", got)
+	}
+}
+
+func TestDurableBufferRemovals(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		remove   func(*DurableBuffer)
+		expected []string
+	}{
+		{
+			name:     "delete event",
+			remove:   func(d *DurableBuffer) { d.DeleteEvent(ctx, &nostr.Event{ID: "id-2"}) },
+			expected: []string{"id-3", "id-4", "id-5"},
+		},
+		{
+			name:     "delete by filter",
+			remove:   func(d *DurableBuffer) { d.DeleteByFilter(ctx, nostr.Filter{IDs: []string{"id-2", "id-4"}}) },
+			expected: []string{"id-3", "id-5"},
+		},
+		{
+			name:     "clear",
+			remove:   func(d *DurableBuffer) { d.Clear() },
+			expected: []string{"id-5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			buffer, err := NewDurableBuffer(dir, 4, time.Hour)
+			if err != nil {
+				t.Fatalf("Failed to create durable buffer: %v", err)
+			}
+
+			// the removed events are both in the segments and pending. The deleted events keep their slot
+			// until it's overwritten, so saving id-5 evicts id-1
+			for i := range 4 {
+				buffer.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000))
+				buffer.Flush()
+			}
+			buffer.SaveEvent(ctx, createTestEvent("id-4", 20000))
+
+			test.remove(buffer)
+			buffer.SaveEvent(ctx, createTestEvent("id-5", 20000))
+
+			restarted := reopen(t, buffer, dir, 4)
+			events, _ := restarted.QueryEvents(ctx, nostr.Filter{})
+			if got := ids(events); !slices.Equal(got, test.expected) {
+				t.Fatalf("Expected %v after the restart, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestDurableBufferCloseTwice(t *testing.T) {
+	buffer, err := NewDurableBuffer(t.TempDir(), 5, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create durable buffer: %v", err)
+	}
+
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Failed to close durable buffer: %v", err)
+	}
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Expected the second close to do nothing, got %v", err)
+	}
+}
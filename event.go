@@ -0,0 +1,20 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// cloneEvent returns a deep copy of the event, so that the buffers own the events they store
+// and callers can reuse or modify the saved ones. Strings are immutable, so only the tags are copied.
+func cloneEvent(evt *nostr.Event) *nostr.Event {
+	clone := *evt
+	if evt.Tags != nil {
+		clone.Tags = make(nostr.Tags, len(evt.Tags))
+		for i, tag := range evt.Tags {
+			clone.Tags[i] = slices.Clone(tag)
+		}
+	}
+	return &clone
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+)
+
+// Exists reports whether the event with the ID is in the buffer. Unlike a query for the ID, it doesn't copy
+// the event and returns at the first match. Only full IDs are matched, not prefixes.
+// With [WithIDBloomFilter], the IDs that are not in the buffer are answered without scanning it,
+// otherwise the buffer is scanned from the newest event. It returns false if ctx is cancelled before the
+// event is found.
+func (cb *AtomicCircularBuffer2) Exists(ctx context.Context, id string) bool {
+	if cb.ids != nil && len(id) == 64 && !cb.ids.mayContain(id) {
+		return false
+	}
+
+	start, end := cb.bounds()
+	for pos := end; pos > start; pos-- {
+		if (end-pos)%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return false
+		}
+		if stored := cb.slot(pos - 1).Load(); stored != nil && stored.Event.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]BufferOption{
+		"scan":  nil,
+		"bloom": {WithIDBloomFilter()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(100, opts...)
+			for i := range 250 {
+				cb.SaveEvent(ctx, createTestEvent(hexID(i), 1))
+			}
+			cb.DeleteEvent(ctx, &nostr.Event{ID: hexID(200)})
+
+			tests := []struct {
+				name     string
+				id       string
+				expected bool
+			}{
+				{"newest", hexID(249), true},
+				{"oldest", hexID(150), true},
+				{"recently evicted", hexID(149), false},
+				{"long evicted", hexID(0), false},
+				{"deleted", hexID(200), false},
+				{"never saved", hexID(1000), false},
+				{"prefix", hexID(249)[:10], false},
+			}
+
+			for _, test := range tests {
+				if got := cb.Exists(ctx, test.id); got != test.expected {
+					t.Fatalf("%s: expected %v, got %v", test.name, test.expected, got)
+				}
+			}
+
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			if cb.Exists(cancelled, hexID(249)) {
+				t.Fatal("Expected a cancelled context to stop the scan")
+			}
+		})
+	}
+}
+
+// BenchmarkExists tests checking for IDs that are not in the buffer, the common case when syncing with another relay
+func BenchmarkExists(b *testing.B) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]BufferOption{
+		"scan":  nil,
+		"bloom": {WithIDBloomFilter()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			cb := NewAtomicCircularBuffer2(10000, opts...)
+			for i := range 10000 {
+				cb.SaveEvent(ctx, createTestEvent(hexID(i), 1))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cb.Exists(ctx, hexID(10000+i))
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// expiration returns the CreatedAt before which events are expired, see [WithMaxAge].
+func (cb *AtomicCircularBuffer2) expiration() nostr.Timestamp {
+	return cb.clock.Now() - nostr.Timestamp(cb.maxAge/time.Second)
+}
+
+// sweepExpired empties the slots of the expired events, returning how many were removed.
+// Like deleted events, they are no longer counted by Len, but their slots are only reused once overwritten
+// or the buffer compacted.
+func (cb *AtomicCircularBuffer2) sweepExpired() int {
+	if cb.compactInterval > 0 {
+		cb.compactMu.RLock()
+		defer cb.compactMu.RUnlock()
+	}
+
+	cutoff := cb.expiration()
+	removed := 0
+
+	start, end := cb.bounds()
+	for pos := start; pos < end; pos++ {
+		slot := cb.slot(pos)
+		stored := slot.Load()
+		if stored == nil || stored.Event.CreatedAt >= cutoff {
+			continue
+		}
+
+		if slot.CompareAndSwap(stored, nil) {
+			if cb.index != nil {
+				cb.index.remove(stored.Event, pos)
+			}
+			if cb.authors != nil {
+				cb.authors.remove(stored.Event.PubKey, pos)
+			}
+			cb.uncount()
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		cb.version.Add(1)
+	}
+	return removed
+}
+
+// sweepLoop periodically removes the expired events until the buffer is closed.
+func (cb *AtomicCircularBuffer2) sweepLoop() {
+	ticker := time.NewTicker(max(cb.maxAge/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cb.done:
+			return
+		case <-ticker.C:
+			cb.sweepExpired()
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMaxAge(t *testing.T) {
+	ctx := context.Background()
+	clock := newFakeClock(10000)
+	cb := NewAtomicCircularBuffer2(10, WithMaxAge(time.Minute), WithTagIndex(), WithClock(clock))
+	defer cb.Close()
+
+	for _, e := range []struct {
+		id  string
+		age time.Duration
+	}{
+		{"expired", 2 * time.Minute},
+		{"old", 50 * time.Second},
+		{"new", 0},
+	} {
+		evt := createTimedEvent(e.id, int64(clock.Now())-int64(e.age/time.Second))
+		evt.Tags = nostr.Tags{{"t", "tag"}}
+		cb.SaveEvent(ctx, evt)
+	}
+
+	query := func(filter nostr.Filter) []string {
+		t.Helper()
+		events, err := cb.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return ids(events)
+	}
+
+	if got := query(nostr.Filter{}); len(got) != 2 || got[0] != "old" || got[1] != "new" {
+		t.Fatalf("expected the expired event to be skipped, got %v", got)
+	}
+	if got := query(nostr.Filter{Since: timestamp(0)}); len(got) != 2 {
+		t.Fatalf("expected an earlier since not to include expired events, got %v", got)
+	}
+
+	// after 20 seconds, the old event expires as well, including for indexed queries
+	clock.Advance(20 * time.Second)
+	if got := query(nostr.Filter{Tags: nostr.TagMap{"t": {"tag"}}}); len(got) != 1 || got[0] != "new" {
+		t.Fatalf("expected only the new event, got %v", got)
+	}
+
+	if removed := cb.sweepExpired(); removed != 2 {
+		t.Fatalf("expected the sweeper to remove 2 events, removed %d", removed)
+	}
+	if n := len(slices.Collect(cb.All())); n != 1 {
+		t.Fatalf("expected 1 event left in the buffer, got %d", n)
+	}
+	if err := cb.CheckIntegrity(); err != nil {
+		t.Fatalf("unexpected integrity error: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ExtendedFilter is a [nostr.Filter] with additional constraints that are not part of NIP-01.
+// The extended constraints are applied after the standard matching, and always take precedence:
+// an event both included and excluded by the filter is excluded.
+type ExtendedFilter struct {
+	nostr.Filter
+
+	// ExcludeKinds rejects the events with any of these kinds.
+	ExcludeKinds []int
+
+	// ExcludeAuthors rejects the events published by any of these pubkeys, regardless of their case.
+	ExcludeAuthors []string
+
+	// AllTags requires, for every tag name, that all the listed values are present among the event's tags
+	// with that name, unlike the Tags of the filter which are satisfied by any of the values.
+	AllTags map[string][]string
+
+	// PatternTags requires, for every tag name, that any of the listed patterns matches the value of a tag
+	// with that name. A pattern ending in "*" matches the values starting with the rest of it, for example
+	// "nostr*" matches "nostr" and "nostrdev", while other patterns must be equal to the value.
+	PatternTags map[string][]string
+
+	// TagPresence makes a tag name listed in the Tags of the filter without any value, as in {"#t": []},
+	// require the event to have at least one tag with that name, whatever its value.
+	// By default such a filter matches no event, as required by NIP-01 (see [NormalizeFilter]).
+	TagPresence bool
+
+	// present holds the tag names that must be present, moved out of the Tags by prepare
+	present []string
+}
+
+// prepare returns the filter ready to be matched. The excluded authors are lowercased, like the Authors of the
+// embedded filter by [NormalizeFilter]. If TagPresence is set, the tag names without values are moved from the
+// Tags of the embedded filter to the names that must be present.
+// The slices and maps of the original filter are never modified.
+func (f ExtendedFilter) prepare() ExtendedFilter {
+	f.ExcludeAuthors = lowercased(f.ExcludeAuthors)
+	if !f.TagPresence {
+		return f
+	}
+
+	f.present = nil
+	for name, values := range f.Filter.Tags {
+		if len(values) == 0 {
+			f.present = append(f.present, name)
+		}
+	}
+
+	if len(f.present) > 0 {
+		f.Filter.Tags = cloneTagMap(f.Filter.Tags)
+		for _, name := range f.present {
+			delete(f.Filter.Tags, name)
+		}
+	}
+	return f
+}
+
+// accepts reports whether the event, which already matched the embedded filter, satisfies the extended constraints.
+func (f ExtendedFilter) accepts(evt *nostr.Event) bool {
+	if len(f.ExcludeKinds) > 0 && slices.Contains(f.ExcludeKinds, evt.Kind) {
+		return false
+	}
+
+	if len(f.ExcludeAuthors) > 0 && slices.Contains(f.ExcludeAuthors, evt.PubKey) {
+		return false
+	}
+
+	for _, name := range f.present {
+		if !hasTagName(evt, name) {
+			return false
+		}
+	}
+
+	return eventMatchesFilterAll(evt, f.AllTags) && eventMatchesPatterns(evt, f.PatternTags)
+}
+
+// eventMatchesFilterAll reports whether the event has, for every tag name, all the values listed for it.
+// An empty requirement is always satisfied.
+func eventMatchesFilterAll(evt *nostr.Event, allTags map[string][]string) bool {
+	for tagName, values := range allTags {
+		for _, v := range values {
+			if !hasTag(evt, tagName, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// eventMatchesPatterns reports whether the event has, for every tag name, a tag whose value matches any of the
+// patterns listed for it, see [ExtendedFilter.PatternTags]. An empty requirement is always satisfied.
+func eventMatchesPatterns(evt *nostr.Event, patternTags map[string][]string) bool {
+	for tagName, patterns := range patternTags {
+		found := slices.ContainsFunc(evt.Tags, func(tag nostr.Tag) bool {
+			return len(tag) > 1 && tag[0] == tagName && slices.ContainsFunc(patterns, func(p string) bool {
+				return matchesPattern(p, tag[1])
+			})
+		})
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesPattern reports whether the value matches the pattern, by prefix if it ends in "*", exactly otherwise.
+func matchesPattern(pattern, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+// hasTagName reports whether the event has a tag with the provided name, whatever its value.
+func hasTagName(evt *nostr.Event, name string) bool {
+	return slices.ContainsFunc(evt.Tags, func(tag nostr.Tag) bool {
+		return len(tag) > 1 && tag[0] == name
+	})
+}
+
+// hasTag reports whether the event has a tag with the provided name and value.
+func hasTag(evt *nostr.Event, name, value string) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) > 1 && tag[0] == name && tag[1] == value {
+			return true
+		}
+	}
+	return false
+}
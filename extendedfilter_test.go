@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryEventsExtExclusions(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(20)
+
+	for i := range 10 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), i%3)
+		evt.PubKey = fmt.Sprintf("pk-%d", i%2)
+		cb.SaveEvent(ctx, evt)
+	}
+
+	tests := []struct {
+		name     string
+		filter   ExtendedFilter
+		expected []string
+	}{
+		{
+			name:     "exclude kind",
+			filter:   ExtendedFilter{ExcludeKinds: []int{0}},
+			expected: []string{"id-1", "id-2", "id-4", "id-5", "id-7", "id-8"},
+		},
+		{
+			name:     "exclude author",
+			filter:   ExtendedFilter{ExcludeAuthors: []string{"pk-0"}},
+			expected: []string{"id-1", "id-3", "id-5", "id-7", "id-9"},
+		},
+		{
+			name:     "exclude uppercase author",
+			filter:   ExtendedFilter{ExcludeAuthors: []string{"PK-0"}},
+			expected: []string{"id-1", "id-3", "id-5", "id-7", "id-9"},
+		},
+		{
+			name: "include kinds and exclude author",
+			filter: ExtendedFilter{
+				Filter:         nostr.Filter{Kinds: []int{1, 2}},
+				ExcludeAuthors: []string{"pk-1"},
+			},
+			expected: []string{"id-2", "id-4", "id-8"},
+		},
+		{
+			name: "author both included and excluded",
+			filter: ExtendedFilter{
+				Filter:         nostr.Filter{Authors: []string{"pk-0"}},
+				ExcludeAuthors: []string{"pk-0"},
+			},
+			expected: nil,
+		},
+		{
+			name: "limit counts only accepted events",
+			filter: ExtendedFilter{
+				Filter:       nostr.Filter{Limit: 2},
+				ExcludeKinds: []int{0, 1},
+			},
+			expected: []string{"id-2", "id-5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := cb.QueryEventsExt(ctx, test.filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			if len(events) != len(test.expected) {
+				t.Fatalf("Expected %v, got %d events", test.expected, len(events))
+			}
+			for i, evt := range events {
+				if evt.ID != test.expected[i] {
+					t.Fatalf("Expected %v, got event %s at position %d", test.expected, evt.ID, i)
+				}
+			}
+		})
+	}
+}
+
+func TestEventMatchesFilterAll(t *testing.T) {
+	evt := createTestEvent("id", 1)
+	evt.Tags = nostr.Tags{{"e", "a"}, {"e", "b"}, {"p", "c"}}
+
+	tests := []struct {
+		name     string
+		allTags  map[string][]string
+		expected bool
+	}{
+		{"all values present", map[string][]string{"e": {"a", "b"}}, true},
+		{"all values present across tag names", map[string][]string{"e": {"b"}, "p": {"c"}}, true},
+		{"some values missing", map[string][]string{"e": {"a", "b", "z"}}, false},
+		{"value under another tag name", map[string][]string{"e": {"c"}}, false},
+		{"empty requirement", nil, true},
+		{"empty values", map[string][]string{"e": {}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := eventMatchesFilterAll(evt, test.allTags); got != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueryEventsExtAllTags(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+
+	tagged := map[string]nostr.Tags{
+		"both":   {{"e", "a"}, {"e", "b"}},
+		"only-a": {{"e", "a"}},
+		"none":   {},
+	}
+	for id, tags := range tagged {
+		evt := createTestEvent(id, 1)
+		evt.Tags = tags
+		cb.SaveEvent(ctx, evt)
+	}
+
+	// the standard tags match any of the values, the extended ones require all of them
+	filter := ExtendedFilter{
+		Filter:  nostr.Filter{Tags: nostr.TagMap{"e": {"a", "b"}}},
+		AllTags: map[string][]string{"e": {"a", "b"}},
+	}
+
+	events, err := cb.QueryEventsExt(ctx, filter)
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "both" {
+		t.Fatalf("Expected only the event with both tags, got %v", events)
+	}
+}
+
+func TestQueryEventsExtPatternTags(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+
+	hashtags := map[string]string{
+		"nostr":    "nostr",
+		"nostrdev": "nostrdev",
+		"bitcoin":  "bitcoin",
+		"star":     "*",
+	}
+	for id, hashtag := range hashtags {
+		evt := createTestEvent(id, 1)
+		evt.Tags = nostr.Tags{{"t", hashtag}}
+		cb.SaveEvent(ctx, evt)
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		expected []string
+	}{
+		{"exact", []string{"nostr"}, []string{"nostr"}},
+		{"prefix", []string{"nostr*"}, []string{"nostr", "nostrdev"}},
+		{"exact or prefix", []string{"bitcoin", "nostrd*"}, []string{"bitcoin", "nostrdev"}},
+		{"no match", []string{"nostrich", "lightning*"}, nil},
+		{"wildcard", []string{"*"}, []string{"bitcoin", "nostr", "nostrdev", "star"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := cb.QueryEventsExt(ctx, ExtendedFilter{PatternTags: map[string][]string{"t": test.patterns}})
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			got := ids(events)
+			slices.Sort(got)
+			if !slices.Equal(got, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+
+	// the standard tags never match by prefix
+	events, err := cb.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"t": {"nostr*"}}})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("Expected the standard filter to match values exactly, got %v", ids(events))
+	}
+}
+
+func TestQueryEventsExtTagPresence(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10, WithTagIndex())
+
+	tagged := map[string]nostr.Tags{
+		"nostr":   {{"t", "nostr"}},
+		"both":    {{"t", "bitcoin"}, {"p", "alice"}},
+		"mention": {{"p", "alice"}},
+		"bare":    {{"t"}},
+		"none":    {},
+	}
+	for id, tags := range tagged {
+		evt := createTestEvent(id, 1)
+		evt.Tags = tags
+		cb.SaveEvent(ctx, evt)
+	}
+
+	tests := []struct {
+		name     string
+		tags     nostr.TagMap
+		expected []string
+	}{
+		{"present", nostr.TagMap{"t": {}}, []string{"both", "nostr"}},
+		{"nil values", nostr.TagMap{"t": nil}, []string{"both", "nostr"}},
+		{"absent", nostr.TagMap{"e": {}}, nil},
+		{"all present", nostr.TagMap{"t": {}, "p": {}}, []string{"both"}},
+		{"present and value", nostr.TagMap{"t": {}, "p": {"alice"}}, []string{"both"}},
+		{"value only", nostr.TagMap{"t": {"nostr"}}, []string{"nostr"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := ExtendedFilter{Filter: nostr.Filter{Tags: test.tags}, TagPresence: true}
+			events, err := cb.QueryEventsExt(ctx, filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			got := ids(events)
+			slices.Sort(got)
+			if !slices.Equal(got, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+
+			if len(filter.Filter.Tags) != len(test.tags) {
+				t.Fatalf("Expected the tags of the filter to be left unchanged, got %v", filter.Filter.Tags)
+			}
+		})
+	}
+
+	// without the extended semantic, an empty list of values matches nothing, as required by NIP-01
+	for _, query := range []func(nostr.Filter) ([]*nostr.Event, error){
+		func(f nostr.Filter) ([]*nostr.Event, error) { return cb.QueryEvents(ctx, f) },
+		func(f nostr.Filter) ([]*nostr.Event, error) { return cb.QueryEventsExt(ctx, ExtendedFilter{Filter: f}) },
+	} {
+		events, err := query(nostr.Filter{Tags: nostr.TagMap{"t": {}}})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("Expected no events by default, got %v", ids(events))
+		}
+	}
+}
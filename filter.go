@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrUnsatisfiableFilter is returned by [NormalizeFilter] when the filter can't match any event,
+// for example because all of its IDs were empty strings.
+var ErrUnsatisfiableFilter = errors.New("filter cannot match any event")
+
+// ErrFilterTooComplex is returned by [NormalizeFilter] when the filter has more values than allowed
+// by [MaxIDs], [MaxAuthors] or [MaxTagValues].
+var ErrFilterTooComplex = errors.New("filter is too complex")
+
+var (
+	// MaxIDs is the maximum number of IDs a filter can have. Zero means no maximum.
+	MaxIDs int
+
+	// MaxAuthors is the maximum number of authors a filter can have. Zero means no maximum.
+	MaxAuthors int
+
+	// MaxTagValues is the maximum number of tag values a filter can have, summed across all its tags.
+	// Zero means no maximum.
+	MaxTagValues int
+)
+
+// NormalizeFilter validates the filter and returns a cleaned-up copy of it.
+// Filters with negative timestamps or limit, or with Since after Until, are rejected.
+// Filters with too many values are rejected with [ErrFilterTooComplex], as matching them is expensive.
+// Empty strings are removed from IDs, Authors and tag values, so they can't accidentally
+// match everything. IDs and Authors are lowercased, so that they match regardless of their case.
+// If a constraint has no values, or is left with none, [ErrUnsatisfiableFilter]
+// is returned, as it can't match any event (see [MatchEvent]).
+// The slices of the original filter are never modified.
+func NormalizeFilter(f nostr.Filter) (nostr.Filter, error) {
+	return normalizeFilter(f, 0)
+}
+
+// normalizeFilter is like [NormalizeFilter], but also clamps the limit to the capacity, if positive.
+func normalizeFilter(f nostr.Filter, capacity int) (nostr.Filter, error) {
+	if f.Since != nil && *f.Since < 0 {
+		return f, fmt.Errorf("invalid filter: negative since (%d)", *f.Since)
+	}
+	if f.Until != nil && *f.Until < 0 {
+		return f, fmt.Errorf("invalid filter: negative until (%d)", *f.Until)
+	}
+	if f.Since != nil && f.Until != nil && *f.Since > *f.Until {
+		return f, fmt.Errorf("invalid filter: since (%d) is after until (%d)", *f.Since, *f.Until)
+	}
+	if f.Limit < 0 {
+		return f, fmt.Errorf("invalid filter: negative limit (%d)", f.Limit)
+	}
+
+	if err := checkComplexity(f); err != nil {
+		return f, err
+	}
+
+	if capacity > 0 && f.Limit > capacity {
+		f.Limit = capacity
+	}
+
+	if f.Kinds != nil && len(f.Kinds) == 0 {
+		return f, ErrUnsatisfiableFilter
+	}
+
+	var ok bool
+	if f.IDs, ok = withoutEmpty(f.IDs); !ok {
+		return f, ErrUnsatisfiableFilter
+	}
+	if f.Authors, ok = withoutEmpty(f.Authors); !ok {
+		return f, ErrUnsatisfiableFilter
+	}
+
+	// event IDs and pubkeys are lowercase hex, but some clients send them uppercase
+	f.IDs = lowercased(f.IDs)
+	f.Authors = lowercased(f.Authors)
+
+	cloned := false
+	for key, values := range f.Tags {
+		cleaned, ok := withoutEmpty(values)
+		if !ok {
+			return f, ErrUnsatisfiableFilter
+		}
+
+		if len(cleaned) != len(values) {
+			if !cloned {
+				f.Tags = cloneTagMap(f.Tags)
+				cloned = true
+			}
+			f.Tags[key] = cleaned
+		}
+	}
+
+	return f, nil
+}
+
+// checkComplexity returns [ErrFilterTooComplex] if the filter has more values than allowed.
+func checkComplexity(f nostr.Filter) error {
+	if MaxIDs > 0 && len(f.IDs) > MaxIDs {
+		return fmt.Errorf("%w: %d IDs, the maximum is %d", ErrFilterTooComplex, len(f.IDs), MaxIDs)
+	}
+	if MaxAuthors > 0 && len(f.Authors) > MaxAuthors {
+		return fmt.Errorf("%w: %d authors, the maximum is %d", ErrFilterTooComplex, len(f.Authors), MaxAuthors)
+	}
+
+	if MaxTagValues > 0 {
+		values := 0
+		for _, v := range f.Tags {
+			values += len(v)
+		}
+		if values > MaxTagValues {
+			return fmt.Errorf("%w: %d tag values, the maximum is %d", ErrFilterTooComplex, values, MaxTagValues)
+		}
+	}
+	return nil
+}
+
+// withoutEmpty returns the values without the empty strings, allocating only if needed.
+// It returns false if the values are not nil, but contain no value other than empty strings.
+func withoutEmpty(values []string) ([]string, bool) {
+	empty := 0
+	for _, v := range values {
+		if v == "" {
+			empty++
+		}
+	}
+
+	switch {
+	case values == nil:
+		return nil, true
+
+	case empty == len(values):
+		return nil, false
+
+	case empty == 0:
+		return values, true
+	}
+
+	cleaned := make([]string, 0, len(values)-empty)
+	for _, v := range values {
+		if v != "" {
+			cleaned = append(cleaned, v)
+		}
+	}
+	return cleaned, true
+}
+
+// splitFilterByKind splits the filter into one filter per kind, keyed by the kind, so that a store partitioned
+// by kind only queries the partitions holding the requested kinds, see [NewMultiBufferByKind]. All the other fields of the filter are
+// preserved, sharing its slices and tags. A filter without kinds matches every kind, so it can't be split
+// and nil is returned: it must be run against all the partitions.
+// The limit applies to each split filter, so the merged results must be limited again.
+func splitFilterByKind(filter nostr.Filter) map[int]nostr.Filter {
+	if filter.Kinds == nil {
+		return nil
+	}
+
+	split := make(map[int]nostr.Filter, len(filter.Kinds))
+	for _, kind := range filter.Kinds {
+		f := filter
+		f.Kinds = []int{kind}
+		split[kind] = f
+	}
+	return split
+}
+
+// lowercased returns the values in lowercase. If they are already lowercase, values is returned as is,
+// so that well-behaved clients don't pay for a copy.
+func lowercased(values []string) []string {
+	i := slices.IndexFunc(values, hasUpper)
+	if i == -1 {
+		return values
+	}
+
+	lower := slices.Clone(values)
+	for ; i < len(lower); i++ {
+		lower[i] = strings.ToLower(lower[i])
+	}
+	return lower
+}
+
+// hasUpper reports whether s has any uppercase ASCII letter.
+func hasUpper(s string) bool {
+	for i := range len(s) {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneTagMap returns a shallow copy of the tag map.
+func cloneTagMap(tags nostr.TagMap) nostr.TagMap {
+	clone := make(nostr.TagMap, len(tags))
+	for k, v := range tags {
+		clone[k] = v
+	}
+	return clone
+}
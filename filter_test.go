@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func timestamp(t int64) *nostr.Timestamp {
+	ts := nostr.Timestamp(t)
+	return &ts
+}
+
+func TestNormalizeFilterRejectsInvalid(t *testing.T) {
+	tests := map[string]nostr.Filter{
+		"negative since":     {Since: timestamp(-1)},
+		"negative until":     {Until: timestamp(-1)},
+		"since after until":  {Since: timestamp(200), Until: timestamp(100)},
+		"negative limit":     {Limit: -5},
+		"only empty IDs":     {IDs: []string{"", ""}},
+		"only empty authors": {Authors: []string{""}},
+		"only empty tags":    {Tags: nostr.TagMap{"e": []string{""}}},
+	}
+
+	for name, filter := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NormalizeFilter(filter); err == nil {
+				t.Fatalf("Expected filter %v to be rejected", filter)
+			}
+		})
+	}
+}
+
+func TestNormalizeFilterStripsEmpty(t *testing.T) {
+	ids := []string{"", "abc", ""}
+	filter := nostr.Filter{
+		IDs:     ids,
+		Authors: []string{"pk", ""},
+		Tags:    nostr.TagMap{"e": []string{"", "x"}, "p": []string{"y"}},
+		Since:   timestamp(100),
+		Until:   timestamp(100),
+	}
+
+	normalized, err := NormalizeFilter(filter)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !slices.Equal(normalized.IDs, []string{"abc"}) {
+		t.Errorf("Expected IDs [abc], got %v", normalized.IDs)
+	}
+	if !slices.Equal(normalized.Authors, []string{"pk"}) {
+		t.Errorf("Expected authors [pk], got %v", normalized.Authors)
+	}
+	if !slices.Equal(normalized.Tags["e"], []string{"x"}) || !slices.Equal(normalized.Tags["p"], []string{"y"}) {
+		t.Errorf("Expected tags e=[x] p=[y], got %v", normalized.Tags)
+	}
+
+	// the original filter must be untouched
+	if !slices.Equal(ids, []string{"", "abc", ""}) || len(filter.Tags["e"]) != 2 {
+		t.Errorf("The original filter was modified: %v", filter)
+	}
+}
+
+func TestNormalizeFilterClampsLimit(t *testing.T) {
+	normalized, err := normalizeFilter(nostr.Filter{Limit: 1000}, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if normalized.Limit != 10 {
+		t.Fatalf("Expected limit to be clamped to 10, got %d", normalized.Limit)
+	}
+
+	normalized, _ = NormalizeFilter(nostr.Filter{Limit: 1000})
+	if normalized.Limit != 1000 {
+		t.Fatalf("Expected limit to be untouched without a capacity, got %d", normalized.Limit)
+	}
+}
+
+func TestQueryEmptyIDsReturnsNothing(t *testing.T) {
+	ctx := context.Background()
+	filter := nostr.Filter{IDs: []string{""}}
+
+	cb := NewCircularBuffer(10)
+	acb := NewAtomicCircularBuffer(10)
+	acb2 := NewAtomicCircularBuffer2(10)
+
+	for i := range 5 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+		cb.SaveEvent(ctx, evt)
+		acb.SaveEvent(ctx, evt)
+		acb2.SaveEvent(ctx, evt)
+	}
+
+	events, err := acb2.QueryEvents(ctx, filter)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("AtomicCircularBuffer2: expected no events, got %d", len(events))
+	}
+
+	for name, query := range map[string]func(context.Context, nostr.Filter) (chan *nostr.Event, error){
+		"CircularBuffer":       cb.QueryEvents,
+		"AtomicCircularBuffer": acb.QueryEvents,
+	} {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+
+		count := 0
+		for range ch {
+			count++
+		}
+		if count != 0 {
+			t.Errorf("%s: expected no events, got %d", name, count)
+		}
+	}
+
+	if _, err := acb2.QueryEvents(ctx, nostr.Filter{Limit: -1}); err == nil || errors.Is(err, ErrUnsatisfiableFilter) {
+		t.Errorf("Expected an invalid filter error, got %v", err)
+	}
+}
+
+func TestQueryCaseInsensitiveIDs(t *testing.T) {
+	ctx := context.Background()
+	evt := createTestEvent(hexID(1), 1)
+	evt.PubKey = hexID(2)
+
+	cb := NewCircularBuffer(10)
+	acb := NewAtomicCircularBuffer(10)
+	acb2 := NewAtomicCircularBuffer2(10, WithIDBloomFilter())
+	cb.SaveEvent(ctx, evt)
+	acb.SaveEvent(ctx, evt)
+	acb2.SaveEvent(ctx, evt)
+
+	mixed := []byte(hexID(1))
+	for i := 0; i < len(mixed); i += 2 {
+		mixed[i] = strings.ToUpper(string(mixed[i]))[0]
+	}
+
+	filters := map[string]nostr.Filter{
+		"uppercase ID":     {IDs: []string{strings.ToUpper(hexID(1))}},
+		"mixed case ID":    {IDs: []string{string(mixed)}},
+		"uppercase prefix": {IDs: []string{strings.ToUpper(hexID(1)[:8])}},
+		"uppercase author": {Authors: []string{"x", strings.ToUpper(hexID(2))}},
+	}
+
+	for name, filter := range filters {
+		original := slices.Clone(filter.IDs)
+
+		if !MatchEvent(evt, filter) {
+			t.Errorf("%s: expected MatchEvent to match", name)
+		}
+
+		events, _ := acb2.QueryEvents(ctx, filter)
+		if len(events) != 1 {
+			t.Errorf("%s: AtomicCircularBuffer2: expected 1 event, got %d", name, len(events))
+		}
+
+		for buffer, query := range map[string]func(context.Context, nostr.Filter) (chan *nostr.Event, error){
+			"CircularBuffer":       cb.QueryEvents,
+			"AtomicCircularBuffer": acb.QueryEvents,
+		} {
+			ch, _ := query(ctx, filter)
+			if events := collectEvents(ch); len(events) != 1 {
+				t.Errorf("%s: %s: expected 1 event, got %d", name, buffer, len(events))
+			}
+		}
+
+		if !slices.Equal(filter.IDs, original) {
+			t.Errorf("%s: expected the filter not to be modified, got %v", name, filter.IDs)
+		}
+	}
+
+	// lowercase values are used as they are
+	ids := []string{hexID(1), hexID(2)}
+	if allocs := testing.AllocsPerRun(100, func() { lowercased(ids) }); allocs != 0 {
+		t.Errorf("expected lowercase values not to allocate, got %v allocations", allocs)
+	}
+}
+
+// setComplexityLimits replaces MaxIDs, MaxAuthors and MaxTagValues for the duration of the test.
+func setComplexityLimits(t *testing.T, ids, authors, tagValues int) {
+	oldIDs, oldAuthors, oldTagValues := MaxIDs, MaxAuthors, MaxTagValues
+	MaxIDs, MaxAuthors, MaxTagValues = ids, authors, tagValues
+	t.Cleanup(func() { MaxIDs, MaxAuthors, MaxTagValues = oldIDs, oldAuthors, oldTagValues })
+}
+
+// values returns n distinct non-empty strings
+func values(n int) []string {
+	v := make([]string, n)
+	for i := range v {
+		v[i] = fmt.Sprintf("v-%d", i)
+	}
+	return v
+}
+
+func TestNormalizeFilterComplexity(t *testing.T) {
+	setComplexityLimits(t, 10, 5, 8)
+
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		rejected bool
+	}{
+		{"IDs at the limit", nostr.Filter{IDs: values(10)}, false},
+		{"IDs over the limit", nostr.Filter{IDs: values(11)}, true},
+		{"authors at the limit", nostr.Filter{Authors: values(5)}, false},
+		{"authors over the limit", nostr.Filter{Authors: values(6)}, true},
+		{"tag values at the limit", nostr.Filter{Tags: nostr.TagMap{"e": values(4), "p": values(4)}}, false},
+		{"tag values over the limit", nostr.Filter{Tags: nostr.TagMap{"e": values(4), "p": values(5)}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NormalizeFilter(test.filter)
+			if test.rejected && !errors.Is(err, ErrFilterTooComplex) {
+				t.Fatalf("Expected ErrFilterTooComplex, got %v", err)
+			}
+			if !test.rejected && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryComplexFilterDoesNotScan(t *testing.T) {
+	setComplexityLimits(t, 10, 0, 0)
+	ctx := context.Background()
+
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("v-%d", i), 1))
+	}
+
+	// accept is only called on the events matching the filter, so it reports whether the buffer was scanned
+	scanned := 0
+	accept := func(*nostr.Event) bool {
+		scanned++
+		return true
+	}
+
+	events, err := cb.query(ctx, nostr.Filter{IDs: values(10)}, accept, nil)
+	if err != nil || len(events) != 10 || scanned != 10 {
+		t.Fatalf("Expected the filter under the limit to match 10 events, got %d (%v)", len(events), err)
+	}
+
+	scanned = 0
+	if _, err := cb.query(ctx, nostr.Filter{IDs: values(11)}, accept, nil); !errors.Is(err, ErrFilterTooComplex) {
+		t.Fatalf("Expected ErrFilterTooComplex, got %v", err)
+	}
+	if scanned != 0 {
+		t.Fatalf("Expected the rejected filter not to scan the buffer, %d events were matched", scanned)
+	}
+}
+
+func TestSplitFilterByKind(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 90 {
+		evt := createTestEvent(fmt.Sprintf("id-%02d", i), i%6)
+		evt.CreatedAt = nostr.Timestamp(1000 + i)
+		evt.Tags = nostr.Tags{{"t", fmt.Sprint(i % 4)}}
+		cb.SaveEvent(ctx, evt)
+	}
+
+	filters := []nostr.Filter{
+		{Kinds: []int{1, 3, 4}},
+		{Kinds: []int{0, 5, 5}, Since: timestamp(1020), Until: timestamp(1070)},
+		{Kinds: []int{2, 3}, Tags: nostr.TagMap{"t": {"1", "3"}}},
+		{Kinds: []int{1, 42}, IDs: []string{"id-1", "id-7"}},
+	}
+
+	for _, filter := range filters {
+		split := splitFilterByKind(filter)
+
+		var union []*nostr.Event
+		for kind, f := range split {
+			if len(f.Kinds) != 1 || f.Kinds[0] != kind {
+				t.Fatalf("%v: expected the split filter of kind %d to only have that kind, got %v", filter, kind, f.Kinds)
+			}
+			if f.Since != filter.Since || f.Until != filter.Until || len(f.Tags) != len(filter.Tags) || len(f.IDs) != len(filter.IDs) {
+				t.Fatalf("%v: expected the other fields to be preserved, got %v", filter, f)
+			}
+
+			events, _ := cb.QueryEvents(ctx, f)
+			union = append(union, events...)
+		}
+
+		expected, _ := cb.QueryEvents(ctx, filter)
+		got := ids(union)
+		slices.Sort(got)
+		if !slices.Equal(got, ids(expected)) {
+			t.Fatalf("%v: expected the union of the splits to be %v, got %v", filter, ids(expected), got)
+		}
+	}
+
+	if split := splitFilterByKind(nostr.Filter{}); split != nil {
+		t.Fatalf("expected a filter without kinds not to be split, got %v", split)
+	}
+}
+
+// TestEmptyFilterMatchesEverything tests that a filter without constraints, or with empty tags, matches every live
+// event through every path, with and without the indexes
+func TestEmptyFilterMatchesEverything(t *testing.T) {
+	ctx := context.Background()
+	filters := []nostr.Filter{{}, {Tags: nostr.TagMap{}}}
+
+	// the bare event has no tags, no pubkey and a zero CreatedAt
+	bare := &nostr.Event{ID: hexID(0)}
+	for _, filter := range filters {
+		if !MatchEvent(bare, filter) || !MatchEvent(createTestEvent("id", 20000), filter) {
+			t.Fatalf("Expected %v to match any event", filter)
+		}
+	}
+
+	for name, opts := range map[string][]BufferOption{
+		"plain":   nil,
+		"indexed": {WithTagIndex(), WithAuthorIndex(), WithTimeIndex(time.Minute), WithIDBloomFilter(), WithQueryCache(10, time.Minute)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// 50 events in a 30 slot buffer, so that 20 are evicted, and one deleted
+			cb := NewAtomicCircularBuffer2(30, opts...)
+			cb.SaveEvent(ctx, bare)
+			for i := 1; i < 50; i++ {
+				cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%3))
+			}
+			cb.DeleteEvent(ctx, &nostr.Event{ID: "id-30"})
+			live := ids(slices.Collect(cb.All()))
+			if len(live) != 29 {
+				t.Fatalf("Expected 29 live events, got %d", len(live))
+			}
+
+			for _, filter := range filters {
+				events, err := cb.QueryEvents(ctx, filter)
+				if err != nil || !slices.Equal(ids(events), live) {
+					t.Fatalf("QueryEvents: expected %v, got %v (%v)", live, ids(events), err)
+				}
+
+				eventIDs, err := cb.QueryIDs(ctx, filter)
+				if err != nil || !slices.Equal(eventIDs, live) {
+					t.Fatalf("QueryIDs: expected %v, got %v (%v)", live, eventIDs, err)
+				}
+
+				count, err := cb.CountEvents(ctx, filter)
+				if err != nil || count != 29 {
+					t.Fatalf("CountEvents: expected 29, got %d (%v)", count, err)
+				}
+
+				visited := 0
+				cb.ForEachMatching(ctx, filter, func(*nostr.Event) bool { visited++; return true })
+				if visited != 29 {
+					t.Fatalf("ForEachMatching: expected 29 events, visited %d", visited)
+				}
+
+				ordered, err := cb.QueryEventsOrdered(ctx, filter, QueryOptions{Order: Descending})
+				if err != nil || len(ordered) != 29 {
+					t.Fatalf("QueryEventsOrdered: expected 29 events, got %d (%v)", len(ordered), err)
+				}
+
+				var paged []*nostr.Event
+				for cursor := (Cursor{}); ; {
+					page, next, err := cb.QueryPage(ctx, filter, cursor, 7)
+					if err != nil {
+						t.Fatalf("QueryPage: %v", err)
+					}
+					paged = append(paged, page...)
+					if next.IsZero() {
+						break
+					}
+					cursor = next
+				}
+				if len(paged) != 29 {
+					t.Fatalf("QueryPage: expected 29 events over the pages, got %d", len(paged))
+				}
+
+				// the limit still applies
+				filter.Limit = 5
+				events, err = cb.QueryEvents(ctx, filter)
+				if err != nil || !slices.Equal(ids(events), live[:5]) {
+					t.Fatalf("QueryEvents with limit: expected %v, got %v (%v)", live[:5], ids(events), err)
+				}
+			}
+		})
+	}
+
+	// the legacy buffers
+	cb := NewCircularBuffer(30)
+	acb := NewAtomicCircularBuffer(30)
+	for i := range 50 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), i%3)
+		cb.SaveEvent(ctx, evt)
+		acb.SaveEvent(ctx, evt)
+	}
+	for name, query := range map[string]func(context.Context, nostr.Filter) (chan *nostr.Event, error){
+		"CircularBuffer":       cb.QueryEvents,
+		"AtomicCircularBuffer": acb.QueryEvents,
+	} {
+		for _, filter := range filters {
+			ch, err := query(ctx, filter)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if events := collectEvents(ch); len(events) != 30 {
+				t.Fatalf("%s: expected 30 events, got %d", name, len(events))
+			}
+		}
+	}
+
+	// the stores built on top of the buffers
+	mb := NewMultiBuffer([]*AtomicCircularBuffer2{NewAtomicCircularBuffer2(30), NewAtomicCircularBuffer2(30)}, nil)
+	rs := NewReplaceableStore()
+	for i := range 20 {
+		mb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%3))
+
+		profile := createTestEvent(fmt.Sprintf("profile-%d", i), 0)
+		profile.PubKey = hexID(i % 5)
+		rs.SaveEvent(ctx, profile)
+	}
+	for name, test := range map[string]struct {
+		store    Store
+		expected int
+	}{
+		"MultiBuffer":      {mb, 20},
+		"ReplaceableStore": {rs, 5},
+	} {
+		for _, filter := range filters {
+			events, err := test.store.QueryEvents(ctx, filter)
+			if err != nil || len(events) != test.expected {
+				t.Fatalf("%s: expected %d events, got %d (%v)", name, test.expected, len(events), err)
+			}
+		}
+	}
+}
+
+// TestQueryEmptyFilter tests that the relay returns the newest events up to the default limit for an empty filter,
+// through the general path rather than the fast paths
+func TestQueryEmptyFilter(t *testing.T) {
+	ctx := context.Background()
+	ephemeral := NewAtomicCircularBuffer2(50)
+	for i := range 30 {
+		ephemeral.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("ephemeral-%02d", i), int64(1000+2*i)))
+	}
+	store := &mockStore{}
+	for i := range 30 {
+		store.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("regular-%02d", i), int64(1001+2*i)))
+	}
+	setupStores(t, store, ephemeral)
+	setLimits(t, 10, 100)
+
+	filters := nostr.Filters{{}}
+	if isIDsOnly(filters) || isEphemeralOnly(filters) {
+		t.Fatal("Expected the empty filter not to take a fast path")
+	}
+
+	events, err := Query(ctx, nil, filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, evt := range events {
+		got = append(got, evt.ID)
+	}
+	expected := []string{
+		"regular-29", "ephemeral-29", "regular-28", "ephemeral-28", "regular-27",
+		"ephemeral-27", "regular-26", "ephemeral-26", "regular-25", "ephemeral-25",
+	}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
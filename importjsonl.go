@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ImportOption configures optional behaviour of [ImportJSONL].
+type ImportOption func(*importOptions)
+
+type importOptions struct {
+	verify bool
+}
+
+// WithSignatureCheck makes [ImportJSONL] verify the ID and the signature of every event,
+// counting the events failing the check as failed instead of saving them.
+func WithSignatureCheck() ImportOption {
+	return func(o *importOptions) {
+		o.verify = true
+	}
+}
+
+// ImportJSONL reads newline-delimited JSON events from r and saves them into the store, in order.
+// Lines that can't be parsed, events failing the checks and events the store refuses are logged and counted
+// as failed, without stopping the import. Blank lines are skipped. It returns the number of events saved
+// and failed, and an error only if reading r fails or ctx is cancelled, in which case the counts cover the
+// lines processed so far.
+func ImportJSONL(ctx context.Context, r io.Reader, store Store, opts ...ImportOption) (imported int, failed int, err error) {
+	var o importOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// a bufio.Reader rather than a bufio.Scanner, so that lines are never too long
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		if err := ctx.Err(); err != nil {
+			return imported, failed, err
+		}
+
+		data, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return imported, failed, fmt.Errorf("failed to read line %d: %w", line, err)
+		}
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			if err := importEvent(ctx, data, store, o); err != nil {
+				log.Printf("[WARN] import line %d: %v", line, err)
+				failed++
+			} else {
+				imported++
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return imported, failed, nil
+		}
+	}
+}
+
+// importEvent parses the event and saves it into the store.
+func importEvent(ctx context.Context, data []byte, store Store, o importOptions) error {
+	evt := &nostr.Event{}
+	if err := evt.UnmarshalJSON(data); err != nil {
+		return fmt.Errorf("malformed event: %w", err)
+	}
+
+	if o.verify {
+		if !evt.CheckID() {
+			return fmt.Errorf("event %s: invalid ID", evt.ID)
+		}
+		ok, err := evt.CheckSignature()
+		if err != nil {
+			return fmt.Errorf("event %s: failed to check the signature: %w", evt.ID, err)
+		}
+		if !ok {
+			return fmt.Errorf("event %s: invalid signature", evt.ID)
+		}
+	}
+
+	if err := store.SaveEvent(ctx, evt); err != nil {
+		return fmt.Errorf("event %s: %w", evt.ID, err)
+	}
+	return nil
+}
+
+// databaseStore adapts a database to the Store interface, saving the events the way the relay does:
+// replaceable and addressable events replace the previous versions, while ephemeral events are refused,
+// as they are never persisted.
+type databaseStore struct {
+	collectingStore
+	db eventstore.Store
+}
+
+// newDatabaseStore returns a databaseStore around the database.
+func newDatabaseStore(db eventstore.Store) databaseStore {
+	return databaseStore{collectingStore: collectingStore{db}, db: db}
+}
+
+// SaveEvent saves the event into the database, replacing the previous versions of replaceable events.
+func (s databaseStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	switch {
+	case nostr.IsEphemeralKind(evt.Kind):
+		return fmt.Errorf("ephemeral kind %d is never persisted", evt.Kind)
+	case nostr.IsReplaceableKind(evt.Kind), nostr.IsAddressableKind(evt.Kind):
+		return s.db.ReplaceEvent(ctx, evt)
+	default:
+		return s.db.SaveEvent(ctx, evt)
+	}
+}
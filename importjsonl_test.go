@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// signedJSONL returns the JSON lines of the events, signed with a new key
+func signedJSONL(t *testing.T, events ...*nostr.Event) []string {
+	t.Helper()
+	sk := nostr.GeneratePrivateKey()
+
+	lines := make([]string, len(events))
+	for i, evt := range events {
+		if err := evt.Sign(sk); err != nil {
+			t.Fatalf("Failed to sign the event: %v", err)
+		}
+		lines[i] = evt.String()
+	}
+	return lines
+}
+
+func TestImportJSONL(t *testing.T) {
+	ctx := context.Background()
+	lines := signedJSONL(t,
+		&nostr.Event{Kind: 1, CreatedAt: 1000, Content: "first"},
+		&nostr.Event{Kind: 1, CreatedAt: 1001, Content: "second"},
+		&nostr.Event{Kind: 1, CreatedAt: 1002, Content: "third"},
+	)
+	// the signature of the third event no longer matches
+	tampered := strings.Replace(lines[2], `"third"`, `"changed"`, 1)
+
+	input := strings.Join([]string{lines[0], `{"id": "malformed"`, "", lines[1], tampered}, "\n")
+
+	tests := []struct {
+		name     string
+		opts     []ImportOption
+		imported int
+		failed   int
+	}{
+		{"unverified", nil, 3, 1},
+		{"verified", []ImportOption{WithSignatureCheck()}, 2, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(10)
+			imported, failed, err := ImportJSONL(ctx, strings.NewReader(input), cb, test.opts...)
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			if imported != test.imported || failed != test.failed {
+				t.Fatalf("Expected %d imported and %d failed, got %d and %d", test.imported, test.failed, imported, failed)
+			}
+			if cb.Len() != test.imported {
+				t.Fatalf("Expected %d events in the store, got %d", test.imported, cb.Len())
+			}
+		})
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := ImportJSONL(cancelled, strings.NewReader(input), NewAtomicCircularBuffer2(10)); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// TestRunImport tests that the import subcommand saves the events into the database the way the relay does
+func TestRunImport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "relay.db")
+
+	lines := signedJSONL(t,
+		&nostr.Event{Kind: 1, CreatedAt: 1000, Content: "note"},
+		&nostr.Event{Kind: 0, CreatedAt: 1000, Content: "old profile"},
+		&nostr.Event{Kind: 0, CreatedAt: 1001, Content: "new profile"},
+		&nostr.Event{Kind: 20000, CreatedAt: 1000, Content: "ephemeral"},
+	)
+	file := filepath.Join(dir, "events.jsonl")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write the file: %v", err)
+	}
+
+	if err := runImport(ctx, []string{"-sqlite-path", path, "-verify", file}, nil); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	sqlite := &sqlite3.SQLite3Backend{DatabaseURL: path}
+	if err := sqlite.Init(); err != nil {
+		t.Fatalf("Failed to open the database: %v", err)
+	}
+	defer sqlite.Close()
+
+	events, err := newDatabaseStore(sqlite).QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query the database: %v", err)
+	}
+
+	var contents []string
+	for _, evt := range events {
+		contents = append(contents, evt.Content)
+	}
+	slices.Sort(contents)
+	if expected := []string{"new profile", "note"}; !slices.Equal(contents, expected) {
+		t.Fatalf("Expected %v, got %v", expected, contents)
+	}
+
+	if err := runImport(ctx, []string{"-sqlite-path", path}, nil); err == nil {
+		t.Fatal("Expected an error without a file to import")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "fmt"
+
+// CheckIntegrity verifies the invariants of the buffer, returning a descriptive error for the first one violated:
+//   - the span of live positions never exceeds the size, nor the number of saves;
+//   - the live positions [head-span, head) hold exactly count events, the others being left empty by deletions;
+//   - the slots outside the live positions are empty, when the buffer is not full.
+//
+// The check is only reliable while no write is in progress, so it's meant for tests and debugging.
+func (cb *AtomicCircularBuffer2) CheckIntegrity() error {
+	head := cb.head.Load()
+	span := cb.span.Load()
+	count := cb.count.Load()
+
+	if span > cb.size {
+		return fmt.Errorf("integrity: span %d exceeds the size %d", span, cb.size)
+	}
+	if span > head {
+		return fmt.Errorf("integrity: span %d exceeds the %d saved events", span, head)
+	}
+	if unsortedAt := cb.unsortedAt.Load(); unsortedAt > head {
+		return fmt.Errorf("integrity: unsorted position %d is past the head %d", unsortedAt, head)
+	}
+
+	start := head - span
+	stored := uint64(0)
+	for pos := start; pos < head; pos++ {
+		if cb.slot(pos).Load() != nil {
+			stored++
+		}
+	}
+	if stored != count {
+		return fmt.Errorf("integrity: %d events in the live positions, but the count is %d", stored, count)
+	}
+
+	if span == cb.size {
+		return nil
+	}
+
+	for i := range cb.buffer {
+		// the live slots are the ones whose position modulo size is within [start, head)
+		offset := (uint64(i) + cb.size - start%cb.size) % cb.size
+		if offset < span {
+			continue
+		}
+		if stored := cb.buffer[i].Load(); stored != nil {
+			return fmt.Errorf("integrity: slot %d outside the live positions [%d, %d) holds event %s", i, start, head, stored.Event.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	ctx := context.Background()
+
+	// fill saves n events in a new buffer with capacity 10
+	fill := func(n int) *AtomicCircularBuffer2 {
+		cb := NewAtomicCircularBuffer2(10)
+		for i := range n {
+			cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+		}
+		return cb
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		for _, n := range []int{0, 4, 10, 25} {
+			cb := fill(n)
+			if err := cb.CheckIntegrity(); err != nil {
+				t.Fatalf("after %d saves: unexpected error: %v", n, err)
+			}
+
+			// holes left by deletes and compaction are valid
+			cb.DeleteEvent(ctx, &nostr.Event{ID: fmt.Sprintf("id-%d", n-1)})
+			if err := cb.CheckIntegrity(); err != nil {
+				t.Fatalf("after %d saves and a delete: unexpected error: %v", n, err)
+			}
+			cb.Compact()
+			if err := cb.CheckIntegrity(); err != nil {
+				t.Fatalf("after %d saves and compaction: unexpected error: %v", n, err)
+			}
+		}
+	})
+
+	corruptions := map[string]struct {
+		saves   int
+		corrupt func(cb *AtomicCircularBuffer2)
+		err     string
+	}{
+		"span over size": {
+			saves:   10,
+			corrupt: func(cb *AtomicCircularBuffer2) { cb.span.Store(11) },
+			err:     "exceeds the size",
+		},
+		"span over saves": {
+			saves:   4,
+			corrupt: func(cb *AtomicCircularBuffer2) { cb.span.Store(5) },
+			err:     "exceeds the 4 saved events",
+		},
+		"span too low": {
+			saves:   4,
+			corrupt: func(cb *AtomicCircularBuffer2) { cb.span.Store(2) },
+			err:     "2 events in the live positions, but the count is 4",
+		},
+		"count not decremented": {
+			saves:   4,
+			corrupt: func(cb *AtomicCircularBuffer2) { cb.buffer[1].Store(nil) },
+			err:     "3 events in the live positions, but the count is 4",
+		},
+		"event outside the live positions": {
+			saves: 15,
+			corrupt: func(cb *AtomicCircularBuffer2) {
+				cb.span.Store(3)
+				cb.count.Store(3)
+				cb.buffer[0].Store(&StoredEvent{Event: createTestEvent("x", 1)})
+			},
+			err: "slot 0 outside the live positions",
+		},
+	}
+
+	for name, test := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			cb := fill(test.saves)
+			test.corrupt(cb)
+
+			err := cb.CheckIntegrity()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import "slices"
+
+// linearKindsThreshold is the number of kinds up to which a linear scan is faster than a binary search.
+const linearKindsThreshold = 8
+
+// kindMatcher checks the kind of an event against the kinds of a filter.
+// It's built once per query, so that the per-event check doesn't depend on how many kinds were requested.
+type kindMatcher struct {
+	mode   kindMatchMode
+	single int   // the only kind of the filter, in matchSingle mode
+	kinds  []int // the kinds of the filter, sorted in matchSorted mode
+}
+
+type kindMatchMode uint8
+
+const (
+	matchAnyKind kindMatchMode = iota // the filter has nil kinds, so every kind matches
+	matchSingle
+	matchLinear
+	matchSorted
+)
+
+// newKindMatcher returns the kindMatcher for the kinds of a filter.
+// Like in go-nostr, nil kinds match every kind, while an empty slice matches none.
+// The provided slice is never modified.
+func newKindMatcher(kinds []int) kindMatcher {
+	switch {
+	case kinds == nil:
+		return kindMatcher{mode: matchAnyKind}
+
+	case len(kinds) == 1:
+		return kindMatcher{mode: matchSingle, single: kinds[0]}
+
+	case len(kinds) <= linearKindsThreshold:
+		return kindMatcher{mode: matchLinear, kinds: kinds}
+
+	default:
+		sorted := slices.Clone(kinds)
+		slices.Sort(sorted)
+		return kindMatcher{mode: matchSorted, kinds: sorted}
+	}
+}
+
+// contains reports whether the kind matches.
+// The common cases are kept small enough to be inlined in the scan loop.
+func (m *kindMatcher) contains(kind int) bool {
+	switch m.mode {
+	case matchSingle:
+		return kind == m.single
+	case matchAnyKind:
+		return true
+	}
+	return m.search(kind)
+}
+
+// search looks for the kind among the kinds of the filter.
+func (m *kindMatcher) search(kind int) bool {
+	if m.mode == matchLinear {
+		for _, k := range m.kinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+
+	_, found := slices.BinarySearch(m.kinds, kind)
+	return found
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKindMatcher(t *testing.T) {
+	tests := [][]int{
+		nil,
+		{7},
+		{3, 1, 2},
+		{64, 3, 9, 12, 1, 30, 7, 100, 2, 0, 55},
+	}
+
+	for _, kinds := range tests {
+		matcher := newKindMatcher(kinds)
+		for kind := range 120 {
+			expected := len(kinds) == 0 || slices.Contains(kinds, kind)
+			if got := matcher.contains(kind); got != expected {
+				t.Fatalf("kinds %v: expected contains(%d) to be %v, got %v", kinds, kind, expected, got)
+			}
+		}
+	}
+}
+
+func TestKindMatcherDoesNotModifyFilter(t *testing.T) {
+	kinds := []int{20, 19, 18, 17, 16, 15, 14, 13, 12, 11}
+	newKindMatcher(kinds)
+	if !slices.Equal(kinds, []int{20, 19, 18, 17, 16, 15, 14, 13, 12, 11}) {
+		t.Fatalf("The filter kinds were modified: %v", kinds)
+	}
+}
+
+func TestQueryManyKinds(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(200)
+	for i := range 200 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%100))
+	}
+
+	kinds := make([]int, 0, 50)
+	for k := 99; k >= 0; k -= 2 {
+		kinds = append(kinds, k)
+	}
+
+	events, err := cb.QueryEvents(ctx, nostr.Filter{Kinds: kinds})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	if len(events) != 100 {
+		t.Fatalf("Expected 100 events, got %d", len(events))
+	}
+	for _, evt := range events {
+		if evt.Kind%2 != 1 {
+			t.Fatalf("Event with kind %d should not match", evt.Kind)
+		}
+	}
+}
+
+// requestedKinds returns n distinct kinds, half of which are present in a buffer filled by fillKinds
+func requestedKinds(n int) []int {
+	kinds := make([]int, n)
+	for i := range kinds {
+		kinds[i] = i * 2
+	}
+	return kinds
+}
+
+// fillKinds returns a full buffer of 10k events with kinds in [0, 64)
+func fillKinds() *AtomicCircularBuffer2 {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10000)
+	for i := range 10000 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%64))
+	}
+	return cb
+}
+
+// BenchmarkKindMatching compares the linear scan of the filter kinds with the precomputed kindMatcher
+func BenchmarkKindMatching(b *testing.B) {
+	cb := fillKinds()
+	events := make([]*nostr.Event, 0, 10000)
+	for i := range cb.buffer {
+		events = append(events, cb.buffer[i].Load().Event)
+	}
+
+	for _, n := range []int{1, 8, 64} {
+		kinds := requestedKinds(n)
+
+		b.Run(fmt.Sprintf("linear-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matches := 0
+				for _, evt := range events {
+					if slices.Contains(kinds, evt.Kind) {
+						matches++
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("matcher-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matches := 0
+				matcher := newKindMatcher(kinds)
+				for _, evt := range events {
+					if matcher.contains(evt.Kind) {
+						matches++
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkQueryKinds tests query performance of AtomicCircularBuffer2 with 1, 8 and 64 requested kinds
+func BenchmarkQueryKinds(b *testing.B) {
+	cb := fillKinds()
+	ctx := context.Background()
+
+	for _, n := range []int{1, 8, 64} {
+		filter := nostr.Filter{Kinds: requestedKinds(n), Limit: 10000}
+
+		b.Run(fmt.Sprintf("kinds-%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = cb.QueryEvents(ctx, filter)
+			}
+		})
+	}
+}
@@ -2,36 +2,273 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"slices"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/fiatjaf/eventstore"
 	"github.com/fiatjaf/eventstore/sqlite3"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/pippellia-btc/rely"
+	"golang.org/x/sync/errgroup"
 )
 
+// maxParallelQueries bounds the number of store queries a single REQ can run concurrently.
+const maxParallelQueries = 8
+
 var (
-	db             sqlite3.SQLite3Backend
-	ephemeralStore *AtomicCircularBuffer2
+	db             eventstore.Store
+	ephemeralStore Store
+)
+
+var (
+	// DefaultLimit is the limit applied to the filters of a REQ that don't specify one.
+	// Zero means no default, leaving the filter unlimited.
+	DefaultLimit int
+
+	// MaxLimit is the maximum number of events a single filter is allowed to request.
+	// Larger limits are clamped to it. Zero means no maximum.
+	MaxLimit int
+
+	// MaxSubscriptions is the maximum number of subscriptions a client can have open at once.
+	// REQs opening more are closed, see [tooManySubscriptions]. Zero means no maximum.
+	MaxSubscriptions int
+
+	// AllowedEphemeralKinds restricts the ephemeral store to these kinds.
+	// Ephemeral events of other kinds are rejected. Empty means all ephemeral kinds are allowed.
+	AllowedEphemeralKinds []int
+
+	// SaveLimiter limits the rate at which each client can publish events. Nil means no limit.
+	SaveLimiter *RateLimiter
+
+	// MaxFutureDrift is how far in the future the CreatedAt of an event is allowed to be.
+	// Later events are rejected, as they would stay the newest. Zero means no check.
+	MaxFutureDrift time.Duration
+
+	// QueryTimeout is how long the queries of a REQ can run. When it expires, the queries still running are
+	// cancelled, and the events of the completed ones are returned. Zero means no timeout.
+	QueryTimeout time.Duration
+
+	// EphemeralFastPath makes REQs with a single filter for ephemeral kinds only query the ephemeral store,
+	// directly on the calling goroutine, as SQLite never stores ephemeral events. It's enabled by default.
+	EphemeralFastPath = true
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		ctx, cancel := context.WithCancel(context.Background())
+		go rely.HandleSignals(cancel)
+
+		err := runImport(ctx, os.Args[2:], os.Stdin)
+		cancel()
+
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] import failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] invalid configuration: %v", err)
+		os.Exit(2)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 	go rely.HandleSignals(cancel)
 
-	db = sqlite3.SQLite3Backend{DatabaseURL: "./rely-sqlite.db"}
+	err = run(ctx, cfg)
+	cancel()
+
+	if err != nil {
+		log.Printf("[ERROR] relay stopped: %v", err)
+		os.Exit(1)
+	}
+}
+
+// run sets up the stores as configured, and serves the relay on the configured address until ctx is cancelled.
+// It returns an error if the relay fails to start or stops unexpectedly.
+func run(ctx context.Context, cfg Config) error {
+	sqlite := &sqlite3.SQLite3Backend{DatabaseURL: cfg.SQLitePath}
+	if err := sqlite.Init(); err != nil {
+		return fmt.Errorf("failed to open the database %s: %w", cfg.SQLitePath, err)
+	}
+	defer sqlite.Close()
+	db = sqlite
+
+	store, err := newEphemeralStore(cfg)
+	if err != nil {
+		return err
+	}
+	holder := NewStoreHolder(store)
+	ephemeralStore = holder
+	log.Printf("[RELAY] ephemeral store implementation: %s, capacity: %d", cfg.EphemeralImpl, cfg.EphemeralCapacity)
+	go resetOnHangup(ctx, holder, cfg)
 
-	ephemeralStore = NewAtomicCircularBuffer2(500)
+	DefaultLimit = 100
+	MaxLimit = 500
+	MaxSubscriptions = 20
+
+	SaveLimiter = NewRateLimiter(20, 50)
+	MaxFutureDrift = 15 * time.Minute
+	QueryTimeout = cfg.QueryTimeout
+	MinPoW = cfg.MinPoW
+
+	MaxIDs = 500
+	MaxAuthors = 500
+	MaxTagValues = 1000
+
+	RelayInfo.Limitation = &nip11.RelayLimitationDocument{
+		MaxLimit:         MaxLimit,
+		MaxSubscriptions: MaxSubscriptions,
+		MaxEventTags:     2000,
+		MinPowDifficulty: MinPoW,
+	}
 
 	relay := rely.NewRelay()
 	relay.OnEvent = Save
 	relay.OnFilters = Query
+	relay.RejectFilters = append(relay.RejectFilters, tooManySubscriptions)
 
-	addr := "localhost:3334"
-	log.Printf("[RELAY] running on %s", addr)
+	log.Printf("[RELAY] running on %s", cfg.Addr)
 
-	if err := relay.StartAndServe(ctx, addr); err != nil {
+	if err := serve(ctx, relay, cfg.Addr); err != nil {
+		return fmt.Errorf("failed to serve the relay on %s: %w", cfg.Addr, err)
+	}
+	return nil
+}
+
+// tooManySubscriptions rejects the REQs of the clients that already have [MaxSubscriptions] subscriptions open.
+// A REQ replacing an open subscription with the same ID is rejected too, as the filters don't carry the ID.
+func tooManySubscriptions(c *rely.Client, _ nostr.Filters) error {
+	return checkSubscriptions(len(c.Subscriptions()))
+}
+
+// checkSubscriptions returns an error if a client with that many subscriptions open can't open another one.
+func checkSubscriptions(open int) error {
+	if MaxSubscriptions > 0 && open >= MaxSubscriptions {
+		return fmt.Errorf("rate-limited: too many open subscriptions, the maximum is %d", MaxSubscriptions)
+	}
+	return nil
+}
+
+// runImport runs the import subcommand, which saves the events of a JSON-lines file into the SQLite database
+// of the relay, see [ImportJSONL]. The file is read from stdin if its path is "-".
+//
+//	rely-evstore import [-sqlite-path path] [-verify] file.jsonl
+func runImport(ctx context.Context, args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("rely-evstore import", flag.ContinueOnError)
+	path := fs.String("sqlite-path", envOr(envKey("SQLITE_PATH", "RELY_SQLITE_PATH"), defaultSQLitePath), "path of the SQLite database")
+	verify := fs.Bool("verify", false, "verify the ID and the signature of every event")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected the path of the file to import, or - for stdin")
+	}
+
+	r := stdin
+	if name := fs.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	sqlite := &sqlite3.SQLite3Backend{DatabaseURL: *path}
+	if err := sqlite.Init(); err != nil {
+		return fmt.Errorf("failed to open the database %s: %w", *path, err)
+	}
+	defer sqlite.Close()
+
+	var opts []ImportOption
+	if *verify {
+		opts = append(opts, WithSignatureCheck())
+	}
+
+	imported, failed, err := ImportJSONL(ctx, r, newDatabaseStore(sqlite), opts...)
+	log.Printf("[RELAY] imported %d events into %s, %d failed", imported, *path, failed)
+	return err
+}
+
+// newEphemeralStore returns the ephemeral store as configured.
+// The bloom filter of the IDs is only supported by [ImplAtomic2].
+func newEphemeralStore(cfg Config) (Store, error) {
+	opts := []BufferOption{WithMaxEventSize(64 * 1024), WithMaxTags(2000)}
+	if cfg.EphemeralImpl == ImplAtomic2 {
+		opts = append(opts, WithIDBloomFilter())
+	}
+	return NewEphemeralStore(cfg.EphemeralImpl, cfg.EphemeralCapacity, opts...)
+}
+
+// resetOnHangup replaces the ephemeral store of the holder with an empty one every time the process
+// receives a SIGHUP, until ctx is cancelled. The relay keeps serving during the swap, see [StoreHolder].
+func resetOnHangup(ctx context.Context, holder *StoreHolder, cfg Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hangup:
+			store, err := newEphemeralStore(cfg)
+			if err != nil {
+				log.Printf("[ERROR] resetting the ephemeral store: %v", err)
+				continue
+			}
+
+			if old, ok := holder.Swap(store).(*AtomicCircularBuffer2); ok {
+				old.Close()
+			}
+			log.Printf("[RELAY] ephemeral store reset")
+		}
+	}
+}
+
+// serve is like [rely.Relay.StartAndServe], but also serves the NIP-11 relay information document.
+// It blocks until ctx is cancelled, then shuts down the server.
+func serve(ctx context.Context, relay *rely.Relay, addr string) error {
+	relay.Start(ctx)
+	server := &http.Server{Addr: addr, Handler: withRelayInfo(relay)}
+
+	exitErr := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			exitErr <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+
+	case err := <-exitErr:
+		return err
 	}
 }
 
@@ -39,8 +276,18 @@ func Save(c *rely.Client, e *nostr.Event) error {
 	log.Printf("[EVENT] received: %s (kind: %d)", e.ID, e.Kind)
 	ctx := context.Background()
 
+	if err := validate(ctx, c, e); err != nil {
+		log.Printf("[REJECTED] %s: %v", e.ID, err)
+		return err
+	}
+
 	switch {
 	case nostr.IsEphemeralKind(e.Kind):
+		if len(AllowedEphemeralKinds) > 0 && !slices.Contains(AllowedEphemeralKinds, e.Kind) {
+			log.Printf("[REJECTED] %s: ephemeral kind %d not allowed", e.ID, e.Kind)
+			return fmt.Errorf("blocked: ephemeral kind %d is not accepted by this relay", e.Kind)
+		}
+
 		err := ephemeralStore.SaveEvent(ctx, e)
 		if err != nil {
 			log.Printf("[ERROR] storing ephemeral event: %v", err)
@@ -59,6 +306,13 @@ func Save(c *rely.Client, e *nostr.Event) error {
 			return err
 		}
 		log.Printf("[REGULAR] saved: %s", e.ID)
+
+		if e.Kind == nostr.KindDeletion {
+			if err := handleDeletion(ctx, e); err != nil {
+				log.Printf("[ERROR] handling deletion request: %v", err)
+				return err
+			}
+		}
 		return nil
 	}
 }
@@ -73,54 +327,337 @@ func saveReplaceableEvent(ctx context.Context, e *nostr.Event) error {
 	return nil
 }
 
+// Query runs every filter against SQLite and the ephemeral store.
+// All these queries run concurrently, and their results are merged as they complete.
+// The merged events are deduplicated, sorted newest first and capped to the sum of the limits, see [maxResults].
+// The first SQLite error cancels the remaining queries and is returned, while errors
+// from the ephemeral store are only logged. See [EphemeralFastPath] for the REQs skipping SQLite,
+// and [queryByIDs] for the REQs asking for events by ID only.
+// The queries still running after [QueryTimeout] are cancelled, and the events of the completed ones are returned,
+// as are the events found so far by the fast path and by the lookups by ID.
 func Query(ctx context.Context, c *rely.Client, filters nostr.Filters) ([]nostr.Event, error) {
 	log.Printf("[QUERY] received filters with %d subscriptions", len(filters))
 
-	capacity := estimateCapacityFromFilters(filters)
-	result := make([]nostr.Event, 0, capacity)
+	for _, filter := range filters {
+		if err := checkComplexity(filter); err != nil {
+			log.Printf("[REJECTED] filter: %v", err)
+			return nil, err
+		}
+	}
+
+	// the context of the caller tells its cancellation apart from the timeout
+	parent := ctx
+	if QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, QueryTimeout)
+		defer cancel()
+	}
+
+	filters = applyLimits(filters)
+	if EphemeralFastPath && isEphemeralOnly(filters) {
+		result, err := queryEphemeral(ctx, filters[0])
+		if timedOut(parent, err) {
+			log.Printf("[WARN] query timed out, returning the %d events found so far", len(result))
+		}
+		return result, nil
+	}
+	if isIDsOnly(filters) {
+		result, err := queryByIDs(ctx, filters)
+		if timedOut(parent, err) {
+			log.Printf("[WARN] query timed out, returning the %d events found so far", len(result))
+			return result, nil
+		}
+		return result, err
+	}
+
+	shape := reqShape(filters)
+	result := make([]nostr.Event, 0, estimateCapacity(filters))
+
+	var mu sync.Mutex
+	collect := func(events []*nostr.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range events {
+			if event != nil {
+				result = append(result, *event)
+			}
+		}
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(maxParallelQueries)
 
 	for _, filter := range filters {
-		hasEphemeralKinds := false
 		if len(filter.Kinds) > 0 {
-			hasEphemeralKinds = slices.ContainsFunc(filter.Kinds, nostr.IsEphemeralKind)
+			hasEphemeralKinds := slices.ContainsFunc(filter.Kinds, nostr.IsEphemeralKind)
 			log.Printf("[DEBUG] filter has kinds: %v, hasEphemeralKinds: %v", filter.Kinds, hasEphemeralKinds)
 		} else {
 			// If no kinds specified, assume all kinds including ephemeral
-			hasEphemeralKinds = true
 			log.Printf("[DEBUG] filter has no kinds specified, assuming hasEphemeralKinds: true")
 		}
 
-		eventChan, err := db.QueryEvents(ctx, filter)
-		if err != nil {
-			log.Printf("[ERROR] querying events: %v", err)
-			return nil, err
-		}
-		for event := range eventChan {
-			result = append(result, *event)
-		}
+		group.Go(func() error {
+			events, err := queryDB(ctx, filter)
+			if err != nil {
+				log.Printf("[ERROR] querying events: %v", err)
+				return err
+			}
+			collect(events)
+			return nil
+		})
 
 		// Always query ephemeral store for events, regardless of filter kinds
 		// This ensures we don't miss any ephemeral events
-		log.Printf("[DEBUG] querying ephemeral store for filter: %v", filter)
-		events, err := ephemeralStore.QueryEvents(ctx, filter)
-		if err != nil {
-			log.Printf("[ERROR] querying ephemeral events: %v", err)
-		} else {
-			for _, event := range events {
-				if event != nil {
-					result = append(result, *event)
-				}
+		group.Go(func() error {
+			log.Printf("[DEBUG] querying ephemeral store for filter: %v", filter)
+			events, err := queryEphemeralStore(ctx, filter)
+			if err != nil {
+				log.Printf("[ERROR] querying ephemeral events: %v", err)
+				return nil
 			}
-		}
+			collect(events)
+			return nil
+		})
+	}
+
+	// the partial results of the queries timing out are not observed, as they would skew the estimates
+	err := group.Wait()
+	switch {
+	case timedOut(parent, err):
+		log.Printf("[WARN] query timed out, returning the %d events found so far", len(result))
+	case err != nil:
+		return nil, err
+	default:
+		resultSizes.observe(shape, len(result))
 	}
+	result = mergeResults(result, maxResults(filters))
 
 	log.Printf("[QUERY] found %d events matching filters", len(result))
 	return result, nil
 }
 
+// timedOut reports whether the error is the expiration of [QueryTimeout], rather than the cancellation
+// of the parent context of the query.
+func timedOut(parent context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil
+}
+
+// isEphemeralOnly reports whether the filters are a single filter that only matches ephemeral kinds.
+func isEphemeralOnly(filters nostr.Filters) bool {
+	if len(filters) != 1 || len(filters[0].Kinds) == 0 {
+		return false
+	}
+	for _, kind := range filters[0].Kinds {
+		if !nostr.IsEphemeralKind(kind) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryEphemeral returns the events of the ephemeral store matching the filter, sorted newest first.
+// Like in [Query], errors from the ephemeral store are only logged, but returned along with the events
+// found before ctx was done, if any, so that the caller can tell a timeout.
+func queryEphemeral(ctx context.Context, filter nostr.Filter) ([]nostr.Event, error) {
+	events, err := queryEphemeralStore(ctx, filter)
+	if err != nil {
+		log.Printf("[ERROR] querying ephemeral events: %v", err)
+	}
+
+	result := make([]nostr.Event, 0, len(events))
+	for _, event := range events {
+		if event != nil {
+			result = append(result, *event)
+		}
+	}
+	result = mergeResults(result, filter.Limit)
+
+	log.Printf("[QUERY] found %d ephemeral events matching the filter", len(result))
+	return result, err
+}
+
+// orderedStore is implemented by the stores that can apply the limit of a filter to the newest events,
+// like [AtomicCircularBuffer2].
+type orderedStore interface {
+	QueryEventsOrdered(ctx context.Context, filter nostr.Filter, opts QueryOptions) ([]*nostr.Event, error)
+}
+
+// queryEphemeralStore returns the events of the ephemeral store matching the filter, including the newest
+// ones within its limit, as the results are merged by [mergeResults] which keeps the newest.
+// Stores that are not an [orderedStore] apply the limit in insertion order, so they are queried without it.
+// A store held by a [StoreHolder] is queried directly.
+func queryEphemeralStore(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	store := loadEphemeralStore()
+	if ordered, ok := store.(orderedStore); ok {
+		return ordered.QueryEventsOrdered(ctx, filter, QueryOptions{Order: Descending})
+	}
+
+	filter.Limit = 0
+	return store.QueryEvents(ctx, filter)
+}
+
+// loadEphemeralStore returns the ephemeral store, or the store it currently forwards to if it's a [StoreHolder],
+// so that the optional methods of the store, like the ordered queries or the deletions, can be used.
+func loadEphemeralStore() Store {
+	if holder, ok := ephemeralStore.(*StoreHolder); ok {
+		return holder.Load()
+	}
+	return ephemeralStore
+}
+
+// isIDsOnly reports whether the filters only ask for events by their full IDs, with no other constraint.
+// Prefixes are excluded, as they can match any number of events.
+func isIDsOnly(filters nostr.Filters) bool {
+	if len(filters) == 0 {
+		return false
+	}
+	for _, filter := range filters {
+		if len(filter.IDs) == 0 || filter.LimitZero || filter.Kinds != nil || filter.Authors != nil ||
+			filter.Tags != nil || filter.Since != nil || filter.Until != nil || filter.Search != "" {
+			return false
+		}
+		for _, id := range filter.IDs {
+			if len(id) != 64 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queryByIDs returns the events with the IDs requested by the filters, see [isIDsOnly], sorted newest first.
+// The IDs are looked up in the ephemeral store first, and only the ones it doesn't have are looked up
+// in SQLite by primary key, which is skipped altogether when all of them are found.
+// Like in [Query], errors from the ephemeral store are only logged, while SQLite errors are returned,
+// along with the events found before ctx was done, if any, so that the caller can return them after a timeout.
+func queryByIDs(ctx context.Context, filters nostr.Filters) ([]nostr.Event, error) {
+	var wanted []string
+	for _, filter := range filters {
+		wanted = append(wanted, lowercased(filter.IDs)...)
+	}
+	slices.Sort(wanted)
+	wanted = slices.Compact(wanted)
+
+	found := make(map[string]*nostr.Event, len(wanted))
+	events, err := ephemeralStore.QueryEvents(ctx, nostr.Filter{IDs: wanted})
+	if err != nil {
+		log.Printf("[ERROR] querying ephemeral events: %v", err)
+	}
+	for _, event := range events {
+		if event != nil {
+			found[event.ID] = event
+		}
+	}
+
+	// the events found before ctx is done are kept, while the other SQLite errors fail the query
+	var dbErr error
+	missing := slices.DeleteFunc(slices.Clone(wanted), func(id string) bool { return found[id] != nil })
+	if len(missing) > 0 {
+		events, dbErr = queryDB(ctx, nostr.Filter{IDs: missing})
+		if dbErr != nil {
+			log.Printf("[ERROR] querying events: %v", dbErr)
+			if ctx.Err() == nil {
+				return nil, dbErr
+			}
+		}
+		for _, event := range events {
+			if event != nil {
+				found[event.ID] = event
+			}
+		}
+	}
+
+	// every filter keeps its own limit, before the results are merged like in Query
+	result := make([]nostr.Event, 0, len(found))
+	for _, filter := range filters {
+		var matched []nostr.Event
+		for _, id := range lowercased(filter.IDs) {
+			if event, ok := found[id]; ok {
+				matched = append(matched, *event)
+			}
+		}
+		result = append(result, mergeResults(matched, filter.Limit)...)
+	}
+	result = mergeResults(result, maxResults(filters))
+
+	log.Printf("[QUERY] found %d of %d events requested by ID", len(result), len(wanted))
+	return result, dbErr
+}
+
+// applyLimits returns a copy of the filters with [DefaultLimit] applied to the ones without a limit,
+// and every limit clamped to [MaxLimit]. Filters with LimitZero are left untouched.
+func applyLimits(filters nostr.Filters) nostr.Filters {
+	limited := make(nostr.Filters, len(filters))
+	for i, filter := range filters {
+		if !filter.LimitZero {
+			if filter.Limit == 0 && DefaultLimit > 0 {
+				filter.Limit = DefaultLimit
+			}
+			if MaxLimit > 0 && filter.Limit > MaxLimit {
+				filter.Limit = MaxLimit
+			}
+		}
+		limited[i] = filter
+	}
+	return limited
+}
+
+// maxResults returns the maximum number of events to return for the filters of a REQ, which is the sum of their limits.
+// Filters with LimitZero don't count. It returns 0, meaning no maximum, if any other filter has no limit.
+func maxResults(filters nostr.Filters) int {
+	total := 0
+	for _, filter := range filters {
+		if filter.LimitZero {
+			continue
+		}
+		if filter.Limit == 0 {
+			return 0
+		}
+		total += filter.Limit
+	}
+	return total
+}
+
+// mergeResults sorts the events newest first, removes the duplicates and keeps at most limit of them.
+// A limit of 0 keeps all the events. The order is deterministic regardless of the store each event comes from:
+// events with the same CreatedAt are ordered by ID, the lowest first, as in [Descending] order.
+func mergeResults(events []nostr.Event, limit int) []nostr.Event {
+	slices.SortFunc(events, func(a, b nostr.Event) int { return compareDescending(&a, &b) })
+
+	// duplicates have the same CreatedAt and ID, so they are next to each other
+	events = slices.CompactFunc(events, func(a, b nostr.Event) bool { return a.ID == b.ID })
+
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// queryDB returns the events of the database matching the filter.
+// It stops early if ctx gets cancelled, returning the events received so far with the context error.
+func queryDB(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	eventChan, err := db.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*nostr.Event
+	for {
+		select {
+		case <-ctx.Done():
+			return events, ctx.Err()
+
+		case event, ok := <-eventChan:
+			if !ok {
+				return events, nil
+			}
+			events = append(events, event)
+		}
+	}
+}
+
 func estimateCapacityFromFilters(filters nostr.Filters) int {
 	const defaultCapacity = 16
-	const maxCapacity = 2048
 	const eventsPerFilter = 32
 
 	if len(filters) == 0 {
@@ -145,8 +682,8 @@ func estimateCapacityFromFilters(filters nostr.Filters) int {
 		return defaultCapacity
 	}
 
-	if totalCapacity > maxCapacity {
-		return maxCapacity
+	if totalCapacity > maxResultCapacity {
+		return maxResultCapacity
 	}
 
 	return totalCapacity
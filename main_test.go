@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+// mockStore is an in-memory eventstore.Store whose queries take a configurable time.
+type mockStore struct {
+	delay   time.Duration
+	err     error
+	events  []*nostr.Event
+	queries atomic.Int64
+}
+
+func (m *mockStore) Init() error { return nil }
+func (m *mockStore) Close()      {}
+
+func (m *mockStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	m.events = append(m.events, evt)
+	return nil
+}
+
+func (m *mockStore) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	return m.SaveEvent(ctx, evt)
+}
+
+func (m *mockStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	m.events = slices.DeleteFunc(m.events, func(e *nostr.Event) bool { return e.ID == evt.ID })
+	return nil
+}
+
+func (m *mockStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	m.queries.Add(1)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(m.delay):
+	}
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	ch := make(chan *nostr.Event, len(m.events))
+	for _, evt := range m.events {
+		if filter.Matches(evt) {
+			ch <- evt
+		}
+	}
+	close(ch)
+	return ch, nil
+}
+
+// setupStores replaces the global stores for the duration of the test.
+func setupStores(t *testing.T, store *mockStore, ephemeral Store) {
+	oldDB, oldEphemeral := db, ephemeralStore
+	db, ephemeralStore = store, ephemeral
+	t.Cleanup(func() { db, ephemeralStore = oldDB, oldEphemeral })
+}
+
+func TestQueryParallel(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	store := &mockStore{delay: delay, events: []*nostr.Event{createTestEvent("regular", 1)}}
+	ephemeral := NewAtomicCircularBuffer2(10)
+	ephemeral.SaveEvent(context.Background(), createTestEvent("ephemeral", 20000))
+	setupStores(t, store, ephemeral)
+
+	filters := nostr.Filters{{Kinds: []int{1}}, {Kinds: []int{20000}}}
+
+	start := time.Now()
+	events, err := Query(context.Background(), nil, filters)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+
+	// sequential queries would take 2*delay
+	if elapsed > delay*3/2 {
+		t.Fatalf("Expected the queries to run in parallel, took %v", elapsed)
+	}
+}
+
+func TestQueryReturnsError(t *testing.T) {
+	errBroken := errors.New("database is broken")
+	setupStores(t, &mockStore{err: errBroken}, NewAtomicCircularBuffer2(10))
+
+	_, err := Query(context.Background(), nil, nostr.Filters{{}, {}})
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("Expected the database error, got %v", err)
+	}
+}
+
+func TestQueryCancelled(t *testing.T) {
+	setupStores(t, &mockStore{delay: time.Second}, NewAtomicCircularBuffer2(10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := Query(ctx, nil, nostr.Filters{{}}); err == nil {
+		t.Fatal("Expected an error for a cancelled query")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected the query to stop on cancellation, took %v", elapsed)
+	}
+}
+
+// setLimits replaces DefaultLimit and MaxLimit for the duration of the test.
+func setLimits(t *testing.T, defaultLimit, maxLimit int) {
+	oldDefault, oldMax := DefaultLimit, MaxLimit
+	DefaultLimit, MaxLimit = defaultLimit, maxLimit
+	t.Cleanup(func() { DefaultLimit, MaxLimit = oldDefault, oldMax })
+}
+
+func TestQueryLimits(t *testing.T) {
+	ctx := context.Background()
+	ephemeral := NewAtomicCircularBuffer2(10)
+	for i := range 20 {
+		ephemeral.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000))
+	}
+	setupStores(t, &mockStore{}, ephemeral)
+
+	tests := []struct {
+		name         string
+		defaultLimit int
+		maxLimit     int
+		filter       nostr.Filter
+		expected     int
+	}{
+		{"no limits", 0, 0, nostr.Filter{}, 10},
+		{"default applied", 3, 0, nostr.Filter{}, 3},
+		{"explicit limit wins over default", 3, 0, nostr.Filter{Limit: 7}, 7},
+		{"limit clamped to max", 0, 5, nostr.Filter{Limit: 1000}, 5},
+		{"default clamped to max", 8, 4, nostr.Filter{}, 4},
+		{"limit below max", 0, 5, nostr.Filter{Limit: 2}, 2},
+		{"default above buffer capacity", 50, 0, nostr.Filter{}, 10},
+		{"max above buffer capacity", 0, 50, nostr.Filter{Limit: 1000}, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setLimits(t, test.defaultLimit, test.maxLimit)
+
+			events, err := Query(ctx, nil, nostr.Filters{test.filter})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(events) != test.expected {
+				t.Fatalf("Expected %d events, got %d", test.expected, len(events))
+			}
+		})
+	}
+}
+
+func TestApplyLimitsDoesNotModifyFilters(t *testing.T) {
+	setLimits(t, 10, 20)
+
+	filters := nostr.Filters{{}, {Limit: 100}, {LimitZero: true}}
+	limited := applyLimits(filters)
+
+	if filters[0].Limit != 0 || filters[1].Limit != 100 {
+		t.Fatalf("Expected the original filters to be unchanged, got %v", filters)
+	}
+	if limited[0].Limit != 10 || limited[1].Limit != 20 || limited[2].Limit != 0 {
+		t.Fatalf("Expected limits 10, 20 and 0, got %d, %d and %d", limited[0].Limit, limited[1].Limit, limited[2].Limit)
+	}
+}
+
+func TestRunBusyPort(t *testing.T) {
+	setupStores(t, &mockStore{}, NewAtomicCircularBuffer2(10))
+	setLimits(t, 0, 0)
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	cfg := Config{
+		Addr:              listener.Addr().String(),
+		EphemeralImpl:     ImplAtomic2,
+		EphemeralCapacity: 10,
+		SQLitePath:        filepath.Join(t.TempDir(), "relay.db"),
+	}
+	if err := run(ctx, cfg); err == nil {
+		t.Fatal("Expected an error when the port is already in use")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Expected run to fail before the context expired")
+	}
+}
+
+func TestQueryRejectsComplexFilters(t *testing.T) {
+	setupStores(t, &mockStore{}, NewAtomicCircularBuffer2(10))
+	setComplexityLimits(t, 0, 2, 0)
+
+	_, err := Query(context.Background(), nil, nostr.Filters{{}, {Authors: []string{"a", "b", "c"}}})
+	if !errors.Is(err, ErrFilterTooComplex) {
+		t.Fatalf("Expected ErrFilterTooComplex, got %v", err)
+	}
+}
+
+// setAllowedEphemeralKinds replaces AllowedEphemeralKinds for the duration of the test.
+func setAllowedEphemeralKinds(t *testing.T, kinds ...int) {
+	old := AllowedEphemeralKinds
+	AllowedEphemeralKinds = kinds
+	t.Cleanup(func() { AllowedEphemeralKinds = old })
+}
+
+func TestSaveAllowedEphemeralKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []int
+		kind    int
+		stored  bool
+	}{
+		{"allowed kind", []int{20000, 20001}, 20001, true},
+		{"disallowed kind", []int{20000, 20001}, 25000, false},
+		{"empty allowlist", nil, 25000, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ephemeral := NewAtomicCircularBuffer2(10)
+			setupStores(t, &mockStore{}, ephemeral)
+			setAllowedEphemeralKinds(t, test.allowed...)
+
+			err := Save(&rely.Client{}, createTestEvent("id-0", test.kind))
+			stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+
+			if test.stored {
+				if err != nil {
+					t.Fatalf("Expected the event to be accepted, got %v", err)
+				}
+				if len(stored) != 1 {
+					t.Fatalf("Expected the event to be stored, got %d events", len(stored))
+				}
+				return
+			}
+
+			if err == nil || !strings.HasPrefix(err.Error(), "blocked:") {
+				t.Fatalf("Expected an error starting with %q, got %v", "blocked:", err)
+			}
+			if len(stored) != 0 {
+				t.Fatalf("Expected the rejected event not to be stored, got %d events", len(stored))
+			}
+		})
+	}
+}
+
+func TestQueryMergesResults(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	// the same 15 events are in both stores, so every filter gets duplicates
+	var events []*nostr.Event
+	ephemeral := NewAtomicCircularBuffer2(20)
+	for i := range 15 {
+		evt := createTimedEvent(fmt.Sprintf("id-%02d", i), int64(1000+i))
+		events = append(events, evt)
+		ephemeral.SaveEvent(ctx, evt)
+	}
+	setupStores(t, &mockStore{events: events}, ephemeral)
+
+	// the two filters overlap on the kind 1 events
+	filters := nostr.Filters{{Kinds: []int{1}, Limit: 10}, {Limit: 10}}
+	result, err := Query(ctx, nil, filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(result) != 15 {
+		t.Fatalf("Expected the 15 distinct events, got %d", len(result))
+	}
+	for i, evt := range result {
+		if expected := fmt.Sprintf("id-%02d", 14-i); evt.ID != expected {
+			t.Fatalf("Expected %s at position %d, newest first, got %s", expected, i, evt.ID)
+		}
+	}
+
+	// with more distinct events than the sum of the limits, the result is capped
+	for i := 15; i < 40; i++ {
+		evt := createTimedEvent(fmt.Sprintf("id-%02d", i), int64(1000+i))
+		events = append(events, evt)
+	}
+	setupStores(t, &mockStore{events: events}, ephemeral)
+
+	result, err = Query(ctx, nil, filters)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(result) != 20 {
+		t.Fatalf("Expected the result to be capped to 20 events, got %d", len(result))
+	}
+	if result[0].ID != "id-39" {
+		t.Fatalf("Expected the newest event first, got %s", result[0].ID)
+	}
+}
+
+// TestQueryMergeOrder tests that the events of both stores are merged in a deterministic order,
+// newest first and by ID for the same CreatedAt, before the limit is applied
+func TestQueryMergeOrder(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	// the events of the two stores share their timestamps, and are saved out of order
+	stored := []struct {
+		id        string
+		createdAt int64
+		ephemeral bool
+	}{
+		{"d", 1002, false},
+		{"a", 1000, true},
+		{"f", 1002, true},
+		{"b", 1001, false},
+		{"e", 1002, true},
+		{"c", 1001, true},
+		{"g", 1000, false},
+		{"h", 1003, true},
+		{"i", 1001, false},
+	}
+
+	filters := nostr.Filters{{Kinds: []int{1, 20000}, Limit: 4}}
+	expected := []string{"h", "d", "e", "f"}
+
+	for _, impl := range []string{ImplMutex, ImplAtomic1, ImplAtomic2} {
+		t.Run(impl, func(t *testing.T) {
+			ephemeral, err := NewEphemeralStore(impl, 10)
+			if err != nil {
+				t.Fatalf("Failed to create the store: %v", err)
+			}
+			store := &mockStore{}
+
+			for _, s := range stored {
+				evt := createTimedEvent(s.id, s.createdAt)
+				if s.ephemeral {
+					evt.Kind = 20000
+					ephemeral.SaveEvent(ctx, evt)
+				} else {
+					store.SaveEvent(ctx, evt)
+				}
+			}
+			setupStores(t, store, ephemeral)
+
+			events, err := Query(ctx, nil, filters)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, evt := range events {
+				got = append(got, evt.ID)
+			}
+			if !slices.Equal(got, expected) {
+				t.Fatalf("Expected %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	tests := []struct {
+		filters  nostr.Filters
+		expected int
+	}{
+		{nostr.Filters{{Limit: 10}, {Limit: 5}}, 15},
+		{nostr.Filters{{Limit: 10}, {}}, 0},
+		{nostr.Filters{{Limit: 10}, {LimitZero: true}}, 10},
+	}
+
+	for _, test := range tests {
+		if got := maxResults(test.filters); got != test.expected {
+			t.Errorf("maxResults(%v): expected %d, got %d", test.filters, test.expected, got)
+		}
+	}
+}
+
+// setEphemeralFastPath replaces EphemeralFastPath for the duration of the test.
+func setEphemeralFastPath(t testing.TB, enabled bool) {
+	old := EphemeralFastPath
+	EphemeralFastPath = enabled
+	t.Cleanup(func() { EphemeralFastPath = old })
+}
+
+func TestQueryEphemeralFastPath(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	ephemeral := NewAtomicCircularBuffer2(20)
+	for i := range 10 {
+		ephemeral.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%02d", i), int64(1000+i)))
+	}
+	for i := range 10 {
+		evt := createTimedEvent(fmt.Sprintf("ephemeral-%02d", i), int64(1000+i))
+		evt.Kind = 20000
+		ephemeral.SaveEvent(ctx, evt)
+	}
+
+	// the database always fails, so only the fast path can succeed
+	setupStores(t, &mockStore{err: errors.New("database is broken")}, ephemeral)
+
+	filters := nostr.Filters{{Kinds: []int{20000, 20001}, Limit: 3}}
+	setEphemeralFastPath(t, false)
+	if _, err := Query(ctx, nil, filters); err == nil {
+		t.Fatal("Expected the general path to query the database")
+	}
+
+	setEphemeralFastPath(t, true)
+	events, err := Query(ctx, nil, filters)
+	if err != nil {
+		t.Fatalf("Expected the fast path to skip the database, got %v", err)
+	}
+
+	var got []string
+	for _, evt := range events {
+		got = append(got, evt.ID)
+	}
+	if expected := []string{"ephemeral-09", "ephemeral-08", "ephemeral-07"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// filters with regular kinds, or more than one filter, take the general path
+	for _, filters := range []nostr.Filters{
+		{{Kinds: []int{20000, 1}}},
+		{{}},
+		{{Kinds: []int{20000}}, {Kinds: []int{20001}}},
+	} {
+		if _, err := Query(ctx, nil, filters); err == nil {
+			t.Fatalf("Expected %v to query the database", filters)
+		}
+	}
+}
+
+func BenchmarkQueryEphemeral(b *testing.B) {
+	ctx := context.Background()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ephemeral := NewAtomicCircularBuffer2(500)
+	for i := range 500 {
+		ephemeral.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000+i%10))
+	}
+
+	oldDB, oldEphemeral := db, ephemeralStore
+	db, ephemeralStore = &mockStore{}, ephemeral
+	b.Cleanup(func() { db, ephemeralStore = oldDB, oldEphemeral })
+
+	filters := nostr.Filters{{Kinds: []int{20003}, Limit: 20}}
+
+	b.Run("fast", func(b *testing.B) {
+		setEphemeralFastPath(b, true)
+		for i := 0; i < b.N; i++ {
+			_, _ = Query(ctx, nil, filters)
+		}
+	})
+
+	b.Run("general", func(b *testing.B) {
+		setEphemeralFastPath(b, false)
+		for i := 0; i < b.N; i++ {
+			_, _ = Query(ctx, nil, filters)
+		}
+	})
+}
+
+// setMaxFutureDrift replaces MaxFutureDrift for the duration of the test.
+func setMaxFutureDrift(t *testing.T, drift time.Duration) {
+	old := MaxFutureDrift
+	MaxFutureDrift = drift
+	t.Cleanup(func() { MaxFutureDrift = old })
+}
+
+func TestSaveFutureEvents(t *testing.T) {
+	ephemeral := NewAtomicCircularBuffer2(10)
+	setupStores(t, &mockStore{}, ephemeral)
+	setMaxFutureDrift(t, 15*time.Minute)
+
+	now := time.Now()
+	withinDrift := createTimedEvent("within-drift", now.Add(time.Minute).Unix())
+	withinDrift.Kind = 20000
+	if err := Save(&rely.Client{}, withinDrift); err != nil {
+		t.Fatalf("Expected the event within the drift to be accepted, got %v", err)
+	}
+
+	farFuture := createTimedEvent("far-future", now.Add(time.Hour).Unix())
+	farFuture.Kind = 20000
+	err := Save(&rely.Client{}, farFuture)
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid:") {
+		t.Fatalf("Expected an error starting with %q, got %v", "invalid:", err)
+	}
+
+	stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+	if len(stored) != 1 || stored[0].ID != "within-drift" {
+		t.Fatalf("Expected only the event within the drift to be stored, got %v", ids(stored))
+	}
+}
+
+func TestQueryByIDs(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	ephemeral := NewAtomicCircularBuffer2(10, WithIDBloomFilter())
+	store := &mockStore{}
+	for i := range 6 {
+		evt := createTimedEvent(hexID(i), int64(1000+i))
+		if i%2 == 0 {
+			evt.Kind = 20000
+			ephemeral.SaveEvent(ctx, evt)
+		} else {
+			store.SaveEvent(ctx, evt)
+		}
+	}
+	setupStores(t, store, ephemeral)
+
+	tests := []struct {
+		name     string
+		filters  nostr.Filters
+		expected []string
+		queries  int64
+	}{
+		{"ephemeral only", nostr.Filters{{IDs: []string{hexID(0), hexID(4)}}}, []string{hexID(4), hexID(0)}, 0},
+		{"both stores", nostr.Filters{{IDs: []string{hexID(1), hexID(2), hexID(5)}}}, []string{hexID(5), hexID(2), hexID(1)}, 1},
+		{"unknown ID", nostr.Filters{{IDs: []string{hexID(3), hexID(100)}}}, []string{hexID(3)}, 1},
+		{"uppercase ID", nostr.Filters{{IDs: []string{strings.ToUpper(hexID(2))}}}, []string{hexID(2)}, 0},
+		{"limit per filter", nostr.Filters{{IDs: []string{hexID(0), hexID(1), hexID(2)}, Limit: 1}, {IDs: []string{hexID(3)}}}, []string{hexID(3), hexID(2)}, 1},
+		{"duplicate IDs", nostr.Filters{{IDs: []string{hexID(1), hexID(4)}}, {IDs: []string{hexID(4), hexID(1)}}}, []string{hexID(4), hexID(1)}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store.queries.Store(0)
+			events, err := Query(ctx, nil, test.filters)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, evt := range events {
+				got = append(got, evt.ID)
+			}
+			if !slices.Equal(got, test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+			if queries := store.queries.Load(); queries != test.queries {
+				t.Fatalf("Expected %d database queries, got %d", test.queries, queries)
+			}
+		})
+	}
+
+	// prefixes and other constraints take the general path
+	for _, filters := range []nostr.Filters{
+		{{IDs: []string{hexID(1)[:10]}}},
+		{{IDs: []string{hexID(1)}, Kinds: []int{1}}},
+		{{IDs: []string{hexID(1)}}, {Kinds: []int{1}}},
+	} {
+		if isIDsOnly(filters) {
+			t.Fatalf("Expected %v not to be an IDs only REQ", filters)
+		}
+	}
+}
+
+// setQueryTimeout replaces QueryTimeout for the duration of the test.
+func setQueryTimeout(t *testing.T, timeout time.Duration) {
+	old := QueryTimeout
+	QueryTimeout = timeout
+	t.Cleanup(func() { QueryTimeout = old })
+}
+
+// TestQueryTimeout tests that the queries of a REQ running past the timeout are cancelled promptly,
+// returning the events of the queries completed in time
+func TestQueryTimeout(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	// the scan for 100 authors of a large buffer takes much longer than the timeout
+	large := NewAtomicCircularBuffer2(200_000)
+	for i := range 200_000 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), 20000)
+		evt.PubKey = hexID(i % 1000)
+		large.SaveEvent(ctx, evt)
+	}
+	authors := make([]string, 100)
+	for i := range authors {
+		authors[i] = hexID(1000 + i)
+	}
+
+	slow := &mockStore{delay: 10 * time.Second}
+	setupStores(t, slow, large)
+	setQueryTimeout(t, 5*time.Millisecond)
+
+	for _, filters := range []nostr.Filters{
+		{{Authors: authors}},
+		{{Authors: authors, Kinds: []int{20000}}},
+	} {
+		start := time.Now()
+		events, err := Query(ctx, nil, filters)
+		if err != nil {
+			t.Fatalf("Expected the timeout not to fail the query, got %v", err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("Expected no events, got %d", len(events))
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Expected the query to be cancelled promptly, took %v", elapsed)
+		}
+	}
+
+	// the events of the ephemeral store are returned, while SQLite times out
+	small := NewAtomicCircularBuffer2(10)
+	for i := range 5 {
+		small.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("ephemeral-%d", i), int64(1000+i)))
+	}
+	setupStores(t, slow, small)
+	setQueryTimeout(t, 50*time.Millisecond)
+
+	events, err := Query(ctx, nil, nostr.Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatalf("Expected the timeout not to fail the query, got %v", err)
+	}
+	if len(events) != 5 || events[0].ID != "ephemeral-4" {
+		t.Fatalf("Expected the 5 ephemeral events, got %d", len(events))
+	}
+
+	// the events requested by ID found in the ephemeral store are returned, while SQLite times out
+	found, missing := createTestEvent(hexID(1), 20000), hexID(2)
+	small.SaveEvent(ctx, found)
+	events, err = Query(ctx, nil, nostr.Filters{{IDs: []string{found.ID, missing}}})
+	if err != nil {
+		t.Fatalf("Expected the timeout not to fail the query, got %v", err)
+	}
+	if len(events) != 1 || events[0].ID != found.ID {
+		t.Fatalf("Expected the event found in the ephemeral store, got %v", events)
+	}
+
+	// the fast path returns the events found before the timeout
+	setEphemeralFastPath(t, true)
+	setupStores(t, slow, large)
+	setQueryTimeout(t, time.Millisecond)
+	start := time.Now()
+	events, err = Query(ctx, nil, nostr.Filters{{Kinds: []int{20000}}})
+	if err != nil || len(events) == 0 {
+		t.Fatalf("Expected the events found before the timeout, got %d (%v)", len(events), err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the query to be cancelled promptly, took %v", elapsed)
+	}
+}
+
+func TestMaxSubscriptions(t *testing.T) {
+	old := MaxSubscriptions
+	t.Cleanup(func() { MaxSubscriptions = old })
+
+	MaxSubscriptions = 2
+	for open, rejected := range []bool{false, false, true, true} {
+		err := checkSubscriptions(open)
+		if rejected && (err == nil || !strings.HasPrefix(err.Error(), "rate-limited:")) {
+			t.Fatalf("Expected a client with %d subscriptions to be rate-limited, got %v", open, err)
+		}
+		if !rejected && err != nil {
+			t.Fatalf("Expected a client with %d subscriptions to open another one, got %v", open, err)
+		}
+	}
+
+	if err := tooManySubscriptions(&rely.Client{}, nostr.Filters{{}}); err != nil {
+		t.Fatalf("Expected a client without subscriptions to open one, got %v", err)
+	}
+
+	MaxSubscriptions = 0
+	if err := checkSubscriptions(1000); err != nil {
+		t.Fatalf("Expected no maximum, got %v", err)
+	}
+}
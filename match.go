@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MatchEvent reports whether the event matches the filter, with the same semantics as [nostr.Filter.Matches]:
+// kinds match exactly, tags by any of their values, and the event must have been created within Since and Until.
+// Nil constraints match everything, while empty ones match nothing.
+// The only deliberate differences are that IDs and authors also match by prefix, as allowed by older relays,
+// and regardless of the case of the filter values. Empty values are not prefixes of anything, though.
+// Malformed events never make it panic: a nil event matches nothing, and tags without a value are ignored.
+// This is the matching used by all the buffers.
+func MatchEvent(evt *nostr.Event, filter nostr.Filter) bool {
+	filter.IDs = lowercased(filter.IDs)
+	filter.Authors = lowercased(filter.Authors)
+	kinds := newKindMatcher(filter.Kinds)
+	return matchEvent(evt, filter, &kinds)
+}
+
+// matchEvent is like [MatchEvent], but checks the kinds of the filter with the provided kindMatcher,
+// so that it can be built once per query.
+//
+// The cheapest checks are done first, so that most events are rejected before comparing any string:
+// the time bounds are two integer comparisons and the kinds a lookup, while IDs and authors are compared
+// as strings, possibly by prefix, and tags need a scan of the event's tags for every value.
+// Checking the kinds before the time bounds makes no measurable difference in BenchmarkMatchEvent.
+func matchEvent(evt *nostr.Event, filter nostr.Filter, kinds *kindMatcher) bool {
+	if evt == nil {
+		return false
+	}
+
+	if filter.Since != nil && evt.CreatedAt < *filter.Since {
+		return false
+	}
+	if filter.Until != nil && evt.CreatedAt > *filter.Until {
+		return false
+	}
+
+	if !kinds.contains(evt.Kind) {
+		return false
+	}
+
+	if filter.IDs != nil && !matchesAnyPrefix(filter.IDs, evt.ID) {
+		return false
+	}
+
+	if filter.Authors != nil && !matchesAnyPrefix(filter.Authors, evt.PubKey) {
+		return false
+	}
+
+	for tagName, values := range filter.Tags {
+		if values == nil {
+			continue
+		}
+
+		found := false
+	tagLoop:
+		for _, tag := range evt.Tags {
+			if len(tag) > 1 && tag[0] == tagName {
+				for _, v := range values {
+					if v == tag[1] {
+						found = true
+						break tagLoop
+					}
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesAnyPrefix reports whether s is equal to any of the values,
+// or starts with any of the non-empty values shorter than a full 64 characters hex string.
+func matchesAnyPrefix(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+		if len(v) > 0 && len(v) < 64 && len(s) >= len(v) && s[:len(v)] == v {
+			return true
+		}
+	}
+	return false
+}
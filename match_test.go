@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMatchEvent(t *testing.T) {
+	id := "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	pubkey := "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+
+	evt := &nostr.Event{
+		ID:        id,
+		PubKey:    pubkey,
+		CreatedAt: 1000,
+		Kind:      7,
+		Tags:      nostr.Tags{{"e", "a"}, {"p", "b"}, {"t"}},
+	}
+
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		expected bool
+	}{
+		{"empty filter", nostr.Filter{}, true},
+		{"exact ID", nostr.Filter{IDs: []string{"other", id}}, true},
+		{"ID prefix", nostr.Filter{IDs: []string{"abcd"}}, true},
+		{"wrong ID", nostr.Filter{IDs: []string{"abce"}}, false},
+		{"exact author", nostr.Filter{Authors: []string{pubkey}}, true},
+		{"author prefix", nostr.Filter{Authors: []string{"fedc"}}, true},
+		{"wrong author", nostr.Filter{Authors: []string{"abcd"}}, false},
+		{"kind", nostr.Filter{Kinds: []int{1, 7}}, true},
+		{"wrong kind", nostr.Filter{Kinds: []int{1, 2}}, false},
+		{"many kinds", nostr.Filter{Kinds: []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}, true},
+		{"tag value", nostr.Filter{Tags: nostr.TagMap{"e": {"z", "a"}}}, true},
+		{"tag values of several names", nostr.Filter{Tags: nostr.TagMap{"e": {"a"}, "p": {"b"}}}, true},
+		{"wrong tag value", nostr.Filter{Tags: nostr.TagMap{"e": {"b"}}}, false},
+		{"tag without value", nostr.Filter{Tags: nostr.TagMap{"t": {""}}}, false},
+		{"empty tag values", nostr.Filter{Tags: nostr.TagMap{"e": {}}}, false},
+		{"empty IDs", nostr.Filter{IDs: []string{}}, false},
+		{"empty kinds", nostr.Filter{Kinds: []int{}}, false},
+		{"since", nostr.Filter{Since: timestamp(1000)}, true},
+		{"after since", nostr.Filter{Since: timestamp(1001)}, false},
+		{"until", nostr.Filter{Until: timestamp(1000)}, true},
+		{"before until", nostr.Filter{Until: timestamp(999)}, false},
+		{"all constraints", nostr.Filter{IDs: []string{"ab"}, Authors: []string{"fe"}, Kinds: []int{7}, Tags: nostr.TagMap{"p": {"b"}}, Since: timestamp(900), Until: timestamp(1100)}, true},
+		{"all constraints but one", nostr.Filter{IDs: []string{"ab"}, Authors: []string{"fe"}, Kinds: []int{8}, Tags: nostr.TagMap{"p": {"b"}}, Since: timestamp(900), Until: timestamp(1100)}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MatchEvent(evt, test.filter); got != test.expected {
+				t.Fatalf("Expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+// matchCorpus returns events and filters covering every kind of constraint, with full IDs and pubkeys only
+func matchCorpus() ([]*nostr.Event, []nostr.Filter) {
+	hex := func(prefix string, i int) string {
+		return fmt.Sprintf("%s%062d", prefix, i)
+	}
+
+	var events []*nostr.Event
+	for i := range 60 {
+		events = append(events, &nostr.Event{
+			ID:        hex("aa", i),
+			PubKey:    hex("bb", i%4),
+			CreatedAt: nostr.Timestamp(1000 + i),
+			Kind:      i % 12,
+			Tags:      nostr.Tags{{"e", fmt.Sprint(i % 5)}, {"p", hex("bb", i%3)}, {"t"}},
+		})
+	}
+
+	filters := []nostr.Filter{
+		{},
+		{IDs: []string{hex("aa", 3), hex("aa", 42), "unknown"}},
+		{IDs: []string{}},
+		{Authors: []string{hex("bb", 1)}},
+		{Authors: []string{hex("bb", 0), hex("bb", 2)}, Kinds: []int{0, 2, 4}},
+		{Kinds: []int{5}},
+		{Kinds: []int{}},
+		{Kinds: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 11, 20}},
+		{Tags: nostr.TagMap{"e": {"1", "3"}}},
+		{Tags: nostr.TagMap{"e": {"2"}, "p": {hex("bb", 1)}}},
+		{Tags: nostr.TagMap{"e": {}}},
+		{Tags: nostr.TagMap{"t": {""}}},
+		{Since: timestamp(1030)},
+		{Until: timestamp(1010)},
+		{Since: timestamp(1020), Until: timestamp(1040), Kinds: []int{1, 3}},
+		{Authors: []string{hex("bb", 3)}, Tags: nostr.TagMap{"e": {"4"}}, Since: timestamp(1001)},
+	}
+	return events, filters
+}
+
+// TestMatchEventLikeGoNostr tests that MatchEvent agrees with go-nostr's Filter.Matches,
+// and that the buffers return exactly the events it matches
+func TestMatchEventLikeGoNostr(t *testing.T) {
+	ctx := context.Background()
+	events, filters := matchCorpus()
+
+	cb := NewAtomicCircularBuffer2(len(events))
+	for _, evt := range events {
+		cb.SaveEvent(ctx, evt)
+	}
+
+	for _, filter := range filters {
+		var expected []string
+		for _, evt := range events {
+			if got, want := MatchEvent(evt, filter), filter.Matches(evt); got != want {
+				t.Fatalf("filter %v, event %s: expected %v, got %v", filter, evt.ID, want, got)
+			}
+			if filter.Matches(evt) {
+				expected = append(expected, evt.ID)
+			}
+		}
+
+		result, err := cb.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+
+		ids := make([]string, len(result))
+		for i, evt := range result {
+			ids[i] = evt.ID
+		}
+		if !slices.Equal(ids, expected) {
+			t.Fatalf("filter %v: expected %v, got %v", filter, expected, ids)
+		}
+	}
+}
+
+// TestMatchEventTagIntersection tests that the tag names of a filter must all be matched, each by any of its values,
+// when the events repeat the same tag name with different values
+func TestMatchEventTagIntersection(t *testing.T) {
+	ctx := context.Background()
+	filter := nostr.Filter{Tags: nostr.TagMap{"e": {"e-1"}, "p": {"p-1"}}}
+
+	tests := []struct {
+		name     string
+		tags     nostr.Tags
+		expected bool
+	}{
+		{"both tags", nostr.Tags{{"e", "e-1"}, {"p", "p-1"}}, true},
+		{"right e, wrong p", nostr.Tags{{"e", "e-1"}, {"p", "p-2"}}, false},
+		{"wrong e, right p", nostr.Tags{{"e", "e-2"}, {"p", "p-1"}}, false},
+		{"right e, no p", nostr.Tags{{"e", "e-1"}}, false},
+		{"several p, the first matching", nostr.Tags{{"e", "e-1"}, {"p", "p-1"}, {"p", "p-2"}, {"p", "p-3"}}, true},
+		{"several p, the last matching", nostr.Tags{{"p", "p-2"}, {"p", "p-3"}, {"e", "e-1"}, {"p", "p-1"}}, true},
+		{"several p, none matching", nostr.Tags{{"e", "e-1"}, {"p", "p-2"}, {"p", "p-3"}}, false},
+		{"several e and p", nostr.Tags{{"e", "e-2"}, {"p", "p-2"}, {"e", "e-1"}, {"p", "p-1"}}, true},
+		{"values swapped between names", nostr.Tags{{"e", "p-1"}, {"p", "e-1"}}, false},
+		{"repeated matching tag", nostr.Tags{{"e", "e-1"}, {"p", "p-1"}, {"p", "p-1"}}, true},
+	}
+
+	// the tag index narrows the search by a single tag name, so it must agree with the scan
+	indexed := NewAtomicCircularBuffer2(len(tests), WithTagIndex())
+	scanned := NewAtomicCircularBuffer2(len(tests))
+
+	var expected []string
+	for i, test := range tests {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+		evt.Tags = test.tags
+
+		if got := MatchEvent(evt, filter); got != test.expected {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+		if got := filter.Matches(evt); got != test.expected {
+			t.Fatalf("%s: expected go-nostr to return %v, got %v", test.name, test.expected, got)
+		}
+
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+		if test.expected {
+			expected = append(expected, evt.ID)
+		}
+	}
+
+	for _, cb := range []*AtomicCircularBuffer2{indexed, scanned} {
+		events, err := cb.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if got := ids(events); !slices.Equal(got, expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
+
+// randomMalformed returns a random event and filter mixing valid values with malformed ones: nil and short tags,
+// nil and empty constraints, empty values. The IDs and pubkeys are either full, empty or not hex,
+// so that the prefix matching doesn't differ from go-nostr.
+func randomMalformed(rng *rand.Rand) (*nostr.Event, nostr.Filter) {
+	values := []string{"", "zz", hexID(0), hexID(1), hexID(2)}
+	names := []string{"", "e", "p", "ee"}
+	value := func() string { return values[rng.IntN(len(values))] }
+	name := func() string { return names[rng.IntN(len(names))] }
+	maybe := func() bool { return rng.IntN(2) == 0 }
+
+	strs := func() []string {
+		switch rng.IntN(4) {
+		case 0:
+			return nil
+		case 1:
+			return []string{}
+		default:
+			out := make([]string, 1+rng.IntN(3))
+			for i := range out {
+				out[i] = value()
+			}
+			return out
+		}
+	}
+	ts := func() *nostr.Timestamp {
+		if maybe() {
+			return nil
+		}
+		return timestamp(int64(rng.IntN(5) - 1))
+	}
+
+	evt := &nostr.Event{ID: value(), PubKey: value(), Kind: rng.IntN(4) - 1, CreatedAt: nostr.Timestamp(rng.IntN(4))}
+	switch rng.IntN(3) {
+	case 0:
+		evt.Tags = nil
+	case 1:
+		evt.Tags = nostr.Tags{}
+	default:
+		for range 1 + rng.IntN(4) {
+			switch rng.IntN(5) {
+			case 0:
+				evt.Tags = append(evt.Tags, nil)
+			case 1:
+				evt.Tags = append(evt.Tags, nostr.Tag{})
+			case 2:
+				evt.Tags = append(evt.Tags, nostr.Tag{name()})
+			case 3:
+				evt.Tags = append(evt.Tags, nostr.Tag{name(), value()})
+			default:
+				evt.Tags = append(evt.Tags, nostr.Tag{name(), value(), "extra"})
+			}
+		}
+	}
+
+	filter := nostr.Filter{IDs: strs(), Authors: strs(), Since: ts(), Until: ts()}
+	switch rng.IntN(3) {
+	case 0:
+		filter.Kinds = nil
+	case 1:
+		filter.Kinds = []int{}
+	default:
+		filter.Kinds = []int{rng.IntN(4) - 1, rng.IntN(4) - 1}
+	}
+	switch rng.IntN(3) {
+	case 0:
+		filter.Tags = nil
+	case 1:
+		filter.Tags = nostr.TagMap{}
+	default:
+		filter.Tags = nostr.TagMap{}
+		for range 1 + rng.IntN(2) {
+			filter.Tags[name()] = strs()
+		}
+	}
+	return evt, filter
+}
+
+// TestMatchEventMalformed feeds random malformed events and filters to the matcher and the buffers, which must
+// never panic, and checks that the matcher agrees with go-nostr
+func TestMatchEventMalformed(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewPCG(3, 4))
+	buffers := []*AtomicCircularBuffer2{
+		NewAtomicCircularBuffer2(50),
+		NewAtomicCircularBuffer2(50, WithTagIndex(), WithAuthorIndex(), WithTimeIndex(time.Minute), WithOrderIndex()),
+	}
+
+	for i := range 20000 {
+		evt, filter := randomMalformed(rng)
+		if got, want := MatchEvent(evt, filter), filter.Matches(evt); got != want {
+			t.Fatalf("event %v, filter %v: expected %v, got %v", evt, filter, want, got)
+		}
+
+		if i%100 != 0 {
+			continue
+		}
+		// the queries fail only for the invalid filters, like the ones with a negative since
+		_, invalid := NormalizeFilter(filter)
+		if errors.Is(invalid, ErrUnsatisfiableFilter) {
+			invalid = nil
+		}
+		for _, cb := range buffers {
+			cb.SaveEvent(ctx, evt)
+			if _, err := cb.QueryEvents(ctx, filter); (err != nil) != (invalid != nil) {
+				t.Fatalf("filter %v: expected error %v, got %v", filter, invalid, err)
+			}
+			if _, err := cb.QueryEventsOrdered(ctx, filter, QueryOptions{}); (err != nil) != (invalid != nil) {
+				t.Fatalf("filter %v: expected error %v, got %v", filter, invalid, err)
+			}
+		}
+	}
+
+	if MatchEvent(nil, nostr.Filter{}) {
+		t.Fatal("Expected a nil event not to match")
+	}
+	if MatchEvent(&nostr.Event{ID: hexID(0)}, nostr.Filter{IDs: []string{""}}) {
+		t.Fatal("Expected an empty ID not to match as a prefix")
+	}
+}
+
+// TestMatchEventPrefixes tests the deliberate difference from go-nostr, which only matches full IDs and pubkeys
+func TestMatchEventPrefixes(t *testing.T) {
+	evt := &nostr.Event{ID: "abcdef", PubKey: "012345"}
+	filter := nostr.Filter{IDs: []string{"abc"}, Authors: []string{"0123"}}
+
+	if !MatchEvent(evt, filter) {
+		t.Fatal("Expected the prefixes to match")
+	}
+	if filter.Matches(evt) {
+		t.Fatal("Expected go-nostr not to match prefixes")
+	}
+}
+
+// BenchmarkMatchEvent tests the matching of a realistic filter, asking for the reactions and notes of some
+// followed authors since some time, against events of many kinds and authors
+func BenchmarkMatchEvent(b *testing.B) {
+	events := make([]*nostr.Event, 10000)
+	for i := range events {
+		events[i] = &nostr.Event{
+			ID:        hexID(i),
+			PubKey:    hexID(i % 200),
+			CreatedAt: nostr.Timestamp(1000 + i),
+			Kind:      i % 20,
+			Tags:      nostr.Tags{{"e", hexID(i / 2)}, {"p", hexID(i % 50)}},
+		}
+	}
+
+	authors := make([]string, 20)
+	for i := range authors {
+		authors[i] = hexID(i * 10)
+	}
+	filter := nostr.Filter{
+		Kinds:   []int{1, 7},
+		Authors: authors,
+		Since:   timestamp(5000),
+	}
+	kinds := newKindMatcher(filter.Kinds)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matches := 0
+		for _, evt := range events {
+			if matchEvent(evt, filter, &kinds) {
+				matches++
+			}
+		}
+	}
+}
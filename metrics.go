@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// queryDurationBuckets are the upper bounds (in seconds) of the query latency histogram.
+var queryDurationBuckets = [...]float64{
+	0.000001, 0.000005, 0.00001, 0.00005, 0.0001, 0.0005,
+	0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1,
+}
+
+// Metrics collects counters and a query latency histogram for the stores.
+// All fields are updated atomically, so a Metrics can be read while the buffer is in use.
+type Metrics struct {
+	EventsSaved         atomic.Uint64
+	EventsEvicted       atomic.Uint64
+	EventsEvictedUnread atomic.Uint64
+	QueriesTotal        atomic.Uint64
+	QueryEventsReturned atomic.Uint64
+
+	// per-bucket (non cumulative) counts, the last one is the +Inf bucket
+	durationBuckets [len(queryDurationBuckets) + 1]atomic.Uint64
+	durationSum     atomic.Int64 // nanoseconds
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// observeSave records a saved event, and whether it evicted an older one.
+func (m *Metrics) observeSave(evicted bool) {
+	m.EventsSaved.Add(1)
+	if evicted {
+		m.EventsEvicted.Add(1)
+	}
+}
+
+// observeQuery records a completed query, the number of events it returned and how long it took.
+func (m *Metrics) observeQuery(returned int, d time.Duration) {
+	m.QueriesTotal.Add(1)
+	m.QueryEventsReturned.Add(uint64(returned))
+	m.durationSum.Add(int64(d))
+
+	seconds := d.Seconds()
+	for i, bound := range queryDurationBuckets {
+		if seconds <= bound {
+			m.durationBuckets[i].Add(1)
+			return
+		}
+	}
+	m.durationBuckets[len(queryDurationBuckets)].Add(1)
+}
+
+// WriteProm writes the metrics to w using the Prometheus text exposition format.
+func (m *Metrics) WriteProm(w io.Writer) error {
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"evstore_events_saved_total", "Total number of events saved.", m.EventsSaved.Load()},
+		{"evstore_events_evicted_total", "Total number of events overwritten to make room for newer ones.", m.EventsEvicted.Load()},
+		{"evstore_events_evicted_unread_total", "Total number of events overwritten without having been returned by any query.", m.EventsEvictedUnread.Load()},
+		{"evstore_queries_total", "Total number of queries served.", m.QueriesTotal.Load()},
+		{"evstore_query_events_returned_total", "Total number of events returned by queries.", m.QueryEventsReturned.Load()},
+	}
+
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value); err != nil {
+			return err
+		}
+	}
+
+	const name = "evstore_query_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Query latency distribution.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+
+	var cumulative uint64
+	for i, bound := range queryDurationBuckets {
+		cumulative += m.durationBuckets[i].Load()
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, cumulative); err != nil {
+			return err
+		}
+	}
+	cumulative += m.durationBuckets[len(queryDurationBuckets)].Load()
+
+	sum := time.Duration(m.durationSum.Load()).Seconds()
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n",
+		name, cumulative, name, strconv.FormatFloat(sum, 'g', -1, 64), name, cumulative)
+	return err
+}
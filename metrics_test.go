@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewMetrics()
+	cb := NewAtomicCircularBuffer2(3, WithMetrics(metrics))
+
+	for i := range 5 {
+		if err := cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i)); err != nil {
+			t.Fatalf("Failed to save event: %v", err)
+		}
+	}
+
+	if _, err := cb.QueryEvents(ctx, nostr.Filter{}); err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if _, err := cb.QueryEvents(ctx, nostr.Filter{Kinds: []int{4}}); err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if _, err := cb.QueryEvents(ctx, nostr.Filter{Kinds: []int{0}}); err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	checks := []struct {
+		name     string
+		got      uint64
+		expected uint64
+	}{
+		{"events saved", metrics.EventsSaved.Load(), 5},
+		{"events evicted", metrics.EventsEvicted.Load(), 2},
+		{"queries", metrics.QueriesTotal.Load(), 3},
+		{"query events returned", metrics.QueryEventsReturned.Load(), 4},
+	}
+
+	for _, c := range checks {
+		if c.got != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.name, c.expected, c.got)
+		}
+	}
+
+	var sb strings.Builder
+	if err := metrics.WriteProm(&sb); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	output := sb.String()
+	expectedLines := []string{
+		"# TYPE evstore_events_saved_total counter",
+		"evstore_events_saved_total 5",
+		"evstore_events_evicted_total 2",
+		"evstore_queries_total 3",
+		"evstore_query_events_returned_total 4",
+		"# TYPE evstore_query_duration_seconds histogram",
+		`evstore_query_duration_seconds_bucket{le="+Inf"} 3`,
+		"evstore_query_duration_seconds_count 3",
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
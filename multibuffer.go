@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MultiBuffer shards events across several [AtomicCircularBuffer2] and queries them as one.
+type MultiBuffer struct {
+	shards    []*AtomicCircularBuffer2
+	shardFunc func(*nostr.Event) int
+	byKind    bool // whether the events are routed by kind, see NewMultiBufferByKind
+
+	// Parallel makes QueryEvents scan the shards concurrently. It must be set before using the buffer.
+	Parallel bool
+}
+
+// NewMultiBuffer creates a MultiBuffer over the provided shards.
+// Saved events are routed to the shard returned by shardFunc (modulo the number of shards).
+// If shardFunc is nil, events are routed by pubkey with [ShardByPubkey].
+func NewMultiBuffer(shards []*AtomicCircularBuffer2, shardFunc func(*nostr.Event) int) *MultiBuffer {
+	if len(shards) == 0 {
+		panic("at least one shard is required")
+	}
+
+	if shardFunc == nil {
+		shardFunc = ShardByPubkey
+	}
+
+	return &MultiBuffer{
+		shards:    shards,
+		shardFunc: shardFunc,
+	}
+}
+
+// NewMultiBufferByKind creates a MultiBuffer over the provided shards routing the events by kind with [ShardByKind].
+// The queries with kinds only scan the shards holding them.
+func NewMultiBufferByKind(shards []*AtomicCircularBuffer2) *MultiBuffer {
+	mb := NewMultiBuffer(shards, ShardByKind)
+	mb.byKind = true
+	return mb
+}
+
+// ShardByKind returns the event kind, so that all the events of a kind go to the same shard.
+func ShardByKind(evt *nostr.Event) int {
+	return evt.Kind
+}
+
+// ShardByPubkey returns a hash of the event pubkey, so that all the events of an author go to the same shard.
+func ShardByPubkey(evt *nostr.Event) int {
+	h := fnv.New32a()
+	h.Write([]byte(evt.PubKey))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+// SaveEvent saves the event in the shard chosen by the shard function.
+func (mb *MultiBuffer) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt == nil {
+		return errors.New("event cannot be nil")
+	}
+	return mb.shards[mb.shardOf(evt)].SaveEvent(ctx, evt)
+}
+
+// shardOf returns the index of the shard the event belongs to.
+func (mb *MultiBuffer) shardOf(evt *nostr.Event) int {
+	i := mb.shardFunc(evt) % len(mb.shards)
+	if i < 0 {
+		i += len(mb.shards)
+	}
+	return i
+}
+
+// QueryEvents returns the events matching the filter across all shards, without duplicates,
+// sorted from the newest to the oldest. The limit of the filter applies to the merged result.
+func (mb *MultiBuffer) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	limit := filter.Limit
+	filter.Limit = 0 // each shard must return all its matches, as the newest ones could be anywhere
+
+	queries := mb.shardQueries(filter)
+	results := make([][]*nostr.Event, len(queries))
+	errs := make([]error, len(queries))
+
+	if mb.Parallel {
+		var wg sync.WaitGroup
+		for i, q := range queries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], errs[i] = q.shard.QueryEvents(ctx, q.filter)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i, q := range queries {
+			results[i], errs[i] = q.shard.QueryEvents(ctx, q.filter)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	merged := slices.Concat(results...)
+	sortNewestFirst(merged)
+	merged = slices.CompactFunc(merged, func(a, b *nostr.Event) bool { return a.ID == b.ID })
+
+	if limit > 0 && len(merged) > limit {
+		merged = merged[:limit]
+	}
+	return merged, nil
+}
+
+// shardQuery is a filter to run against a shard.
+type shardQuery struct {
+	shard  *AtomicCircularBuffer2
+	filter nostr.Filter
+}
+
+// shardQueries returns the filters to run against the shards to answer the filter. When the events are routed
+// by kind, the filter is split by kind, see splitFilterByKind, so that each kind is only queried in its shard.
+// Otherwise, or without kinds, the filter is run against every shard.
+func (mb *MultiBuffer) shardQueries(filter nostr.Filter) []shardQuery {
+	var split map[int]nostr.Filter
+	if mb.byKind {
+		split = splitFilterByKind(filter)
+	}
+
+	if split == nil {
+		queries := make([]shardQuery, len(mb.shards))
+		for i, shard := range mb.shards {
+			queries[i] = shardQuery{shard: shard, filter: filter}
+		}
+		return queries
+	}
+
+	queries := make([]shardQuery, 0, len(split))
+	for kind, f := range split {
+		queries = append(queries, shardQuery{shard: mb.shards[mb.shardOf(&nostr.Event{Kind: kind})], filter: f})
+	}
+	return queries
+}
+
+// Len returns the number of events across all shards.
+func (mb *MultiBuffer) Len() int {
+	total := 0
+	for _, shard := range mb.shards {
+		total += shard.Len()
+	}
+	return total
+}
+
+// sortNewestFirst sorts the events by CreatedAt descending, breaking ties by ID ascending as in NIP-01.
+// Events with the same ID end up next to each other.
+func sortNewestFirst(events []*nostr.Event) {
+	slices.SortFunc(events, func(a, b *nostr.Event) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
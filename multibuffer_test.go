@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func newShards(n, capacity int) []*AtomicCircularBuffer2 {
+	shards := make([]*AtomicCircularBuffer2, n)
+	for i := range shards {
+		shards[i] = NewAtomicCircularBuffer2(capacity)
+	}
+	return shards
+}
+
+func TestMultiBufferRouting(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(4, 1000)
+	mb := NewMultiBuffer(shards, nil)
+
+	const authors = 400
+	for i := range authors {
+		for j := range 3 {
+			evt := createTestEvent(fmt.Sprintf("id-%d-%d", i, j), 1)
+			evt.PubKey = fmt.Sprintf("pubkey-%d", i)
+			if err := mb.SaveEvent(ctx, evt); err != nil {
+				t.Fatalf("Failed to save event: %v", err)
+			}
+		}
+	}
+
+	if mb.Len() != authors*3 {
+		t.Fatalf("Expected %d events, got %d", authors*3, mb.Len())
+	}
+
+	// the events should be spread roughly evenly
+	expected := authors * 3 / len(shards)
+	for i, shard := range shards {
+		count := int(shard.count.Load())
+		if count < expected/2 || count > expected*3/2 {
+			t.Errorf("Shard %d has %d events, expected around %d", i, count, expected)
+		}
+
+		// all the events of an author must be in the same shard
+		events, _ := shard.QueryEvents(ctx, nostr.Filter{})
+		for _, evt := range events {
+			if mb.shardOf(evt) != i {
+				t.Fatalf("Event %s routed to the wrong shard", evt.ID)
+			}
+		}
+	}
+}
+
+func TestMultiBufferCustomShardFunc(t *testing.T) {
+	ctx := context.Background()
+	shards := newShards(3, 10)
+	mb := NewMultiBuffer(shards, func(evt *nostr.Event) int { return -evt.Kind })
+
+	for kind := range 6 {
+		mb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", kind), kind))
+	}
+
+	for i, shard := range shards {
+		if count := shard.count.Load(); count != 2 {
+			t.Errorf("Shard %d: expected 2 events, got %d", i, count)
+		}
+	}
+}
+
+func TestMultiBufferQueryLimit(t *testing.T) {
+	ctx := context.Background()
+
+	for _, parallel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("parallel=%v", parallel), func(t *testing.T) {
+			shards := newShards(3, 100)
+			mb := NewMultiBuffer(shards, func(evt *nostr.Event) int { return int(evt.CreatedAt) })
+			mb.Parallel = parallel
+
+			for i := range 30 {
+				mb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%02d", i), int64(i)))
+			}
+
+			// the same event stored in two shards must be returned once
+			shards[0].SaveEvent(ctx, createTimedEvent("id-29", 29))
+
+			events, err := mb.QueryEvents(ctx, nostr.Filter{Limit: 5})
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			expected := []string{"id-29", "id-28", "id-27", "id-26", "id-25"}
+			if len(events) != len(expected) {
+				t.Fatalf("Expected %v, got %d events", expected, len(events))
+			}
+			for i, evt := range events {
+				if evt.ID != expected[i] {
+					t.Fatalf("Expected %v, got %s at %d", expected, evt.ID, i)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiBufferByKind(t *testing.T) {
+	ctx := context.Background()
+	metrics := make([]*Metrics, 3)
+	shards := make([]*AtomicCircularBuffer2, len(metrics))
+	for i := range shards {
+		metrics[i] = NewMetrics()
+		shards[i] = NewAtomicCircularBuffer2(10, WithMetrics(metrics[i]))
+	}
+	mb := NewMultiBufferByKind(shards)
+
+	for kind := range 6 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", kind), kind)
+		evt.CreatedAt = nostr.Timestamp(kind)
+		mb.SaveEvent(ctx, evt)
+	}
+
+	// kinds 1 and 4 are both in the second shard, the others are not scanned
+	events, err := mb.QueryEvents(ctx, nostr.Filter{Kinds: []int{1, 4}})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if got, expected := ids(events), []string{"id-4", "id-1"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i, m := range metrics {
+		if queried := m.QueriesTotal.Load() > 0; queried != (i == 1) {
+			t.Fatalf("Shard %d: unexpected queried %v", i, queried)
+		}
+	}
+
+	// without kinds, every shard is scanned
+	events, _ = mb.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 6 {
+		t.Fatalf("Expected 6 events, got %d", len(events))
+	}
+}
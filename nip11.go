@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// RelayInfo is the NIP-11 relay information document, served to the HTTP requests
+// accepting application/nostr+json. Its limitation is filled in from the relay limits at startup.
+var RelayInfo = nip11.RelayInformationDocument{
+	Name:          "rely-evstore",
+	Description:   "A relay keeping ephemeral events in memory and the others in SQLite",
+	SupportedNIPs: []any{1, 9, 11, 13, 70},
+	Software:      "https://github.com/gzuuus/rely-eventStore",
+}
+
+// withRelayInfo returns a handler serving [RelayInfo] to the requests asking for it,
+// and passing all the others to next.
+func withRelayInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/nostr+json") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// NIP-11 requires the document to be accessible from any origin
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.Header().Set("Content-Type", "application/nostr+json")
+
+		if err := json.NewEncoder(w).Encode(RelayInfo); err != nil {
+			log.Printf("[ERROR] writing the relay information document: %v", err)
+		}
+	})
+}
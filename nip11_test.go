@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+func TestRelayInfo(t *testing.T) {
+	oldInfo := RelayInfo
+	t.Cleanup(func() { RelayInfo = oldInfo })
+
+	RelayInfo.Name = "test relay"
+	RelayInfo.Limitation = &nip11.RelayLimitationDocument{MaxLimit: 500, MaxSubscriptions: 20}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUpgradeRequired)
+	})
+	server := httptest.NewServer(withRelayInfo(next))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request the relay information: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "application/nostr+json" {
+		t.Fatalf("Expected application/nostr+json, got %q", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal("Expected the document to be accessible from any origin")
+	}
+
+	var info struct {
+		Name          string `json:"name"`
+		SupportedNIPs []int  `json:"supported_nips"`
+		Limitation    struct {
+			MaxLimit         int `json:"max_limit"`
+			MaxSubscriptions int `json:"max_subscriptions"`
+		} `json:"limitation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode the relay information: %v", err)
+	}
+
+	if info.Name != "test relay" {
+		t.Fatalf("Expected name %q, got %q", "test relay", info.Name)
+	}
+	if len(info.SupportedNIPs) == 0 || info.SupportedNIPs[0] != 1 {
+		t.Fatalf("Expected the supported NIPs to include NIP-01, got %v", info.SupportedNIPs)
+	}
+	if info.Limitation.MaxLimit != 500 || info.Limitation.MaxSubscriptions != 20 {
+		t.Fatalf("Unexpected limitation %+v", info.Limitation)
+	}
+
+	// other requests are passed to the relay
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to request the relay: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("Expected the request to reach the relay, got status %d", resp.StatusCode)
+	}
+}
+
+func TestSupportedNIPs(t *testing.T) {
+	for _, nip := range []int{1, 9, 11, 13, 70} {
+		if !slices.Contains(RelayInfo.SupportedNIPs, any(nip)) {
+			t.Errorf("Expected NIP-%02d to be advertised, got %v", nip, RelayInfo.SupportedNIPs)
+		}
+	}
+}
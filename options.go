@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrBufferFull is returned by SaveEvent when the buffer is full and its policy is [RejectNew].
+var ErrBufferFull = errors.New("buffer is full")
+
+// ErrEventTooLarge is returned by SaveEvent when the event exceeds the limits set with
+// [WithMaxEventSize] or [WithMaxTags].
+var ErrEventTooLarge = errors.New("event is too large")
+
+// ErrEventInFuture is returned by SaveEvent when the event is created too far in the future,
+// see [WithMaxFutureDrift].
+var ErrEventInFuture = errors.New("event is too far in the future")
+
+// ErrTooBusy is returned by the queries of a buffer when the maximum number of concurrent queries is reached
+// and its policy is [RejectWhenBusy], see [WithMaxConcurrentQueries].
+var ErrTooBusy = errors.New("too many concurrent queries")
+
+// ErrUnsupportedOption is returned when creating a [CircularBuffer] or an [AtomicCircularBuffer] with an option
+// supported only by [AtomicCircularBuffer2], which they would otherwise silently ignore.
+var ErrUnsupportedOption = errors.New("option not supported by this buffer")
+
+// OverflowPolicy decides what a buffer does when saving an event while it's full.
+type OverflowPolicy int
+
+const (
+	// DropOldest overwrites the oldest event with the new one. This is the default.
+	DropOldest OverflowPolicy = iota
+
+	// RejectNew keeps the stored events, and rejects the new one with [ErrBufferFull].
+	RejectNew
+)
+
+// BusyPolicy decides what a query does when the maximum number of concurrent queries is reached,
+// see [WithMaxConcurrentQueries].
+type BusyPolicy int
+
+const (
+	// WaitWhenBusy makes the query wait until another query completes, or until its context is cancelled.
+	WaitWhenBusy BusyPolicy = iota
+
+	// RejectWhenBusy makes the query fail immediately with [ErrTooBusy].
+	RejectWhenBusy
+)
+
+// EvictionPolicy decides which event a full buffer evicts to make room for a new one.
+type EvictionPolicy int
+
+const (
+	// FIFO evicts the oldest saved event. This is the default.
+	FIFO EvictionPolicy = iota
+
+	// LRU evicts the least recently used event, where saving and being returned by a query are uses,
+	// so that events still being queried stay in the buffer even if they are old.
+	LRU
+)
+
+// BufferOption configures optional behaviour of a circular buffer at construction time.
+type BufferOption func(*bufferOptions)
+
+// bufferOptions holds the optional settings shared by the buffer implementations.
+type bufferOptions struct {
+	metrics *Metrics
+	tracer  trace.Tracer
+	onEvict func(*nostr.Event)
+	policy  OverflowPolicy
+
+	eviction EvictionPolicy
+
+	// semaphore bounding the concurrent queries, nil unless enabled with [WithMaxConcurrentQueries]
+	querySlots chan struct{}
+	busyPolicy BusyPolicy
+
+	indexTags    bool
+	indexAuthors bool
+	indexOrder   bool
+	timeBucket   time.Duration
+
+	maxEventSize int
+	maxTags      int
+
+	maxFutureDrift time.Duration
+
+	compactInterval time.Duration
+
+	bloomIDs bool
+
+	cacheSize int
+	cacheTTL  time.Duration
+
+	maxAge time.Duration
+
+	clock Clock
+}
+
+// newBufferOptions applies the provided options on top of the defaults.
+func newBufferOptions(opts []BufferOption) bufferOptions {
+	o := bufferOptions{clock: realClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// checkLegacy returns [ErrUnsupportedOption] if any of the options set is supported only by [AtomicCircularBuffer2].
+func (o bufferOptions) checkLegacy() error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{o.metrics != nil, "WithMetrics"},
+		{o.tracer != nil, "WithTracer"},
+		{o.eviction != FIFO, "WithEvictionPolicy"},
+		{o.indexTags, "WithTagIndex"},
+		{o.indexAuthors, "WithAuthorIndex"},
+		{o.indexOrder, "WithOrderIndex"},
+		{o.timeBucket > 0, "WithTimeIndex"},
+		{o.compactInterval > 0, "WithCompaction"},
+		{o.bloomIDs, "WithIDBloomFilter"},
+		{o.cacheSize > 0 && o.cacheTTL > 0, "WithQueryCache"},
+		{o.maxAge > 0, "WithMaxAge"},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("%w: %s", ErrUnsupportedOption, option.name)
+		}
+	}
+	return nil
+}
+
+// validate returns [ErrEventTooLarge] if the event exceeds the size limits,
+// and [ErrEventInFuture] if it's created too far in the future.
+func (o bufferOptions) validate(evt *nostr.Event) error {
+	if o.maxTags > 0 && len(evt.Tags) > o.maxTags {
+		return fmt.Errorf("%w: %d tags, the maximum is %d", ErrEventTooLarge, len(evt.Tags), o.maxTags)
+	}
+
+	if o.maxFutureDrift > 0 {
+		if latest := o.clock.Now() + nostr.Timestamp(o.maxFutureDrift/time.Second); evt.CreatedAt > latest {
+			return fmt.Errorf("%w: created at %d, the latest accepted is %d", ErrEventInFuture, evt.CreatedAt, latest)
+		}
+	}
+
+	if o.maxEventSize > 0 {
+		data, err := evt.MarshalJSON()
+		if err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+		if len(data) > o.maxEventSize {
+			return fmt.Errorf("%w: %d bytes, the maximum is %d", ErrEventTooLarge, len(data), o.maxEventSize)
+		}
+	}
+	return nil
+}
+
+// acquireQuery takes a slot for a query, if the concurrent queries are bounded, see [WithMaxConcurrentQueries].
+// When no slot is free, it waits for one or returns [ErrTooBusy] depending on the policy. If ctx is cancelled
+// while waiting, its error is returned. The slot must be released with releaseQuery.
+func (o bufferOptions) acquireQuery(ctx context.Context) error {
+	if o.querySlots == nil {
+		return nil
+	}
+
+	select {
+	case o.querySlots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if o.busyPolicy == RejectWhenBusy {
+		return ErrTooBusy
+	}
+
+	select {
+	case o.querySlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseQuery releases the slot taken by acquireQuery.
+func (o bufferOptions) releaseQuery() {
+	if o.querySlots != nil {
+		<-o.querySlots
+	}
+}
+
+// WithMetrics makes the buffer record its activity into m.
+// The same Metrics can be shared by several buffers to get aggregated numbers.
+// Metrics are currently recorded only by [AtomicCircularBuffer2].
+func WithMetrics(m *Metrics) BufferOption {
+	return func(o *bufferOptions) {
+		o.metrics = m
+	}
+}
+
+// WithTracer makes the buffer create a span with the tracer for every save and query, with the kind of the
+// saved event, the number of values of every constraint of the filter and the number of events returned.
+// Without a tracer, no span is created.
+// Spans are currently created only by [AtomicCircularBuffer2].
+func WithTracer(tracer trace.Tracer) BufferOption {
+	return func(o *bufferOptions) {
+		o.tracer = tracer
+	}
+}
+
+// WithOnEvict registers a callback that is called with every event overwritten to make room for a new one.
+// The callback runs on the goroutine calling SaveEvent, after the save has completed and without holding
+// any internal lock, so a slow callback slows down its own writer but never stalls the others.
+func WithOnEvict(fn func(*nostr.Event)) BufferOption {
+	return func(o *bufferOptions) {
+		o.onEvict = fn
+	}
+}
+
+// WithOverflowPolicy sets what the buffer does when saving an event while it's full.
+func WithOverflowPolicy(policy OverflowPolicy) BufferOption {
+	return func(o *bufferOptions) {
+		o.policy = policy
+	}
+}
+
+// WithMaxConcurrentQueries bounds the number of queries running concurrently on the buffer to n, so that
+// a storm of queries can't saturate the CPU. The policy decides whether the queries over the limit wait for
+// a slot or fail with [ErrTooBusy]. The limit covers QueryEvents and its variants returning events.
+// A limit of zero or less means no limit.
+func WithMaxConcurrentQueries(n int, policy BusyPolicy) BufferOption {
+	return func(o *bufferOptions) {
+		o.querySlots = nil
+		if n > 0 {
+			o.querySlots = make(chan struct{}, n)
+		}
+		o.busyPolicy = policy
+	}
+}
+
+// WithEvictionPolicy sets which event the buffer evicts when saving an event while it's full.
+// It has no effect with the [RejectNew] overflow policy, which never evicts events.
+//
+// [LRU] is approximated with the clock algorithm, as finding the exact least recently used event would scan
+// the whole buffer on every save: the oldest event is evicted only if it hasn't been returned by a query since
+// it was saved, otherwise it's saved again at the head, like a pinned event, and the next oldest is considered.
+// The events saved again get a new sequence number, so they are returned after the ones saved before them.
+// The policy is currently supported only by [AtomicCircularBuffer2].
+func WithEvictionPolicy(policy EvictionPolicy) BufferOption {
+	return func(o *bufferOptions) {
+		o.eviction = policy
+	}
+}
+
+// WithTagIndex makes the buffer maintain an index of the tags of its events, so that queries
+// filtering by tag values only look at the events having them instead of scanning the whole buffer.
+// It speeds up tag queries at the cost of memory and slower saves.
+// The index is currently maintained only by [AtomicCircularBuffer2].
+func WithTagIndex() BufferOption {
+	return func(o *bufferOptions) {
+		o.indexTags = true
+	}
+}
+
+// WithAuthorIndex makes the buffer maintain an index of the pubkeys of its events, so that queries
+// filtering by authors, like the feeds of the followed users, only look at the events they published
+// instead of scanning the whole buffer. Only the queries with full 64 characters pubkeys use the index.
+// The index is currently maintained only by [AtomicCircularBuffer2].
+func WithAuthorIndex() BufferOption {
+	return func(o *bufferOptions) {
+		o.indexAuthors = true
+	}
+}
+
+// WithOrderIndex makes the buffer keep the positions of its events sorted by CreatedAt, so that ordered queries,
+// like [AtomicCircularBuffer2.QueryEventsOrdered] and [AtomicCircularBuffer2.QueryPage], read the events in order
+// and stop at the limit instead of collecting and sorting all the matching ones. Events saved in about the order
+// they were created are cheap to insert, while every event older than most of the buffer moves the positions
+// of the newer ones. Ordered queries with tags or authors narrowed by their own index still sort their events.
+// The index is currently maintained only by [AtomicCircularBuffer2].
+func WithOrderIndex() BufferOption {
+	return func(o *bufferOptions) {
+		o.indexOrder = true
+	}
+}
+
+// WithTimeIndex makes the buffer maintain a coarse index of the CreatedAt of its events, grouped in buckets
+// of the width (rounded to the second), so that queries with Since or Until only look at the events saved
+// around the ones created in that window instead of scanning the whole buffer. It's meant for very large
+// buffers, where the events are saved mostly in chronological order, but not strictly enough for the
+// binary search done on sorted buffers. Widths of about a minute work well for most relays.
+// The index is currently maintained only by [AtomicCircularBuffer2].
+func WithTimeIndex(width time.Duration) BufferOption {
+	return func(o *bufferOptions) {
+		o.timeBucket = width
+	}
+}
+
+// WithMaxEventSize rejects the events whose JSON serialization is larger than size bytes,
+// so that the memory used by a full buffer stays predictable.
+func WithMaxEventSize(size int) BufferOption {
+	return func(o *bufferOptions) {
+		o.maxEventSize = size
+	}
+}
+
+// WithMaxTags rejects the events with more than n tags.
+func WithMaxTags(n int) BufferOption {
+	return func(o *bufferOptions) {
+		o.maxTags = n
+	}
+}
+
+// WithMaxFutureDrift rejects the events created more than drift after the current time. Such events
+// would stay the newest of the buffer, and never expire with [WithMaxAge]. It's disabled by default.
+func WithMaxFutureDrift(drift time.Duration) BufferOption {
+	return func(o *bufferOptions) {
+		o.maxFutureDrift = drift
+	}
+}
+
+// WithCompaction makes the buffer remove the empty slots left by deleted events every interval,
+// see [AtomicCircularBuffer2.Compact]. Saves and deletes briefly wait for each compaction to complete.
+// The background compaction runs until the buffer is closed. It's disabled by default.
+// Compaction is currently supported only by [AtomicCircularBuffer2].
+func WithCompaction(interval time.Duration) BufferOption {
+	return func(o *bufferOptions) {
+		o.compactInterval = interval
+	}
+}
+
+// WithIDBloomFilter makes the buffer keep a bloom filter of the IDs of its events, so that queries for
+// IDs that are not in the buffer return immediately instead of scanning it. The filter uses about 20 bits
+// per event, and has a false positive rate of about 2%, in which case the query scans the buffer as usual.
+// Only the queries with full 64 characters IDs can be skipped.
+// The bloom filter is currently maintained only by [AtomicCircularBuffer2].
+func WithIDBloomFilter() BufferOption {
+	return func(o *bufferOptions) {
+		o.bloomIDs = true
+	}
+}
+
+// WithQueryCache makes the buffer cache the results of up to size recent queries for the ttl,
+// so that repeated identical filters are answered without scanning the buffer.
+// Any save or delete invalidates all the cached results. The cache is disabled if size or ttl are not positive.
+// The cache is currently maintained only by [AtomicCircularBuffer2].
+func WithQueryCache(size int, ttl time.Duration) BufferOption {
+	return func(o *bufferOptions) {
+		o.cacheSize = size
+		o.cacheTTL = ttl
+	}
+}
+
+// WithMaxAge makes the events expire once they are older than maxAge, regardless of how full the buffer is.
+// The age is measured from the CreatedAt of the events. Queries skip the expired events, and a background
+// sweeper removes them from the buffer every maxAge/2 (at most once per second), until the buffer is closed.
+// Results cached with [WithQueryCache] might include events that expired within the cache TTL.
+// Expiration is currently supported only by [AtomicCircularBuffer2].
+func WithMaxAge(maxAge time.Duration) BufferOption {
+	return func(o *bufferOptions) {
+		o.maxAge = maxAge
+	}
+}
+
+// WithClock makes the buffer read the time from the clock instead of the system clock.
+// It's meant for tests, to control the expiration of [WithMaxAge] and the check of [WithMaxFutureDrift].
+func WithClock(clock Clock) BufferOption {
+	return func(o *bufferOptions) {
+		o.clock = clock
+	}
+}
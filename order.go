@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Order is the order of the events returned by a query.
+type Order int
+
+const (
+	// Descending orders the events from the newest to the oldest, as NIP-01 requires.
+	// Events with the same CreatedAt are ordered by ID, the lowest first.
+	Descending Order = iota
+
+	// Ascending orders the events from the oldest to the newest, exactly the reverse of [Descending].
+	Ascending
+)
+
+// QueryOptions are the options of [AtomicCircularBuffer2.QueryEventsOrdered].
+// The zero value orders the events in [Descending] order.
+type QueryOptions struct {
+	Order Order
+}
+
+// QueryEventsOrdered is like [AtomicCircularBuffer2.QueryEvents], but returns the events sorted by CreatedAt
+// in the order of the options. The limit of the filter keeps the first events in that order, so the newest
+// when [Descending] and the oldest when [Ascending].
+// If ctx is cancelled during the scan, the events found so far are returned in order with the context error.
+func (cb *AtomicCircularBuffer2) QueryEventsOrdered(ctx context.Context, filter nostr.Filter, opts QueryOptions) ([]*nostr.Event, error) {
+	if cb.metrics == nil {
+		return cb.queryOrdered(ctx, filter, nil, opts.Order)
+	}
+
+	start := time.Now()
+	events, err := cb.queryOrdered(ctx, filter, nil, opts.Order)
+	cb.metrics.observeQuery(len(events), time.Since(start))
+	return events, err
+}
+
+// queryOrdered collects the events matching the filter and accepted by accept, if not nil,
+// then sorts them in the order and applies the limit of the filter.
+// With [WithOrderIndex], the events are read in order instead, unless another index narrows the search.
+func (cb *AtomicCircularBuffer2) queryOrdered(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, order Order) ([]*nostr.Event, error) {
+	narrowed := (cb.index != nil && len(filter.Tags) > 0) || (cb.authors != nil && len(filter.Authors) > 0)
+	if cb.order != nil && !narrowed {
+		return cb.queryInOrder(ctx, filter, accept, order)
+	}
+
+	stored, limit, err := cb.collect(ctx, filter, accept)
+	if len(stored) == 0 {
+		return nil, err
+	}
+
+	slices.SortFunc(stored, func(a, b *StoredEvent) int { return compareDescending(a.Event, b.Event) })
+	if order == Ascending {
+		slices.Reverse(stored)
+	}
+
+	if limit > 0 && len(stored) > limit {
+		stored = stored[:limit]
+	}
+
+	events := make([]*nostr.Event, len(stored))
+	for i, s := range stored {
+		cb.markReturned(s)
+		events[i] = s.Event
+	}
+	return events, err
+}
+
+// QueryStoredEvents is like [AtomicCircularBuffer2.QueryEventsOrdered], but returns the events with their
+// sequence numbers, and orders the events with the same CreatedAt by insertion instead of by ID:
+// the last saved first when [Descending], the first saved first when [Ascending].
+func (cb *AtomicCircularBuffer2) QueryStoredEvents(ctx context.Context, filter nostr.Filter, opts QueryOptions) ([]StoredEvent, error) {
+	stored, limit, err := cb.collect(ctx, filter, nil)
+	if err != nil || len(stored) == 0 {
+		return nil, err
+	}
+
+	slices.SortFunc(stored, func(a, b *StoredEvent) int {
+		if c := cmp.Compare(b.Event.CreatedAt, a.Event.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.Seq, a.Seq)
+	})
+	if opts.Order == Ascending {
+		slices.Reverse(stored)
+	}
+
+	if limit > 0 && len(stored) > limit {
+		stored = stored[:limit]
+	}
+
+	events := make([]StoredEvent, len(stored))
+	for i, s := range stored {
+		cb.markReturned(s)
+		events[i] = StoredEvent{Event: s.Event, Seq: s.Seq}
+	}
+	return events, nil
+}
+
+// collect returns all the stored events matching the filter and accepted by accept, if not nil,
+// in insertion order, and the limit of the filter, which is left to the caller to apply after sorting.
+// The events are not marked as returned, which is left to the caller for the events kept within the limit.
+// If ctx is cancelled during the scan, the events found so far are returned with the context error.
+func (cb *AtomicCircularBuffer2) collect(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool) ([]*StoredEvent, int, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	limit := filter.Limit
+	filter.Limit = 0
+
+	var stored []*StoredEvent
+	start, end := cb.bounds()
+	err = cb.peek(ctx, filter, accept, start, end, nil, func(s *StoredEvent) bool {
+		stored = append(stored, s)
+		return true
+	})
+	return stored, limit, err
+}
+
+// queryInOrder returns the events matching the filter and accepted by accept, if not nil, in the order,
+// reading them from the order index, up to the limit of the filter.
+// If ctx is cancelled during the walk, the events found so far are returned with the context error.
+func (cb *AtomicCircularBuffer2) queryInOrder(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, order Order) ([]*nostr.Event, error) {
+	filter, err := normalizeFilter(filter, int(cb.size))
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if cb.ids != nil && !cb.mayContainAny(filter.IDs) {
+		return nil, nil
+	}
+
+	if cb.maxAge > 0 {
+		// expired events are skipped as if the filter asked for the events since the expiration, see scan
+		cutoff := cb.expiration()
+		if filter.Since == nil || *filter.Since < cutoff {
+			filter.Since = &cutoff
+		}
+	}
+
+	kinds := newKindMatcher(filter.Kinds)
+	var events []*nostr.Event
+	walked := 0
+
+	cb.order.walk(filter.Since, filter.Until, order, func(e orderEntry) bool {
+		if walked%ctxCheckInterval == 0 && ctx.Err() != nil {
+			err = ctx.Err()
+			return false
+		}
+		walked++
+
+		stored := cb.slot(e.pos).Load()
+		if !cb.holds(stored, e) || !matchEvent(stored.Event, filter, &kinds) || (accept != nil && !accept(stored.Event)) {
+			return true
+		}
+
+		cb.markReturned(stored)
+		events = append(events, stored.Event)
+		return filter.Limit == 0 || len(events) < filter.Limit
+	})
+	return events, err
+}
+
+// isCurrent reports whether the entry of the order index refers to an event still in the buffer.
+func (cb *AtomicCircularBuffer2) isCurrent(e orderEntry) bool {
+	return cb.holds(cb.slot(e.pos).Load(), e)
+}
+
+// holds reports whether the stored event, loaded from the position of the entry of the order index,
+// is the event of the entry, rather than a later one or nothing if it was evicted or deleted.
+func (cb *AtomicCircularBuffer2) holds(stored *StoredEvent, e orderEntry) bool {
+	if stored == nil || stored.Event.ID != e.id || stored.Event.CreatedAt != e.createdAt {
+		return false
+	}
+	start, end := cb.bounds()
+	return e.pos >= start && e.pos < end
+}
+
+// compareDescending compares the events in [Descending] order.
+func compareDescending(a, b *nostr.Event) int {
+	if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryEventsOrdered(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+
+	// saved out of order, with b and c sharing the same CreatedAt
+	for _, e := range []struct {
+		id        string
+		createdAt nostr.Timestamp
+	}{
+		{"d", 400}, {"a", 100}, {"c", 200}, {"e", 500}, {"b", 200},
+	} {
+		evt := createTestEvent(e.id, 1)
+		evt.CreatedAt = e.createdAt
+		cb.SaveEvent(ctx, evt)
+	}
+
+	tests := []struct {
+		name     string
+		filter   nostr.Filter
+		opts     QueryOptions
+		expected []string
+	}{
+		{name: "default descending", expected: []string{"e", "d", "b", "c", "a"}},
+		{name: "ascending", opts: QueryOptions{Order: Ascending}, expected: []string{"a", "c", "b", "d", "e"}},
+		{name: "descending limit", filter: nostr.Filter{Limit: 3}, expected: []string{"e", "d", "b"}},
+		{name: "ascending limit", filter: nostr.Filter{Limit: 2}, opts: QueryOptions{Order: Ascending}, expected: []string{"a", "c"}},
+		{name: "descending limit within tie", filter: nostr.Filter{Until: timestamp(200), Limit: 1}, expected: []string{"b"}},
+		{name: "ascending limit within tie", filter: nostr.Filter{Since: timestamp(200), Limit: 1}, opts: QueryOptions{Order: Ascending}, expected: []string{"c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := cb.QueryEventsOrdered(ctx, test.filter, test.opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ids(events); !slices.Equal(got, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestQueryStoredEvents(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+
+	// same CreatedAt, saved in an order different from the one of their IDs
+	for _, id := range []string{"c", "a", "d", "b"} {
+		cb.SaveEvent(ctx, createTimedEvent(id, 100))
+	}
+	cb.SaveEvent(ctx, createTimedEvent("older", 50))
+
+	// storedIDs returns the IDs of the stored events, checking their sequence numbers are unique
+	storedIDs := func(events []StoredEvent) []string {
+		seen := make(map[uint64]bool)
+		ids := make([]string, len(events))
+		for i, s := range events {
+			if seen[s.Seq] {
+				t.Fatalf("duplicated sequence number %d", s.Seq)
+			}
+			seen[s.Seq] = true
+			ids[i] = s.Event.ID
+		}
+		return ids
+	}
+
+	for range 3 {
+		// the order is the same on every query
+		events, _ := cb.QueryStoredEvents(ctx, nostr.Filter{}, QueryOptions{Order: Ascending})
+		if got, expected := storedIDs(events), []string{"older", "c", "a", "d", "b"}; !slices.Equal(got, expected) {
+			t.Fatalf("ascending: expected %v, got %v", expected, got)
+		}
+
+		events, _ = cb.QueryStoredEvents(ctx, nostr.Filter{}, QueryOptions{})
+		if got, expected := storedIDs(events), []string{"b", "d", "a", "c", "older"}; !slices.Equal(got, expected) {
+			t.Fatalf("descending: expected %v, got %v", expected, got)
+		}
+	}
+
+	// the sequence numbers survive compaction, and are never reused after a clear
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "a"})
+	cb.Compact()
+	events, _ := cb.QueryStoredEvents(ctx, nostr.Filter{IDs: []string{"b"}}, QueryOptions{})
+	if len(events) != 1 || events[0].Seq != 3 {
+		t.Fatalf("expected b to keep its sequence number 3 after compaction, got %v", events)
+	}
+
+	cb.Clear()
+	cb.SaveEvent(ctx, createTimedEvent("new", 100))
+	events, _ = cb.QueryStoredEvents(ctx, nostr.Filter{}, QueryOptions{})
+	if len(events) != 1 || events[0].Seq != 5 {
+		t.Fatalf("expected the sequence numbers to continue after a clear, got %v", events)
+	}
+}
+
+// TestQueryOrderedCancelled tests that the ordered queries return the events found before ctx is cancelled
+func TestQueryOrderedCancelled(t *testing.T) {
+	for name, opts := range map[string][]BufferOption{"collect": nil, "order index": {WithOrderIndex()}} {
+		t.Run(name, func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(2000, opts...)
+			for i := range 2000 {
+				cb.SaveEvent(context.Background(), createTimedEvent(fmt.Sprintf("id-%d", i), int64(i)))
+			}
+
+			// the query accepts one event out of ten, and is cancelled after seeing 300 events,
+			// which it notices at the next check of ctx, before reaching the limit
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			seen := 0
+			accept := func(*nostr.Event) bool {
+				if seen++; seen == 300 {
+					cancel()
+				}
+				return seen%10 == 0
+			}
+
+			events, err := cb.queryOrdered(ctx, nostr.Filter{Limit: 100}, accept, Descending)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected the query to be cancelled, got %v", err)
+			}
+			if len(events) == 0 || len(events) > 100 {
+				t.Fatalf("Expected the events found before the cancellation within the limit, got %d", len(events))
+			}
+			if !slices.IsSortedFunc(events, compareDescending) {
+				t.Fatalf("Expected the events found to be sorted, got %v", ids(events))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// minOrderIndexPrune is the number of entries of an orderIndex below which the stale ones are never pruned.
+const minOrderIndexPrune = 64
+
+// orderIndex keeps the positions of the events in a buffer sorted in [Ascending] order, the reverse of
+// [Descending], so that ordered queries read the events in order instead of sorting them.
+// Evicted and deleted events are not removed from the index, as removing the oldest entries on every save
+// would move all the others: their entries become stale, and are skipped by the readers and pruned once in a while.
+type orderIndex struct {
+	mu      sync.RWMutex
+	entries []orderEntry
+	pruneAt int
+
+	// current reports whether the entry still refers to an event in the buffer
+	current func(orderEntry) bool
+}
+
+// orderEntry is the entry of the event saved at pos in an orderIndex.
+type orderEntry struct {
+	createdAt nostr.Timestamp
+	id        string
+	pos       uint64
+}
+
+// newOrderIndex returns an orderIndex for a buffer of the capacity, whose stale entries are the ones
+// for which current returns false.
+func newOrderIndex(capacity int, current func(orderEntry) bool) *orderIndex {
+	return &orderIndex{
+		pruneAt: max(2*capacity, minOrderIndexPrune),
+		current: current,
+	}
+}
+
+// compareEntries compares the entries in [Ascending] order.
+func compareEntries(a, b orderEntry) int {
+	if c := cmp.Compare(a.createdAt, b.createdAt); c != 0 {
+		return c
+	}
+	return strings.Compare(b.id, a.id)
+}
+
+// add inserts the entry of the event saved at the position. Events are usually saved in about the order
+// they were created, so they are inserted close to the end.
+func (idx *orderIndex) add(evt *nostr.Event, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry := orderEntry{createdAt: evt.CreatedAt, id: evt.ID, pos: pos}
+	i, _ := slices.BinarySearchFunc(idx.entries, entry, compareEntries)
+	idx.entries = slices.Insert(idx.entries, i, entry)
+
+	if len(idx.entries) >= idx.pruneAt {
+		idx.entries = slices.DeleteFunc(idx.entries, func(e orderEntry) bool { return !idx.current(e) })
+		idx.pruneAt = max(2*len(idx.entries), idx.pruneAt)
+	}
+}
+
+// remove drops the entry of the event saved at the position, when it's updated in place.
+func (idx *orderIndex) remove(evt *nostr.Event, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	entry := orderEntry{createdAt: evt.CreatedAt, id: evt.ID, pos: pos}
+	i, _ := slices.BinarySearchFunc(idx.entries, entry, compareEntries)
+	for ; i < len(idx.entries) && compareEntries(idx.entries[i], entry) == 0; i++ {
+		if idx.entries[i].pos == pos {
+			idx.entries = slices.Delete(idx.entries, i, i+1)
+			return
+		}
+	}
+}
+
+// reset empties the index.
+func (idx *orderIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries = idx.entries[:0]
+}
+
+// walk calls fn with the entries created in [since, until], any of which can be nil, in the order,
+// until fn returns false. The entries might be stale. Saves wait for the walk to complete.
+func (idx *orderIndex) walk(since, until *nostr.Timestamp, order Order, fn func(orderEntry) bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	byCreatedAt := func(e orderEntry, t nostr.Timestamp) int { return cmp.Compare(e.createdAt, t) }
+
+	from, to := 0, len(idx.entries)
+	if since != nil {
+		from, _ = slices.BinarySearchFunc(idx.entries, *since, byCreatedAt)
+	}
+	if until != nil {
+		to, _ = slices.BinarySearchFunc(idx.entries, *until+1, byCreatedAt)
+	}
+
+	if order == Ascending {
+		for i := from; i < to; i++ {
+			if !fn(idx.entries[i]) {
+				return
+			}
+		}
+		return
+	}
+
+	for i := to - 1; i >= from; i-- {
+		if !fn(idx.entries[i]) {
+			return
+		}
+	}
+}
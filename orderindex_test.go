@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestOrderIndexMatchesSort(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	// 1000 events in a 300 slot buffer, so that the index must skip the evicted events,
+	// created mostly in order, with some created much earlier and many at the same time
+	indexed := NewAtomicCircularBuffer2(300, WithOrderIndex())
+	sorted := NewAtomicCircularBuffer2(300)
+	for i := range 1000 {
+		evt := createTimedEvent(hexID(i), int64(1000+i/3))
+		evt.Kind = i % 3
+		if rng.IntN(10) == 0 {
+			evt.CreatedAt -= nostr.Timestamp(rng.IntN(500))
+		}
+		indexed.SaveEvent(ctx, evt)
+		sorted.SaveEvent(ctx, evt)
+	}
+
+	// deleted and updated events must be found in their new place, or not at all
+	for _, i := range []int{800, 850, 950} {
+		indexed.DeleteEvent(ctx, &nostr.Event{ID: hexID(i)})
+		sorted.DeleteEvent(ctx, &nostr.Event{ID: hexID(i)})
+	}
+	for _, i := range []int{801, 900} {
+		backdate := func(evt *nostr.Event) { evt.CreatedAt = 1100 }
+		indexed.UpdateEvent(ctx, hexID(i), backdate)
+		sorted.UpdateEvent(ctx, hexID(i), backdate)
+	}
+
+	filters := []nostr.Filter{
+		{},
+		{Limit: 10},
+		{Kinds: []int{1}, Limit: 25},
+		{Since: timestamp(1200), Until: timestamp(1250)},
+		{Since: timestamp(1300), Limit: 7},
+		{Until: timestamp(1150), Limit: 7},
+		{Since: timestamp(1100), Until: timestamp(1100)},
+		{IDs: []string{hexID(999), hexID(801), hexID(3)}},
+		{Since: timestamp(5000)},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, filter := range filters {
+			for _, order := range []Order{Descending, Ascending} {
+				expected, err := sorted.QueryEventsOrdered(ctx, filter, QueryOptions{Order: order})
+				if err != nil {
+					t.Fatalf("Failed to query events: %v", err)
+				}
+
+				events, err := indexed.QueryEventsOrdered(ctx, filter, QueryOptions{Order: order})
+				if err != nil {
+					t.Fatalf("Failed to query events: %v", err)
+				}
+
+				if !slices.Equal(ids(events), ids(expected)) {
+					t.Fatalf("filter %v, order %d: expected %v, got %v", filter, order, ids(expected), ids(events))
+				}
+			}
+		}
+
+		// the pages are read from the index too
+		var paged []string
+		for cursor := (Cursor{}); ; {
+			page, next, err := indexed.QueryPage(ctx, nostr.Filter{Kinds: []int{2}}, cursor, 17)
+			if err != nil {
+				t.Fatalf("Failed to query a page: %v", err)
+			}
+			paged = append(paged, ids(page)...)
+			if next.IsZero() {
+				break
+			}
+			cursor = next
+		}
+		expected, _ := sorted.QueryEventsOrdered(ctx, nostr.Filter{Kinds: []int{2}}, QueryOptions{})
+		if !slices.Equal(paged, ids(expected)) {
+			t.Fatalf("Expected the pages to hold %v, got %v", ids(expected), paged)
+		}
+	}
+
+	check()
+
+	// compaction moves the events, so the index is rebuilt
+	indexed.Compact()
+	sorted.Compact()
+	check()
+
+	// the stale entries of the evicted events are eventually pruned
+	for i := 1000; i < 5000; i++ {
+		evt := createTimedEvent(hexID(i), int64(1000+i/3))
+		indexed.SaveEvent(ctx, evt)
+		sorted.SaveEvent(ctx, evt)
+	}
+	check()
+
+	if entries := len(indexed.order.entries); entries > 2*300 {
+		t.Fatalf("Expected the stale entries to be pruned, got %d entries", entries)
+	}
+
+	indexed.Clear()
+	if len(indexed.order.entries) != 0 {
+		t.Fatal("Expected Clear to empty the index")
+	}
+}
+
+// BenchmarkOrderedQuery tests a query for the 100 newest events of a buffer of 100k events, sorting the matching
+// events or reading them from the order index, with the events saved about in the order they were created,
+// or in the reverse order. The saves are benchmarked separately, as the reverse order is the worst case of the index,
+// moving all its entries on every save.
+func BenchmarkOrderedQuery(b *testing.B) {
+	ctx := context.Background()
+	const size = 100_000
+
+	insertions := map[string]func(i int) int64{
+		"near-sorted": func(i int) int64 {
+			if i%100 == 0 {
+				return int64(1_000_000 + i - 50)
+			}
+			return int64(1_000_000 + i)
+		},
+		"reverse": func(i int) int64 { return int64(2_000_000 - i) },
+	}
+	modes := map[string][]BufferOption{
+		"sort":    nil,
+		"indexed": {WithOrderIndex()},
+	}
+
+	for insertion, createdAt := range insertions {
+		events := make([]*nostr.Event, size)
+		for i := range events {
+			events[i] = createTimedEvent(fmt.Sprintf("id-%d", i), createdAt(i))
+		}
+
+		for mode, opts := range modes {
+			b.Run(insertion+"/query/"+mode, func(b *testing.B) {
+				cb := NewAtomicCircularBuffer2(size, opts...)
+				for _, evt := range events {
+					cb.SaveEvent(ctx, evt)
+				}
+				filter := nostr.Filter{Limit: 100}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					result, _ := cb.QueryEventsOrdered(ctx, filter, QueryOptions{})
+					if len(result) != 100 {
+						b.Fatalf("Expected 100 events, got %d", len(result))
+					}
+				}
+			})
+
+			// the saves into the full buffer continue the insertion order
+			b.Run(insertion+"/save/"+mode, func(b *testing.B) {
+				cb := NewAtomicCircularBuffer2(size, opts...)
+				for _, evt := range events {
+					cb.SaveEvent(ctx, evt)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					cb.SaveEvent(ctx, createTimedEvent("new", createdAt(size+i)))
+				}
+			})
+		}
+	}
+}
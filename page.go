@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Cursor is the position of a client paging through the buffer with [AtomicCircularBuffer2.QueryPage].
+// It holds the CreatedAt and ID of the last event seen. The zero Cursor is the start of the pages.
+type Cursor struct {
+	CreatedAt nostr.Timestamp
+	ID        string
+}
+
+// IsZero reports whether the cursor is the zero Cursor.
+func (c Cursor) IsZero() bool {
+	return c == Cursor{}
+}
+
+// QueryPage returns up to pageSize events matching the filter that come after the cursor, in [Descending] order,
+// and the cursor of the next page. When there are no more events, the returned cursor is the zero Cursor.
+//
+// The pages are stable across saves and evictions: events newer than the cursor are never returned, so nothing
+// is duplicated, and evicted or deleted events are simply skipped.
+// The limit of the filter is ignored.
+func (cb *AtomicCircularBuffer2) QueryPage(ctx context.Context, filter nostr.Filter, cursor Cursor, pageSize int) ([]*nostr.Event, Cursor, error) {
+	if pageSize <= 0 {
+		return nil, Cursor{}, fmt.Errorf("invalid page size: %d", pageSize)
+	}
+
+	var accept func(*nostr.Event) bool
+	if !cursor.IsZero() {
+		if filter.Until == nil || *filter.Until > cursor.CreatedAt {
+			filter.Until = &cursor.CreatedAt
+		}
+
+		last := &nostr.Event{CreatedAt: cursor.CreatedAt, ID: cursor.ID}
+		accept = func(evt *nostr.Event) bool { return compareDescending(last, evt) < 0 }
+	}
+
+	// one more event than the page tells whether there is a next page
+	filter.Limit = pageSize + 1
+	filter.LimitZero = false
+
+	events, err := cb.queryOrdered(ctx, filter, accept, Descending)
+	if err != nil {
+		return nil, Cursor{}, err
+	}
+
+	if len(events) <= pageSize {
+		return events, Cursor{}, nil
+	}
+
+	events = events[:pageSize]
+	last := events[pageSize-1]
+	return events, Cursor{CreatedAt: last.CreatedAt, ID: last.ID}, nil
+}
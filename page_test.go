@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryPage(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+
+	// pairs of events share the same CreatedAt, so that pages split ties
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%02d", i), int64(1000+i/2)))
+	}
+
+	var cursor Cursor
+	var prev *nostr.Event
+	seen := make(map[string]bool)
+	pages := 0
+
+	for {
+		events, next, err := cb.QueryPage(ctx, nostr.Filter{}, cursor, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		pages++
+
+		for _, evt := range events {
+			if seen[evt.ID] {
+				t.Fatalf("page %d: duplicated event %s", pages, evt.ID)
+			}
+			if prev != nil && compareDescending(prev, evt) >= 0 {
+				t.Fatalf("page %d: event %s is not after %s", pages, evt.ID, prev.ID)
+			}
+			seen[evt.ID] = true
+			prev = evt
+		}
+
+		if next.IsZero() {
+			break
+		}
+		cursor = next
+	}
+
+	if pages != 10 {
+		t.Fatalf("expected 10 pages, got %d", pages)
+	}
+	if len(seen) != 100 {
+		t.Fatalf("expected to see 100 events, got %d", len(seen))
+	}
+}
+
+func TestQueryPageConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%03d", i), int64(1000+i)))
+	}
+
+	var cursor Cursor
+	seen := make(map[string]bool)
+	saved := 100
+
+	for {
+		events, next, err := cb.QueryPage(ctx, nostr.Filter{}, cursor, 10)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for _, evt := range events {
+			if seen[evt.ID] {
+				t.Fatalf("duplicated event %s", evt.ID)
+			}
+			seen[evt.ID] = true
+		}
+
+		if next.IsZero() {
+			break
+		}
+		cursor = next
+
+		// newer events evict the oldest ones between the pages
+		for range 5 {
+			cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%03d", saved), int64(1000+saved)))
+			saved++
+		}
+	}
+
+	// the new events are all newer than the first page, so they're never returned
+	for i := 100; i < saved; i++ {
+		if seen[fmt.Sprintf("id-%03d", i)] {
+			t.Fatalf("event id-%03d saved after the first page was returned", i)
+		}
+	}
+
+	// the events that survived all the evictions must all have been returned
+	for i := saved - 100; i < 100; i++ {
+		if !seen[fmt.Sprintf("id-%03d", i)] {
+			t.Fatalf("gap: event id-%03d was never returned", i)
+		}
+	}
+}
+
+func TestQueryPageInvalidSize(t *testing.T) {
+	cb := NewAtomicCircularBuffer2(10)
+	if _, _, err := cb.QueryPage(context.Background(), nostr.Filter{}, Cursor{}, 0); err == nil {
+		t.Fatal("expected an error for a page size of 0")
+	}
+}
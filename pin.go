@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrEventNotFound is returned when the event with the provided ID is not in the buffer.
+var ErrEventNotFound = errors.New("event not found")
+
+// ErrTooManyPinned is returned by [AtomicCircularBuffer2.Pin] when pinning one more event would leave
+// no event that can be evicted to make room for new ones.
+var ErrTooManyPinned = errors.New("too many pinned events")
+
+// pinSet is the set of the IDs of the pinned events.
+type pinSet struct {
+	mu  sync.RWMutex
+	ids map[string]struct{}
+
+	// len is the number of pinned IDs, so that saves don't take the lock when no event is pinned
+	len atomic.Int64
+}
+
+// contains reports whether the ID is pinned.
+func (p *pinSet) contains(id string) bool {
+	if p.len.Load() == 0 {
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.ids[id]
+	return ok
+}
+
+// add pins the ID, unless max IDs are already pinned. It reports whether the ID is pinned.
+func (p *pinSet) add(id string, max int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.ids[id]; ok {
+		return true
+	}
+	if len(p.ids) >= max {
+		return false
+	}
+
+	if p.ids == nil {
+		p.ids = make(map[string]struct{})
+	}
+	p.ids[id] = struct{}{}
+	p.len.Store(int64(len(p.ids)))
+	return true
+}
+
+// remove unpins the ID.
+func (p *pinSet) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.ids, id)
+	p.len.Store(int64(len(p.ids)))
+}
+
+// reset unpins all the IDs.
+func (p *pinSet) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clear(p.ids)
+	p.len.Store(0)
+}
+
+// Pin prevents the event with the ID from being evicted by newer events: when its turn comes, it's moved
+// to the head of the buffer and the next oldest event is evicted instead, so it gets a new sequence number.
+// Moved events are out of chronological order, so queries by time can no longer narrow their scan.
+// The event stays pinned until it's unpinned, deleted or the buffer is cleared. Pinned events still expire
+// with [WithMaxAge]. At most capacity-1 events can be pinned, so that there is always an event to evict,
+// otherwise [ErrTooManyPinned] is returned. [ErrEventNotFound] is returned if the event is not in the buffer.
+// Pinning has no effect with the [RejectNew] policy, as events are never evicted.
+func (cb *AtomicCircularBuffer2) Pin(id string) error {
+	if _, _, found := cb.find(id); !found {
+		return ErrEventNotFound
+	}
+	if !cb.pins.add(id, int(cb.size)-1) {
+		return ErrTooManyPinned
+	}
+	return nil
+}
+
+// Unpin lets the event with the ID be evicted again, see [AtomicCircularBuffer2.Pin].
+func (cb *AtomicCircularBuffer2) Unpin(id string) {
+	cb.pins.remove(id)
+}
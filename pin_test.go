@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPin(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(5, WithTagIndex(), WithIDBloomFilter())
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	if err := cb.Pin("id-1"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+	if err := cb.Pin("id-3"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+	if err := cb.Pin("missing"); !errors.Is(err, ErrEventNotFound) {
+		t.Fatalf("Expected ErrEventNotFound, got %v", err)
+	}
+
+	var evicted []string
+	cb.onEvict = func(evt *nostr.Event) { evicted = append(evicted, evt.ID) }
+
+	// the pinned events survive many saves, while the others are evicted in order
+	for i := 5; i < 100; i++ {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	// a batch is saved one by one while events are pinned
+	cb.SaveEvents(ctx, []*nostr.Event{createTestEvent("batch-0", 1), createTestEvent("batch-1", 1)})
+
+	got := ids(slices.Collect(cb.All()))
+	slices.Sort(got)
+	if expected := []string{"batch-0", "batch-1", "id-1", "id-3", "id-99"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	if slices.Contains(evicted, "id-1") || slices.Contains(evicted, "id-3") {
+		t.Fatalf("Expected the pinned events never to be evicted, evicted %v", evicted)
+	}
+	if len(evicted) != 97 {
+		t.Fatalf("Expected 97 evicted events, got %d", len(evicted))
+	}
+	if err := cb.CheckIntegrity(); err != nil {
+		t.Fatalf("Unexpected integrity error: %v", err)
+	}
+
+	// pinned events are still found by the queries
+	events, err := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-1"}, Tags: nostr.TagMap{"e": {"test-tag"}}})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Expected to find the pinned event, got %v, %v", ids(events), err)
+	}
+
+	// once unpinned, the events are evicted again
+	cb.Unpin("id-1")
+	cb.Unpin("id-3")
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("new-%d", i), 1))
+	}
+	if got := ids(slices.Collect(cb.All())); slices.Contains(got, "id-1") || slices.Contains(got, "id-3") {
+		t.Fatalf("Expected the unpinned events to be evicted, got %v", got)
+	}
+}
+
+func TestPinAll(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(3)
+	for i := range 3 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	if err := cb.Pin("id-0"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+	if err := cb.Pin("id-1"); err != nil {
+		t.Fatalf("Failed to pin: %v", err)
+	}
+	if err := cb.Pin("id-2"); !errors.Is(err, ErrTooManyPinned) {
+		t.Fatalf("Expected ErrTooManyPinned when pinning all the events, got %v", err)
+	}
+	if err := cb.Pin("id-1"); err != nil {
+		t.Fatalf("Expected pinning an event twice to succeed, got %v", err)
+	}
+
+	// the only unpinned slot keeps accepting new events
+	for i := 3; i < 10; i++ {
+		if err := cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1)); err != nil {
+			t.Fatalf("Failed to save: %v", err)
+		}
+	}
+
+	got := ids(slices.Collect(cb.All()))
+	slices.Sort(got)
+	if expected := []string{"id-0", "id-1", "id-9"}; !slices.Equal(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// deleting a pinned event unpins it, making room for another one
+	cb.DeleteEvent(ctx, createTestEvent("id-0", 1))
+	if err := cb.Pin("id-9"); err != nil {
+		t.Fatalf("Expected to pin after deleting a pinned event, got %v", err)
+	}
+}
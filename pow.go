@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// MinPoW is the minimum proof of work difficulty (NIP-13) of the events accepted by [Save],
+// as the number of leading zero bits of their ID. Zero means no minimum.
+var MinPoW int
+
+// checkPoW rejects the events whose ID doesn't reach [MinPoW] leading zero bits.
+// When the nonce tag of the event commits to a target difficulty, the target must also reach MinPoW,
+// so that events lucky enough to meet the minimum without having worked for it are rejected,
+// and the ID must reach the target.
+func checkPoW(e *nostr.Event) error {
+	if MinPoW <= 0 {
+		return nil
+	}
+
+	difficulty := 0
+	if len(e.ID) == 64 {
+		difficulty = nip13.Difficulty(e.ID)
+	}
+
+	if nonce := e.Tags.Find("nonce"); len(nonce) >= 3 {
+		target, err := strconv.Atoi(nonce[2])
+		if err != nil {
+			return fmt.Errorf("pow: invalid target difficulty %q in the nonce tag", nonce[2])
+		}
+		if target < MinPoW {
+			return fmt.Errorf("pow: committed target difficulty %d is less than %d", target, MinPoW)
+		}
+		if difficulty < target {
+			return fmt.Errorf("pow: difficulty %d doesn't reach the committed target %d", difficulty, target)
+		}
+	}
+
+	if difficulty < MinPoW {
+		return fmt.Errorf("pow: difficulty %d is less than %d", difficulty, MinPoW)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+func setMinPoW(t *testing.T, difficulty int) {
+	old := MinPoW
+	MinPoW = difficulty
+	t.Cleanup(func() { MinPoW = old })
+}
+
+func TestSavePoW(t *testing.T) {
+	ephemeral := NewAtomicCircularBuffer2(10)
+	setupStores(t, &mockStore{}, ephemeral)
+	setMinPoW(t, 16)
+
+	// IDs with 20, 16 and 12 leading zero bits
+	const (
+		id20 = "00000f0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+		id16 = "0000ff0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+		id12 = "000fff0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	)
+
+	tests := []struct {
+		name     string
+		id       string
+		nonce    nostr.Tag
+		accepted bool
+	}{
+		{"meeting the difficulty", id16, nil, true},
+		{"above the difficulty", id20, nil, true},
+		{"below the difficulty", id12, nil, false},
+		{"meeting the committed target", id20, nostr.Tag{"nonce", "1", "18"}, true},
+		{"below the committed target", id16, nostr.Tag{"nonce", "1", "18"}, false},
+		{"committed target below the minimum", id20, nostr.Tag{"nonce", "1", "8"}, false},
+		{"invalid committed target", id20, nostr.Tag{"nonce", "1", "many"}, false},
+		{"nonce without target", id16, nostr.Tag{"nonce", "1"}, true},
+		{"short ID", "0000", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evt := createTestEvent(test.id, 20000)
+			if test.nonce != nil {
+				evt.Tags = nostr.Tags{test.nonce}
+			}
+
+			err := Save(&rely.Client{}, evt)
+			if test.accepted && err != nil {
+				t.Fatalf("Expected the event to be accepted, got %v", err)
+			}
+			if !test.accepted && (err == nil || !strings.HasPrefix(err.Error(), "pow:")) {
+				t.Fatalf("Expected an error starting with %q, got %v", "pow:", err)
+			}
+		})
+	}
+
+	stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+	if len(stored) != 4 {
+		t.Fatalf("Expected only the 4 accepted events to be stored, got %v", ids(stored))
+	}
+
+	// without a minimum, every event is accepted
+	setMinPoW(t, 0)
+	if err := Save(&rely.Client{}, createTestEvent(id12, 20000)); err != nil {
+		t.Fatalf("Expected the event to be accepted, got %v", err)
+	}
+}
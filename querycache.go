@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// queryCache is an LRU cache of query results, keyed by the fingerprint of the filter.
+// Every write to the buffer bumps its version, which invalidates all the cached results at once.
+// This is coarse, but cheap and always correct, and it still helps when the same filters
+// are queried many times between two writes, as it's the case for popular feeds.
+type queryCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+	hits    uint64
+
+	// now is time.Now, replaced in tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	events  []*nostr.Event
+	version uint64
+	expires time.Time
+}
+
+func newQueryCache(size int, ttl time.Duration) *queryCache {
+	return &queryCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the events cached for the key, if they were cached at the version and are not expired.
+func (c *queryCache) get(key string, version uint64) ([]*nostr.Event, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if entry.version != version || c.now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	c.hits++
+	return entry.events, true
+}
+
+// put caches the events of the key, computed at the version, evicting the least recently used entry if full.
+func (c *queryCache) put(key string, version uint64, events []*nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, events: events, version: version, expires: c.now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// fingerprint returns a canonical representation of the filter, equal for filters that only differ
+// in the order of their values, which can't change the result.
+func fingerprint(f nostr.Filter) string {
+	var b strings.Builder
+	writeSorted := func(name string, values []string) {
+		if values == nil {
+			return
+		}
+		b.WriteString(name)
+		b.WriteByte('[')
+		for _, v := range slices.Sorted(slices.Values(values)) {
+			b.WriteString(strconv.Quote(v))
+			b.WriteByte(',')
+		}
+		b.WriteByte(']')
+	}
+
+	writeSorted("ids", f.IDs)
+	writeSorted("authors", f.Authors)
+
+	if f.Kinds != nil {
+		b.WriteString("kinds[")
+		for _, k := range slices.Sorted(slices.Values(f.Kinds)) {
+			b.WriteString(strconv.Itoa(k))
+			b.WriteByte(',')
+		}
+		b.WriteByte(']')
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(f.Tags)) {
+		writeSorted("#"+strconv.Quote(name), f.Tags[name])
+	}
+
+	if f.Since != nil {
+		b.WriteString("since" + strconv.FormatInt(int64(*f.Since), 10))
+	}
+	if f.Until != nil {
+		b.WriteString("until" + strconv.FormatInt(int64(*f.Until), 10))
+	}
+	b.WriteString("limit" + strconv.Itoa(f.Limit))
+	if f.LimitZero {
+		b.WriteString("zero")
+	}
+	if f.Search != "" {
+		b.WriteString("search" + strconv.Quote(f.Search))
+	}
+	return b.String()
+}
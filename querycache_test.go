@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryCache(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10, WithQueryCache(2, time.Minute))
+	for i := range 5 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%2))
+	}
+
+	query := func(filter nostr.Filter) []*nostr.Event {
+		t.Helper()
+		events, err := cb.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return events
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		hits := cb.cache.hits
+		first := query(nostr.Filter{Kinds: []int{0, 1}})
+
+		// the order of the values doesn't change the result, so it's the same entry
+		second := query(nostr.Filter{Kinds: []int{1, 0}})
+		if cb.cache.hits != hits+1 {
+			t.Fatalf("expected a cache hit, got %d hits", cb.cache.hits-hits)
+		}
+		if len(first) != 5 || len(second) != 5 {
+			t.Fatalf("expected 5 events, got %d and %d", len(first), len(second))
+		}
+
+		// the cached result is not shared with the callers
+		second[0] = nil
+		if third := query(nostr.Filter{Kinds: []int{0, 1}}); third[0] == nil {
+			t.Fatal("expected the cached result to be unaffected by the caller")
+		}
+	})
+
+	t.Run("invalidated by writes", func(t *testing.T) {
+		filter := nostr.Filter{Kinds: []int{1}}
+		if events := query(filter); len(events) != 2 {
+			t.Fatalf("expected 2 events, got %d", len(events))
+		}
+
+		cb.SaveEvent(ctx, createTestEvent("id-5", 1))
+		if events := query(filter); len(events) != 3 {
+			t.Fatalf("expected the new event after a save, got %d events", len(events))
+		}
+
+		cb.DeleteEvent(ctx, &nostr.Event{ID: "id-1"})
+		if events := query(filter); len(events) != 2 {
+			t.Fatalf("expected the deleted event to be gone, got %d events", len(events))
+		}
+	})
+
+	t.Run("ttl expiry", func(t *testing.T) {
+		now := time.Now()
+		cb.cache.now = func() time.Time { return now }
+
+		filter := nostr.Filter{Kinds: []int{0}}
+		query(filter)
+
+		hits := cb.cache.hits
+		now = now.Add(30 * time.Second)
+		query(filter)
+		if cb.cache.hits != hits+1 {
+			t.Fatal("expected a cache hit before the ttl")
+		}
+
+		now = now.Add(time.Minute)
+		query(filter)
+		if cb.cache.hits != hits+1 {
+			t.Fatal("expected a cache miss after the ttl")
+		}
+	})
+
+	t.Run("lru eviction", func(t *testing.T) {
+		for kind := range 3 {
+			query(nostr.Filter{Kinds: []int{kind + 10}})
+		}
+		if n := cb.cache.lru.Len(); n != 2 {
+			t.Fatalf("expected the cache to hold 2 entries, got %d", n)
+		}
+	})
+}
+
+func TestQueryCacheDisabledByDefault(t *testing.T) {
+	cb := NewAtomicCircularBuffer2(10)
+	if cb.cache != nil {
+		t.Fatal("expected the cache to be disabled by default")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryStats describes the work done by a query, to help tuning the capacity of the buffer.
+// Many more scanned positions than matched events suggest the buffer is too large for the filters it receives.
+type QueryStats struct {
+	// Scanned is the number of positions of the buffer visited by the query.
+	Scanned int
+	// Matched is the number of events matching the filter.
+	Matched int
+	// Returned is the number of events returned.
+	Returned int
+	// Duration is how long the query took.
+	Duration time.Duration
+}
+
+// QueryEventsWithStats is like [AtomicCircularBuffer2.QueryEvents], but also returns the statistics of the query.
+// It never uses the query cache, so that the statistics always describe a scan of the buffer.
+func (cb *AtomicCircularBuffer2) QueryEventsWithStats(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, QueryStats, error) {
+	var stats QueryStats
+	start := time.Now()
+	events, err := cb.queryEvents(ctx, filter, nil, nil, &stats)
+	stats.Duration = time.Since(start)
+	stats.Returned = len(events)
+
+	if cb.metrics != nil {
+		cb.metrics.observeQuery(len(events), stats.Duration)
+	}
+	return events, stats, err
+}
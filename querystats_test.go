@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestQueryEventsWithStats(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 60 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), i%3))
+	}
+
+	events, stats, err := cb.QueryEventsWithStats(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Scanned != cb.Len() || stats.Matched != 60 || stats.Returned != len(events) || len(events) != 60 {
+		t.Fatalf("match all: expected 60 events scanned, matched and returned, got %+v", stats)
+	}
+
+	_, stats, _ = cb.QueryEventsWithStats(ctx, nostr.Filter{Kinds: []int{1}})
+	if stats.Scanned != 60 || stats.Matched != 20 || stats.Returned != 20 {
+		t.Fatalf("selective: expected 60 scanned, 20 matched and returned, got %+v", stats)
+	}
+
+	// the scan stops once the limit is reached
+	_, stats, _ = cb.QueryEventsWithStats(ctx, nostr.Filter{Kinds: []int{1}, Limit: 5})
+	if stats.Scanned != 14 || stats.Returned != 5 {
+		t.Fatalf("limit: expected 14 scanned and 5 returned, got %+v", stats)
+	}
+}
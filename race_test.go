@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -22,3 +24,187 @@ func TestRace(t *testing.T) {
 		ab.SaveEvent(ctx, event)
 	}
 }
+
+func TestConcurrentSaveAndQuery(t *testing.T) {
+	const (
+		writers = 4
+		saves   = 20000
+	)
+
+	ctx := context.Background()
+	ab := NewAtomicCircularBuffer2(100)
+	done := make(chan struct{})
+
+	for w := range writers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := range saves {
+				ab.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d-%d", w, i), 1))
+			}
+		}()
+	}
+
+	running := writers
+	for running > 0 {
+		select {
+		case <-done:
+			running--
+		default:
+		}
+
+		events, err := ab.QueryEvents(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if len(events) > 100 {
+			t.Fatalf("Expected at most 100 events, got %d", len(events))
+		}
+		for _, evt := range events {
+			if evt == nil || !strings.HasPrefix(evt.ID, "id-") {
+				t.Fatalf("Unexpected event returned: %v", evt)
+			}
+		}
+	}
+
+	if count := ab.count.Load(); count != 100 {
+		t.Fatalf("Expected the count to saturate at 100, got %d", count)
+	}
+}
+
+func TestAtomicCircularBufferConcurrentSaveAndQuery(t *testing.T) {
+	const (
+		writers = 4
+		saves   = 20000
+	)
+
+	ctx := context.Background()
+	ab := NewAtomicCircularBuffer(100)
+	done := make(chan struct{})
+
+	for w := range writers {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := range saves {
+				ab.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d-%d", w, i), 1))
+			}
+		}()
+	}
+
+	running := writers
+	for running > 0 {
+		select {
+		case <-done:
+			running--
+		default:
+		}
+
+		ch, err := ab.QueryEvents(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		events := collectEvents(ch)
+		if len(events) > 100 {
+			t.Fatalf("Expected at most 100 events, got %d", len(events))
+		}
+		for _, evt := range events {
+			if evt == nil || !strings.HasPrefix(evt.ID, "id-") {
+				t.Fatalf("Unexpected event returned: %v", evt)
+			}
+		}
+	}
+
+	// no save is lost: every slot holds one of the last events
+	if count := ab.Len(); count != 100 {
+		t.Fatalf("Expected the count to saturate at 100, got %d", count)
+	}
+	if head := ab.head.Load(); head != writers*saves {
+		t.Fatalf("Expected %d saves, got %d", writers*saves, head)
+	}
+}
+
+func TestCircularBufferQueryWhileSaving(t *testing.T) {
+	ctx := context.Background()
+	cb := NewCircularBuffer(50)
+	for i := range 50 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 10000 {
+			cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("new-%d", i), 1))
+		}
+	}()
+
+	// the returned events are read while the slots holding them are being overwritten
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		ch, err := cb.QueryEvents(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		for evt := range ch {
+			if !strings.HasPrefix(evt.ID, "id-") && !strings.HasPrefix(evt.ID, "new-") {
+				t.Fatalf("Unexpected event returned: %v", evt)
+			}
+		}
+	}
+
+	// the buffer keeps its own copy of the events, unaffected by changes to the saved ones
+	evt := createTestEvent("mutable", 1)
+	cb.SaveEvent(ctx, evt)
+	evt.ID = "mutated"
+
+	ch, _ := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"mutable"}})
+	if events := collectEvents(ch); len(events) != 1 {
+		t.Fatalf("Expected the saved copy of the event, got %v", events)
+	}
+}
+
+func TestUpdateWhileQuerying(t *testing.T) {
+	ctx := context.Background()
+	ab := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		evt := createTestEvent(fmt.Sprintf("id-%d", i), 1)
+		evt.Tags = nostr.Tags{{"expiration", "0"}}
+		ab.SaveEvent(ctx, evt)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 20000 {
+			ab.UpdateEvent(ctx, fmt.Sprintf("id-%d", i%100), func(evt *nostr.Event) {
+				evt.Tags[0][1] = fmt.Sprint(i)
+				evt.Content = fmt.Sprint(i)
+			})
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		events, err := ab.QueryEvents(ctx, nostr.Filter{})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+		if len(events) != 100 {
+			t.Fatalf("Expected the updates to keep 100 events, got %d", len(events))
+		}
+		for _, evt := range events {
+			if evt.Tags[0][1] != evt.Content && !strings.HasPrefix(evt.Content, "test content") {
+				t.Fatalf("Read a partially updated event: %v", evt)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pippellia-btc/rely"
+)
+
+// RateLimiter is a token bucket rate limiter with one bucket per client.
+// Each bucket refills at rate tokens per second, up to burst tokens, and every event takes one token.
+// It's safe for concurrent use.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[any]*bucket
+
+	// buckets that have been idle long enough to be full again are the same as new ones,
+	// so they are evicted when sweeping, at most once per idle period
+	idle      time.Duration
+	lastSweep time.Time
+
+	// now is time.Now, replaced in tests
+	now func() time.Time
+
+	// pubkeyOf is clientPubkey, replaced in tests to fake authenticated clients
+	pubkeyOf func(*rely.Client) *string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing each client rate events per second, with bursts of up to burst events.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		buckets:  make(map[any]*bucket),
+		idle:     time.Duration(float64(burst) / rate * float64(time.Second)),
+		now:      time.Now,
+		pubkeyOf: clientPubkey,
+	}
+}
+
+// Allow reports whether the client can send one more event, taking a token from its bucket if so.
+func (l *RateLimiter) Allow(c *rely.Client) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > l.idle {
+		l.sweep(now)
+	}
+
+	key := l.clientKey(c)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep evicts the buckets that have been idle long enough to be full again.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > l.idle {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// clientKey identifies the client: authenticated clients by their pubkey, so that reconnecting
+// doesn't reset their bucket, and the others by their connection.
+func (l *RateLimiter) clientKey(c *rely.Client) any {
+	if pubkey := l.pubkeyOf(c); pubkey != nil {
+		return *pubkey
+	}
+	return c
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pippellia-btc/rely"
+)
+
+// fakeLimiterClock makes the limiter use a clock that only moves when advanced, returning the function that advances it.
+func fakeLimiterClock(l *RateLimiter) func(time.Duration) {
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(2, 5)
+	advance := fakeLimiterClock(limiter)
+	client, other := &rely.Client{}, &rely.Client{}
+
+	// a burst within the budget is accepted
+	for i := range 5 {
+		if !limiter.Allow(client) {
+			t.Fatalf("expected event %d of the burst to be allowed", i)
+		}
+	}
+
+	// the rest of the burst is throttled
+	if limiter.Allow(client) {
+		t.Fatal("expected the event over the burst to be throttled")
+	}
+
+	// other clients have their own bucket
+	if !limiter.Allow(other) {
+		t.Fatal("expected another client to be allowed")
+	}
+
+	// the bucket refills at 2 events per second
+	advance(time.Second)
+	for i := range 2 {
+		if !limiter.Allow(client) {
+			t.Fatalf("expected event %d after a second to be allowed", i)
+		}
+	}
+	if limiter.Allow(client) {
+		t.Fatal("expected the third event after a second to be throttled")
+	}
+
+	// buckets idle long enough to be full again are evicted
+	advance(10 * time.Second)
+	limiter.Allow(client)
+	if n := len(limiter.buckets); n != 1 {
+		t.Fatalf("expected the idle bucket to be evicted, got %d buckets", n)
+	}
+}
+
+func TestRateLimiterPubkey(t *testing.T) {
+	pubkey := "pubkey"
+	limiter := NewRateLimiter(1, 1)
+	limiter.pubkeyOf = func(*rely.Client) *string { return &pubkey }
+	fakeLimiterClock(limiter)
+
+	// authenticated clients share the bucket of their pubkey across connections
+	if !limiter.Allow(&rely.Client{}) {
+		t.Fatal("expected the first event to be allowed")
+	}
+	if limiter.Allow(&rely.Client{}) {
+		t.Fatal("expected a new connection of the same pubkey to be throttled")
+	}
+}
+
+// setSaveLimiter replaces SaveLimiter for the duration of the test.
+func setSaveLimiter(t *testing.T, limiter *RateLimiter) {
+	old := SaveLimiter
+	SaveLimiter = limiter
+	t.Cleanup(func() { SaveLimiter = old })
+}
+
+func TestSaveRateLimited(t *testing.T) {
+	ephemeral := NewAtomicCircularBuffer2(10)
+	setupStores(t, &mockStore{}, ephemeral)
+	limiter := NewRateLimiter(1, 3)
+	fakeLimiterClock(limiter)
+	setSaveLimiter(t, limiter)
+
+	client := &rely.Client{}
+	for i := range 3 {
+		if err := Save(client, createTestEvent(fmt.Sprintf("id-%d", i), 20000)); err != nil {
+			t.Fatalf("expected event %d to be accepted, got %v", i, err)
+		}
+	}
+
+	err := Save(client, createTestEvent("id-3", 20000))
+	if err == nil || !strings.HasPrefix(err.Error(), "rate-limited:") {
+		t.Fatalf("expected a rate-limited error, got %v", err)
+	}
+	if n := ephemeral.Len(); n != 3 {
+		t.Fatalf("expected the throttled event not to be stored, got %d events", n)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ReplaceEvent saves a replaceable or addressable event following NIP-01: the buffer keeps only the newest event
+// for each pubkey and kind, and also d-tag for the addressable kinds. The older versions are deleted after the event
+// is saved. If a newer version is already in the buffer, the event is dropped and [ErrOlderEvent] is returned.
+// The versions are found with a query, which uses the tag index for the addressable kinds if enabled with [WithTagIndex].
+// It mirrors the ReplaceEvent of the SQLite backend, so that replaceable kinds can be kept in memory.
+func (cb *AtomicCircularBuffer2) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt == nil {
+		return errors.New("event cannot be nil")
+	}
+
+	key, ok := keyOf(evt)
+	if !ok {
+		return fmt.Errorf("kind %d is neither replaceable nor addressable", evt.Kind)
+	}
+
+	cb.replaceMu.Lock()
+	defer cb.replaceMu.Unlock()
+
+	filter := nostr.Filter{Authors: []string{key.pubkey}, Kinds: []int{key.kind}}
+	if key.d != "" {
+		filter.Tags = nostr.TagMap{"d": {key.d}}
+	}
+
+	var older []*nostr.Event
+	newer := false
+	err := cb.ForEachMatching(ctx, filter, func(stored *nostr.Event) bool {
+		if k, _ := keyOf(stored); k != key {
+			return true
+		}
+		if !isNewer(evt, stored) {
+			newer = true
+			return false
+		}
+		older = append(older, stored)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if newer {
+		return ErrOlderEvent
+	}
+
+	if err := cb.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+	for _, old := range older {
+		if err := cb.DeleteEvent(ctx, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
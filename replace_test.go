@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReplaceEvent(t *testing.T) {
+	ctx := context.Background()
+
+	for name, opts := range map[string][]BufferOption{
+		"scan":    nil,
+		"indexed": {WithTagIndex()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cb := NewAtomicCircularBuffer2(20, opts...)
+
+			// replacement of a replaceable kind, per pubkey
+			for _, evt := range []*nostr.Event{
+				createReplaceableEvent("m1", "pk", 0, 100, ""),
+				createReplaceableEvent("m2", "pk", 0, 200, ""),
+				createReplaceableEvent("other", "other", 0, 100, ""),
+			} {
+				if err := cb.ReplaceEvent(ctx, evt); err != nil {
+					t.Fatalf("Failed to replace %s: %v", evt.ID, err)
+				}
+			}
+
+			// older versions are rejected, and so is a tie with a higher ID
+			if err := cb.ReplaceEvent(ctx, createReplaceableEvent("m0", "pk", 0, 150, "")); !errors.Is(err, ErrOlderEvent) {
+				t.Fatalf("Expected ErrOlderEvent for an older event, got %v", err)
+			}
+			if err := cb.ReplaceEvent(ctx, createReplaceableEvent("m3", "pk", 0, 200, "")); !errors.Is(err, ErrOlderEvent) {
+				t.Fatalf("Expected ErrOlderEvent for a tie with a higher ID, got %v", err)
+			}
+
+			// the addressable kinds are also replaced per d-tag
+			for _, evt := range []*nostr.Event{
+				createReplaceableEvent("a1", "pk", 30000, 100, "list1"),
+				createReplaceableEvent("a2", "pk", 30000, 100, "list2"),
+				createReplaceableEvent("a3", "pk", 30000, 200, "list1"),
+				createReplaceableEvent("a4", "pk", 30000, 100, ""),
+			} {
+				if err := cb.ReplaceEvent(ctx, evt); err != nil {
+					t.Fatalf("Failed to replace %s: %v", evt.ID, err)
+				}
+			}
+
+			expected := []string{"m2", "other", "a2", "a3", "a4"}
+			if got := ids(slices.Collect(cb.All())); !slices.Equal(got, expected) {
+				t.Fatalf("Expected %v, got %v", expected, got)
+			}
+
+			if err := cb.ReplaceEvent(ctx, createTestEvent("regular", 1)); err == nil {
+				t.Fatal("Expected an error replacing a regular kind")
+			}
+		})
+	}
+}
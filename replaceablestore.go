@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrOlderEvent is returned when saving a replaceable event that is older than the stored version.
+var ErrOlderEvent = errors.New("a newer version of this event is already stored")
+
+// replaceableKey identifies the slot of a replaceable or addressable event.
+// For replaceable kinds the d-tag is always empty.
+type replaceableKey struct {
+	pubkey string
+	kind   int
+	d      string
+}
+
+// keyOf returns the replaceable key of the event, and false if its kind is neither replaceable nor addressable.
+func keyOf(evt *nostr.Event) (replaceableKey, bool) {
+	switch {
+	case nostr.IsReplaceableKind(evt.Kind):
+		return replaceableKey{pubkey: evt.PubKey, kind: evt.Kind}, true
+
+	case nostr.IsAddressableKind(evt.Kind):
+		return replaceableKey{pubkey: evt.PubKey, kind: evt.Kind, d: evt.Tags.GetD()}, true
+
+	default:
+		return replaceableKey{}, false
+	}
+}
+
+// isNewer reports whether a should replace b according to NIP-01: the most recent CreatedAt wins,
+// and in case of a tie the event with the lowest ID is retained.
+func isNewer(a, b *nostr.Event) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+// ReplaceableStore is a thread-safe, in-memory store for replaceable and addressable events.
+// It only keeps the newest event for each (pubkey, kind, d-tag).
+type ReplaceableStore struct {
+	mu     sync.RWMutex
+	events map[replaceableKey]*nostr.Event
+}
+
+// NewReplaceableStore creates an empty ReplaceableStore.
+func NewReplaceableStore() *ReplaceableStore {
+	return &ReplaceableStore{
+		events: make(map[replaceableKey]*nostr.Event),
+	}
+}
+
+// SaveEvent stores the event if it's newer than the one stored under the same key.
+// Older events are dropped and [ErrOlderEvent] is returned.
+// If ctx is already cancelled, its error is returned and the store is left unchanged.
+func (rs *ReplaceableStore) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if evt == nil {
+		return errors.New("event cannot be nil")
+	}
+
+	key, ok := keyOf(evt)
+	if !ok {
+		return fmt.Errorf("kind %d is neither replaceable nor addressable", evt.Kind)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if stored, ok := rs.events[key]; ok && !isNewer(evt, stored) {
+		return ErrOlderEvent
+	}
+
+	// the store keeps its own copy, unaffected by later changes to the event
+	rs.events[key] = cloneEvent(evt)
+	return nil
+}
+
+// QueryEvents returns the stored events matching the filter, sorted from the newest to the oldest.
+// The events are matched like in the buffers, see [MatchEvent], and invalid filters are rejected,
+// see [NormalizeFilter]. Filters that determine the keys of the events they match, see [filterKeys],
+// look them up directly instead of scanning the whole store.
+func (rs *ReplaceableStore) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	filter, err := normalizeFilter(filter, 0)
+	if err != nil {
+		if errors.Is(err, ErrUnsatisfiableFilter) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	kinds := newKindMatcher(filter.Kinds)
+
+	rs.mu.RLock()
+	result := make([]*nostr.Event, 0, min(len(rs.events), 32))
+	if keys, ok := filterKeys(filter, len(rs.events)); ok {
+		for _, key := range keys {
+			if evt, ok := rs.events[key]; ok && matchEvent(evt, filter, &kinds) {
+				result = append(result, evt)
+			}
+		}
+	} else {
+		for _, evt := range rs.events {
+			if matchEvent(evt, filter, &kinds) {
+				result = append(result, evt)
+			}
+		}
+	}
+	rs.mu.RUnlock()
+
+	slices.SortFunc(result, func(a, b *nostr.Event) int {
+		if isNewer(a, b) {
+			return -1
+		}
+		return 1
+	})
+
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result, nil
+}
+
+// filterKeys returns the keys of all the events the normalized filter can match, and false if the filter
+// doesn't determine them or if they are more than limit, as looking them up would be slower than a scan.
+// The keys are determined when the filter has full pubkeys as authors, rather than prefixes, and kinds,
+// all replaceable or addressable, and a "#d" tag for the addressable kinds.
+// Duplicated values in the filter produce a single key.
+func filterKeys(filter nostr.Filter, limit int) ([]replaceableKey, bool) {
+	if len(filter.Authors) == 0 || len(filter.Kinds) == 0 {
+		return nil, false
+	}
+	if slices.ContainsFunc(filter.Authors, func(a string) bool { return len(a) != 64 }) {
+		return nil, false
+	}
+
+	ds := filter.Tags["d"]
+	for _, kind := range filter.Kinds {
+		switch {
+		case nostr.IsReplaceableKind(kind):
+		case nostr.IsAddressableKind(kind) && len(ds) > 0:
+		default:
+			return nil, false
+		}
+	}
+
+	keys := make(map[replaceableKey]struct{})
+	for _, kind := range filter.Kinds {
+		// replaceable events are stored with an empty d-tag, whatever tags they have
+		kindDs := ds
+		if nostr.IsReplaceableKind(kind) {
+			kindDs = []string{""}
+		}
+
+		for _, author := range filter.Authors {
+			for _, d := range kindDs {
+				keys[replaceableKey{pubkey: author, kind: kind, d: d}] = struct{}{}
+				if len(keys) > limit {
+					return nil, false
+				}
+			}
+		}
+	}
+	return slices.Collect(maps.Keys(keys)), true
+}
+
+// Len returns the number of stored events.
+func (rs *ReplaceableStore) Len() int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return len(rs.events)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func createReplaceableEvent(id, pubkey string, kind int, createdAt nostr.Timestamp, d string) *nostr.Event {
+	evt := &nostr.Event{
+		ID:        id,
+		PubKey:    pubkey,
+		Kind:      kind,
+		CreatedAt: createdAt,
+	}
+	if d != "" {
+		evt.Tags = nostr.Tags{{"d", d}}
+	}
+	return evt
+}
+
+func TestReplaceableStoreReplacement(t *testing.T) {
+	ctx := context.Background()
+	rs := NewReplaceableStore()
+
+	old := createReplaceableEvent("aaa", "pk", 0, 100, "")
+	newer := createReplaceableEvent("bbb", "pk", 0, 200, "")
+
+	if err := rs.SaveEvent(ctx, old); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+	if err := rs.SaveEvent(ctx, newer); err != nil {
+		t.Fatalf("Failed to save newer event: %v", err)
+	}
+
+	events, err := rs.QueryEvents(ctx, nostr.Filter{Authors: []string{"pk"}, Kinds: []int{0}})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "bbb" {
+		t.Fatalf("Expected only the newer event, got %v", events)
+	}
+}
+
+func TestReplaceableStoreKeepsCopy(t *testing.T) {
+	ctx := context.Background()
+	rs := NewReplaceableStore()
+
+	evt := createReplaceableEvent("aaa", "pk", 0, 100, "")
+	evt.Content = "original"
+	if err := rs.SaveEvent(ctx, evt); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+
+	// changes by the caller after the save must not affect the stored event
+	evt.Content = "changed"
+	evt.Tags = append(evt.Tags, nostr.Tag{"t", "changed"})
+
+	events, _ := rs.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 1 || events[0].Content != "original" || len(events[0].Tags) != 0 {
+		t.Fatalf("Expected the original event, got %v", events)
+	}
+}
+
+func TestReplaceableStoreRejectsOlder(t *testing.T) {
+	ctx := context.Background()
+	rs := NewReplaceableStore()
+
+	if err := rs.SaveEvent(ctx, createReplaceableEvent("bbb", "pk", 3, 200, "")); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+
+	err := rs.SaveEvent(ctx, createReplaceableEvent("aaa", "pk", 3, 100, ""))
+	if !errors.Is(err, ErrOlderEvent) {
+		t.Fatalf("Expected ErrOlderEvent, got %v", err)
+	}
+
+	// same timestamp: the lowest ID is retained
+	if err := rs.SaveEvent(ctx, createReplaceableEvent("ccc", "pk", 3, 200, "")); !errors.Is(err, ErrOlderEvent) {
+		t.Fatalf("Expected ErrOlderEvent for higher ID tie, got %v", err)
+	}
+	if err := rs.SaveEvent(ctx, createReplaceableEvent("abc", "pk", 3, 200, "")); err != nil {
+		t.Fatalf("Expected lower ID tie to replace, got %v", err)
+	}
+
+	events, _ := rs.QueryEvents(ctx, nostr.Filter{})
+	if len(events) != 1 || events[0].ID != "abc" {
+		t.Fatalf("Expected event abc to be stored, got %v", events)
+	}
+}
+
+func TestReplaceableStoreAddressable(t *testing.T) {
+	ctx := context.Background()
+	rs := NewReplaceableStore()
+
+	events := []*nostr.Event{
+		createReplaceableEvent("a1", "pk", 30000, 100, "list1"),
+		createReplaceableEvent("a2", "pk", 30000, 100, "list2"),
+		createReplaceableEvent("a3", "pk", 30000, 200, "list1"),
+		createReplaceableEvent("a4", "other", 30000, 100, "list1"),
+	}
+
+	for _, evt := range events {
+		if err := rs.SaveEvent(ctx, evt); err != nil {
+			t.Fatalf("Failed to save event %s: %v", evt.ID, err)
+		}
+	}
+
+	if rs.Len() != 3 {
+		t.Fatalf("Expected 3 stored events, got %d", rs.Len())
+	}
+
+	result, err := rs.QueryEvents(ctx, nostr.Filter{
+		Authors: []string{"pk"},
+		Tags:    nostr.TagMap{"d": []string{"list1"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(result) != 1 || result[0].ID != "a3" {
+		t.Fatalf("Expected only a3 for d=list1, got %v", result)
+	}
+
+	if err := rs.SaveEvent(ctx, createReplaceableEvent("r1", "pk", 1, 100, "")); err == nil {
+		t.Fatal("Expected error saving a regular kind")
+	}
+}
+
+func TestReplaceableStoreDTagLookup(t *testing.T) {
+	ctx := context.Background()
+	rs := NewReplaceableStore()
+	pk, other := hexID(1), hexID(2)
+
+	for i := range 5 {
+		d := fmt.Sprintf("list%d", i)
+		rs.SaveEvent(ctx, createReplaceableEvent("pk-"+d, pk, 30000, 100, d))
+		rs.SaveEvent(ctx, createReplaceableEvent("other-"+d, other, 30000, 100, d))
+	}
+	rs.SaveEvent(ctx, createReplaceableEvent("metadata", pk, 0, 100, ""))
+
+	filter := nostr.Filter{
+		Kinds:   []int{30000},
+		Authors: []string{pk},
+		Tags:    nostr.TagMap{"d": []string{"list1"}},
+	}
+	if keys, ok := filterKeys(filter, rs.Len()); !ok || len(keys) != 1 {
+		t.Fatalf("Expected the filter to resolve to a single key, got %v", keys)
+	}
+
+	result, err := rs.QueryEvents(ctx, filter)
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(result) != 1 || result[0].ID != "pk-list1" {
+		t.Fatalf("Expected only pk-list1, got %v", result)
+	}
+
+	// uppercase and prefix authors match like in the buffers, the prefixes by scanning the store
+	for _, author := range []string{strings.ToUpper(pk), pk[:8]} {
+		f := filter
+		f.Authors = []string{author}
+		if result, _ := rs.QueryEvents(ctx, f); len(result) != 1 || result[0].ID != "pk-list1" {
+			t.Fatalf("author %s: expected only pk-list1, got %v", author, result)
+		}
+	}
+
+	// the other constraints of the filter still apply to the events looked up
+	filter.Until = timestamp(50)
+	if result, _ := rs.QueryEvents(ctx, filter); len(result) != 0 {
+		t.Fatalf("Expected no events before the until, got %v", result)
+	}
+
+	tests := []struct {
+		name   string
+		filter nostr.Filter
+		ok     bool
+	}{
+		{"replaceable without d", nostr.Filter{Kinds: []int{0}, Authors: []string{pk}}, true},
+		{"addressable without d", nostr.Filter{Kinds: []int{30000}, Authors: []string{pk}}, false},
+		{"regular kind", nostr.Filter{Kinds: []int{1}, Authors: []string{pk}, Tags: nostr.TagMap{"d": {"list1"}}}, false},
+		{"no authors", nostr.Filter{Kinds: []int{30000}, Tags: nostr.TagMap{"d": {"list1"}}}, false},
+		{"prefix author", nostr.Filter{Kinds: []int{0}, Authors: []string{pk[:8]}}, false},
+	}
+	for _, test := range tests {
+		if _, ok := filterKeys(test.filter, rs.Len()); ok != test.ok {
+			t.Errorf("%s: expected ok to be %v, got %v", test.name, test.ok, ok)
+		}
+	}
+
+	// looking up more keys than the stored events is slower than a scan
+	many := nostr.Filter{Kinds: []int{30000}, Authors: []string{pk, other}, Tags: nostr.TagMap{"d": values(10)}}
+	if _, ok := filterKeys(many, rs.Len()); ok {
+		t.Fatal("Expected the filter with more keys than events to be scanned")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Snapshot writes the events in the buffer to w with the codec, from the oldest to the newest,
+// so that they can be restored with [AtomicCircularBuffer2.Load]. A nil codec means [JSONCodec].
+// Like [AtomicCircularBuffer2.All], the range of events is fixed when the snapshot starts, and deleted events are skipped.
+func (cb *AtomicCircularBuffer2) Snapshot(w io.Writer, codec Codec) error {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	bw := bufio.NewWriter(w)
+	for evt := range cb.All() {
+		if err := codec.Encode(bw, evt); err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", evt.ID, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// Load saves the events of a snapshot written by [AtomicCircularBuffer2.Snapshot] with the same codec,
+// in the order they were written, returning the number of events saved. A nil codec means [JSONCodec].
+// Loading stops at the first event that can't be decoded or saved, keeping the events saved before it.
+func (cb *AtomicCircularBuffer2) Load(ctx context.Context, r io.Reader, codec Codec) (int, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	br := bufio.NewReader(r)
+	saved := 0
+	for {
+		evt, err := codec.Decode(br)
+		if errors.Is(err, io.EOF) {
+			return saved, nil
+		}
+		if err != nil {
+			return saved, fmt.Errorf("failed to decode event %d: %w", saved, err)
+		}
+
+		if err := cb.SaveEvent(ctx, evt); err != nil {
+			return saved, err
+		}
+		saved++
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BufferSnapshot is an immutable view of the events of an [AtomicCircularBuffer2] at the time it was taken,
+// see [AtomicCircularBuffer2.SnapshotView]. Its queries are unaffected by the saves, evictions and deletes
+// happening on the buffer afterwards, so that a long paging is consistent from the first to the last page.
+// It's safe for concurrent use.
+type BufferSnapshot struct {
+	buf *AtomicCircularBuffer2
+}
+
+// SnapshotView returns a view of the events currently in the buffer, for consistent paging.
+// It copies the pointers to the events, but not the events themselves, so it costs a slot per event
+// and keeps them from being garbage collected until the view is no longer used.
+// The options of the buffer, like indexes, caches and expiration, don't apply to the view.
+func (cb *AtomicCircularBuffer2) SnapshotView() *BufferSnapshot {
+	start, end := cb.bounds()
+	stored := make([]*StoredEvent, 0, end-start)
+	for pos := start; pos < end; pos++ {
+		if s := cb.slot(pos).Load(); s != nil {
+			stored = append(stored, s)
+		}
+	}
+
+	buf := NewAtomicCircularBuffer2(max(len(stored), 1))
+	for i, s := range stored {
+		buf.buffer[i].Store(s)
+		if i > 0 && s.Event.CreatedAt < stored[i-1].Event.CreatedAt {
+			buf.unsortedAt.Store(uint64(i) + 1)
+		}
+	}
+
+	buf.head.Store(uint64(len(stored)))
+	buf.saved.Store(uint64(len(stored)))
+	buf.span.Store(uint64(len(stored)))
+	buf.count.Store(uint64(len(stored)))
+	return &BufferSnapshot{buf: buf}
+}
+
+// Len returns the number of events in the snapshot.
+func (s *BufferSnapshot) Len() int {
+	return s.buf.Len()
+}
+
+// QueryEvents is like [AtomicCircularBuffer2.QueryEvents], on the events of the snapshot.
+func (s *BufferSnapshot) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	return s.buf.QueryEvents(ctx, filter)
+}
+
+// QueryPage is like [AtomicCircularBuffer2.QueryPage], on the events of the snapshot.
+func (s *BufferSnapshot) QueryPage(ctx context.Context, filter nostr.Filter, cursor Cursor, pageSize int) ([]*nostr.Event, Cursor, error) {
+	return s.buf.QueryPage(ctx, filter, cursor, pageSize)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSnapshotViewPaging(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(100)
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%03d", i), int64(1000+i/2)))
+	}
+	cb.DeleteEvent(ctx, &nostr.Event{ID: "id-050"})
+
+	snapshot := cb.SnapshotView()
+	if snapshot.Len() != 99 {
+		t.Fatalf("Expected the 99 events left in the snapshot, got %d", snapshot.Len())
+	}
+	expected, _ := snapshot.QueryEvents(ctx, nostr.Filter{})
+
+	// the whole buffer is evicted and rewritten while paging, with events both older and newer than the cursor
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("new-%d", i), int64(900+i%300)))
+			if i%10 == 0 {
+				cb.DeleteEvent(ctx, &nostr.Event{ID: fmt.Sprintf("id-%03d", i/10)})
+			}
+		}
+	}()
+
+	var paged []*nostr.Event
+	var cursor Cursor
+	for {
+		events, next, err := snapshot.QueryPage(ctx, nostr.Filter{}, cursor, 7)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		paged = append(paged, events...)
+		if next.IsZero() {
+			break
+		}
+		cursor = next
+
+		// make sure the buffer changes between the pages
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("between-%s", cursor.ID), int64(cursor.CreatedAt)))
+	}
+
+	close(done)
+	wg.Wait()
+	for i := range 100 {
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("last-%d", i), 2000))
+	}
+
+	slices.SortFunc(expected, compareDescending)
+	if !slices.Equal(ids(paged), ids(expected)) {
+		t.Fatalf("Expected the pages to hold exactly the events of the snapshot %v, got %v", ids(expected), ids(paged))
+	}
+
+	if events, _ := snapshot.QueryEvents(ctx, nostr.Filter{}); len(events) != 99 {
+		t.Fatalf("Expected the snapshot to be unaffected by the writes, got %d events", len(events))
+	}
+	if events, _ := cb.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-099"}}); len(events) != 0 {
+		t.Fatal("Expected the buffer to have evicted the events of the snapshot")
+	}
+}
+
+func TestSnapshotViewEmpty(t *testing.T) {
+	snapshot := NewAtomicCircularBuffer2(10).SnapshotView()
+	if snapshot.Len() != 0 {
+		t.Fatalf("Expected an empty snapshot, got %d events", snapshot.Len())
+	}
+
+	events, next, err := snapshot.QueryPage(context.Background(), nostr.Filter{}, Cursor{}, 10)
+	if err != nil || len(events) != 0 || !next.IsZero() {
+		t.Fatalf("Expected an empty page, got %d events, cursor %v and error %v", len(events), next, err)
+	}
+}
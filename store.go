@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Store is the interface of the in-memory stores holding the ephemeral events of the relay.
+type Store interface {
+	SaveEvent(ctx context.Context, evt *nostr.Event) error
+	QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error)
+}
+
+// The buffer implementations that can back the ephemeral store, see [NewEphemeralStore].
+const (
+	ImplMutex   = "mutex"
+	ImplAtomic1 = "atomic1"
+	ImplAtomic2 = "atomic2"
+)
+
+// NewEphemeralStore returns a Store backed by the buffer implementation with the provided name,
+// one of [ImplMutex], [ImplAtomic1] or [ImplAtomic2]. The options supported only by [AtomicCircularBuffer2]
+// are rejected with [ErrUnsupportedOption] by the other implementations.
+func NewEphemeralStore(impl string, capacity int, opts ...BufferOption) (Store, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidCapacity, capacity)
+	}
+
+	switch impl {
+	case ImplMutex:
+		cb, err := NewCircularBufferE(capacity, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return collectingStore{cb}, nil
+	case ImplAtomic1:
+		cb, err := NewAtomicCircularBufferE(capacity, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return collectingStore{cb}, nil
+	case ImplAtomic2:
+		return NewAtomicCircularBuffer2(capacity, opts...), nil
+	default:
+		return nil, fmt.Errorf("unknown ephemeral store implementation %q, expected %s, %s or %s",
+			impl, ImplMutex, ImplAtomic1, ImplAtomic2)
+	}
+}
+
+// channelBuffer is implemented by the buffers returning the events of a query through a channel.
+type channelBuffer interface {
+	SaveEvent(ctx context.Context, evt *nostr.Event) error
+	QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+}
+
+// collectingStore adapts a channelBuffer to the Store interface, collecting the events of its queries.
+type collectingStore struct {
+	channelBuffer
+}
+
+// QueryEvents returns the events matching the filter.
+// It stops early, returning the context error, if ctx gets cancelled.
+func (s collectingStore) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := s.channelBuffer.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*nostr.Event
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+
+		case evt, ok := <-ch:
+			if !ok {
+				return events, nil
+			}
+			events = append(events, evt)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	_ Store = (*AtomicCircularBuffer2)(nil)
+	_ Store = collectingStore{}
+)
+
+func TestNewEphemeralStore(t *testing.T) {
+	ctx := context.Background()
+
+	for _, impl := range []string{ImplMutex, ImplAtomic1, ImplAtomic2} {
+		t.Run(impl, func(t *testing.T) {
+			store, err := NewEphemeralStore(impl, 3)
+			if err != nil {
+				t.Fatalf("Failed to create the store: %v", err)
+			}
+
+			for i := range 5 {
+				if err := store.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000+i%2)); err != nil {
+					t.Fatalf("Failed to save event: %v", err)
+				}
+			}
+
+			events, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{20000}})
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(events) != 2 || events[0].ID != "id-2" || events[1].ID != "id-4" {
+				t.Fatalf("Expected id-2 and id-4, got %v", ids(events))
+			}
+		})
+	}
+}
+
+func TestNewEphemeralStoreInvalid(t *testing.T) {
+	if _, err := NewEphemeralStore("atomic3", 10); err == nil {
+		t.Fatal("Expected an error for an unknown implementation")
+	}
+	if _, err := NewEphemeralStore(ImplAtomic2, 0); err == nil {
+		t.Fatal("Expected an error for a zero capacity")
+	}
+
+	// the options supported only by AtomicCircularBuffer2 are rejected by the other implementations
+	for _, impl := range []string{ImplMutex, ImplAtomic1} {
+		if _, err := NewEphemeralStore(impl, 10, WithEvictionPolicy(LRU)); !errors.Is(err, ErrUnsupportedOption) {
+			t.Fatalf("%s: expected ErrUnsupportedOption, got %v", impl, err)
+		}
+		if _, err := NewEphemeralStore(impl, 10, WithOverflowPolicy(RejectNew), WithMaxTags(10)); err != nil {
+			t.Fatalf("%s: expected the supported options to be accepted, got %v", impl, err)
+		}
+	}
+	if _, err := NewEphemeralStore(ImplAtomic2, 10, WithEvictionPolicy(LRU)); err != nil {
+		t.Fatalf("Expected AtomicCircularBuffer2 to support the eviction policy, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var _ eventstore.Store = (*StoreAdapter)(nil)
+
+// StoreAdapter wraps an [AtomicCircularBuffer2] to implement the [eventstore.Store] interface,
+// so that the buffer can be used by khatru and the other relays of the eventstore ecosystem.
+type StoreAdapter struct {
+	*AtomicCircularBuffer2
+}
+
+// NewStoreAdapter returns a StoreAdapter around the provided buffer.
+func NewStoreAdapter(cb *AtomicCircularBuffer2) *StoreAdapter {
+	return &StoreAdapter{AtomicCircularBuffer2: cb}
+}
+
+// Init does nothing, as the buffer is ready to use once created.
+func (s *StoreAdapter) Init() error { return nil }
+
+// Close closes the buffer, stopping its background compaction if enabled.
+func (s *StoreAdapter) Close() { s.AtomicCircularBuffer2.Close() }
+
+// QueryEvents returns a channel that will receive all events matching the filter.
+// The events are collected before returning, into a closed channel large enough to hold them all,
+// so consumers can stop reading it at any time without leaking anything.
+func (s *StoreAdapter) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	events, err := s.AtomicCircularBuffer2.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return sendAll(events), nil
+}
+
+// ReplaceEvent saves a replaceable or addressable event, deleting the older versions of it,
+// see [AtomicCircularBuffer2.ReplaceEvent]. Other events are simply saved.
+// If a newer version is already stored, the event is not saved and nil is returned,
+// like the other eventstore backends do.
+func (s *StoreAdapter) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	if evt == nil {
+		return errors.New("event cannot be nil")
+	}
+
+	if _, ok := keyOf(evt); !ok {
+		return s.SaveEvent(ctx, evt)
+	}
+
+	err := s.AtomicCircularBuffer2.ReplaceEvent(ctx, evt)
+	if errors.Is(err, ErrOlderEvent) {
+		return nil
+	}
+	return err
+}
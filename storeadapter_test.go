@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestStoreAdapter(t *testing.T) {
+	ctx := context.Background()
+
+	var store eventstore.Store = NewStoreAdapter(NewAtomicCircularBuffer2(10))
+	if err := store.Init(); err != nil {
+		t.Fatalf("Failed to init the store: %v", err)
+	}
+	defer store.Close()
+
+	evt := createTestEvent("id-0", 20000)
+	if err := store.SaveEvent(ctx, evt); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+	if err := store.SaveEvent(ctx, createTestEvent("id-1", 20001)); err != nil {
+		t.Fatalf("Failed to save event: %v", err)
+	}
+
+	ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: []string{"id-0"}})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	events := collectEvents(ch)
+	if len(events) != 1 || events[0].ID != "id-0" {
+		t.Fatalf("Expected to find id-0, got %v", events)
+	}
+
+	if err := store.DeleteEvent(ctx, evt); err != nil {
+		t.Fatalf("Failed to delete event: %v", err)
+	}
+
+	ch, _ = store.QueryEvents(ctx, nostr.Filter{})
+	events = collectEvents(ch)
+	if len(events) != 1 || events[0].ID != "id-1" {
+		t.Fatalf("Expected only id-1 after the deletion, got %v", events)
+	}
+}
+
+func TestStoreAdapterReplaceEvent(t *testing.T) {
+	ctx := context.Background()
+	store := NewStoreAdapter(NewAtomicCircularBuffer2(10))
+
+	steps := []*nostr.Event{
+		createReplaceableEvent("a", "pk", 30000, 100, "list"),
+		createReplaceableEvent("b", "pk", 30000, 200, "list"),
+		createReplaceableEvent("c", "pk", 30000, 150, "list"),
+		createReplaceableEvent("d", "pk", 30000, 100, "other"),
+		createReplaceableEvent("e", "pk", 30000, 100, ""),
+		createReplaceableEvent("f", "pk", 30000, 200, ""),
+		createReplaceableEvent("g", "pk", 30000, 150, ""),
+	}
+
+	for _, evt := range steps {
+		if err := store.ReplaceEvent(ctx, evt); err != nil {
+			t.Fatalf("Failed to replace event: %v", err)
+		}
+	}
+
+	events := collectEvents(must(store.QueryEvents(ctx, nostr.Filter{})))
+	ids := make(map[string]bool)
+	for _, evt := range events {
+		ids[evt.ID] = true
+	}
+
+	if len(events) != 3 || !ids["b"] || !ids["d"] || !ids["f"] {
+		t.Fatalf("Expected events b, d and f, got %v", events)
+	}
+}
+
+func TestStoreAdapterQueryAbandoned(t *testing.T) {
+	ctx := context.Background()
+	store := NewStoreAdapter(NewAtomicCircularBuffer2(10))
+	for i := range 5 {
+		store.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 20000))
+	}
+
+	ch, err := store.QueryEvents(ctx, nostr.Filter{})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+
+	// the consumer reads a single event and abandons the channel, which must already hold the others
+	<-ch
+	if len(ch) != 4 {
+		t.Fatalf("Expected the other 4 events to be buffered, got %d", len(ch))
+	}
+
+	events := collectEvents(ch)
+	if len(events) != 4 {
+		t.Fatalf("Expected the channel to be closed after the events, got %d events", len(events))
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// StoreHolder is a Store forwarding every call to another Store, which can be swapped at any time
+// without stopping the relay, for example to replace the ephemeral store with an empty one.
+// The saves and queries that already started on the previous store complete on it,
+// while the ones starting after the swap go to the new store.
+type StoreHolder struct {
+	current atomic.Pointer[Store]
+}
+
+// NewStoreHolder returns a StoreHolder forwarding to the store, which must not be nil.
+func NewStoreHolder(store Store) *StoreHolder {
+	h := &StoreHolder{}
+	h.current.Store(&store)
+	return h
+}
+
+// Load returns the store the calls are currently forwarded to.
+func (h *StoreHolder) Load() Store {
+	return *h.current.Load()
+}
+
+// Swap forwards the next calls to the store, which must not be nil, and returns the previous one.
+// The previous store keeps serving the calls that already started, so it must not be modified
+// until they complete.
+func (h *StoreHolder) Swap(store Store) Store {
+	return *h.current.Swap(&store)
+}
+
+// SaveEvent saves the event into the current store.
+func (h *StoreHolder) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	return h.Load().SaveEvent(ctx, evt)
+}
+
+// QueryEvents returns the events of the current store matching the filter.
+func (h *StoreHolder) QueryEvents(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	return h.Load().QueryEvents(ctx, filter)
+}
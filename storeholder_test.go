@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestStoreHolderSwap(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+
+	old := NewAtomicCircularBuffer2(10)
+	holder := NewStoreHolder(old)
+	setupStores(t, &mockStore{}, holder)
+
+	holder.SaveEvent(ctx, createTestEvent("before", 20000))
+
+	fresh := NewAtomicCircularBuffer2(20)
+	if previous := holder.Swap(fresh); previous != Store(old) {
+		t.Fatal("Expected Swap to return the previous store")
+	}
+	if holder.Load() != Store(fresh) {
+		t.Fatal("Expected the new store to be loaded")
+	}
+
+	holder.SaveEvent(ctx, createTestEvent("after", 20000))
+
+	if events, _ := old.QueryEvents(ctx, nostr.Filter{}); len(events) != 1 || events[0].ID != "before" {
+		t.Fatalf("Expected the previous store to be left with its events, got %v", ids(events))
+	}
+
+	events, err := Query(ctx, nil, nostr.Filters{{Kinds: []int{20000}}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "after" {
+		t.Fatalf("Expected only the event saved after the swap, got %v", events)
+	}
+}
+
+// TestStoreHolderConcurrentSwap tests swapping the store while saves and queries are running,
+// which is meant to be run with the race detector
+func TestStoreHolderConcurrentSwap(t *testing.T) {
+	ctx := context.Background()
+	setLimits(t, 0, 0)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	holder := NewStoreHolder(NewAtomicCircularBuffer2(100))
+	setupStores(t, &mockStore{}, holder)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := holder.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d-%d", w, i), 20000)); err != nil {
+					t.Errorf("Unexpected save error: %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := Query(ctx, nil, nostr.Filters{{Kinds: []int{20000}, Limit: 10}}); err != nil {
+					t.Errorf("Unexpected query error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	impls := []string{ImplAtomic2, ImplMutex, ImplAtomic1}
+	for i := range 200 {
+		store, err := NewEphemeralStore(impls[i%len(impls)], 50+i)
+		if err != nil {
+			t.Fatalf("Failed to create the store: %v", err)
+		}
+		holder.Swap(store)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestResetOnHangup(t *testing.T) {
+	// the signal is caught by this channel as well, so the test process can't be killed by it
+	// even before resetOnHangup starts listening
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGHUP)
+	defer signal.Stop(caught)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := NewAtomicCircularBuffer2(10)
+	first.SaveEvent(ctx, createTestEvent("before", 20000))
+	holder := NewStoreHolder(first)
+
+	cfg := Config{EphemeralImpl: ImplAtomic2, EphemeralCapacity: 10}
+	go resetOnHangup(ctx, holder, cfg)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for holder.Load() == Store(first) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the store to be reset on SIGHUP")
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if events, _ := holder.QueryEvents(ctx, nostr.Filter{}); len(events) != 0 {
+		t.Fatalf("Expected the new store to be empty, got %v", ids(events))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// subscriptionBuffer is the capacity of the channel of a subscription.
+const subscriptionBuffer = 64
+
+// subscription is a filter registered with [AtomicCircularBuffer2.Subscribe].
+type subscription struct {
+	filter nostr.Filter
+	kinds  kindMatcher
+	events chan *nostr.Event
+}
+
+// subscribers are the subscriptions of a buffer. The zero value has no subscriptions.
+type subscribers struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+
+	// number of subscriptions, so that saves skip the lock when there are none
+	n atomic.Int64
+}
+
+// Subscribe streams the events saved from now on that match the filter, until the returned cancel function
+// is called or ctx is done, which closes the channel. The limit of the filter is ignored.
+//
+// Saves never wait for subscribers: when a subscriber doesn't keep up and its channel is full,
+// the new events are dropped for it. Invalid filters return an already closed channel, see [NormalizeFilter].
+func (cb *AtomicCircularBuffer2) Subscribe(ctx context.Context, filter nostr.Filter) (<-chan *nostr.Event, func()) {
+	filter, err := normalizeFilter(filter, 0)
+	if err != nil {
+		if !errors.Is(err, ErrUnsatisfiableFilter) {
+			ch := make(chan *nostr.Event)
+			close(ch)
+			return ch, func() {}
+		}
+		// keep the subscription open, so that it behaves like any other until cancelled
+		filter.Kinds = []int{}
+	}
+	filter.Limit = 0
+
+	sub := &subscription{
+		filter: filter,
+		kinds:  newKindMatcher(filter.Kinds),
+		events: make(chan *nostr.Event, subscriptionBuffer),
+	}
+
+	cb.subs.mu.Lock()
+	if cb.subs.subs == nil {
+		cb.subs.subs = make(map[*subscription]struct{})
+	}
+	cb.subs.subs[sub] = struct{}{}
+	cb.subs.n.Add(1)
+	cb.subs.mu.Unlock()
+
+	done := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			cb.subs.mu.Lock()
+			delete(cb.subs.subs, sub)
+			cb.subs.n.Add(-1)
+			cb.subs.mu.Unlock()
+
+			close(sub.events)
+			close(done)
+		})
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return sub.events, cancel
+}
+
+// notify sends the saved event to the subscriptions matching it.
+func (cb *AtomicCircularBuffer2) notify(evt *nostr.Event) {
+	if cb.subs.n.Load() == 0 {
+		return
+	}
+
+	cb.subs.mu.RLock()
+	defer cb.subs.mu.RUnlock()
+
+	for sub := range cb.subs.subs {
+		if matchEvent(evt, sub.filter, &sub.kinds) {
+			select {
+			case sub.events <- evt:
+			default:
+				// the subscriber is not keeping up
+			}
+		}
+	}
+}
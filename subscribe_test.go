@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// receive returns the events received from the channel until it's closed or no event arrives for a while
+func receive(ch <-chan *nostr.Event) (events []*nostr.Event, closed bool) {
+	for {
+		select {
+		case evt, ok := <-ch:
+			if !ok {
+				return events, true
+			}
+			events = append(events, evt)
+		case <-time.After(50 * time.Millisecond):
+			return events, false
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	cb.SaveEvent(ctx, createTestEvent("before", 1))
+
+	ch, cancel := cb.Subscribe(ctx, nostr.Filter{Kinds: []int{1}, Limit: 1})
+
+	cb.SaveEvent(ctx, createTestEvent("match-1", 1))
+	cb.SaveEvent(ctx, createTestEvent("other", 2))
+	cb.SaveEvents(ctx, []*nostr.Event{createTestEvent("match-2", 1), createTestEvent("match-3", 1)})
+
+	// only the matching events saved after subscribing are delivered, regardless of the limit
+	events, closed := receive(ch)
+	if got := ids(events); fmt.Sprint(got) != "[match-1 match-2 match-3]" || closed {
+		t.Fatalf("expected the 3 matching events, got %v (closed: %v)", got, closed)
+	}
+
+	cancel()
+	cb.SaveEvent(ctx, createTestEvent("match-4", 1))
+	if events, closed := receive(ch); len(events) != 0 || !closed {
+		t.Fatalf("expected the channel to be closed after cancel, got %v", ids(events))
+	}
+	cancel()
+}
+
+func TestSubscribeContextDone(t *testing.T) {
+	cb := NewAtomicCircularBuffer2(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ := cb.Subscribe(ctx, nostr.Filter{})
+
+	cancel()
+	if _, closed := receive(ch); !closed {
+		t.Fatal("expected the channel to be closed when the context is done")
+	}
+	if n := cb.subs.n.Load(); n != 0 {
+		t.Fatalf("expected no subscriptions left, got %d", n)
+	}
+}
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	ch, cancel := cb.Subscribe(ctx, nostr.Filter{})
+	defer cancel()
+
+	// saves don't block on a subscriber that doesn't read
+	for i := range 2 * subscriptionBuffer {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if n := len(ch); n != subscriptionBuffer {
+		t.Fatalf("expected %d events buffered, got %d", subscriptionBuffer, n)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// tagIndex is an inverted index from the tags of the events in a buffer to their positions.
+// Only the tags with a single letter name are indexed, as they are the only ones that can be queried.
+type tagIndex struct {
+	mu        sync.RWMutex
+	positions map[string]map[uint64]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{positions: make(map[string]map[uint64]struct{})}
+}
+
+// tagIndexKey returns the key of the index for the tag name and value.
+func tagIndexKey(name, value string) string {
+	return name + "\x00" + value
+}
+
+// indexable reports whether the tag should be indexed.
+func indexable(tag nostr.Tag) bool {
+	return len(tag) > 1 && len(tag[0]) == 1
+}
+
+// add indexes the tags of the event saved at the position.
+func (idx *tagIndex) add(evt *nostr.Event, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, tag := range evt.Tags {
+		if !indexable(tag) {
+			continue
+		}
+
+		key := tagIndexKey(tag[0], tag[1])
+		set, ok := idx.positions[key]
+		if !ok {
+			set = make(map[uint64]struct{}, 1)
+			idx.positions[key] = set
+		}
+		set[pos] = struct{}{}
+	}
+}
+
+// remove drops the tags of the event saved at the position, after it has been evicted or deleted.
+func (idx *tagIndex) remove(evt *nostr.Event, pos uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, tag := range evt.Tags {
+		if !indexable(tag) {
+			continue
+		}
+
+		key := tagIndexKey(tag[0], tag[1])
+		set, ok := idx.positions[key]
+		if !ok {
+			continue
+		}
+
+		delete(set, pos)
+		if len(set) == 0 {
+			delete(idx.positions, key)
+		}
+	}
+}
+
+// reset empties the index.
+func (idx *tagIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	clear(idx.positions)
+}
+
+// candidates returns, in ascending order, the positions in [start, end) of the events that can match the tags.
+// The positions are looked up for the most selective tag name, so the events must still be matched against the
+// whole filter. It returns false if the index can't narrow the search, because the tags have no indexed values.
+func (idx *tagIndex) candidates(tags nostr.TagMap, start, end uint64) ([]uint64, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var best []map[uint64]struct{}
+	bestSize := -1
+
+	for name, values := range tags {
+		if len(values) == 0 || len(name) != 1 {
+			continue
+		}
+
+		sets := make([]map[uint64]struct{}, 0, len(values))
+		size := 0
+		for _, value := range values {
+			if set, ok := idx.positions[tagIndexKey(name, value)]; ok {
+				sets = append(sets, set)
+				size += len(set)
+			}
+		}
+
+		if bestSize == -1 || size < bestSize {
+			best, bestSize = sets, size
+		}
+	}
+
+	if bestSize == -1 {
+		return nil, false
+	}
+
+	positions := make([]uint64, 0, bestSize)
+	for _, set := range best {
+		for pos := range set {
+			if pos >= start && pos < end {
+				positions = append(positions, pos)
+			}
+		}
+	}
+
+	slices.Sort(positions)
+	return slices.Compact(positions), true
+}
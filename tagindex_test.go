@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// createTaggedEvent creates a test event referencing the event e and the pubkey p
+func createTaggedEvent(id string, kind int, e, p string) *nostr.Event {
+	evt := createTestEvent(id, kind)
+	evt.Tags = nostr.Tags{{"e", e}, {"p", p}, {"alt", e}}
+	return evt
+}
+
+func TestTagIndexMatchesScan(t *testing.T) {
+	ctx := context.Background()
+
+	// 175 events in a 50 slot buffer, so that the index must follow the wrap-around eviction
+	indexed := NewAtomicCircularBuffer2(50, WithTagIndex())
+	scanned := NewAtomicCircularBuffer2(50)
+	for i := range 175 {
+		evt := createTaggedEvent(fmt.Sprintf("id-%d", i), i%3, fmt.Sprintf("e-%d", i%7), fmt.Sprintf("p-%d", i%5))
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+
+	// deleted events must disappear from the index as well
+	for _, id := range []string{"id-130", "id-140", "id-170"} {
+		indexed.DeleteEvent(ctx, &nostr.Event{ID: id})
+		scanned.DeleteEvent(ctx, &nostr.Event{ID: id})
+	}
+
+	filters := []nostr.Filter{
+		{Tags: nostr.TagMap{"e": {"e-3"}}},
+		{Tags: nostr.TagMap{"e": {"e-0", "e-1"}}},
+		{Tags: nostr.TagMap{"e": {"e-2"}, "p": {"p-4"}}},
+		{Tags: nostr.TagMap{"e": {"e-5"}}, Kinds: []int{1}},
+		{Tags: nostr.TagMap{"e": {"e-6"}}, Limit: 2},
+		{Tags: nostr.TagMap{"e": {"unknown"}}},
+		{Tags: nostr.TagMap{"alt": {"e-1"}}},
+	}
+
+	for _, filter := range filters {
+		expected, err := scanned.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+
+		events, err := indexed.QueryEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+
+		if len(events) != len(expected) {
+			t.Fatalf("filter %v: expected %d events, got %d", filter, len(expected), len(events))
+		}
+		for i := range events {
+			if events[i].ID != expected[i].ID {
+				t.Fatalf("filter %v: expected %s at %d, got %s", filter, expected[i].ID, i, events[i].ID)
+			}
+		}
+	}
+}
+
+func TestTagIndexClear(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10, WithTagIndex())
+	cb.SaveEvent(ctx, createTaggedEvent("old", 1, "e-0", "p-0"))
+
+	cb.Clear()
+	if len(cb.index.positions) != 0 {
+		t.Fatalf("Expected an empty index after clearing, got %d keys", len(cb.index.positions))
+	}
+
+	cb.SaveEvent(ctx, createTaggedEvent("new", 1, "e-0", "p-0"))
+	events, _ := cb.QueryEvents(ctx, nostr.Filter{Tags: nostr.TagMap{"e": {"e-0"}}})
+	if len(events) != 1 || events[0].ID != "new" {
+		t.Fatalf("Expected only the new event, got %v", events)
+	}
+}
+
+// BenchmarkTagQuery compares a query for a tag value on a 50k buffer with and without the tag index
+func BenchmarkTagQuery(b *testing.B) {
+	const size = 50000
+	ctx := context.Background()
+	filter := nostr.Filter{Tags: nostr.TagMap{"e": {"e-42"}}}
+
+	indexed := NewAtomicCircularBuffer2(size, WithTagIndex())
+	scanned := NewAtomicCircularBuffer2(size)
+	for i := range size {
+		evt := createTaggedEvent(fmt.Sprintf("id-%d", i), 1, fmt.Sprintf("e-%d", i%1000), fmt.Sprintf("p-%d", i%100))
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = indexed.QueryEvents(ctx, filter)
+		}
+	})
+
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = scanned.QueryEvents(ctx, filter)
+		}
+	})
+}
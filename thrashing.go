@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// thrashingThreshold is the fraction of the events evicted without ever being queried above which
+// the buffer is considered thrashing: events are saved much faster than clients are interested in them.
+const thrashingThreshold = 0.9
+
+// evictionStats counts the evicted events, and the ones among them that were never returned by a query.
+type evictionStats struct {
+	total  atomic.Uint64
+	unread atomic.Uint64
+
+	// unread evictions since the start of the current window of evictions, as large as the buffer
+	windowUnread atomic.Uint64
+	thrashing    atomic.Bool
+}
+
+// UnreadEvictions returns the number of events overwritten to make room for newer ones
+// without having ever been returned by a query.
+func (cb *AtomicCircularBuffer2) UnreadEvictions() uint64 {
+	return cb.evictions.unread.Load()
+}
+
+// observeEviction records the eviction of the stored event. Once every window of evictions as large as
+// the buffer, it logs a warning if the buffer started thrashing, see [thrashingThreshold].
+func (cb *AtomicCircularBuffer2) observeEviction(stored *StoredEvent) {
+	if !stored.wasRead() {
+		cb.evictions.unread.Add(1)
+		cb.evictions.windowUnread.Add(1)
+		if cb.metrics != nil {
+			cb.metrics.EventsEvictedUnread.Add(1)
+		}
+	}
+
+	if cb.evictions.total.Add(1)%cb.size != 0 {
+		return
+	}
+
+	unread := cb.evictions.windowUnread.Swap(0)
+	thrashing := float64(unread) >= thrashingThreshold*float64(cb.size)
+	if cb.evictions.thrashing.Swap(thrashing) != thrashing && thrashing {
+		log.Printf("[WARN] buffer thrashing: %d of the last %d evicted events were never queried", unread, cb.size)
+	}
+}
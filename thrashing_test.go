@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestUnreadEvictions(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx := context.Background()
+	metrics := NewMetrics()
+	cb := NewAtomicCircularBuffer2(10, WithMetrics(metrics))
+
+	// nobody queries, so all the evicted events are unread
+	for i := range 30 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if n := cb.UnreadEvictions(); n != 20 {
+		t.Fatalf("Expected 20 unread evictions, got %d", n)
+	}
+	if n := metrics.EventsEvictedUnread.Load(); n != 20 {
+		t.Fatalf("Expected the metrics to count 20 unread evictions, got %d", n)
+	}
+	if !strings.Contains(logs.String(), "[WARN] buffer thrashing") {
+		t.Fatalf("Expected a thrashing warning, got %q", logs.String())
+	}
+
+	// the events returned by a query are no longer unread when evicted
+	if _, err := cb.QueryEvents(ctx, nostr.Filter{Limit: 4}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 30; i < 40; i++ {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if n := cb.UnreadEvictions(); n != 26 {
+		t.Fatalf("Expected 26 unread evictions, got %d", n)
+	}
+}
+
+func TestUnreadEvictionsOrdered(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	for i := range 10 {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+
+	// only the events within the limit are returned, the others matched but were cut;
+	// both queries return the 4 oldest, as the events with the same CreatedAt are ordered by ID and by insertion
+	if _, err := cb.QueryEventsOrdered(ctx, nostr.Filter{Limit: 4}, QueryOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := cb.QueryStoredEvents(ctx, nostr.Filter{Limit: 4}, QueryOptions{Order: Ascending}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 10; i < 20; i++ {
+		cb.SaveEvent(ctx, createTestEvent(fmt.Sprintf("id-%d", i), 1))
+	}
+	if n := cb.UnreadEvictions(); n != 6 {
+		t.Fatalf("Expected 6 unread evictions, got %d", n)
+	}
+}
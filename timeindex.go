@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// minTimeIndexPrune is the number of buckets of a timeIndex below which the evicted ones are never pruned.
+const minTimeIndexPrune = 64
+
+// timeIndex is a coarse index from the CreatedAt of the events in a buffer to their positions.
+// The events are grouped in buckets of the same width of time, each holding the range of the positions
+// of its events. The ranges only grow, so they can include positions of events deleted, evicted,
+// or belonging to other buckets, and the events must still be matched against the filter.
+type timeIndex struct {
+	mu      sync.RWMutex
+	width   int64
+	buckets map[int64]posRange
+	pruneAt int
+}
+
+// posRange is a range [from, to) of positions in the buffer.
+type posRange struct {
+	from, to uint64
+}
+
+// newTimeIndex returns a timeIndex with buckets of the width, at least one second.
+func newTimeIndex(width time.Duration) *timeIndex {
+	return &timeIndex{
+		width:   max(int64(width/time.Second), 1),
+		buckets: make(map[int64]posRange),
+		pruneAt: minTimeIndexPrune,
+	}
+}
+
+// bucket returns the bucket of the timestamp.
+func (idx *timeIndex) bucket(t nostr.Timestamp) int64 {
+	return int64(t) / idx.width
+}
+
+// add records the event saved at the position. The buckets whose events are all before evictedBefore
+// are dropped once in a while, so that the index doesn't grow with the buckets that are no longer in the buffer.
+func (idx *timeIndex) add(evt *nostr.Event, pos, evictedBefore uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	key := idx.bucket(evt.CreatedAt)
+	r, ok := idx.buckets[key]
+	if !ok {
+		idx.buckets[key] = posRange{from: pos, to: pos + 1}
+		if len(idx.buckets) >= idx.pruneAt {
+			idx.prune(evictedBefore)
+		}
+		return
+	}
+
+	idx.buckets[key] = posRange{from: min(r.from, pos), to: max(r.to, pos+1)}
+}
+
+// prune drops the buckets whose events are all before the position. It must be called with the lock held.
+func (idx *timeIndex) prune(before uint64) {
+	for key, r := range idx.buckets {
+		if r.to <= before {
+			delete(idx.buckets, key)
+		}
+	}
+	idx.pruneAt = max(2*len(idx.buckets), minTimeIndexPrune)
+}
+
+// reset empties the index.
+func (idx *timeIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	clear(idx.buckets)
+	idx.pruneAt = minTimeIndexPrune
+}
+
+// ranges returns, in ascending order and without overlaps, the ranges of positions within [start, end)
+// holding the events that can have been created between since and until, both included if not nil.
+func (idx *timeIndex) ranges(since, until *nostr.Timestamp, start, end uint64) []posRange {
+	idx.mu.RLock()
+	var ranges []posRange
+	for key, r := range idx.buckets {
+		if since != nil && key < idx.bucket(*since) || until != nil && key > idx.bucket(*until) {
+			continue
+		}
+
+		r.from, r.to = max(r.from, start), min(r.to, end)
+		if r.from < r.to {
+			ranges = append(ranges, r)
+		}
+	}
+	idx.mu.RUnlock()
+
+	slices.SortFunc(ranges, func(a, b posRange) int { return cmp.Compare(a.from, b.from) })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.from <= merged[n-1].to {
+			merged[n-1].to = max(merged[n-1].to, r.to)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// jitteredEvent creates a test event created about i seconds after 1000, with every tenth event
+// created two minutes earlier, so that the buffer is never sorted
+func jitteredEvent(i int) *nostr.Event {
+	createdAt := int64(1000 + i)
+	if i%10 == 3 {
+		createdAt -= 120
+	}
+	return createTimedEvent(fmt.Sprintf("id-%d", i), createdAt)
+}
+
+func TestTimeIndexMatchesScan(t *testing.T) {
+	ctx := context.Background()
+
+	// 1000 events in a 300 slot buffer, so that the index must follow the wrap-around eviction
+	indexed := NewAtomicCircularBuffer2(300, WithTimeIndex(time.Minute))
+	scanned := NewAtomicCircularBuffer2(300)
+	for i := range 1000 {
+		evt := jitteredEvent(i)
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+
+	// deleted and updated events must be found in their new place, or not at all
+	for _, id := range []string{"id-800", "id-813", "id-950"} {
+		indexed.DeleteEvent(ctx, &nostr.Event{ID: id})
+		scanned.DeleteEvent(ctx, &nostr.Event{ID: id})
+	}
+	for _, id := range []string{"id-801", "id-900"} {
+		backdate := func(evt *nostr.Event) { evt.CreatedAt = 1500 }
+		indexed.UpdateEvent(ctx, id, backdate)
+		scanned.UpdateEvent(ctx, id, backdate)
+	}
+
+	if indexed.sortedFrom(indexed.head.Load() - indexed.span.Load()) {
+		t.Fatal("Expected the buffer not to be sorted, so that the time index is used")
+	}
+
+	filters := []nostr.Filter{
+		{Since: timestamp(1800), Until: timestamp(1850)},
+		{Since: timestamp(1700), Until: timestamp(1700)},
+		{Since: timestamp(1900)},
+		{Until: timestamp(1750)},
+		{Since: timestamp(1490), Until: timestamp(1510)},
+		{Since: timestamp(1800), Until: timestamp(1900), Limit: 5},
+		{Since: timestamp(1800), Until: timestamp(1900), Kinds: []int{2}},
+		{Since: timestamp(500), Until: timestamp(600)},
+		{Since: timestamp(5000)},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, filter := range filters {
+			expected, err := scanned.QueryEvents(ctx, filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			events, err := indexed.QueryEvents(ctx, filter)
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+
+			if !slices.Equal(ids(events), ids(expected)) {
+				t.Fatalf("filter %v: expected %v, got %v", filter, ids(expected), ids(events))
+			}
+		}
+	}
+
+	check()
+
+	// compaction moves the events, so the index is rebuilt
+	indexed.Compact()
+	scanned.Compact()
+	check()
+
+	// the buckets of the evicted events are eventually pruned
+	for i := 1000; i < 10000; i++ {
+		evt := jitteredEvent(i)
+		indexed.SaveEvent(ctx, evt)
+		scanned.SaveEvent(ctx, evt)
+	}
+	check()
+
+	if buckets := len(indexed.times.buckets); buckets > 2*minTimeIndexPrune {
+		t.Fatalf("Expected the evicted buckets to be pruned, got %d buckets", buckets)
+	}
+
+	indexed.Clear()
+	if len(indexed.times.buckets) != 0 {
+		t.Fatal("Expected Clear to empty the index")
+	}
+}
+
+// BenchmarkTimeWindowQuery tests a query for a 5 minutes window in a buffer of 200k events
+// saved over about 5 hours, out of order often enough to prevent the binary search of sorted buffers
+func BenchmarkTimeWindowQuery(b *testing.B) {
+	ctx := context.Background()
+	const size = 200_000
+
+	for name, opts := range map[string][]BufferOption{
+		"scan":    nil,
+		"indexed": {WithTimeIndex(time.Minute)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			cb := NewAtomicCircularBuffer2(size, opts...)
+			for i := range size {
+				evt := createTimedEvent(hexID(i), int64(1_000_000+i/10))
+				if i%1000 == 0 {
+					evt.CreatedAt -= 30
+				}
+				cb.SaveEvent(ctx, evt)
+			}
+			filter := nostr.Filter{Since: timestamp(1_010_000), Until: timestamp(1_010_300)}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				events, _ := cb.QueryEvents(ctx, filter)
+				if len(events) < 3000 {
+					b.Fatalf("Expected at least 3000 events, got %d", len(events))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// createTimedEvent creates a test event with the provided CreatedAt
+func createTimedEvent(id string, createdAt int64) *nostr.Event {
+	evt := createTestEvent(id, 1)
+	evt.CreatedAt = nostr.Timestamp(createdAt)
+	return evt
+}
+
+// fillTimed saves n events with increasing CreatedAt starting from 1000, one per second
+func fillTimed(cb *AtomicCircularBuffer2, n int) {
+	ctx := context.Background()
+	for i := range n {
+		cb.SaveEvent(ctx, createTimedEvent(fmt.Sprintf("id-%d", i), int64(1000+i)))
+	}
+}
+
+func TestTimeWindowQuery(t *testing.T) {
+	ctx := context.Background()
+
+	// 25 events in a 10 slot buffer, so the window spans the wrap-around
+	cb := NewAtomicCircularBuffer2(10)
+	fillTimed(cb, 25)
+
+	if !cb.sortedFrom(cb.head.Load() - cb.span.Load()) {
+		t.Fatal("Expected the buffer to be sorted")
+	}
+
+	tests := []struct {
+		since, until *nostr.Timestamp
+		expected     []string
+	}{
+		{timestamp(1017), timestamp(1019), []string{"id-17", "id-18", "id-19"}},
+		{timestamp(1022), nil, []string{"id-22", "id-23", "id-24"}},
+		{nil, timestamp(1016), []string{"id-15", "id-16"}},
+		{timestamp(900), timestamp(1014), nil},
+		{timestamp(1030), nil, nil},
+	}
+
+	for _, test := range tests {
+		events, err := cb.QueryEvents(ctx, nostr.Filter{Since: test.since, Until: test.until})
+		if err != nil {
+			t.Fatalf("Failed to query events: %v", err)
+		}
+
+		if len(events) != len(test.expected) {
+			t.Fatalf("since %v until %v: expected %v, got %d events", test.since, test.until, test.expected, len(events))
+		}
+		for i, evt := range events {
+			if evt.ID != test.expected[i] {
+				t.Fatalf("since %v until %v: expected %v, got %s at %d", test.since, test.until, test.expected, evt.ID, i)
+			}
+		}
+	}
+}
+
+func TestTimeWindowUnsorted(t *testing.T) {
+	ctx := context.Background()
+	cb := NewAtomicCircularBuffer2(10)
+	fillTimed(cb, 8)
+
+	// an old event published late must still be found
+	cb.SaveEvent(ctx, createTimedEvent("late", 500))
+	cb.SaveEvent(ctx, createTimedEvent("id-8", 1008))
+
+	if cb.sortedFrom(0) {
+		t.Fatal("Expected the buffer to be unsorted")
+	}
+
+	events, err := cb.QueryEvents(ctx, nostr.Filter{Until: timestamp(600)})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "late" {
+		t.Fatalf("Expected the late event, got %v", events)
+	}
+
+	// once the late event is evicted, the buffer is sorted again
+	fillTimed(cb, 10)
+	if !cb.sortedFrom(cb.head.Load() - cb.span.Load()) {
+		t.Fatal("Expected the buffer to be sorted after evicting the late event")
+	}
+}
+
+// BenchmarkTimeWindow compares a narrow time window query over a large sorted buffer,
+// which can skip most of the buffer, with the same query over an unsorted one, which has to scan it all
+func BenchmarkTimeWindow(b *testing.B) {
+	const size = 100000
+	ctx := context.Background()
+	filter := nostr.Filter{Since: timestamp(1000 + size/2), Until: timestamp(1000 + size/2 + 100), Limit: 500}
+
+	sorted := NewAtomicCircularBuffer2(size)
+	fillTimed(sorted, size)
+
+	unsorted := NewAtomicCircularBuffer2(size)
+	fillTimed(unsorted, size-1)
+	unsorted.SaveEvent(ctx, createTimedEvent("late", 1))
+
+	b.Run("sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = sorted.QueryEvents(ctx, filter)
+		}
+	})
+
+	b.Run("unsorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = unsorted.QueryEvents(ctx, filter)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The names of the spans created by the buffers traced with [WithTracer].
+const (
+	spanSaveEvent   = "evstore.SaveEvent"
+	spanQueryEvents = "evstore.QueryEvents"
+)
+
+// tracedSave saves the event within a span, with the kind of the event.
+func (cb *AtomicCircularBuffer2) tracedSave(ctx context.Context, evt *nostr.Event) error {
+	var attrs []attribute.KeyValue
+	if evt != nil {
+		attrs = append(attrs, attribute.Int("nostr.event.kind", evt.Kind))
+	}
+
+	ctx, span := cb.tracer.Start(ctx, spanSaveEvent, trace.WithAttributes(attrs...))
+	err := cb.saveEvent(ctx, evt)
+	endSpan(span, err)
+	return err
+}
+
+// tracedQuery runs the query within a span, with the number of values of every constraint of the filter
+// and the number of events returned.
+func (cb *AtomicCircularBuffer2) tracedQuery(ctx context.Context, filter nostr.Filter, accept func(*nostr.Event) bool, dst []*nostr.Event) ([]*nostr.Event, error) {
+	tagValues := 0
+	for _, values := range filter.Tags {
+		tagValues += len(values)
+	}
+
+	ctx, span := cb.tracer.Start(ctx, spanQueryEvents, trace.WithAttributes(
+		attribute.Int("nostr.filter.ids", len(filter.IDs)),
+		attribute.Int("nostr.filter.authors", len(filter.Authors)),
+		attribute.Int("nostr.filter.kinds", len(filter.Kinds)),
+		attribute.Int("nostr.filter.tag_values", tagValues),
+		attribute.Int("nostr.filter.limit", filter.Limit),
+	))
+
+	events, err := cb.measuredQuery(ctx, filter, accept, dst)
+	span.SetAttributes(attribute.Int("evstore.query.results", len(events)))
+	endSpan(span, err)
+	return events, err
+}
+
+// endSpan ends the span, recording the error if not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttributes returns the attributes of the span by key
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	cb := NewAtomicCircularBuffer2(2, WithTracer(provider.Tracer("test")), WithOverflowPolicy(RejectNew))
+	cb.SaveEvent(ctx, createTestEvent("a", 20000))
+	cb.SaveEvent(ctx, createTestEvent("b", 20001))
+	cb.SaveEvent(ctx, createTestEvent("c", 20002))
+
+	filter := nostr.Filter{
+		Kinds: []int{20000, 20001, 20002},
+		Tags:  nostr.TagMap{"e": {"x", "y"}, "p": {"z"}},
+		Limit: 10,
+	}
+	cb.QueryEvents(ctx, filter)
+	cb.QueryEvents(ctx, nostr.Filter{Kinds: []int{20000}})
+
+	spans := recorder.Ended()
+	if len(spans) != 5 {
+		t.Fatalf("Expected 5 spans, got %d", len(spans))
+	}
+
+	for i, kind := range []int64{20000, 20001, 20002} {
+		span := spans[i]
+		if span.Name() != spanSaveEvent {
+			t.Fatalf("Expected span %d to be %s, got %s", i, spanSaveEvent, span.Name())
+		}
+		if got := spanAttributes(span)["nostr.event.kind"].AsInt64(); got != kind {
+			t.Fatalf("Expected span %d to have kind %d, got %d", i, kind, got)
+		}
+	}
+
+	// the third save is rejected, as the buffer is full
+	if spans[1].Status().Code != codes.Unset {
+		t.Fatalf("Expected the successful save to have no error, got %v", spans[1].Status())
+	}
+	if status := spans[2].Status(); status.Code != codes.Error || status.Description != ErrBufferFull.Error() {
+		t.Fatalf("Expected the rejected save to record %v, got %v", ErrBufferFull, status)
+	}
+
+	query := spans[3]
+	if query.Name() != spanQueryEvents {
+		t.Fatalf("Expected the span to be %s, got %s", spanQueryEvents, query.Name())
+	}
+
+	expected := map[attribute.Key]int64{
+		"nostr.filter.ids":        0,
+		"nostr.filter.authors":    0,
+		"nostr.filter.kinds":      3,
+		"nostr.filter.tag_values": 3,
+		"nostr.filter.limit":      10,
+		"evstore.query.results":   0,
+	}
+	attrs := spanAttributes(query)
+	for key, value := range expected {
+		if got, ok := attrs[key]; !ok || got.AsInt64() != value {
+			t.Fatalf("Expected %s to be %d, got %v", key, value, got.Emit())
+		}
+	}
+
+	if got := spanAttributes(spans[4])["evstore.query.results"].AsInt64(); got != 1 {
+		t.Fatalf("Expected the second query to return 1 event, got %d", got)
+	}
+}
+
+func TestTracingQueryError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	cb := NewAtomicCircularBuffer2(10, WithTracer(provider.Tracer("test")))
+	cb.SaveEvent(context.Background(), createTestEvent("a", 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cb.QueryEvents(ctx, nostr.Filter{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the query to be cancelled, got %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[1].Name() != spanQueryEvents || spans[1].Status().Code != codes.Error {
+		t.Fatalf("Expected a query span recording the error, got %v", spans)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+// Validator checks an event before [Save] routes it to a store.
+// A non-nil error rejects the event, and is sent to the client in the OK message,
+// so it should start with a machine-readable prefix as defined by NIP-01, like "invalid:" or "blocked:".
+type Validator func(ctx context.Context, c *rely.Client, e *nostr.Event) error
+
+// Validators are run in order by [Save] before storing an event, and the first error rejects it
+// without running the others. The defaults enforce [SaveLimiter], [MaxFutureDrift], [MinPoW], NIP-70
+// and [AuthorizeSave], each doing nothing when not configured.
+// Operators can append their own validators, for example to allow only some pubkeys:
+//
+//	Validators = append(Validators, func(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+//		if !slices.Contains(allowed, e.PubKey) {
+//			return errors.New("restricted: not allowed to publish here")
+//		}
+//		return nil
+//	})
+//
+// IDs and signatures are verified by rely before Save is called.
+var Validators = []Validator{
+	ValidateRateLimit,
+	ValidateFutureDrift,
+	ValidatePoW,
+	ValidateProtected,
+	ValidateAuthorization,
+}
+
+// validate runs the [Validators] in order, returning the first error.
+func validate(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	for _, v := range Validators {
+		if err := v(ctx, c, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateRateLimit rejects the events of the clients over [SaveLimiter], if set.
+func ValidateRateLimit(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	if SaveLimiter != nil && !SaveLimiter.Allow(c) {
+		return errors.New("rate-limited: slow down, you are publishing too many events")
+	}
+	return nil
+}
+
+// ValidateFutureDrift rejects the events created more than [MaxFutureDrift] in the future, if set.
+func ValidateFutureDrift(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	if MaxFutureDrift > 0 && e.CreatedAt.Time().After(time.Now().Add(MaxFutureDrift)) {
+		return errors.New("invalid: event creation date is too far in the future")
+	}
+	return nil
+}
+
+// ValidatePoW rejects the events without the proof of work required by [MinPoW], if set.
+func ValidatePoW(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	return checkPoW(e)
+}
+
+// ValidateProtected rejects the protected events (NIP-70) not published by their authenticated author.
+func ValidateProtected(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	return checkProtected(clientPubkey(c), e)
+}
+
+// ValidateAuthorization rejects the events refused by [AuthorizeSave].
+func ValidateAuthorization(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+	return AuthorizeSave(c, e)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/pippellia-btc/rely"
+)
+
+// setValidators replaces Validators for the duration of the test.
+func setValidators(t *testing.T, validators ...Validator) {
+	old := Validators
+	Validators = validators
+	t.Cleanup(func() { Validators = old })
+}
+
+func TestSaveValidators(t *testing.T) {
+	var calls []string
+	validator := func(name, rejected string) Validator {
+		return func(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+			calls = append(calls, name)
+			if e.ID == rejected {
+				return fmt.Errorf("blocked: rejected by %s", name)
+			}
+			return nil
+		}
+	}
+
+	ephemeral := NewAtomicCircularBuffer2(10)
+	setupStores(t, &mockStore{}, ephemeral)
+	setValidators(t, validator("first", "bad-first"), validator("second", "bad-second"))
+
+	tests := []struct {
+		id    string
+		err   string
+		calls []string
+	}{
+		{"good", "", []string{"first", "second"}},
+		{"bad-first", "blocked: rejected by first", []string{"first"}},
+		{"bad-second", "blocked: rejected by second", []string{"first", "second"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			calls = nil
+			err := Save(&rely.Client{}, createTestEvent(test.id, 20000))
+
+			if test.err == "" && err != nil {
+				t.Fatalf("Expected the event to be accepted, got %v", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("Expected the error %q, got %v", test.err, err)
+			}
+			if !slices.Equal(calls, test.calls) {
+				t.Fatalf("Expected the validators %v to run, got %v", test.calls, calls)
+			}
+		})
+	}
+
+	stored, _ := ephemeral.QueryEvents(context.Background(), nostr.Filter{})
+	if len(stored) != 1 || stored[0].ID != "good" {
+		t.Fatalf("Expected only the accepted event to be stored, got %v", ids(stored))
+	}
+}
+
+func TestDefaultValidators(t *testing.T) {
+	setupStores(t, &mockStore{}, NewAtomicCircularBuffer2(10))
+	setMinPoW(t, 8)
+
+	// the defaults keep running after an operator appends its own validator
+	errCustom := errors.New("blocked: custom")
+	setValidators(t, append(slices.Clone(Validators), func(ctx context.Context, c *rely.Client, e *nostr.Event) error {
+		return errCustom
+	})...)
+
+	err := Save(&rely.Client{}, createTestEvent(hexID(1), 20000))
+	if err == nil || !strings.HasPrefix(err.Error(), "pow:") {
+		t.Fatalf("Expected the default PoW validator to reject the event first, got %v", err)
+	}
+
+	setMinPoW(t, 0)
+	if err := Save(&rely.Client{}, createTestEvent(hexID(1), 20000)); !errors.Is(err, errCustom) {
+		t.Fatalf("Expected the custom validator to reject the event, got %v", err)
+	}
+}